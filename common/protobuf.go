@@ -39,6 +39,11 @@ func (p *ProtoBuffer) Reset() {
 	p.index = 0        // for reading
 }
 
+//Bytes returns the encoded byte stream
+func (p *ProtoBuffer) Bytes() []byte {
+	return p.buf
+}
+
 func (p *ProtoBuffer)DecodeKey() (wire uint64, tag uint64, err error) {
 	u, err := p.DecodeVarint()
 	if err != nil {
@@ -269,4 +274,88 @@ func (p *ProtoBuffer) DecodeTimestamp() (t time.Time, err error) {
 
 func (p *ProtoBuffer) DecodeComplete() bool {
 	return p.index >= len(p.buf)
-}
\ No newline at end of file
+}
+
+//Encoding supports, the reverse of the above decoding functions.
+//They are used by storage engines that save data points in the same
+// wire format as they are received.
+
+func (p *ProtoBuffer) EncodeKey(wire uint64, tag uint64) error {
+	return p.EncodeVarint(tag<<3 | wire)
+}
+
+func (p *ProtoBuffer) EncodeVarint(x uint64) error {
+	for x >= 1<<7 {
+		p.buf = append(p.buf, uint8(x&0x7f|0x80))
+		x >>= 7
+	}
+	p.buf = append(p.buf, uint8(x))
+	return nil
+}
+
+func (p *ProtoBuffer) EncodeFixed64(x uint64) error {
+	p.buf = append(p.buf,
+		uint8(x),
+		uint8(x>>8),
+		uint8(x>>16),
+		uint8(x>>24),
+		uint8(x>>32),
+		uint8(x>>40),
+		uint8(x>>48),
+		uint8(x>>56))
+	return nil
+}
+
+func (p *ProtoBuffer) EncodeFloat64(x float64) error {
+	return p.EncodeFixed64(math.Float64bits(x))
+}
+
+func (p *ProtoBuffer) EncodeFixed32(x uint64) error {
+	p.buf = append(p.buf,
+		uint8(x),
+		uint8(x>>8),
+		uint8(x>>16),
+		uint8(x>>24))
+	return nil
+}
+
+func (p *ProtoBuffer) EncodeFloat32(x float32) error {
+	return p.EncodeFixed32(uint64(math.Float32bits(x)))
+}
+
+func (p *ProtoBuffer) EncodeZigzag64(x uint64) error {
+	// use signed number to get arithmetic right shift.
+	return p.EncodeVarint(uint64((x << 1) ^ uint64((int64(x) >> 63))))
+}
+
+func (p *ProtoBuffer) EncodeZigzag32(x uint64) error {
+	// use signed number to get arithmetic right shift.
+	return p.EncodeVarint(uint64((uint32(x) << 1) ^ uint32((int32(x) >> 31))))
+}
+
+func (p *ProtoBuffer) EncodeRawBytes(b []byte) error {
+	p.EncodeVarint(uint64(len(b)))
+	p.buf = append(p.buf, b...)
+	return nil
+}
+
+func (p *ProtoBuffer) EncodeStringBytes(s string) error {
+	p.EncodeVarint(uint64(len(s)))
+	p.buf = append(p.buf, s...)
+	return nil
+}
+
+//Same layout as google.protobuf.Timestamp (seconds = 1, nanos = 2),
+// zero fields are omitted as proto3 does.
+func (p *ProtoBuffer) EncodeTimestamp(t time.Time) error {
+	protoBuf := NewProtoBuffer(nil)
+	if seconds := t.Unix(); seconds != 0 {
+		protoBuf.EncodeKey(WireVarint, 1)
+		protoBuf.EncodeVarint(uint64(seconds))
+	}
+	if nanos := t.Nanosecond(); nanos != 0 {
+		protoBuf.EncodeKey(WireVarint, 2)
+		protoBuf.EncodeVarint(uint64(nanos))
+	}
+	return p.EncodeRawBytes(protoBuf.Bytes())
+}
@@ -921,4 +921,78 @@ func TestProtobufAll0(t *testing.T) {
 	if !testData.DecodeComplete() {
 		t.Fatal("all fields are 0, there should not be any more data")
 	} 
-}
\ No newline at end of file
+}
+//Test encoding, the encoded bytes must be the same as proto.Marshal
+func TestProtobufEncode(t *testing.T) {
+	test := &testdata.TestData_2 {
+		[]*testdata.TestData_2_Data_2{
+			&testdata.TestData_2_Data_2{
+				A: -100,
+				B: 100,
+				C: -100,
+				D: -100,
+				E: 100.5,
+				F: -100.5,
+				Time: &testdata.Timestamp{Seconds:100, Nanos:100},
+			},
+		},
+	}
+	data, err := proto.Marshal(test)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	negative := int64(-100)
+	record := NewProtoBuffer(nil)
+	record.EncodeKey(WireVarint, 1)
+	record.EncodeVarint(uint64(negative))
+	record.EncodeKey(WireVarint, 2)
+	record.EncodeVarint(100)
+	record.EncodeKey(WireVarint, 3)
+	record.EncodeZigzag32(uint64(negative))
+	record.EncodeKey(WireVarint, 4)
+	record.EncodeZigzag64(uint64(negative))
+	record.EncodeKey(WireFixed32, 5)
+	record.EncodeFloat32(100.5)
+	record.EncodeKey(WireFixed64, 6)
+	record.EncodeFloat64(-100.5)
+	record.EncodeKey(WireLengthDelimited, 7)
+	record.EncodeTimestamp(time.Unix(100, 100))
+
+	protoBuffer := NewProtoBuffer(nil)
+	protoBuffer.EncodeKey(WireLengthDelimited, 1)
+	protoBuffer.EncodeRawBytes(record.Bytes())
+
+	if string(protoBuffer.Bytes()) != string(data) {
+		t.Fatalf("encoded bytes not match, want %v, got %v", data, protoBuffer.Bytes())
+	}
+
+	//decode back
+	decoder := NewProtoBuffer(record.Bytes())
+	decoder.DecodeCheckKey(WireVarint, 1)
+	a, _ := decoder.DecodeVarint()
+	decoder.DecodeCheckKey(WireVarint, 2)
+	b, _ := decoder.DecodeVarint()
+	decoder.DecodeCheckKey(WireVarint, 3)
+	c, _ := decoder.DecodeZigzag32()
+	decoder.DecodeCheckKey(WireVarint, 4)
+	d, _ := decoder.DecodeZigzag64()
+	decoder.DecodeCheckKey(WireFixed32, 5)
+	e, _ := decoder.DecodeFloat32()
+	decoder.DecodeCheckKey(WireFixed64, 6)
+	f, _ := decoder.DecodeFloat64()
+	decoder.DecodeCheckKey(WireLengthDelimited, 7)
+	ti, err := decoder.DecodeTimestamp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(a) != -100 || b != 100 || int32(c) != -100 || int64(d) != -100 || e != 100.5 || f != -100.5 {
+		t.Fatal("decoded values not match")
+	}
+	if ti.Unix() != 100 || ti.Nanosecond() != 100 {
+		t.Fatal("time not match")
+	}
+	if !decoder.DecodeComplete() {
+		t.Fatal("there should not be any more data")
+	}
+}
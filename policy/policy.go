@@ -42,7 +42,7 @@ import (
 // 
 // 4. Usage
 //
-// Firstly, create a PolicyEnforcer object given PolicyOpts, the opts should contain the policy file to load
+// Firstly, create a PolicyEnforcer object given Opts, the opts should contain the policy file to load
 // etc. information.
 //
 //   enforcer := LoadRules(opts)
@@ -112,7 +112,7 @@ func (r *PolicyRules) UpdateFromMap(m map[string]interface{}) {
 type PolicyEnforcer struct {
     r *PolicyRules	
 }
-func New(o *PolicyOpts) *PolicyEnforcer {
+func New(o *Opts) *PolicyEnforcer {
     e := &PolicyEnforcer{}
     e.LoadRules(o)
     return e
@@ -130,7 +130,7 @@ func (e *PolicyEnforcer) Enforce(rule interface{},  target map[string]interface{
         return false
     }
 }
-func (e *PolicyEnforcer) LoadRules(o *PolicyOpts) {
+func (e *PolicyEnforcer) LoadRules(o *Opts) {
     //load from json file if exists
     if o.File != "" {
         e.loadJsonFile(o.File)
@@ -41,7 +41,7 @@ func TestLoadPolicyRules(t *testing.T) {
 }
 
 func TestPolicyEnforcerLoad(t *testing.T) {
-	policyOpts := &PolicyOpts{
+	policyOpts := &Opts{
 		File:"testdata/policy.json",
 		Dirs:[]string{
 			"testdata/policy.d1",
@@ -82,7 +82,7 @@ func TestPolicyEnforcerLoad(t *testing.T) {
 }
 
 func TestPolicyEnforcerEnforce(t *testing.T) {
-	policyOpts := &PolicyOpts{
+	policyOpts := &Opts{
 		File:"testdata/policy.json",
 		Dirs:[]string{
 			"testdata/policy.d1",
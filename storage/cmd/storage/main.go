@@ -0,0 +1,12 @@
+// Storage API service, configured by config.toml in the working directory
+// (see storage.Opts)
+package main
+
+import (
+    "log"
+    "github.com/heartsg/dasea/storage"
+)
+
+func main() {
+    log.Fatal(storage.Run())
+}
@@ -0,0 +1,117 @@
+package storage
+
+// CoAP ingestion (see storage/coap)
+//
+// Constrained sensors POST protobuf records, as POST /v1/streams/:id/data,
+// to the resource
+//
+//   coap://host/streams/{id}/data?token={device token}
+//
+// with Content-Format 42 (application/octet-stream) or none. Batches larger
+// than a datagram are sent block-wise (Block1), the token is checked at the
+// first block already. Confirmable requests are acknowledged only after
+// their records are written, with 2.04 Changed or an error code and the
+// error as diagnostic payload. 5.03 with Max-Age means the records should
+// be sent again later.
+import (
+    "errors"
+    "net/http"
+    "strconv"
+    "time"
+    "github.com/heartsg/dasea/storage/coap"
+    "github.com/heartsg/dasea/storage/data"
+    "github.com/heartsg/dasea/storage/meta"
+)
+
+var ErrInvalidResource = errors.New("Invalid CoAP resource, must be streams/{id}/data.")
+
+const (
+    CoAPTokenQuery = "token"
+
+    // Max-Age of 5.03 responses, seconds before records are sent again
+    coapRetryAfter = 1
+)
+
+func serveCoAP(r *coap.Request) *coap.Response {
+    id, resp := coapStream(r)
+    if resp != nil {
+        return resp
+    }
+    if err := data.PutDataPointsFromProtobuf(id, r.Payload); err != nil {
+        return coapError(err)
+    }
+    return &coap.Response{Code: coap.Changed}
+}
+
+// Checks of serveCoAP run at block 0 of block-wise requests, so that blocks
+// are buffered for authorized devices only (see coap.Server.Authorize)
+func authorizeCoAP(r *coap.Request) *coap.Response {
+    _, resp := coapStream(r)
+    return resp
+}
+
+// Data stream a request writes to, the response is non-nil if the request
+// is rejected
+func coapStream(r *coap.Request) (int64, *coap.Response) {
+    id, err := parseResource(r.Path)
+    if err != nil {
+        return 0, coapError(err)
+    }
+    if r.Code != coap.POST {
+        return 0, &coap.Response{Code: coap.MethodNotAllowed}
+    }
+    if r.ContentFormat != -1 && r.ContentFormat != coap.OctetStream {
+        return 0, &coap.Response{Code: coap.UnsupportedContentFormat}
+    }
+    t, err := meta.AuthenticateDeviceToken(r.QueryValue(CoAPTokenQuery), time.Now())
+    if err != nil {
+        return 0, coapError(err)
+    }
+    scope, err := meta.ScopeFromDevice(t.DeviceId)
+    if err == meta.ErrNotFound {
+        return 0, coapError(meta.ErrInvalidToken)
+    }
+    if err != nil {
+        return 0, coapError(err)
+    }
+    if err = checkStream(scope, t, id); err != nil {
+        return 0, coapError(err)
+    }
+    return id, nil
+}
+
+// Data stream id of the UriPath segments streams/{id}/data
+func parseResource(path []string) (int64, error) {
+    if len(path) != 3 || path[0] != "streams" || path[2] != "data" {
+        return 0, ErrInvalidResource
+    }
+    id, err := strconv.ParseInt(path[1], 10, 64)
+    if err != nil {
+        return 0, ErrInvalidResource
+    }
+    return id, nil
+}
+
+// Response code of an error as over HTTP, the error text is the diagnostic
+// payload (see publicError)
+func coapError(err error) *coap.Response {
+    resp := &coap.Response{Payload: []byte(publicError(err).Error())}
+    switch errorStatus(err) {
+    case http.StatusBadRequest:
+        resp.Code = coap.BadRequest
+    case http.StatusUnauthorized:
+        resp.Code = coap.Unauthorized
+    case http.StatusForbidden:
+        resp.Code = coap.Forbidden
+    case http.StatusNotFound:
+        resp.Code = coap.NotFound
+    case http.StatusConflict:
+        resp.Code = coap.Conflict
+    case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+        resp.Code = coap.ServiceUnavailable
+        resp.MaxAge = coapRetryAfter
+    default:
+        resp.Code = coap.InternalServerError
+    }
+    return resp
+}
@@ -0,0 +1,288 @@
+package coap
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+var (
+	ErrMalformedMessage = errors.New("Malformed CoAP message.")
+	ErrInvalidBlock = errors.New("Invalid CoAP block option.")
+)
+
+//Message types (RFC 7252 section 3)
+const (
+	Confirmable = 0
+	NonConfirmable = 1
+	Acknowledgement = 2
+	Reset = 3
+)
+
+//Method and response codes, class << 5 | detail
+const (
+	Empty = 0
+	GET = 1
+	POST = 2
+	PUT = 3
+	DELETE = 4
+
+	Created = 2<<5 | 1
+	Deleted = 2<<5 | 2
+	Valid = 2<<5 | 3
+	Changed = 2<<5 | 4
+	Content = 2<<5 | 5
+	Continue = 2<<5 | 31
+	BadRequest = 4<<5 | 0
+	Unauthorized = 4<<5 | 1
+	BadOption = 4<<5 | 2
+	Forbidden = 4<<5 | 3
+	NotFound = 4<<5 | 4
+	MethodNotAllowed = 4<<5 | 5
+	Conflict = 4<<5 | 9
+	RequestEntityIncomplete = 4<<5 | 8
+	RequestEntityTooLarge = 4<<5 | 13
+	UnsupportedContentFormat = 4<<5 | 15
+	InternalServerError = 5<<5 | 0
+	ServiceUnavailable = 5<<5 | 3
+)
+
+//Option numbers (RFC 7252 section 5.10, RFC 7959 section 2.1)
+const (
+	IfMatch = 1
+	UriHost = 3
+	ETag = 4
+	IfNoneMatch = 5
+	UriPort = 7
+	LocationPath = 8
+	UriPath = 11
+	ContentFormat = 12
+	MaxAge = 14
+	UriQuery = 15
+	Accept = 17
+	LocationQuery = 20
+	Block2 = 23
+	Block1 = 27
+	Size2 = 28
+	ProxyUri = 35
+	ProxyScheme = 39
+	Size1 = 60
+)
+
+//Content formats
+const (
+	TextPlain = 0
+	OctetStream = 42
+	JSON = 50
+)
+
+//Options the server understands, an unknown critical (odd) option fails
+// the request with 4.02 Bad Option
+var knownOptions = map[int]bool{
+	UriHost: true, UriPort: true, UriPath: true, UriQuery: true, ContentFormat: true,
+	Accept: true, Block1: true, Block2: true, Size1: true, Size2: true,
+}
+
+type Option struct {
+	Number int
+	Value []byte
+}
+
+type Message struct {
+	Type byte
+	Code byte
+	MessageId uint16
+	Token []byte
+	//ordered by Number, see AddOption
+	Options []Option
+	Payload []byte
+}
+
+func (m *Message) AddOption(number int, value []byte) {
+	m.Options = append(m.Options, Option{Number: number, Value: value})
+	sort.SliceStable(m.Options, func(i, j int) bool {
+		return m.Options[i].Number < m.Options[j].Number
+	})
+}
+
+//Options are unsigned integers in as few bytes as possible
+func (m *Message) AddUintOption(number int, v uint32) {
+	m.AddOption(number, encodeUint(v))
+}
+
+func (m *Message) Option(number int) ([]byte, bool) {
+	for _, o := range m.Options {
+		if o.Number == number {
+			return o.Value, true
+		}
+	}
+	return nil, false
+}
+
+func (m *Message) UintOption(number int) (uint32, bool) {
+	v, ok := m.Option(number)
+	if !ok || len(v) > 4 {
+		return 0, false
+	}
+	return decodeUint(v), true
+}
+
+//Values of a repeatable option, e.g. the segments of UriPath
+func (m *Message) Strings(number int) []string {
+	values := make([]string, 0)
+	for _, o := range m.Options {
+		if o.Number == number {
+			values = append(values, string(o.Value))
+		}
+	}
+	return values
+}
+
+func encodeUint(v uint32) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	i := 0
+	for i < 4 && b[i] == 0 {
+		i++
+	}
+	return b[i:]
+}
+
+func decodeUint(b []byte) uint32 {
+	var v uint32
+	for _, c := range b {
+		v = v<<8 | uint32(c)
+	}
+	return v
+}
+
+func ParseMessage(buf []byte) (*Message, error) {
+	if len(buf) < 4 || buf[0]>>6 != 1 {
+		return nil, ErrMalformedMessage
+	}
+	m := &Message{
+		Type: (buf[0] >> 4) & 0x03,
+		Code: buf[1],
+		MessageId: binary.BigEndian.Uint16(buf[2:4]),
+	}
+	tokenLength := int(buf[0] & 0x0f)
+	if tokenLength > 8 || len(buf) < 4+tokenLength {
+		return nil, ErrMalformedMessage
+	}
+	m.Token = append([]byte{}, buf[4:4+tokenLength]...)
+	buf = buf[4+tokenLength:]
+
+	number := 0
+	for len(buf) > 0 {
+		if buf[0] == 0xff {
+			if len(buf) == 1 {
+				//payload marker without payload
+				return nil, ErrMalformedMessage
+			}
+			m.Payload = append([]byte{}, buf[1:]...)
+			break
+		}
+		delta, length := int(buf[0]>>4), int(buf[0]&0x0f)
+		buf = buf[1:]
+		var err error
+		if delta, buf, err = optionNibble(delta, buf); err != nil {
+			return nil, err
+		}
+		if length, buf, err = optionNibble(length, buf); err != nil {
+			return nil, err
+		}
+		if len(buf) < length {
+			return nil, ErrMalformedMessage
+		}
+		number += delta
+		m.Options = append(m.Options, Option{Number: number, Value: append([]byte{}, buf[:length]...)})
+		buf = buf[length:]
+	}
+	//empty messages are only a header
+	if m.Code == Empty && (len(m.Token) > 0 || len(m.Options) > 0 || len(m.Payload) > 0) {
+		return nil, ErrMalformedMessage
+	}
+	return m, nil
+}
+
+//Option delta or length with its extended bytes
+func optionNibble(n int, buf []byte) (int, []byte, error) {
+	switch n {
+	case 13:
+		if len(buf) < 1 {
+			return 0, nil, ErrMalformedMessage
+		}
+		return int(buf[0]) + 13, buf[1:], nil
+	case 14:
+		if len(buf) < 2 {
+			return 0, nil, ErrMalformedMessage
+		}
+		return int(binary.BigEndian.Uint16(buf)) + 269, buf[2:], nil
+	case 15:
+		return 0, nil, ErrMalformedMessage
+	}
+	return n, buf, nil
+}
+
+func (m *Message) Marshal() []byte {
+	buf := make([]byte, 4, 4+len(m.Token)+len(m.Payload)+16)
+	buf[0] = 1<<6 | (m.Type&0x03)<<4 | byte(len(m.Token))
+	buf[1] = m.Code
+	binary.BigEndian.PutUint16(buf[2:4], m.MessageId)
+	buf = append(buf, m.Token...)
+
+	number := 0
+	for _, o := range m.Options {
+		delta, deltaExt := nibble(o.Number - number)
+		length, lengthExt := nibble(len(o.Value))
+		buf = append(buf, byte(delta<<4|length))
+		buf = append(buf, deltaExt...)
+		buf = append(buf, lengthExt...)
+		buf = append(buf, o.Value...)
+		number = o.Number
+	}
+	if len(m.Payload) > 0 {
+		buf = append(buf, 0xff)
+		buf = append(buf, m.Payload...)
+	}
+	return buf
+}
+
+func nibble(n int) (int, []byte) {
+	switch {
+	case n < 13:
+		return n, nil
+	case n < 269:
+		return 13, []byte{byte(n - 13)}
+	}
+	return 14, []byte{byte((n - 269) >> 8), byte(n - 269)}
+}
+
+//Block1/Block2 option value (RFC 7959 section 2.2): block number, whether
+// more blocks follow and block size 2^(szx+4)
+type Block struct {
+	Num uint32
+	More bool
+	SZX uint32
+}
+
+func (b Block) Size() int {
+	return 1 << (b.SZX + 4)
+}
+
+func ParseBlock(v uint32) (Block, error) {
+	b := Block{Num: v >> 4, More: v&0x08 != 0, SZX: v & 0x07}
+	//szx 7 is reserved
+	if b.SZX == 7 {
+		return b, ErrInvalidBlock
+	}
+	return b, nil
+}
+
+func (b Block) Value() uint32 {
+	v := b.Num<<4 | b.SZX
+	if b.More {
+		v |= 0x08
+	}
+	return v
+}
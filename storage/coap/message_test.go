@@ -0,0 +1,86 @@
+package coap
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMessage(t *testing.T) {
+	m := &Message{Type: Confirmable, Code: POST, MessageId: 0x1234, Token: []byte{1, 2}, Payload: []byte("records")}
+	m.AddOption(UriQuery, []byte("token=abc"))
+	m.AddOption(UriPath, []byte("streams"))
+	m.AddOption(UriPath, []byte("12"))
+	m.AddOption(UriPath, []byte("data"))
+	m.AddUintOption(ContentFormat, OctetStream)
+	m.AddUintOption(Block1, Block{Num: 300, More: true, SZX: 6}.Value())
+	//extended option delta and length
+	m.AddOption(Size1, bytes.Repeat([]byte{'x'}, 300))
+
+	got, err := ParseMessage(m.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Type != m.Type || got.Code != m.Code || got.MessageId != m.MessageId ||
+		!bytes.Equal(got.Token, m.Token) || !bytes.Equal(got.Payload, m.Payload) {
+		t.Errorf("header or payload changed: %+v", got)
+	}
+	if path := got.Strings(UriPath); len(path) != 3 || path[0] != "streams" || path[1] != "12" || path[2] != "data" {
+		t.Errorf("path should be streams/12/data, got %v", path)
+	}
+	if q := got.Strings(UriQuery); len(q) != 1 || q[0] != "token=abc" {
+		t.Errorf("query should be token=abc, got %v", q)
+	}
+	if cf, ok := got.UintOption(ContentFormat); !ok || cf != OctetStream {
+		t.Errorf("content format should be %d, got %d", OctetStream, cf)
+	}
+	v, _ := got.UintOption(Block1)
+	if b, err := ParseBlock(v); err != nil || b.Num != 300 || !b.More || b.Size() != 1024 {
+		t.Errorf("block should be 300 more 1024, got %+v %v", b, err)
+	}
+	if v, _ := got.Option(Size1); len(v) != 300 {
+		t.Errorf("option of 300 bytes expected, got %d", len(v))
+	}
+}
+
+func TestParseMessage(t *testing.T) {
+	tests := []struct {
+		buf []byte
+		err error
+	}{
+		{[]byte{0x40, 0, 0, 1}, nil},
+		{[]byte{0x40, 0, 0}, ErrMalformedMessage},
+		//version 2
+		{[]byte{0x80, 0, 0, 1}, ErrMalformedMessage},
+		//token length 9
+		{[]byte{0x49, 2, 0, 1, 1, 2, 3, 4, 5, 6, 7, 8, 9}, ErrMalformedMessage},
+		//empty message with a token
+		{[]byte{0x41, 0, 0, 1, 7}, ErrMalformedMessage},
+		//payload marker without payload
+		{[]byte{0x40, 2, 0, 1, 0xff}, ErrMalformedMessage},
+		//option longer than the message
+		{[]byte{0x40, 2, 0, 1, 0xb5, 's'}, ErrMalformedMessage},
+		//reserved option delta 15
+		{[]byte{0x40, 2, 0, 1, 0xf0}, ErrMalformedMessage},
+	}
+	for i, test := range tests {
+		if _, err := ParseMessage(test.buf); err != test.err {
+			t.Errorf("message %d: should be %v, got %v", i, test.err, err)
+		}
+	}
+}
+
+func TestBlock(t *testing.T) {
+	if _, err := ParseBlock(0x07); err != ErrInvalidBlock {
+		t.Errorf("szx 7 should be invalid, got %v", err)
+	}
+	b := Block{Num: 0, More: false, SZX: 0}
+	if b.Value() != 0 || b.Size() != 16 {
+		t.Errorf("first block of 16 bytes should be 0, got %d %d", b.Value(), b.Size())
+	}
+	if v := (Block{Num: 2, More: true, SZX: 2}).Value(); v != 0x2a {
+		t.Errorf("block 2 more 64 should be 0x2a, got %#x", v)
+	}
+	if v := encodeUint(0); len(v) != 0 {
+		t.Errorf("0 should be encoded in 0 bytes, got %v", v)
+	}
+}
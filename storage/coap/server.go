@@ -0,0 +1,429 @@
+package coap
+
+//CoAP (RFC 7252) server over UDP for constrained devices
+//
+//Requests are answered in piggybacked ACKs of confirmable messages and in
+// non-confirmable messages otherwise, so the answer of a confirmable
+// request is sent only after the Handler returns. A confirmable request
+// resent by the client (same endpoint and message id) is not handled
+// again, the saved answer is resent instead.
+//
+//Request payloads larger than one datagram are sent block-wise (RFC 7959
+// Block1): blocks of an endpoint and path are collected in order and
+// answered 2.31 Continue until the last block, then the whole payload is
+// handled as one request. The first block is passed to Authorize (if set)
+// so that unauthorized clients are turned away before anything is buffered,
+// and incomplete transfers of all endpoints are capped by MaxTransfers and
+// MaxTransferBytes, beyond which new blocks are answered 5.03. Block2 (block-wise responses) is not supported,
+// responses are expected to be small.
+//
+//Example:
+//	s := coap.NewServer(coap.HandlerFunc(func(r *coap.Request) *coap.Response {
+//		return &coap.Response{Code: coap.Changed}
+//	}))
+//	log.Fatal(s.ListenAndServe(":5683"))
+import (
+	"bytes"
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrServerClosed = errors.New("CoAP server is closed.")
+
+const (
+	//Largest payload collected from blocks
+	DefaultMaxBodySize = 1 << 20
+	//EXCHANGE_LIFETIME (RFC 7252 section 4.8.2), how long message ids are
+	// remembered and incomplete block transfers are kept
+	DefaultExchangeLifetime = 247 * time.Second
+	//Requests handled at the same time
+	DefaultWorkers = 64
+	//Incomplete block transfers and their buffered bytes, of all endpoints
+	DefaultMaxTransfers = 256
+	DefaultMaxTransferBytes = 16 << 20
+	//Max-Age of 5.03 answers when too many transfers are open
+	transfersRetryAfter = 5
+	//Largest datagram read, a block of 1024 bytes with its options fits
+	maxDatagramSize = 1500
+)
+
+type Request struct {
+	Addr net.Addr
+	//Method code, e.g. POST
+	Code byte
+	//UriPath segments
+	Path []string
+	//UriQuery values, e.g. "token=..."
+	Query []string
+	//-1 if not given
+	ContentFormat int
+	//Whole payload, blocks joined
+	Payload []byte
+}
+
+//Value of the query "name=value", empty if not given
+func (r *Request) QueryValue(name string) string {
+	for _, q := range r.Query {
+		if strings.HasPrefix(q, name+"=") {
+			return q[len(name)+1:]
+		}
+	}
+	return ""
+}
+
+type Response struct {
+	Code byte
+	//Diagnostic text of errors or a small answer
+	Payload []byte
+	//Seconds the response is fresh, e.g. when to retry after 5.03; 0 omits the option
+	MaxAge uint32
+}
+
+type Handler interface {
+	ServeCoAP(r *Request) *Response
+}
+
+type HandlerFunc func(r *Request) *Response
+
+func (f HandlerFunc) ServeCoAP(r *Request) *Response {
+	return f(r)
+}
+
+type Server struct {
+	Handler Handler
+	//Optional, checks a block-wise request at block 0 (the Payload is the
+	// first block only), a non-nil Response rejects the transfer
+	Authorize Handler
+	MaxBodySize int
+	ExchangeLifetime time.Duration
+	Workers int
+	MaxTransfers int
+	MaxTransferBytes int
+
+	mutex sync.Mutex
+	conn net.PacketConn
+	//answers of requests by endpoint and message id, nil while handled
+	exchanges map[exchangeKey]*exchange
+	//incomplete Block1 transfers by endpoint and path
+	transfers map[string]*transfer
+	//bytes buffered by transfers
+	buffered int
+	messageId uint16
+	closed bool
+	wg sync.WaitGroup
+}
+
+type exchangeKey struct {
+	addr string
+	messageId uint16
+}
+
+type exchange struct {
+	answer []byte
+	at time.Time
+}
+
+type transfer struct {
+	payload bytes.Buffer
+	//next block number
+	next uint32
+	at time.Time
+}
+
+func NewServer(h Handler) *Server {
+	return &Server{
+		Handler: h,
+		MaxBodySize: DefaultMaxBodySize,
+		ExchangeLifetime: DefaultExchangeLifetime,
+		Workers: DefaultWorkers,
+		MaxTransfers: DefaultMaxTransfers,
+		MaxTransferBytes: DefaultMaxTransferBytes,
+		exchanges: make(map[exchangeKey]*exchange),
+		transfers: make(map[string]*transfer),
+		messageId: uint16(rand.Intn(1 << 16)),
+	}
+}
+
+func (s *Server) ListenAndServe(addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(conn)
+}
+
+//Read requests from conn until the server is closed
+func (s *Server) Serve(conn net.PacketConn) error {
+	s.mutex.Lock()
+	if s.closed || s.conn != nil {
+		s.mutex.Unlock()
+		conn.Close()
+		return ErrServerClosed
+	}
+	s.conn = conn
+	s.mutex.Unlock()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go s.sweep(stop)
+
+	workers := make(chan struct{}, s.Workers)
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			s.mutex.Lock()
+			closed := s.closed
+			s.mutex.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return err
+		}
+		m, err := ParseMessage(buf[:n])
+		if err != nil {
+			//malformed messages are silently ignored (section 4.2)
+			continue
+		}
+		workers <- struct{}{}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer func() { <-workers }()
+			s.serve(addr, m)
+		}()
+	}
+}
+
+//Forget old message ids and transfers
+func (s *Server) sweep(stop chan struct{}) {
+	ticker := time.NewTicker(s.ExchangeLifetime / 8)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			s.expire(now)
+		}
+	}
+}
+
+func (s *Server) expire(now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for k, e := range s.exchanges {
+		if e != nil && now.Sub(e.at) > s.ExchangeLifetime {
+			delete(s.exchanges, k)
+		}
+	}
+	for k, t := range s.transfers {
+		if now.Sub(t.at) > s.ExchangeLifetime {
+			s.dropTransfer(k)
+		}
+	}
+}
+
+//Forget a transfer, the mutex must be held
+func (s *Server) dropTransfer(key string) {
+	if t, ok := s.transfers[key]; ok {
+		s.buffered -= t.payload.Len()
+		delete(s.transfers, key)
+	}
+}
+
+func (s *Server) Close() error {
+	s.mutex.Lock()
+	s.closed = true
+	conn := s.conn
+	s.mutex.Unlock()
+	var err error
+	if conn != nil {
+		err = conn.Close()
+	}
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) serve(addr net.Addr, m *Message) {
+	switch m.Type {
+	case Acknowledgement, Reset:
+		//nothing is sent confirmable
+		return
+	}
+	if m.Code == Empty {
+		//CoAP ping
+		if m.Type == Confirmable {
+			s.send(addr, &Message{Type: Reset, MessageId: m.MessageId})
+		}
+		return
+	}
+	if m.Code>>5 != 0 {
+		//responses are not expected
+		if m.Type == Confirmable {
+			s.send(addr, &Message{Type: Reset, MessageId: m.MessageId})
+		}
+		return
+	}
+
+	key := exchangeKey{addr: addr.String(), messageId: m.MessageId}
+	s.mutex.Lock()
+	e, seen := s.exchanges[key]
+	if !seen {
+		s.exchanges[key] = nil
+	}
+	s.mutex.Unlock()
+	if seen {
+		//a duplicate, answered again once the first one is answered
+		if e != nil && m.Type == Confirmable {
+			s.write(addr, e.answer)
+		}
+		return
+	}
+
+	answer := s.answer(addr, m)
+	if m.Type == Confirmable {
+		answer.Type = Acknowledgement
+		answer.MessageId = m.MessageId
+	} else {
+		answer.Type = NonConfirmable
+		answer.MessageId = s.nextMessageId()
+	}
+	answer.Token = m.Token
+	b := answer.Marshal()
+	s.mutex.Lock()
+	s.exchanges[key] = &exchange{answer: b, at: time.Now()}
+	s.mutex.Unlock()
+	s.write(addr, b)
+}
+
+//Response of a request, collecting Block1 blocks
+func (s *Server) answer(addr net.Addr, m *Message) *Message {
+	for _, o := range m.Options {
+		if o.Number%2 == 1 && !knownOptions[o.Number] {
+			return &Message{Code: BadOption}
+		}
+	}
+	r := &Request{
+		Addr: addr,
+		Code: m.Code,
+		Path: m.Strings(UriPath),
+		Query: m.Strings(UriQuery),
+		ContentFormat: -1,
+		Payload: m.Payload,
+	}
+	if cf, ok := m.UintOption(ContentFormat); ok {
+		r.ContentFormat = int(cf)
+	}
+
+	v, hasBlock := m.UintOption(Block1)
+	if !hasBlock {
+		if len(r.Payload) > s.MaxBodySize {
+			return tooLarge(s.MaxBodySize)
+		}
+		return response(s.Handler.ServeCoAP(r))
+	}
+	block, err := ParseBlock(v)
+	if err != nil || (block.More && len(m.Payload) != block.Size()) {
+		return &Message{Code: BadRequest, Payload: []byte(ErrInvalidBlock.Error())}
+	}
+	if block.Num == 0 && s.Authorize != nil {
+		if resp := s.Authorize.ServeCoAP(r); resp != nil {
+			return response(resp)
+		}
+	}
+	key := addr.String() + "/" + strings.Join(r.Path, "/")
+	s.mutex.Lock()
+	t := s.transfers[key]
+	if block.Num == 0 {
+		s.dropTransfer(key)
+		if len(s.transfers) >= s.MaxTransfers {
+			s.mutex.Unlock()
+			return busy()
+		}
+		t = &transfer{}
+		s.transfers[key] = t
+	}
+	if t == nil || t.next != block.Num {
+		//blocks must come in order, the transfer starts again from block 0
+		s.dropTransfer(key)
+		s.mutex.Unlock()
+		return &Message{Code: RequestEntityIncomplete}
+	}
+	if t.payload.Len()+len(m.Payload) > s.MaxBodySize {
+		s.dropTransfer(key)
+		s.mutex.Unlock()
+		return tooLarge(s.MaxBodySize)
+	}
+	if s.buffered+len(m.Payload) > s.MaxTransferBytes {
+		s.dropTransfer(key)
+		s.mutex.Unlock()
+		return busy()
+	}
+	t.payload.Write(m.Payload)
+	s.buffered += len(m.Payload)
+	t.next++
+	t.at = time.Now()
+	if block.More {
+		s.mutex.Unlock()
+		a := &Message{Code: Continue}
+		a.AddUintOption(Block1, block.Value())
+		return a
+	}
+	s.dropTransfer(key)
+	s.mutex.Unlock()
+
+	r.Payload = t.payload.Bytes()
+	a := response(s.Handler.ServeCoAP(r))
+	a.AddUintOption(Block1, block.Value())
+	return a
+}
+
+func tooLarge(max int) *Message {
+	a := &Message{Code: RequestEntityTooLarge}
+	a.AddUintOption(Size1, uint32(max))
+	return a
+}
+
+//Too many transfers are open, the client should try again later
+func busy() *Message {
+	a := &Message{Code: ServiceUnavailable}
+	a.AddUintOption(MaxAge, transfersRetryAfter)
+	return a
+}
+
+func response(resp *Response) *Message {
+	if resp == nil {
+		return &Message{Code: InternalServerError}
+	}
+	a := &Message{Code: resp.Code, Payload: resp.Payload}
+	if resp.MaxAge > 0 {
+		a.AddUintOption(MaxAge, resp.MaxAge)
+	}
+	return a
+}
+
+func (s *Server) nextMessageId() uint16 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.messageId++
+	return s.messageId
+}
+
+func (s *Server) send(addr net.Addr, m *Message) {
+	s.write(addr, m.Marshal())
+}
+
+func (s *Server) write(addr net.Addr, b []byte) {
+	if _, err := s.conn.WriteTo(b, addr); err != nil {
+		log.Printf("CoAP answer to %s not sent: %v", addr, err)
+	}
+}
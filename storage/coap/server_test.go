@@ -0,0 +1,293 @@
+package coap
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+//Saves payloads of POST to streams/1/data, answers 4.04 to other paths
+type testHandler struct {
+	mutex sync.Mutex
+	payloads []string
+	//closed when a request starts, the request waits for release
+	started chan struct{}
+	release chan struct{}
+}
+
+func (h *testHandler) ServeCoAP(r *Request) *Response {
+	if h.started != nil {
+		close(h.started)
+		<-h.release
+	}
+	if len(r.Path) != 3 || r.Path[1] != "1" {
+		return &Response{Code: NotFound, Payload: []byte("not found")}
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.payloads = append(h.payloads, string(r.Payload))
+	return &Response{Code: Changed}
+}
+
+func (h *testHandler) saved() []string {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return append([]string{}, h.payloads...)
+}
+
+type testClient struct {
+	t *testing.T
+	conn net.Conn
+}
+
+func testServer(t *testing.T, s *Server) *testClient {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(pc)
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testClient{t: t, conn: conn}
+}
+
+func post(typ byte, id uint16, path string, payload string) *Message {
+	m := &Message{Type: typ, Code: POST, MessageId: id, Token: []byte{byte(id)}, Payload: []byte(payload)}
+	m.AddOption(UriPath, []byte("streams"))
+	m.AddOption(UriPath, []byte(path))
+	m.AddOption(UriPath, []byte("data"))
+	return m
+}
+
+func (c *testClient) send(m *Message) {
+	if _, err := c.conn.Write(m.Marshal()); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+//Next message from the server, nil if none within timeout
+func (c *testClient) receive(timeout time.Duration) *Message {
+	buf := make([]byte, maxDatagramSize)
+	c.conn.SetReadDeadline(time.Now().Add(timeout))
+	n, err := c.conn.Read(buf)
+	if err != nil {
+		return nil
+	}
+	m, err := ParseMessage(buf[:n])
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return m
+}
+
+func (c *testClient) expect(typ byte, code byte) *Message {
+	m := c.receive(5 * time.Second)
+	if m == nil {
+		c.t.Fatalf("expect %d %d, got nothing", typ, code)
+	}
+	if m.Type != typ || m.Code != code {
+		c.t.Fatalf("expect %d %d, got %d %d", typ, code, m.Type, m.Code)
+	}
+	return m
+}
+
+func TestConfirmable(t *testing.T) {
+	h := &testHandler{}
+	s := NewServer(h)
+	c := testServer(t, s)
+	defer s.Close()
+	defer c.conn.Close()
+
+	c.send(post(Confirmable, 7, "1", "a"))
+	m := c.expect(Acknowledgement, Changed)
+	if m.MessageId != 7 || len(m.Token) != 1 || m.Token[0] != 7 {
+		t.Errorf("ACK should be piggybacked on message 7, got %d %v", m.MessageId, m.Token)
+	}
+
+	//a resent request gets the same answer and is not handled again
+	c.send(post(Confirmable, 7, "1", "a"))
+	if m = c.expect(Acknowledgement, Changed); m.MessageId != 7 {
+		t.Errorf("ACK of message 7 expected, got %d", m.MessageId)
+	}
+
+	c.send(post(Confirmable, 8, "2", "b"))
+	if m = c.expect(Acknowledgement, NotFound); string(m.Payload) != "not found" {
+		t.Errorf("diagnostic payload expected, got %q", m.Payload)
+	}
+
+	//non-confirmable requests are answered with new message ids
+	c.send(post(NonConfirmable, 9, "1", "c"))
+	if m = c.expect(NonConfirmable, Changed); m.MessageId == 9 || m.Token[0] != 9 {
+		t.Errorf("NON answer should have a new message id and token 9, got %d %v", m.MessageId, m.Token)
+	}
+
+	//ping
+	c.send(&Message{Type: Confirmable, Code: Empty, MessageId: 10})
+	c.expect(Reset, Empty)
+
+	//unknown critical option
+	bad := post(Confirmable, 11, "1", "d")
+	bad.AddOption(2049, []byte{1})
+	c.send(bad)
+	c.expect(Acknowledgement, BadOption)
+	if saved := h.saved(); len(saved) != 2 || saved[0] != "a" || saved[1] != "c" {
+		t.Errorf("saved payloads should be [a c], got %v", saved)
+	}
+}
+
+func TestAckAfterHandler(t *testing.T) {
+	h := &testHandler{started: make(chan struct{}), release: make(chan struct{})}
+	s := NewServer(h)
+	c := testServer(t, s)
+	defer s.Close()
+	defer c.conn.Close()
+
+	c.send(post(Confirmable, 1, "1", "a"))
+	<-h.started
+	//resent while handled, not answered
+	c.send(post(Confirmable, 1, "1", "a"))
+	if m := c.receive(100 * time.Millisecond); m != nil {
+		t.Error("ACK should not be sent before the request is handled")
+	}
+	close(h.release)
+	c.expect(Acknowledgement, Changed)
+	if m := c.receive(100 * time.Millisecond); m != nil {
+		t.Errorf("one ACK expected, got another %d", m.Code)
+	}
+	if saved := h.saved(); len(saved) != 1 {
+		t.Errorf("request should be handled once, got %v", saved)
+	}
+}
+
+func block1(id uint16, num uint32, more bool, payload string) *Message {
+	m := post(Confirmable, id, "1", payload)
+	m.AddUintOption(Block1, Block{Num: num, More: more, SZX: 0}.Value())
+	return m
+}
+
+func TestBlock1(t *testing.T) {
+	h := &testHandler{}
+	s := NewServer(h)
+	s.MaxBodySize = 40
+	c := testServer(t, s)
+	defer s.Close()
+	defer c.conn.Close()
+
+	c.send(block1(1, 0, true, "0123456789abcdef"))
+	m := c.expect(Acknowledgement, Continue)
+	if v, _ := m.UintOption(Block1); v != (Block{Num: 0, More: true}).Value() {
+		t.Errorf("Continue should echo block 0, got %#x", v)
+	}
+	c.send(block1(2, 1, true, "ghijklmnopqrstuv"))
+	c.expect(Acknowledgement, Continue)
+	c.send(block1(3, 2, false, "wxyz"))
+	m = c.expect(Acknowledgement, Changed)
+	if v, _ := m.UintOption(Block1); v != (Block{Num: 2}).Value() {
+		t.Errorf("last answer should echo block 2, got %#x", v)
+	}
+	if saved := h.saved(); len(saved) != 1 || saved[0] != "0123456789abcdefghijklmnopqrstuvwxyz" {
+		t.Errorf("blocks should be joined, got %v", saved)
+	}
+
+	//blocks out of order
+	c.send(block1(4, 1, true, "0123456789abcdef"))
+	c.expect(Acknowledgement, RequestEntityIncomplete)
+
+	//intermediate blocks must be full
+	c.send(block1(5, 0, true, "short"))
+	c.expect(Acknowledgement, BadRequest)
+
+	//too large
+	c.send(block1(6, 0, true, "0123456789abcdef"))
+	c.expect(Acknowledgement, Continue)
+	c.send(block1(7, 1, true, "0123456789abcdef"))
+	c.expect(Acknowledgement, Continue)
+	c.send(block1(8, 2, true, "0123456789abcdef"))
+	m = c.expect(Acknowledgement, RequestEntityTooLarge)
+	if size, _ := m.UintOption(Size1); size != 40 {
+		t.Errorf("Size1 should be 40, got %d", size)
+	}
+	if saved := h.saved(); len(saved) != 1 {
+		t.Errorf("incomplete transfers should not be handled, got %v", saved)
+	}
+}
+
+func TestBlock1Limits(t *testing.T) {
+	h := &testHandler{}
+	s := NewServer(h)
+	s.Authorize = HandlerFunc(func(r *Request) *Response {
+		if r.QueryValue("token") != "secret" {
+			return &Response{Code: Unauthorized}
+		}
+		return nil
+	})
+	s.MaxTransfers = 1
+	s.MaxTransferBytes = 40
+	c := testServer(t, s)
+	defer s.Close()
+	defer c.conn.Close()
+
+	//rejected at block 0, nothing is buffered
+	c.send(block1(1, 0, true, "0123456789abcdef"))
+	c.expect(Acknowledgement, Unauthorized)
+	s.mutex.Lock()
+	open := len(s.transfers)
+	s.mutex.Unlock()
+	if open != 0 {
+		t.Errorf("unauthorized transfer should not be kept, got %d", open)
+	}
+
+	m := block1(2, 0, true, "0123456789abcdef")
+	m.AddOption(UriQuery, []byte("token=secret"))
+	c.send(m)
+	c.expect(Acknowledgement, Continue)
+	//later blocks are not authorized again
+	c.send(block1(3, 1, true, "ghijklmnopqrstuv"))
+	c.expect(Acknowledgement, Continue)
+
+	//one transfer open already
+	conn, err := net.Dial("udp", c.conn.RemoteAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := &testClient{t: t, conn: conn}
+	defer conn.Close()
+	m = block1(1, 0, true, "0123456789abcdef")
+	m.AddOption(UriQuery, []byte("token=secret"))
+	other.send(m)
+	m = other.expect(Acknowledgement, ServiceUnavailable)
+	if maxAge, _ := m.UintOption(MaxAge); maxAge != transfersRetryAfter {
+		t.Errorf("Max-Age should be %d, got %d", transfersRetryAfter, maxAge)
+	}
+
+	//40 bytes buffered at most
+	c.send(block1(4, 2, true, "0123456789abcdef"))
+	c.expect(Acknowledgement, ServiceUnavailable)
+	s.mutex.Lock()
+	open, buffered := len(s.transfers), s.buffered
+	s.mutex.Unlock()
+	if open != 0 || buffered != 0 {
+		t.Errorf("transfer over the limit should be dropped, got %d %d", open, buffered)
+	}
+	if saved := h.saved(); len(saved) != 0 {
+		t.Errorf("incomplete transfers should not be handled, got %v", saved)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	s := NewServer(&testHandler{})
+	now := time.Now()
+	s.exchanges[exchangeKey{"a", 1}] = &exchange{at: now.Add(-2 * s.ExchangeLifetime)}
+	s.exchanges[exchangeKey{"a", 2}] = &exchange{at: now}
+	s.exchanges[exchangeKey{"a", 3}] = nil
+	s.transfers["a/streams/1/data"] = &transfer{at: now.Add(-2 * s.ExchangeLifetime)}
+	s.transfers["a/streams/1/data"].payload.WriteString("block")
+	s.buffered = 5
+	s.expire(now)
+	if len(s.exchanges) != 2 || len(s.transfers) != 0 || s.buffered != 0 {
+		t.Errorf("old exchanges and transfers should be forgotten, got %v %v", s.exchanges, s.transfers)
+	}
+}
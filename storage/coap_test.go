@@ -0,0 +1,74 @@
+package storage
+
+import (
+    "testing"
+    "github.com/heartsg/dasea/storage/coap"
+    "github.com/heartsg/dasea/storage/data"
+    "github.com/heartsg/dasea/storage/meta"
+)
+
+func TestParseResource(t *testing.T) {
+    tests := []struct {
+        path []string
+        id int64
+        err error
+    }{
+        {[]string{"streams", "12", "data"}, 12, nil},
+        {[]string{"streams", "abc", "data"}, 0, ErrInvalidResource},
+        {[]string{"streams", "12"}, 0, ErrInvalidResource},
+        {[]string{"streams", "12", "data", "json"}, 0, ErrInvalidResource},
+        {[]string{"devices", "12", "data"}, 0, ErrInvalidResource},
+    }
+    for _, test := range tests {
+        id, err := parseResource(test.path)
+        if id != test.id || err != test.err {
+            t.Errorf("%v: should be %d %v, got %d %v", test.path, test.id, test.err, id, err)
+        }
+    }
+}
+
+func TestCoAPError(t *testing.T) {
+    tests := []struct {
+        err error
+        code byte
+        maxAge uint32
+        payload string
+    }{
+        {data.ErrInvalidData, coap.BadRequest, 0, data.ErrInvalidData.Error()},
+        {ErrInvalidResource, coap.BadRequest, 0, ErrInvalidResource.Error()},
+        {meta.ErrInvalidToken, coap.Unauthorized, 0, meta.ErrInvalidToken.Error()},
+        {meta.ErrNotFound, coap.NotFound, 0, meta.ErrNotFound.Error()},
+        {data.ErrDuplicateRecord, coap.Conflict, 0, data.ErrDuplicateRecord.Error()},
+        {data.ErrPipelineFull, coap.ServiceUnavailable, coapRetryAfter, data.ErrPipelineFull.Error()},
+        //server errors are not told
+        {data.ErrCorruptBlock, coap.InternalServerError, 0, "Internal Server Error"},
+    }
+    for _, test := range tests {
+        resp := coapError(test.err)
+        if resp.Code != test.code || resp.MaxAge != test.maxAge || string(resp.Payload) != test.payload {
+            t.Errorf("%v: should be %d %d %q, got %d %d %q", test.err, test.code, test.maxAge, test.payload,
+                resp.Code, resp.MaxAge, resp.Payload)
+        }
+    }
+}
+
+func TestServeCoAP(t *testing.T) {
+    tests := []struct {
+        r *coap.Request
+        code byte
+    }{
+        {&coap.Request{Code: coap.POST, Path: []string{"streams", "x", "data"}, ContentFormat: -1}, coap.BadRequest},
+        {&coap.Request{Code: coap.GET, Path: []string{"streams", "1", "data"}, ContentFormat: -1}, coap.MethodNotAllowed},
+        {&coap.Request{Code: coap.POST, Path: []string{"streams", "1", "data"}, ContentFormat: coap.JSON}, coap.UnsupportedContentFormat},
+        //no device token
+        {&coap.Request{Code: coap.POST, Path: []string{"streams", "1", "data"}, ContentFormat: coap.OctetStream}, coap.Unauthorized},
+    }
+    for _, test := range tests {
+        if resp := serveCoAP(test.r); resp.Code != test.code {
+            t.Errorf("%v: should be %d, got %d", test.r.Path, test.code, resp.Code)
+        }
+        if resp := authorizeCoAP(test.r); resp == nil || resp.Code != test.code {
+            t.Errorf("%v: block 0 should be rejected with %d, got %v", test.r.Path, test.code, resp)
+        }
+    }
+}
@@ -0,0 +1,446 @@
+package data
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"github.com/heartsg/dasea/storage/meta"
+)
+
+var (
+	ErrNotNumeric = errors.New("Data point is not numeric (bool, datetime and string cannot be aggregated).")
+	ErrInvalidInterval = errors.New("Invalid aggregate interval.")
+	ErrInvalidFunction = errors.New("Invalid aggregate function.")
+)
+
+// Aggregate functions, AggregateFunctions is the default order
+var AggregateFunctions = []string{"min", "max", "avg", "sum", "count", "first", "last", "stddev"}
+
+// Interval of aggregate buckets, exactly one of the fields is set.
+//
+// Buckets are aligned in the time zone of the Aggregate: Duration buckets are
+// aligned to the epoch in local (wall clock) time, so 1h buckets start at the
+// local hour even for zones with 30 minute offsets; Days and Months are
+// calendar days and months, so they follow daylight saving changes.
+type Interval struct {
+	Duration time.Duration
+	Days int
+	Months int
+}
+
+// Parse intervals such as "30s", "1m", "1h", "1d", "7d", "1mo", "3mo", "1y"
+func ParseInterval(s string) (Interval, error) {
+	var i Interval
+	unit := strings.TrimLeft(s, "0123456789")
+	n, err := strconv.Atoi(s[:len(s)-len(unit)])
+	if err != nil || n <= 0 {
+		return i, ErrInvalidInterval
+	}
+	switch unit {
+	case "s":
+		i.Duration = time.Duration(n) * time.Second
+	case "m":
+		i.Duration = time.Duration(n) * time.Minute
+	case "h":
+		i.Duration = time.Duration(n) * time.Hour
+	case "d":
+		i.Days = n
+	case "w":
+		i.Days = n * 7
+	case "mo":
+		i.Months = n
+	case "y":
+		i.Months = n * 12
+	default:
+		return i, ErrInvalidInterval
+	}
+	return i, nil
+}
+
+func (i Interval) valid() bool {
+	set := 0
+	if i.Duration > 0 {
+		set++
+	}
+	if i.Days > 0 {
+		set++
+	}
+	if i.Months > 0 {
+		set++
+	}
+	return set == 1 && i.Duration >= 0 && i.Days >= 0 && i.Months >= 0
+}
+
+// floor division for negative times
+func floorDiv(a int64, b int64) int64 {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
+
+// Start of the bucket that t falls in
+func (i Interval) bucket(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	switch {
+	case i.Days > 0:
+		//days since 1970-01-01 in local calendar
+		days := floorDiv(time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC).Unix(), 24*3600)
+		days = floorDiv(days, int64(i.Days)) * int64(i.Days)
+		return time.Date(1970, 1, 1+int(days), 0, 0, 0, 0, loc)
+	case i.Months > 0:
+		months := int64(t.Year())*12 + int64(t.Month()) - 1
+		months = floorDiv(months, int64(i.Months)) * int64(i.Months)
+		return time.Date(int(floorDiv(months, 12)), time.Month(months-floorDiv(months, 12)*12+1), 1, 0, 0, 0, 0, loc)
+	}
+	_, offset := t.Zone()
+	wall := t.UnixNano() + int64(offset)*int64(time.Second)
+	wall = floorDiv(wall, int64(i.Duration)) * int64(i.Duration)
+	return time.Unix(0, wall-int64(offset)*int64(time.Second)).In(loc)
+}
+
+// Aggregate query, groups data points of a DataStream within [Start, End) by
+// Interval and applies Functions to each of Columns.
+type Aggregate struct {
+	Start time.Time
+	End time.Time
+	Interval Interval
+	// Time zone for bucket alignment, UTC if nil
+	Location *time.Location
+	// Numeric DataPointNames. Empty means all numeric data points, bool,
+	// datetime, string and retired data points are skipped.
+	Columns []string
+	// See AggregateFunctions, empty means all
+	Functions []string
+	// Units to convert Columns to and unit system, the same as Query except
+	// that currencies cannot be converted
+	Units []int64
+	UnitSystem string
+}
+
+// One bucket of AggregateResult, Values are indexed by [column][function].
+// Buckets without data points are not returned.
+type Bucket struct {
+	Start time.Time
+	Values [][]float64
+}
+
+type AggregateResult struct {
+	Columns []string
+	// Units of Columns after conversion
+	Units []int64
+	Functions []string
+	Buckets []*Bucket
+}
+
+// running statistics of one column in one bucket
+type aggregateState struct {
+	count int64
+	sum float64
+	min float64
+	max float64
+	first float64
+	last float64
+	//Welford's algorithm for variance
+	mean float64
+	m2 float64
+}
+
+func (s *aggregateState) add(v float64) {
+	if s.count == 0 {
+		s.min, s.max, s.first = v, v, v
+	}
+	s.count++
+	s.sum += v
+	s.min = math.Min(s.min, v)
+	s.max = math.Max(s.max, v)
+	s.last = v
+	delta := v - s.mean
+	s.mean += delta / float64(s.count)
+	s.m2 += delta * (v - s.mean)
+}
+
+// merge statistics of a later period (e.g. a rollup bucket), see
+// Chan et al. for combining variances
+func (s *aggregateState) merge(o *aggregateState) {
+	if o.count == 0 {
+		return
+	}
+	if s.count == 0 {
+		*s = *o
+		return
+	}
+	count := s.count + o.count
+	delta := o.mean - s.mean
+	s.m2 += o.m2 + delta*delta*float64(s.count)*float64(o.count)/float64(count)
+	s.mean += delta * float64(o.count) / float64(count)
+	s.count = count
+	s.sum += o.sum
+	s.min = math.Min(s.min, o.min)
+	s.max = math.Max(s.max, o.max)
+	s.last = o.last
+}
+
+func (s *aggregateState) value(f string) float64 {
+	switch f {
+	case "min":
+		return s.min
+	case "max":
+		return s.max
+	case "avg":
+		return s.sum / float64(s.count)
+	case "sum":
+		return s.sum
+	case "count":
+		return float64(s.count)
+	case "first":
+		return s.first
+	case "last":
+		return s.last
+	case "stddev":
+		//sample standard deviation, 0 for a single data point
+		if s.count < 2 {
+			return 0
+		}
+		return math.Sqrt(s.m2 / float64(s.count-1))
+	}
+	return 0
+}
+
+func numericValue(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+// indexes of numeric data points, including retired ones
+func numericColumns(a *meta.DataStreamAttribute) []int {
+	indexes := make([]int, 0)
+	for i, t := range a.DataPointTypes {
+		zv, err := TypeName2ZeroValue(t)
+		if err != nil {
+			continue
+		}
+		if _, ok := numericValue(zv); ok {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+// Map Columns to indexes of numeric DataPointNames
+func (g *Aggregate) columns(a *meta.DataStreamAttribute) ([]int, error) {
+	indexes := make([]int, 0)
+	if len(g.Columns) == 0 {
+		for _, i := range numericColumns(a) {
+			if !a.IsRetired(i) {
+				indexes = append(indexes, i)
+			}
+		}
+		return indexes, nil
+	}
+	q := &Query{Columns: g.Columns}
+	all, err := q.columns(a)
+	if err != nil {
+		return nil, err
+	}
+	for _, index := range all {
+		zv, err := TypeName2ZeroValue(a.DataPointTypes[index])
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := numericValue(zv); !ok {
+			return nil, ErrNotNumeric
+		}
+		indexes = append(indexes, index)
+	}
+	return indexes, nil
+}
+
+// Groups records (in time order) into buckets, emit is called once
+// a bucket is complete
+type aggregator struct {
+	interval Interval
+	loc *time.Location
+	columns int
+	emit func(start time.Time, states []*aggregateState)
+
+	current time.Time
+	states []*aggregateState
+}
+
+// states of the bucket that t falls in
+func (ag *aggregator) at(t time.Time) []*aggregateState {
+	bucket := ag.interval.bucket(t, ag.loc)
+	if ag.states == nil || !bucket.Equal(ag.current) {
+		ag.flush()
+		ag.current = bucket
+		ag.states = make([]*aggregateState, ag.columns)
+		for i := range ag.states {
+			ag.states[i] = &aggregateState{}
+		}
+	}
+	return ag.states
+}
+
+func (ag *aggregator) flush() {
+	if ag.states == nil {
+		return
+	}
+	ag.emit(ag.current, ag.states)
+	ag.states = nil
+}
+
+// feed raw records of columns (indexes of DataPointNames) within [start, end)
+// to the aggregator, page by page so that memory does not grow with the range
+func (ag *aggregator) raw(store DataStore, dataStreamId int64, a *meta.DataStreamAttribute, indexes []int,
+	start time.Time, end time.Time) error {
+	if !start.Before(end) {
+		return nil
+	}
+	q := &Query{Start: start, End: end, Limit: MaxQueryLimit}
+	for {
+		page, err := q.Run(store, dataStreamId, a)
+		if err != nil {
+			return err
+		}
+		for _, r := range page.Records {
+			states := ag.at(r.Time)
+			for i, index := range indexes {
+				v, _ := numericValue(r.Values[index])
+				states[i].add(v)
+			}
+		}
+		if page.NextCursor == "" {
+			return nil
+		}
+		q.Cursor = page.NextCursor
+	}
+}
+
+func (g *Aggregate) validate() ([]string, error) {
+	if !g.Start.Before(g.End) {
+		return nil, ErrInvalidQuery
+	}
+	if !g.Interval.valid() {
+		return nil, ErrInvalidInterval
+	}
+	functions := g.Functions
+	if len(functions) == 0 {
+		functions = AggregateFunctions
+	}
+	for _, f := range functions {
+		found := false
+		for _, af := range AggregateFunctions {
+			if f == af {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, ErrInvalidFunction
+		}
+	}
+	return functions, nil
+}
+
+// Run the aggregate against raw data points in a DataStore, see AggregateDataPoints
+// for using rollups. Records are read page by page so that memory only grows with
+// the number of buckets.
+func (g *Aggregate) Run(store DataStore, dataStreamId int64, a *meta.DataStreamAttribute) (*AggregateResult, error) {
+	return g.RunWithRollup(store, dataStreamId, a, nil)
+}
+
+// Run the aggregate, reading the part of the range covered by rollup r (if not nil
+// and usable for the Interval, see RollupUsable) from the rollup DataStream instead
+// of raw data points.
+func (g *Aggregate) RunWithRollup(store DataStore, dataStreamId int64, a *meta.DataStreamAttribute,
+	r *meta.Rollup) (*AggregateResult, error) {
+	functions, err := g.validate()
+	if err != nil {
+		return nil, err
+	}
+	indexes, err := g.columns(a)
+	if err != nil {
+		return nil, err
+	}
+	//statistics are gathered in saved units and converted when emitted, so
+	// that raw data points and rollups are handled the same
+	conversions, currencies, units, err := columnConversions(a, indexes, g.Units, g.UnitSystem)
+	if err != nil {
+		return nil, err
+	}
+	//exchange rates change within a bucket
+	for _, c := range currencies {
+		if c != nil {
+			return nil, meta.ErrNotConvertible
+		}
+	}
+	for _, c := range conversions {
+		for _, f := range functions {
+			if c != nil && !aggregateConvertible(c, f) {
+				return nil, meta.ErrNotConvertible
+			}
+		}
+	}
+	loc := g.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	result := &AggregateResult{
+		Columns: make([]string, len(indexes)),
+		Units: units,
+		Functions: functions,
+		Buckets: make([]*Bucket, 0),
+	}
+	for i, index := range indexes {
+		result.Columns[i] = a.DataPointNames[index]
+	}
+	ag := &aggregator{
+		interval: g.Interval,
+		loc: loc,
+		columns: len(indexes),
+		emit: func(start time.Time, states []*aggregateState) {
+			b := &Bucket{Start: start, Values: make([][]float64, len(states))}
+			for i, s := range states {
+				b.Values[i] = make([]float64, len(functions))
+				for j, f := range functions {
+					b.Values[i][j] = s.value(f)
+					if conversions[i] != nil {
+						b.Values[i][j] = convertAggregate(conversions[i], f, b.Values[i][j], s.count)
+					}
+				}
+			}
+			result.Buckets = append(result.Buckets, b)
+		},
+	}
+
+	//raw head, rollup, raw tail, in time order
+	rollupStart, rollupEnd := g.End, g.End
+	if r != nil && RollupUsable(r, g) {
+		rollupStart, rollupEnd = rollupRange(r, g.Start, g.End)
+	}
+	if err = ag.raw(store, dataStreamId, a, indexes, g.Start, rollupStart); err != nil {
+		return nil, err
+	}
+	if rollupStart.Before(rollupEnd) {
+		if err = ag.rollup(store, r, a, indexes, rollupStart, rollupEnd); err != nil {
+			return nil, err
+		}
+	}
+	if err = ag.raw(store, dataStreamId, a, indexes, rollupEnd, g.End); err != nil {
+		return nil, err
+	}
+	ag.flush()
+	return result, nil
+}
@@ -0,0 +1,109 @@
+package data
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseInterval(t *testing.T) {
+	tests := map[string]Interval{
+		"30s": Interval{Duration: 30 * time.Second},
+		"1h": Interval{Duration: time.Hour},
+		"7d": Interval{Days: 7},
+		"1w": Interval{Days: 7},
+		"3mo": Interval{Months: 3},
+		"1y": Interval{Months: 12},
+	}
+	for s, want := range tests {
+		got, err := ParseInterval(s)
+		if err != nil || got != want {
+			t.Errorf("%s: want %v, got %v %v", s, want, got, err)
+		}
+	}
+	for _, s := range []string{"", "h", "0h", "-1h", "1x"} {
+		if _, err := ParseInterval(s); err != ErrInvalidInterval {
+			t.Errorf("%s should be invalid, got %v", s, err)
+		}
+	}
+}
+
+func TestIntervalBucket(t *testing.T) {
+	loc := time.FixedZone("SGT", 8*3600)
+	tm := time.Date(2016, 3, 15, 1, 30, 0, 0, loc)
+	if b := (Interval{Days: 1}).bucket(tm, loc); !b.Equal(time.Date(2016, 3, 15, 0, 0, 0, 0, loc)) {
+		t.Errorf("day bucket should start at local midnight, got %v", b)
+	}
+	if b := (Interval{Duration: time.Hour}).bucket(tm, loc); !b.Equal(time.Date(2016, 3, 15, 1, 0, 0, 0, loc)) {
+		t.Errorf("hour bucket not match, got %v", b)
+	}
+	if b := (Interval{Months: 3}).bucket(tm, loc); !b.Equal(time.Date(2016, 1, 1, 0, 0, 0, 0, loc)) {
+		t.Errorf("quarter bucket not match, got %v", b)
+	}
+	//the same instant is in a different month in UTC
+	tm = time.Date(2016, 4, 1, 2, 0, 0, 0, loc)
+	if b := (Interval{Months: 1}).bucket(tm, time.UTC); !b.Equal(time.Date(2016, 3, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("month bucket should follow time zone, got %v", b)
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dasea-aggregate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewEmbeddedStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.CreateStream(1, testAttribute); err != nil {
+		t.Fatal(err)
+	}
+	//one record per second for 3 minutes, radar = i % 100, dummy = -i, temperature = i / 2
+	start := time.Unix(600, 0)
+	if err = store.Append(1, testAttribute, testRecords(start, 180)); err != nil {
+		t.Fatal(err)
+	}
+
+	g := &Aggregate{Start: start, End: start.Add(time.Hour), Interval: Interval{Duration: time.Minute}}
+	result, err := g.Run(store, 1, testAttribute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Columns) != 3 || result.Columns[2] != "temperature" {
+		t.Fatalf("time column should be skipped, got %v", result.Columns)
+	}
+	if len(result.Buckets) != 3 {
+		t.Fatalf("should get 3 buckets, got %d", len(result.Buckets))
+	}
+	b := result.Buckets[1]
+	if !b.Start.Equal(start.Add(time.Minute)) {
+		t.Errorf("bucket should start at %v, got %v", start.Add(time.Minute), b.Start)
+	}
+	//dummy in the second minute is -60 .. -119
+	want := []float64{-119, -60, -89.5, -5370, 60, -60, -119, math.Sqrt(305)}
+	for i, f := range AggregateFunctions {
+		if math.Abs(b.Values[1][i]-want[i]) > 1e-9 {
+			t.Errorf("%s should be %v, got %v", f, want[i], b.Values[1][i])
+		}
+	}
+
+	g.Columns = []string{"time"}
+	if _, err = g.Run(store, 1, testAttribute); err != ErrNotNumeric {
+		t.Errorf("non numeric column should be rejected, got %v", err)
+	}
+	g.Columns = nil
+	g.Functions = []string{"median"}
+	if _, err = g.Run(store, 1, testAttribute); err != ErrInvalidFunction {
+		t.Errorf("unknown function should be rejected, got %v", err)
+	}
+	g.Functions = nil
+	g.Interval = Interval{Days: 1, Months: 1}
+	if _, err = g.Run(store, 1, testAttribute); err != ErrInvalidInterval {
+		t.Errorf("interval with both days and months should be rejected, got %v", err)
+	}
+}
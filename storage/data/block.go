@@ -0,0 +1,455 @@
+package data
+
+import (
+	"errors"
+	"math"
+	"math/bits"
+	"time"
+	"github.com/heartsg/dasea/common"
+	"github.com/heartsg/dasea/storage/meta"
+)
+
+var ErrCorruptBlock = errors.New("Corrupt compressed data block.")
+
+//A block saves a batch of records column by column (similar to Gorilla, the
+// Facebook in-memory time series database), which is much smaller than saving
+// record by record for sensor data sampled at regular intervals.
+//
+//  message Block {
+//      uint64 count = 1;
+//      bytes times = 2;            //bit stream, delta-of-delta
+//      repeated bytes columns = 3; //one for each data point, see below
+//  }
+//
+//Data points added to the DataStreamAttribute later have no column in older
+// blocks, they are read as zero values.
+//
+//Columns are encoded according to the normalised type,
+//  - int64, uint64: zigzag varint of the delta to the previous value (wraps around)
+//  - float64: bit stream, XOR with the previous value
+//  - bool: bit stream, one bit per value
+//  - time.Time: bit stream, delta-of-delta of unix nano (the same as times)
+//  - string: length delimited strings
+//
+//Delta-of-delta (D) of unix nano are written as,
+//  '0'                   D == 0
+//  '10'   + 14 bits      D in [-2^13, 2^13)
+//  '110'  + 24 bits      D in [-2^23, 2^23)
+//  '1110' + 36 bits      D in [-2^35, 2^35)
+//  '1111' + 64 bits      otherwise
+//
+//XOR of floats are written as,
+//  '0'                   the same as the previous value
+//  '10' + meaningful bits    meaningful bits fall within the previous window
+//  '11' + 5 bits leading zeros + 6 bits length + meaningful bits
+
+type bitWriter struct {
+	buf []byte
+	// unused bits in the last byte
+	free uint
+}
+
+func (w *bitWriter) writeBit(bit bool) {
+	if w.free == 0 {
+		w.buf = append(w.buf, 0)
+		w.free = 8
+	}
+	w.free--
+	if bit {
+		w.buf[len(w.buf)-1] |= 1 << w.free
+	}
+}
+
+// write the lowest n bits of v, most significant first
+func (w *bitWriter) writeBits(v uint64, n uint) {
+	for n > 0 {
+		n--
+		w.writeBit((v>>n)&1 == 1)
+	}
+}
+
+type bitReader struct {
+	buf []byte
+	pos uint
+}
+
+func (r *bitReader) readBit() (bool, error) {
+	if r.pos >= uint(len(r.buf))*8 {
+		return false, ErrCorruptBlock
+	}
+	bit := (r.buf[r.pos/8]>>(7-r.pos%8))&1 == 1
+	r.pos++
+	return bit, nil
+}
+
+func (r *bitReader) readBits(n uint) (uint64, error) {
+	var v uint64
+	for i := uint(0); i < n; i++ {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		v <<= 1
+		if bit {
+			v |= 1
+		}
+	}
+	return v, nil
+}
+
+var deltaOfDeltaBuckets = []struct {
+	control uint64
+	controlBits uint
+	valueBits uint
+}{
+	{0x2, 2, 14},
+	{0x6, 3, 24},
+	{0xe, 4, 36},
+	{0xf, 4, 64},
+}
+
+type deltaOfDeltaEncoder struct {
+	w bitWriter
+	count int
+	prev int64
+	prevDelta int64
+}
+
+func (e *deltaOfDeltaEncoder) encode(t int64) {
+	if e.count == 0 {
+		e.w.writeBits(uint64(t), 64)
+		e.count, e.prev = 1, t
+		return
+	}
+	delta := t - e.prev
+	dod := delta - e.prevDelta
+	e.count, e.prev, e.prevDelta = e.count+1, t, delta
+	if dod == 0 {
+		e.w.writeBit(false)
+		return
+	}
+	for _, b := range deltaOfDeltaBuckets {
+		if b.valueBits == 64 || (dod >= -(1<<(b.valueBits-1)) && dod < 1<<(b.valueBits-1)) {
+			e.w.writeBits(b.control, b.controlBits)
+			e.w.writeBits(uint64(dod), b.valueBits)
+			return
+		}
+	}
+}
+
+type deltaOfDeltaDecoder struct {
+	r bitReader
+	count int
+	prev int64
+	prevDelta int64
+}
+
+func (d *deltaOfDeltaDecoder) decode() (int64, error) {
+	if d.count == 0 {
+		v, err := d.r.readBits(64)
+		if err != nil {
+			return 0, err
+		}
+		d.count, d.prev = 1, int64(v)
+		return d.prev, nil
+	}
+	//the number of leading 1 bits selects the bucket
+	ones := 0
+	for ones < len(deltaOfDeltaBuckets) {
+		bit, err := d.r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		if !bit {
+			break
+		}
+		ones++
+	}
+	var dod int64
+	if ones > 0 {
+		b := deltaOfDeltaBuckets[ones-1]
+		v, err := d.r.readBits(b.valueBits)
+		if err != nil {
+			return 0, err
+		}
+		//sign extend
+		shift := 64 - b.valueBits
+		dod = int64(v<<shift) >> shift
+	}
+	d.prevDelta += dod
+	d.prev += d.prevDelta
+	d.count++
+	return d.prev, nil
+}
+
+type xorEncoder struct {
+	w bitWriter
+	count int
+	prev uint64
+	// whether leading and trailing (the window) are set
+	window bool
+	leading uint
+	trailing uint
+}
+
+func (e *xorEncoder) encode(f float64) {
+	v := math.Float64bits(f)
+	if e.count == 0 {
+		e.w.writeBits(v, 64)
+		e.count, e.prev = 1, v
+		return
+	}
+	x := v ^ e.prev
+	e.count, e.prev = e.count+1, v
+	if x == 0 {
+		e.w.writeBit(false)
+		return
+	}
+	e.w.writeBit(true)
+	leading, trailing := uint(bits.LeadingZeros64(x)), uint(bits.TrailingZeros64(x))
+	if leading > 31 {
+		leading = 31
+	}
+	if e.window && leading >= e.leading && trailing >= e.trailing {
+		e.w.writeBit(false)
+		e.w.writeBits(x>>e.trailing, 64-e.leading-e.trailing)
+		return
+	}
+	e.window, e.leading, e.trailing = true, leading, trailing
+	significant := 64 - leading - trailing
+	e.w.writeBit(true)
+	e.w.writeBits(uint64(leading), 5)
+	//64 does not fit in 6 bits, it is written as 0 (0 is not possible)
+	e.w.writeBits(uint64(significant&63), 6)
+	e.w.writeBits(x>>trailing, significant)
+}
+
+type xorDecoder struct {
+	r bitReader
+	count int
+	prev uint64
+	leading uint
+	trailing uint
+}
+
+func (d *xorDecoder) decode() (float64, error) {
+	if d.count == 0 {
+		v, err := d.r.readBits(64)
+		if err != nil {
+			return 0, err
+		}
+		d.count, d.prev = 1, v
+		return math.Float64frombits(v), nil
+	}
+	d.count++
+	bit, err := d.r.readBit()
+	if err != nil {
+		return 0, err
+	}
+	if !bit {
+		return math.Float64frombits(d.prev), nil
+	}
+	bit, err = d.r.readBit()
+	if err != nil {
+		return 0, err
+	}
+	if bit {
+		leading, err := d.r.readBits(5)
+		if err != nil {
+			return 0, err
+		}
+		significant, err := d.r.readBits(6)
+		if err != nil {
+			return 0, err
+		}
+		if significant == 0 {
+			significant = 64
+		}
+		if leading+significant > 64 {
+			return 0, ErrCorruptBlock
+		}
+		d.leading, d.trailing = uint(leading), uint(64-leading-significant)
+	}
+	x, err := d.r.readBits(64 - d.leading - d.trailing)
+	if err != nil {
+		return 0, err
+	}
+	d.prev ^= x << d.trailing
+	return math.Float64frombits(d.prev), nil
+}
+
+// Encode records (all with len(Values) == NumDataPoints) as a block
+func EncodeBlock(a *meta.DataStreamAttribute, records []*Record) ([]byte, error) {
+	times := &deltaOfDeltaEncoder{}
+	for _, r := range records {
+		if len(r.Values) != int(a.NumDataPoints) {
+			return nil, ErrInvalidData
+		}
+		times.encode(r.Time.UnixNano())
+	}
+	b := common.NewProtoBuffer(nil)
+	b.EncodeKey(common.WireVarint, 1)
+	b.EncodeVarint(uint64(len(records)))
+	b.EncodeKey(common.WireLengthDelimited, 2)
+	b.EncodeRawBytes(times.w.buf)
+
+	for i, t := range a.DataPointTypes {
+		zv, err := TypeName2ZeroValue(t)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range records {
+			if err = TypeNameCheckRange(t, r.Values[i]); err != nil {
+				return nil, err
+			}
+		}
+		var column []byte
+		switch zv.(type) {
+		case int64, uint64:
+			c := common.NewProtoBuffer(nil)
+			var prev uint64
+			for _, r := range records {
+				var v uint64
+				if n, ok := r.Values[i].(int64); ok {
+					v = uint64(n)
+				} else {
+					v = r.Values[i].(uint64)
+				}
+				c.EncodeZigzag64(v - prev)
+				prev = v
+			}
+			column = c.Bytes()
+		case float64:
+			e := &xorEncoder{}
+			for _, r := range records {
+				e.encode(r.Values[i].(float64))
+			}
+			column = e.w.buf
+		case bool:
+			w := &bitWriter{}
+			for _, r := range records {
+				w.writeBit(r.Values[i].(bool))
+			}
+			column = w.buf
+		case time.Time:
+			e := &deltaOfDeltaEncoder{}
+			for _, r := range records {
+				e.encode(r.Values[i].(time.Time).UnixNano())
+			}
+			column = e.w.buf
+		case string:
+			c := common.NewProtoBuffer(nil)
+			for _, r := range records {
+				c.EncodeStringBytes(r.Values[i].(string))
+			}
+			column = c.Bytes()
+		}
+		b.EncodeKey(common.WireLengthDelimited, 3)
+		b.EncodeRawBytes(column)
+	}
+	return b.Bytes(), nil
+}
+
+// Decode a block, it is the reverse of EncodeBlock
+func DecodeBlock(a *meta.DataStreamAttribute, buf []byte) ([]*Record, error) {
+	b := common.NewProtoBuffer(buf)
+	if err := b.DecodeCheckKey(common.WireVarint, 1); err != nil {
+		return nil, err
+	}
+	count, err := b.DecodeVarint()
+	if err != nil {
+		return nil, err
+	}
+	//every record takes at least one bit of the times
+	if count > uint64(len(buf))*8 {
+		return nil, ErrCorruptBlock
+	}
+	if err = b.DecodeCheckKey(common.WireLengthDelimited, 2); err != nil {
+		return nil, err
+	}
+	raw, err := b.DecodeRawBytes(false)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]*Record, count)
+	times := &deltaOfDeltaDecoder{r: bitReader{buf: raw}}
+	for i := range records {
+		t, err := times.decode()
+		if err != nil {
+			return nil, err
+		}
+		records[i] = &Record{Time: time.Unix(0, t).UTC(), Values: make([]interface{}, a.NumDataPoints)}
+	}
+
+	for i, t := range a.DataPointTypes {
+		zv, err := TypeName2ZeroValue(t)
+		if err != nil {
+			return nil, err
+		}
+		//blocks written before data points were added have fewer columns
+		if b.DecodeComplete() {
+			for _, r := range records {
+				r.Values[i] = zv
+			}
+			continue
+		}
+		if err = b.DecodeCheckKey(common.WireLengthDelimited, 3); err != nil {
+			return nil, err
+		}
+		column, err := b.DecodeRawBytes(false)
+		if err != nil {
+			return nil, err
+		}
+		switch zv.(type) {
+		case int64, uint64:
+			c := common.NewProtoBuffer(column)
+			var prev uint64
+			for _, r := range records {
+				delta, err := c.DecodeZigzag64()
+				if err != nil {
+					return nil, err
+				}
+				prev += delta
+				if _, ok := zv.(int64); ok {
+					r.Values[i] = int64(prev)
+				} else {
+					r.Values[i] = prev
+				}
+			}
+		case float64:
+			d := &xorDecoder{r: bitReader{buf: column}}
+			for _, r := range records {
+				if r.Values[i], err = d.decode(); err != nil {
+					return nil, err
+				}
+			}
+		case bool:
+			reader := &bitReader{buf: column}
+			for _, r := range records {
+				if r.Values[i], err = reader.readBit(); err != nil {
+					return nil, err
+				}
+			}
+		case time.Time:
+			d := &deltaOfDeltaDecoder{r: bitReader{buf: column}}
+			for _, r := range records {
+				v, err := d.decode()
+				if err != nil {
+					return nil, err
+				}
+				r.Values[i] = time.Unix(0, v).UTC()
+			}
+		case string:
+			c := common.NewProtoBuffer(column)
+			for _, r := range records {
+				if r.Values[i], err = c.DecodeStringBytes(); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	if !b.DecodeComplete() {
+		return nil, ErrCorruptBlock
+	}
+	return records, nil
+}
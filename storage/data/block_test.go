@@ -0,0 +1,183 @@
+package data
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+	"github.com/heartsg/dasea/storage/meta"
+)
+
+var testBlockAttribute = &meta.DataStreamAttribute{
+	Id: 2,
+	Description: "weather station",
+	NumDataPoints: 6,
+	DataPointNames: []string{"counter", "pressure", "temperature", "raining", "time", "status"},
+	DataPointTypes: []string{"sint64", "uint64", "float64", "bool", "timestamp", "string"},
+	DataPointUnits: []int64{meta.UUnit, meta.UUnit, meta.UDegreeCelsius, meta.UUnit, meta.UUnit, meta.UUnit},
+}
+
+// readings every 10 seconds with some jitter, slowly changing values
+func testBlockRecords(n int) []*Record {
+	rnd := rand.New(rand.NewSource(1))
+	records := make([]*Record, n)
+	t := time.Unix(1451606400, 0)
+	temperature := 25.0
+	for i := range records {
+		t = t.Add(10*time.Second + time.Duration(rnd.Intn(3)-1)*time.Millisecond)
+		if rnd.Intn(10) == 0 {
+			temperature += float64(rnd.Intn(3)-1) * 0.1
+		}
+		records[i] = &Record{
+			Time: t.UTC(),
+			Values: []interface{}{int64(i*3 - 100), uint64(101325 + rnd.Intn(5)), temperature, i%50 < 10,
+				t.Truncate(time.Second).UTC(), "ok"},
+		}
+	}
+	return records
+}
+
+func testCompareRecords(t *testing.T, want []*Record, got []*Record) {
+	if len(got) != len(want) {
+		t.Fatalf("should get %d records, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if !got[i].Time.Equal(want[i].Time) {
+			t.Fatalf("record %d time should be %v, got %v", i, want[i].Time, got[i].Time)
+		}
+		for j := range want[i].Values {
+			w, g := want[i].Values[j], got[i].Values[j]
+			switch v := w.(type) {
+			case time.Time:
+				if !v.Equal(g.(time.Time)) {
+					t.Fatalf("record %d value %d should be %v, got %v", i, j, w, g)
+				}
+			case float64:
+				if math.Float64bits(v) != math.Float64bits(g.(float64)) {
+					t.Fatalf("record %d value %d should be %v, got %v", i, j, w, g)
+				}
+			default:
+				if w != g {
+					t.Fatalf("record %d value %d should be %v, got %v", i, j, w, g)
+				}
+			}
+		}
+	}
+}
+
+func TestBlock(t *testing.T) {
+	records := testBlockRecords(1000)
+	//extremes
+	records = append(records, &Record{
+		Time: time.Unix(0, math.MinInt64).UTC(),
+		Values: []interface{}{int64(math.MaxInt64), uint64(math.MaxUint64), math.NaN(), true, time.Unix(0, math.MaxInt64).UTC(), ""},
+	}, &Record{
+		Time: time.Unix(0, math.MaxInt64).UTC(),
+		Values: []interface{}{int64(math.MinInt64), uint64(0), math.Inf(-1), false, time.Unix(0, 0).UTC(), "中文"},
+	}, &Record{
+		Time: time.Unix(0, math.MaxInt64).UTC(),
+		Values: []interface{}{int64(0), uint64(1), -0.0, false, time.Unix(0, 0).UTC(), "a"},
+	})
+	buf, err := EncodeBlock(testBlockAttribute, records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := DecodeBlock(testBlockAttribute, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCompareRecords(t, records, got)
+
+	//truncated blocks must be rejected, not panic
+	for _, n := range []int{1, len(buf) / 2, len(buf) - 1} {
+		if _, err = DecodeBlock(testBlockAttribute, buf[:n]); err == nil {
+			t.Errorf("truncated block (%d bytes) should be rejected", n)
+		}
+	}
+
+	buf, err = EncodeBlock(testBlockAttribute, []*Record{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = DecodeBlock(testBlockAttribute, buf)
+	if err != nil || len(got) != 0 {
+		t.Errorf("empty block should decode, got %d %v", len(got), err)
+	}
+}
+
+func TestBlockSize(t *testing.T) {
+	records := testBlockRecords(1000)
+	block, err := EncodeBlock(testBlockAttribute, records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	row := 0
+	for _, r := range records {
+		raw, err := EncodeProtobufRecord(testBlockAttribute, r.Values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		row += len(raw) + 8
+	}
+	if len(block)*3 > row {
+		t.Errorf("block should be at least 3 times smaller than rows, block %d bytes, rows %d bytes", len(block), row)
+	}
+}
+
+func BenchmarkEncodeBlock(b *testing.B) {
+	records := testBlockRecords(1000)
+	var size int
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf, err := EncodeBlock(testBlockAttribute, records)
+		if err != nil {
+			b.Fatal(err)
+		}
+		size = len(buf)
+	}
+	b.ReportMetric(float64(size)/float64(len(records)), "bytes/point")
+	b.ReportMetric(float64(b.N*len(records))/b.Elapsed().Seconds(), "points/s")
+}
+
+func BenchmarkDecodeBlock(b *testing.B) {
+	records := testBlockRecords(1000)
+	buf, err := EncodeBlock(testBlockAttribute, records)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(buf)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err = DecodeBlock(testBlockAttribute, buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(len(buf))/float64(len(records)), "bytes/point")
+	b.ReportMetric(float64(b.N*len(records))/b.Elapsed().Seconds(), "points/s")
+}
+
+// rows as saved before blocks, for comparison
+func BenchmarkDecodeRows(b *testing.B) {
+	records := testBlockRecords(1000)
+	rows := make([][]byte, len(records))
+	size := 0
+	for i, r := range records {
+		raw, err := EncodeProtobufRecord(testBlockAttribute, r.Values)
+		if err != nil {
+			b.Fatal(err)
+		}
+		rows[i] = raw
+		size += len(raw) + 8
+	}
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, raw := range rows {
+			if _, err := DecodeProtobufRecord(testBlockAttribute, raw); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	b.ReportMetric(float64(size)/float64(len(records)), "bytes/point")
+	b.ReportMetric(float64(b.N*len(records))/b.Elapsed().Seconds(), "points/s")
+}
@@ -0,0 +1,518 @@
+package data
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"github.com/gocql/gocql"
+	"github.com/heartsg/dasea/storage/meta"
+)
+
+// CassandraStore saves data points in Cassandra (via gocql).
+//
+// All DataStreams that share a DataStreamAttribute are saved in one table,
+//   CREATE TABLE data_<attribute id> (
+//       stream_id bigint,
+//       bucket bigint,     //time bucket, CassandraBucketSize since epoch
+//       ts bigint,         //record time, unix nano
+//       seq timeuuid,      //allows records with the same time (append write mode)
+//       dp1 <cql type>,    //data points, in the order of DataPointNames
+//       ...
+//       PRIMARY KEY ((stream_id, bucket), ts, seq)
+//   )
+// so that a partition holds at most one bucket of one stream and range reads
+// only touch the buckets (partitions) that overlap.
+//
+// Data point columns are named by position instead of DataPointNames so that
+// user defined names never need quoting. Types are mapped to the widest CQL type
+// of each type family (see TypeName2CQLType), so data points can be renamed and
+// widened without altering the table. Added data points are added as columns,
+// which are null (read as zero values) in older rows.
+//
+// Two book keeping tables are used,
+//   streams (stream_id, attribute_id): which streams are created
+//   stream_buckets (stream_id, bucket): which buckets of a stream have data
+type CassandraStore struct {
+	session *gocql.Session
+	keyspace string
+}
+
+const (
+	DefaultCassandraKeyspace = "dasea"
+	CassandraBucketSize = 24 * time.Hour
+	cassandraMaxIn = 100
+)
+
+// seq of records written by write modes other than append, so that there
+// is at most one row for each time
+var cassandraUniqueSeq, _ = gocql.ParseUUID("00000000-0000-1000-8000-000000000000")
+
+//From type name to cql type
+func TypeName2CQLType(t string) (string, error) {
+	var ct string
+	switch t {
+	case "int", "int8", "int16", "int32", "int64", "sint", "sint8", "sint16", "sint32", "sint64",
+		"sfixed32", "sfixed64":
+		ct = "bigint"
+	case "uint", "uint8", "uint16", "uint32", "uint64", "fixed32", "fixed64":
+		//bigint cannot hold the full range of uint64
+		ct = "varint"
+	case "float", "float32", "double", "float64":
+		ct = "double"
+	case "bool":
+		ct = "boolean"
+	case "timestamp", "datetime":
+		//cql timestamp is in milliseconds
+		ct = "timestamp"
+	case "string":
+		ct = "text"
+	default:
+		return "", ErrInvalidType
+	}
+	return ct, nil
+}
+
+// Connect to the cluster given by hosts, user and password are used for
+// PasswordAuthenticator if user is not empty. The keyspace will be created
+// (SimpleStrategy, replication factor 1) if it does not exist.
+func NewCassandraStore(hosts []string, user string, password string, keyspace string) (*CassandraStore, error) {
+	cluster := gocql.NewCluster(hosts...)
+	cluster.Consistency = gocql.Quorum
+	cluster.Timeout = 10 * time.Second
+	if user != "" {
+		cluster.Authenticator = gocql.PasswordAuthenticator{
+			Username: user,
+			Password: password,
+		}
+	}
+	session, err := cluster.CreateSession()
+	if err != nil {
+		return nil, err
+	}
+	c := &CassandraStore{session: session, keyspace: keyspace}
+	err = c.init()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *CassandraStore) init() error {
+	statements := []string{
+		fmt.Sprintf("CREATE KEYSPACE IF NOT EXISTS %s WITH replication = {'class': 'SimpleStrategy', 'replication_factor': 1}",
+			c.keyspace),
+		fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s.streams (stream_id bigint PRIMARY KEY, attribute_id bigint)",
+			c.keyspace),
+		fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s.stream_buckets (stream_id bigint, bucket bigint, PRIMARY KEY (stream_id, bucket))",
+			c.keyspace),
+	}
+	for _, statement := range statements {
+		if err := c.session.Query(statement).Exec(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *CassandraStore) table(a *meta.DataStreamAttribute) string {
+	return fmt.Sprintf("%s.data_%d", c.keyspace, a.Id)
+}
+
+func cassandraColumns(a *meta.DataStreamAttribute) []string {
+	columns := make([]string, a.NumDataPoints)
+	for i := range columns {
+		columns[i] = fmt.Sprintf("dp%d", i+1)
+	}
+	return columns
+}
+
+func cassandraBucket(t time.Time) int64 {
+	n := t.UnixNano()
+	size := int64(CassandraBucketSize)
+	if n < 0 {
+		return (n+1)/size - 1
+	}
+	return n / size
+}
+
+func (c *CassandraStore) CreateStream(dataStreamId int64, a *meta.DataStreamAttribute) error {
+	tmp := ""
+	for i, t := range a.DataPointTypes {
+		cqlType, err := TypeName2CQLType(t)
+		if err != nil {
+			return err
+		}
+		tmp = tmp + fmt.Sprintf("dp%d %s, ", i+1, cqlType)
+	}
+	statement := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (stream_id bigint, bucket bigint, ts bigint, seq timeuuid, %s"+
+		"PRIMARY KEY ((stream_id, bucket), ts, seq))", c.table(a), tmp)
+	err := c.session.Query(statement).Exec()
+	if err != nil {
+		return err
+	}
+
+	applied, err := c.session.Query(fmt.Sprintf("INSERT INTO %s.streams (stream_id, attribute_id) VALUES (?, ?) IF NOT EXISTS", c.keyspace),
+		dataStreamId, a.Id).MapScanCAS(map[string]interface{}{})
+	if err != nil {
+		return err
+	}
+	if !applied {
+		return ErrStreamExists
+	}
+	return nil
+}
+
+func (c *CassandraStore) exists(dataStreamId int64) error {
+	var attributeId int64
+	err := c.session.Query(fmt.Sprintf("SELECT attribute_id FROM %s.streams WHERE stream_id = ?", c.keyspace),
+		dataStreamId).Scan(&attributeId)
+	if err == gocql.ErrNotFound {
+		return ErrStreamNotFound
+	}
+	return err
+}
+
+// buckets of a stream that have data and overlap [start, end)
+func (c *CassandraStore) buckets(dataStreamId int64, start time.Time, end time.Time) ([]int64, error) {
+	buckets := make([]int64, 0)
+	iter := c.session.Query(fmt.Sprintf("SELECT bucket FROM %s.stream_buckets WHERE stream_id = ? AND bucket >= ? AND bucket <= ?", c.keyspace),
+		dataStreamId, cassandraBucket(start), cassandraBucket(end)).Iter()
+	var bucket int64
+	for iter.Scan(&bucket) {
+		buckets = append(buckets, bucket)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return buckets, nil
+}
+
+func (c *CassandraStore) DropStream(dataStreamId int64, a *meta.DataStreamAttribute) error {
+	if err := c.exists(dataStreamId); err != nil {
+		return err
+	}
+	buckets, err := c.buckets(dataStreamId, time.Unix(0, -1<<63), time.Unix(0, 1<<63-1))
+	if err != nil {
+		return err
+	}
+	for _, bucket := range buckets {
+		err = c.session.Query(fmt.Sprintf("DELETE FROM %s WHERE stream_id = ? AND bucket = ?", c.table(a)),
+			dataStreamId, bucket).Exec()
+		if err != nil {
+			return err
+		}
+	}
+	statements := []string{
+		fmt.Sprintf("DELETE FROM %s.stream_buckets WHERE stream_id = ?", c.keyspace),
+		fmt.Sprintf("DELETE FROM %s.streams WHERE stream_id = ?", c.keyspace),
+	}
+	for _, statement := range statements {
+		if err = c.session.Query(statement, dataStreamId).Exec(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Add the columns of data points added to the attribute. The table is shared
+// by all streams of the attribute, so the columns may be there already.
+// Renamed and widened data points keep their columns, see TypeName2CQLType.
+func (c *CassandraStore) AlterStream(dataStreamId int64, a *meta.DataStreamAttribute) error {
+	if err := c.exists(dataStreamId); err != nil {
+		return err
+	}
+	existing := make(map[string]bool)
+	iter := c.session.Query("SELECT column_name FROM system_schema.columns WHERE keyspace_name = ? AND table_name = ?",
+		c.keyspace, fmt.Sprintf("data_%d", a.Id)).Iter()
+	var name string
+	for iter.Scan(&name) {
+		existing[name] = true
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	for i, column := range cassandraColumns(a) {
+		if existing[column] {
+			continue
+		}
+		cqlType, err := TypeName2CQLType(a.DataPointTypes[i])
+		if err != nil {
+			return err
+		}
+		err = c.session.Query(fmt.Sprintf("ALTER TABLE %s ADD %s %s", c.table(a), column, cqlType)).Exec()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *CassandraStore) Append(dataStreamId int64, a *meta.DataStreamAttribute, records []*Record) error {
+	records, err := dedupeRecords(a, records)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	if err = c.exists(dataStreamId); err != nil {
+		return err
+	}
+	columns := cassandraColumns(a)
+	statement := fmt.Sprintf("INSERT INTO %s (stream_id, bucket, ts, seq, %s) VALUES (?, ?, ?, ?%s)",
+		c.table(a), strings.Join(columns, ", "), strings.Repeat(", ?", len(columns)))
+	mode := a.Mode()
+	if mode == meta.WriteModeFirst || mode == meta.WriteModeReject {
+		return c.appendUnique(dataStreamId, a, records, statement+" IF NOT EXISTS")
+	}
+
+	//one unlogged batch per partition
+	batches := make(map[int64]*gocql.Batch)
+	for _, r := range records {
+		bucket := cassandraBucket(r.Time)
+		batch, ok := batches[bucket]
+		if !ok {
+			batch = c.session.NewBatch(gocql.UnloggedBatch)
+			batches[bucket] = batch
+		}
+		//with the same seq, a record overwrites the one of the same time
+		seq := cassandraUniqueSeq
+		if mode == meta.WriteModeAppend {
+			seq = gocql.TimeUUID()
+		}
+		args, err := cassandraArgs(dataStreamId, a, r, seq)
+		if err != nil {
+			return err
+		}
+		batch.Query(statement, args...)
+	}
+	for bucket, batch := range batches {
+		if err = c.addBucket(dataStreamId, bucket); err != nil {
+			return err
+		}
+		if err = c.session.ExecuteBatch(batch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Records written with first or reject write mode. Saved records of the same
+// time are looked up first, so that a rejected batch writes nothing. Records
+// are then inserted one by one with lightweight transactions, so that only
+// one of concurrent writers of the same time wins. As the lookup and the
+// inserts are not atomic, a reject batch racing with another writer may be
+// partially written before ErrDuplicateRecord is returned.
+func (c *CassandraStore) appendUnique(dataStreamId int64, a *meta.DataStreamAttribute, records []*Record, statement string) error {
+	times := make(map[int64][]int64)
+	for _, r := range records {
+		bucket := cassandraBucket(r.Time)
+		times[bucket] = append(times[bucket], r.Time.UnixNano())
+	}
+	saved := make(map[int64]bool)
+	lookup := fmt.Sprintf("SELECT ts FROM %s WHERE stream_id = ? AND bucket = ? AND ts IN ?", c.table(a))
+	for bucket, ts := range times {
+		//keep IN lists short
+		for len(ts) > 0 {
+			n := len(ts)
+			if n > cassandraMaxIn {
+				n = cassandraMaxIn
+			}
+			iter := c.session.Query(lookup, dataStreamId, bucket, ts[:n]).Iter()
+			var t int64
+			for iter.Scan(&t) {
+				saved[t] = true
+			}
+			if err := iter.Close(); err != nil {
+				return err
+			}
+			ts = ts[n:]
+		}
+	}
+	if len(saved) > 0 && a.Mode() == meta.WriteModeReject {
+		return ErrDuplicateRecord
+	}
+
+	for bucket := range times {
+		if err := c.addBucket(dataStreamId, bucket); err != nil {
+			return err
+		}
+	}
+	for _, r := range records {
+		if saved[r.Time.UnixNano()] {
+			continue
+		}
+		args, err := cassandraArgs(dataStreamId, a, r, cassandraUniqueSeq)
+		if err != nil {
+			return err
+		}
+		applied, err := c.session.Query(statement, args...).MapScanCAS(make(map[string]interface{}))
+		if err != nil {
+			return err
+		}
+		if !applied && a.Mode() == meta.WriteModeReject {
+			return ErrDuplicateRecord
+		}
+	}
+	return nil
+}
+
+func (c *CassandraStore) addBucket(dataStreamId int64, bucket int64) error {
+	return c.session.Query(fmt.Sprintf("INSERT INTO %s.stream_buckets (stream_id, bucket) VALUES (?, ?)", c.keyspace),
+		dataStreamId, bucket).Exec()
+}
+
+// values of an INSERT, in the order of the columns
+func cassandraArgs(dataStreamId int64, a *meta.DataStreamAttribute, r *Record, seq gocql.UUID) ([]interface{}, error) {
+	if len(r.Values) != int(a.NumDataPoints) {
+		return nil, ErrInvalidData
+	}
+	args := make([]interface{}, 0, len(r.Values)+4)
+	args = append(args, dataStreamId, cassandraBucket(r.Time), r.Time.UnixNano(), seq)
+	for i, v := range r.Values {
+		if err := TypeNameCheckRange(a.DataPointTypes[i], v); err != nil {
+			return nil, err
+		}
+		args = append(args, v)
+	}
+	return args, nil
+}
+
+// destinations for iter.Scan, in normalised types
+func cassandraScanArgs(a *meta.DataStreamAttribute) ([]interface{}, error) {
+	args := make([]interface{}, a.NumDataPoints)
+	for i, t := range a.DataPointTypes {
+		zv, err := TypeName2ZeroValue(t)
+		if err != nil {
+			return nil, err
+		}
+		switch zv.(type) {
+		case int64:
+			args[i] = new(int64)
+		case uint64:
+			args[i] = new(uint64)
+		case float64:
+			args[i] = new(float64)
+		case bool:
+			args[i] = new(bool)
+		case time.Time:
+			args[i] = new(time.Time)
+		case string:
+			args[i] = new(string)
+		}
+	}
+	return args, nil
+}
+
+func cassandraScanValues(args []interface{}) []interface{} {
+	values := make([]interface{}, len(args))
+	for i, arg := range args {
+		switch p := arg.(type) {
+		case *int64:
+			values[i] = *p
+		case *uint64:
+			values[i] = *p
+		case *float64:
+			values[i] = *p
+		case *bool:
+			values[i] = *p
+		case *time.Time:
+			//null in columns added after the row was written
+			if p.IsZero() {
+				values[i] = time.Unix(0, 0).UTC()
+			} else {
+				values[i] = p.UTC()
+			}
+		case *string:
+			values[i] = *p
+		}
+	}
+	return values
+}
+
+func (c *CassandraStore) Range(dataStreamId int64, a *meta.DataStreamAttribute, start time.Time, end time.Time,
+	descending bool, limit int) ([]*Record, error) {
+	if err := c.exists(dataStreamId); err != nil {
+		return nil, err
+	}
+	buckets, err := c.buckets(dataStreamId, start, end)
+	if err != nil {
+		return nil, err
+	}
+	order := "ASC"
+	if descending {
+		order = "DESC"
+		for i, j := 0, len(buckets)-1; i < j; i, j = i+1, j-1 {
+			buckets[i], buckets[j] = buckets[j], buckets[i]
+		}
+	}
+	statement := fmt.Sprintf("SELECT ts, %s FROM %s WHERE stream_id = ? AND bucket = ? AND ts >= ? AND ts < ? ORDER BY ts %s, seq %s",
+		strings.Join(cassandraColumns(a), ", "), c.table(a), order, order)
+	if limit > 0 {
+		statement = statement + fmt.Sprintf(" LIMIT %d", limit)
+	}
+
+	records := make([]*Record, 0)
+	//buckets are visited in order, stop once the limit is reached
+	for _, bucket := range buckets {
+		if limit > 0 && len(records) >= limit {
+			break
+		}
+		iter := c.session.Query(statement, dataStreamId, bucket, start.UnixNano(), end.UnixNano()).Iter()
+		for {
+			args, err := cassandraScanArgs(a)
+			if err != nil {
+				iter.Close()
+				return nil, err
+			}
+			var ts int64
+			if !iter.Scan(append([]interface{}{&ts}, args...)...) {
+				break
+			}
+			records = append(records, &Record{Time: time.Unix(0, ts).UTC(), Values: cassandraScanValues(args)})
+		}
+		if err = iter.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if limit > 0 && len(records) > limit {
+		records = records[:limit]
+	}
+	return records, nil
+}
+
+func (c *CassandraStore) Delete(dataStreamId int64, a *meta.DataStreamAttribute, start time.Time, end time.Time) error {
+	if err := c.exists(dataStreamId); err != nil {
+		return err
+	}
+	buckets, err := c.buckets(dataStreamId, start, end)
+	if err != nil {
+		return err
+	}
+	for _, bucket := range buckets {
+		bucketStart := bucket * int64(CassandraBucketSize)
+		bucketEnd := bucketStart + int64(CassandraBucketSize)
+		if start.UnixNano() <= bucketStart && end.UnixNano() >= bucketEnd {
+			//the whole partition
+			err = c.session.Query(fmt.Sprintf("DELETE FROM %s WHERE stream_id = ? AND bucket = ?", c.table(a)),
+				dataStreamId, bucket).Exec()
+			if err == nil {
+				err = c.session.Query(fmt.Sprintf("DELETE FROM %s.stream_buckets WHERE stream_id = ? AND bucket = ?", c.keyspace),
+					dataStreamId, bucket).Exec()
+			}
+		} else {
+			err = c.session.Query(fmt.Sprintf("DELETE FROM %s WHERE stream_id = ? AND bucket = ? AND ts >= ? AND ts < ?", c.table(a)),
+				dataStreamId, bucket, start.UnixNano(), end.UnixNano()).Exec()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *CassandraStore) Close() error {
+	c.session.Close()
+	return nil
+}
@@ -0,0 +1,110 @@
+package data
+
+import (
+	"testing"
+	"time"
+	"github.com/heartsg/dasea/storage/meta"
+)
+
+// Needs a local cassandra node, skipped otherwise
+func testCassandraStore(t *testing.T) *CassandraStore {
+	store, err := NewCassandraStore([]string{"127.0.0.1"}, "", "", "dasea_test")
+	if err != nil {
+		t.Skipf("cassandra is not available: %v", err)
+	}
+	return store
+}
+
+func TestCassandraBucket(t *testing.T) {
+	if cassandraBucket(time.Unix(0, 0)) != 0 || cassandraBucket(time.Unix(86399, 0)) != 0 ||
+		cassandraBucket(time.Unix(86400, 0)) != 1 || cassandraBucket(time.Unix(-1, 0)) != -1 {
+		t.Errorf("buckets should be days since epoch")
+	}
+	if _, err := TypeName2CQLType("complex"); err != ErrInvalidType {
+		t.Errorf("unknown type should be rejected, got %v", err)
+	}
+}
+
+func TestCassandraStore(t *testing.T) {
+	store := testCassandraStore(t)
+	defer store.Close()
+
+	store.DropStream(1, testAttribute)
+	err := store.Append(1, testAttribute, testRecords(time.Unix(0, 0), 1))
+	if err != ErrStreamNotFound {
+		t.Errorf("append to a non-existent stream should fail, got %v", err)
+	}
+	if err = store.CreateStream(1, testAttribute); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.CreateStream(1, testAttribute); err != ErrStreamExists {
+		t.Errorf("create an existing stream should fail, got %v", err)
+	}
+
+	//records across two buckets
+	start := time.Unix(86400-100, 0)
+	records := testRecords(start, 200)
+	if err = store.Append(1, testAttribute, records); err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.Range(1, testAttribute, start.Add(50*time.Second), start.Add(150*time.Second), false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 100 {
+		t.Fatalf("should get 100 records, got %d", len(got))
+	}
+	for i, r := range got {
+		if !r.Time.Equal(start.Add(time.Duration(50+i)*time.Second)) || r.Values[1].(int64) != int64(-50-i) {
+			t.Fatalf("record %d not match, got %v %v", i, r.Time, r.Values)
+		}
+	}
+
+	if err = store.Delete(1, testAttribute, start, start.Add(100*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	got, err = store.Range(1, testAttribute, time.Unix(0, 0), start.Add(time.Hour), false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 100 || !got[0].Time.Equal(start.Add(100*time.Second)) {
+		t.Fatalf("should get the last 100 records after delete, got %d", len(got))
+	}
+
+	//last write wins, resent records replace the saved ones
+	a := *testAttribute
+	a.TimestampDataPoint, a.WriteMode = 4, meta.WriteModeLast
+	store.DropStream(2, &a)
+	if err = store.CreateStream(2, &a); err != nil {
+		t.Fatal(err)
+	}
+	defer store.DropStream(2, &a)
+	if err = store.Append(2, &a, records); err != nil {
+		t.Fatal(err)
+	}
+	resent := testRecords(start, 200)
+	for _, r := range resent {
+		r.Values[0] = int64(99)
+	}
+	if err = store.Append(2, &a, resent[100:]); err != nil {
+		t.Fatal(err)
+	}
+	got, err = store.Range(2, &a, start, start.Add(time.Hour), false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 200 || got[0].Values[0].(int64) == 99 || got[100].Values[0].(int64) != 99 {
+		t.Fatalf("resent records should replace saved ones, got %d", len(got))
+	}
+	a.WriteMode = meta.WriteModeReject
+	if err = store.Append(2, &a, resent[150:]); err != ErrDuplicateRecord {
+		t.Errorf("duplicates should be rejected, got %v", err)
+	}
+
+	if err = store.DropStream(1, testAttribute); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.Range(1, testAttribute, start, start.Add(time.Hour), false, 0); err != ErrStreamNotFound {
+		t.Errorf("stream should be dropped, got %v", err)
+	}
+}
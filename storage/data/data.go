@@ -1,233 +1,246 @@
 package data
 
-
 import (
-	"os"
-    "errors"
-	"github.com/gocql/gocql"
-	"github.com/go-xorm/core"
-	_ "github.com/go-sql-driver/mysql"
+	"errors"
+	"time"
+	"github.com/heartsg/dasea/storage/meta"
 )
 
-var Engine *xorm.Engine
+var (
+	ErrInvalidData = errors.New("Invalid data")
+	ErrInvalidType = errors.New("Invalid type")
+	ErrStreamExists = errors.New("Data stream already exists in data store.")
+	ErrStreamNotFound = errors.New("Data stream not found in data store.")
+	ErrStoreNotInitialized = errors.New("Data store is not initialized.")
+	ErrUnknownStore = errors.New("Unknown data store type.")
+	ErrCorruptFrame = errors.New("Corrupt data frame in segment file.")
+	ErrInvalidQuery = errors.New("Invalid query")
+	ErrInvalidCursor = errors.New("Invalid cursor")
+	ErrDuplicateRecord = errors.New("Record of the same time already exists.")
+)
 
-/*
-//CreateData is different from other database operations
-//Because the data table is dynamic for each DataStream, 
+// Record is one row of data points of a DataStream, Values are normalised
+// (see TypeName2ZeroValue) and ordered as DataStreamAttribute.DataPointNames.
+type Record struct {
+	Time time.Time
+	Values []interface{}
+}
+
+// Data are different from other database operations.
+// Because the data table is dynamic for each DataStream,
 // we do not use ORM. Moreover, since data are normally not
-// saved in the same database as user/device, it is good
-// to leave the implementation of data operation different from
-// others so it will be easier to modify later to support
-// big data database such as OceanBase or Hive separately.
+// saved in the same database as meta data, it is good
+// to leave the implementation of data operation behind an interface
+// so that it is easy to support big data databases such as Cassandra,
+// OceanBase or Hive separately.
+//
+// All time ranges are [start, end).
+type DataStore interface {
+	// Create the storage (table, directory etc.) for a DataStream
+	CreateStream(dataStreamId int64, a *meta.DataStreamAttribute) error
+	// Drop the storage and all data points of a DataStream
+	DropStream(dataStreamId int64, a *meta.DataStreamAttribute) error
+	// Change the storage after the DataStreamAttribute evolved (see
+	// meta.DataStreamAttribute.Evolve), records saved before must still be
+	// read with the new attribute
+	AlterStream(dataStreamId int64, a *meta.DataStreamAttribute) error
+	// Append records to a DataStream, records of the same time as saved ones
+	// are handled by the write mode of the DataStreamAttribute (see writemode.go)
+	Append(dataStreamId int64, a *meta.DataStreamAttribute, records []*Record) error
+	// Read records within time range, ordered by time (latest first if descending).
+	// Records of the same time must be returned in a stable order. At most limit
+	// records are returned, limit <= 0 means no limit.
+	Range(dataStreamId int64, a *meta.DataStreamAttribute, start time.Time, end time.Time,
+		descending bool, limit int) ([]*Record, error)
+	// Delete records within time range
+	Delete(dataStreamId int64, a *meta.DataStreamAttribute, start time.Time, end time.Time) error
+	Close() error
+}
+
+var Store DataStore
+
+// Similar to meta.InitEngine, the store must be initialized in main
+// after Opts are loaded. Supported types are,
+//   - embedded: append-only segment files on local disk, hosts[0] is
+//               the directory to save data. No external database is
+//               needed, good for single node deployment and tests.
+//   - cassandra: hosts are the contact points of the cluster, data are
+//               saved in keyspace DefaultCassandraKeyspace.
+//   - mysql, sqlite3, postgres: relational databases (see SQLStore),
+//               hosts[0] is the data source name of the driver, which
+//               holds user and password.
+func InitStore(t string, hosts []string, user string, password string) error {
+	var err error
+	switch t {
+	case "embedded":
+		if len(hosts) == 0 {
+			return ErrUnknownStore
+		}
+		Store, err = NewEmbeddedStore(hosts[0])
+	case "cassandra":
+		if len(hosts) == 0 {
+			return ErrUnknownStore
+		}
+		Store, err = NewCassandraStore(hosts, user, password, DefaultCassandraKeyspace)
+	case string(MySQL), string(SQLite), string(PostgreSQL):
+		if len(hosts) == 0 {
+			return ErrUnknownStore
+		}
+		Store, err = NewSQLStore(t, hosts[0])
+	default:
+		err = ErrUnknownStore
+	}
+	return err
+}
+
+func CloseStore() error {
+	if Store == nil {
+		return nil
+	}
+	err := Store.Close()
+	Store = nil
+	return err
+}
+
 func CreateData(dataStreamId int64) error {
-	tableName := fmt.Sprintf("data_%d", dataStreamId)
-	
-	dataStreamAttribute, err := GetDataStreamAttributeByDataStreamId(dataStreamId)
+	if Store == nil {
+		return ErrStoreNotInitialized
+	}
+	a, err := meta.GetDataStreamAttributeByDataStreamId(dataStreamId)
 	if err != nil {
 		return err
 	}
-	
-	//parse dataStream types, we currently use same logic as XORM
-	tmp := ""
-	for i, t := range dataStreamAttribute.DataPointTypes {
-		sqlType, err := TypeName2SQLType(t)
-		if err != nil {
-			return err
-		}
-		tmp = tmp + fmt.Sprintf(", %s %s not null, index(%s)", 
-			dataStreamAttribute.DataPointNames[i], 
-			sqlType.Name,
-			dataStreamAttribute.DataPointNames[i])
-	}
-	
-	//create sql statement to execute
-	statement := fmt.Sprintf("CREATE TABLE %s (id BIGINT not null primary key auto_increment%s)", 
-		tableName, tmp)
-	_, err = mysqlEngine.Exec(statement)
+	return Store.CreateStream(dataStreamId, a)
+}
+
+func DeleteData(dataStreamId int64) error {
+	if Store == nil {
+		return ErrStoreNotInitialized
+	}
+	a, err := meta.GetDataStreamAttributeByDataStreamId(dataStreamId)
 	if err != nil {
 		return err
 	}
-
-	return nil
+	return Store.DropStream(dataStreamId, a)
 }
 
-//Insert data into table
+//Insert data into data store, the whole batch is decoded before
+// anything is written, so a bad record fails the batch
 func PutDataPointsFromProtobuf(dataStreamId int64, buf []byte) error {
-	tableName := fmt.Sprintf("data_%d", dataStreamId)
-	
-	dataStreamAttribute, err := GetDataStreamAttributeByDataStreamId(dataStreamId)
+	if Store == nil {
+		return ErrStoreNotInitialized
+	}
+	a, err := meta.GetDataStreamAttributeByDataStreamId(dataStreamId)
 	if err != nil {
 		return err
 	}
-	
-	//Start parsing buf (from protobuf)
-	//We cannot use Unmarshal from protobuf.proto because we do not know the structure
-	// in static form, we only know the structure in memory, so we rely on dasea/common/protobuf.go
-	// to decode raw data.
-	dataBuffer := common.NewProtoBuffer(buf)
-	for !dataBuffer.DecodeComplete() {
-		err = dataBuffer.DecodeCheckKey(common.WireLengthDelimited, 1)
-		if err != nil {
-			return err
-		}
-		record, err := dataBuffer.DecodeRawBytes(false)
-		if err != nil {
-			return err
-		}
-		recordBuffer := common.NewProtoBuffer(record)
-		statement := fmt.Sprintf("INSERT INTO %s (", tableName)
-		for i, col := range dataStreamAttribute.DataPointNames {
-			if i == int(dataStreamAttribute.NumDataPoints) - 1 {
-				statement = statement + col + ")"
-			} else {
-				statement = statement + col + ", "
-			}
-		}
-		statement = statement + " VALUES ("
-		lastTag := uint64(0)
-		for !recordBuffer.DecodeComplete() {
-			wire, tag, err := recordBuffer.DecodeKey()
-			if err != nil {
-				return err
-			}
-			//check whether tag is valid
-			if tag > uint64(dataStreamAttribute.NumDataPoints) {
-				err = errors.New("Invalid data")
-				return err
-			}
-			//check whether wire is valid
-			wireCheck, err := TypeName2ProtobufWireType(dataStreamAttribute.DataPointTypes[tag - 1])
-			if err != nil {
-				return err
-			}
-			if wireCheck != wire {
-				err = errors.New("Invalid data")
-			}
-			
-			//tag will be in sequence, but if the value is 0 or nil
-			// it will be omitted			
-			//check whether tag and lastTag has gap, if so, insert defaut values
-			if tag - lastTag > 1 {
-				for it := lastTag + 1; it < tag; it++ {
-					dv, err := TypeName2DefaultValue(dataStreamAttribute.DataPointTypes[it - 1])
-					if err != nil {
-						return err
-					}
-					statement = statement + dv + ", "
-				}
-			}
-			
-			//at last, insert value for this tag
-			var tagValue string
-			switch dataStreamAttribute.DataPointTypes[tag - 1] {
-			case "bool", "uint", "uint8", "uint16", "uint32", "uint64":
-				v1, err := recordBuffer.DecodeVarint()
-				if err != nil {
-					return err
-				}
-				tagValue = fmt.Sprintf("%d", v1)
-			case "int", "int8", "int16", "int32", "int64":
-				v1, err := recordBuffer.DecodeVarint()
-				v1s := int64(v1)
-				if err != nil {
-					return err
-				}
-				tagValue = fmt.Sprintf("%d", v1s)
-			case "sint", "sint8", "sint16", "sint32":
-				v2, err := recordBuffer.DecodeZigzag32()
-				if err != nil {
-					return err
-				}
-				v2s := int32(v2)
-				tagValue = fmt.Sprintf("%d", v2s)
-			case "sint64":
-				v3, err := recordBuffer.DecodeZigzag64()
-				if err != nil {
-					return err
-				}
-				v3s := int64(v3)
-				tagValue = fmt.Sprintf("%d", v3s)
-			case "fixed64":
-				v4, err := recordBuffer.DecodeFixed64()
-				if err != nil {
-					return err
-				}
-				tagValue = fmt.Sprintf("%d", v4)
-			case "sfixed64":
-				v4, err := recordBuffer.DecodeFixed64()
-				if err != nil {
-					return err
-				}
-				v4s := int64(v4)
-				tagValue = fmt.Sprintf("%d", v4s)
-			case "double", "float64":
-				v5, err := recordBuffer.DecodeFloat64()
-				if err != nil {
-					return err
-				}
-				tagValue = fmt.Sprintf("%f", v5)
-			case "fixed32":
-				v6, err := recordBuffer.DecodeFixed32()
-				if err != nil {
-					return err
-				}
-				tagValue = fmt.Sprintf("%d", v6)
-			case "sfixed32":
-				v6, err := recordBuffer.DecodeFixed32()
-				if err != nil {
-					return err
-				}
-				v6s := int64(v6)
-				tagValue = fmt.Sprintf("%d", v6s)
-			case "float", "float32":
-				v7, err := recordBuffer.DecodeFloat32()
-				if err != nil {
-					return err
-				}
-				tagValue = fmt.Sprintf("%f", v7)
-			case "timestamp", "datetime":
-				v8, err := recordBuffer.DecodeTimestamp()
-				if err != nil {
-					return err
-				}
-				tagValue = "\"" + v8.Format("2006-01-02 15:04:05.000000") + "\""
-			default:
-				return errors.New("Invalid data")
-			}
-			statement = statement + tagValue
-			if tag != uint64(dataStreamAttribute.NumDataPoints) {
-				statement = statement + ", "
-			}
-			lastTag = tag
-		}
-		for it := lastTag + 1; it <= uint64(dataStreamAttribute.NumDataPoints); it++ {
-			dv, err := TypeName2DefaultValue(dataStreamAttribute.DataPointTypes[it - 1])
-			if err != nil {
-				return err
-			}
-			if it != uint64(dataStreamAttribute.NumDataPoints) {
-				statement = statement + dv + ", "
-			} else {
-				statement = statement + dv
-			}
-		}
-		statement = statement + ")"
+	records, err := DecodeProtobufRecords(a, buf, time.Now())
+	if err != nil {
+		return err
+	}
+	return appendRecords(dataStreamId, a, records)
+}
 
-		_, err = mysqlEngine.Exec(statement)
-		if err != nil {
-			return err
-		}
+//Queue protobuf data into the ingestion pipeline without waiting for the
+// write, done is called with the result of the write. ErrPipelineFull is
+// returned if the pipeline cannot take more records.
+func QueueDataPointsFromProtobuf(dataStreamId int64, buf []byte, done func(error)) error {
+	if Store == nil {
+		return ErrStoreNotInitialized
+	}
+	if Ingest == nil {
+		return ErrPipelineClosed
+	}
+	a, err := meta.GetDataStreamAttributeByDataStreamId(dataStreamId)
+	if err != nil {
+		return err
+	}
+	records, err := DecodeProtobufRecords(a, buf, time.Now())
+	if err != nil {
+		return err
 	}
+	return Ingest.Put(dataStreamId, a, records, done)
+}
 
+//Write records through the ingestion pipeline if there is one, so that
+// concurrent small batches are coalesced, otherwise write directly
+func appendRecords(dataStreamId int64, a *meta.DataStreamAttribute, records []*Record) error {
+	if len(records) == 0 {
+		return nil
+	}
+	if Ingest != nil {
+		return Ingest.PutWait(dataStreamId, a, records)
+	}
+	err := Store.Append(dataStreamId, a, records)
+	if err != nil {
+		return err
+	}
+	if Rollups != nil {
+		Rollups.Touch(dataStreamId, records)
+	}
 	return nil
 }
 
-func PutDataPointsFromJson() error {
-	return nil
+//Insert json data into data store. Unlike protobuf, good records are saved
+// even if some records in the batch are bad, the bad ones are returned as
+// RecordErrors. The error is non-nil if buf is not valid json or the store fails.
+func PutDataPointsFromJson(dataStreamId int64, buf []byte) ([]*RecordError, error) {
+	if Store == nil {
+		return nil, ErrStoreNotInitialized
+	}
+	a, err := meta.GetDataStreamAttributeByDataStreamId(dataStreamId)
+	if err != nil {
+		return nil, err
+	}
+	records, recordErrors, err := DecodeJsonRecords(a, buf, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return recordErrors, appendRecords(dataStreamId, a, records)
 }
 
+//Query data points, see Query for paging through large ranges
+func GetDataPointsByTime(dataStreamId int64, q *Query) (*Result, error) {
+	if Store == nil {
+		return nil, ErrStoreNotInitialized
+	}
+	a, err := meta.GetDataStreamAttributeByDataStreamId(dataStreamId)
+	if err != nil {
+		return nil, err
+	}
+	return q.Run(Store, dataStreamId, a)
+}
 
-func GetDataPointsByTime(dataStreamId int64) error {
-	return nil
+//Downsample data points into time buckets, see Aggregate. The coarsest
+// usable rollup of the DataStream (if any) is read instead of raw data points.
+func AggregateDataPoints(dataStreamId int64, g *Aggregate) (*AggregateResult, error) {
+	if Store == nil {
+		return nil, ErrStoreNotInitialized
+	}
+	a, err := meta.GetDataStreamAttributeByDataStreamId(dataStreamId)
+	if err != nil {
+		return nil, err
+	}
+	rollups, err := meta.GetRollupsByDataStreamId(dataStreamId)
+	if err != nil {
+		return nil, err
+	}
+	var best *meta.Rollup
+	for _, r := range rollups {
+		if RollupUsable(r, g) && (best == nil || r.IntervalSeconds > best.IntervalSeconds) {
+			best = r
+		}
+	}
+	return g.RunWithRollup(Store, dataStreamId, a, best)
+}
+
+func DeleteDataPointsByTime(dataStreamId int64, start time.Time, end time.Time) error {
+	if Store == nil {
+		return ErrStoreNotInitialized
+	}
+	a, err := meta.GetDataStreamAttributeByDataStreamId(dataStreamId)
+	if err != nil {
+		return err
+	}
+	return Store.Delete(dataStreamId, a, start, end)
 }
-*/
\ No newline at end of file
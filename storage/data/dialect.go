@@ -0,0 +1,224 @@
+package data
+
+import (
+	"fmt"
+	"strings"
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+//SQL dialects of the relational databases supported for data tables (see
+// SQLStore), named by their database/sql driver. Meta tables go through
+// xorm, which has its own dialects for the same databases.
+//
+//Data point types are mapped to the widest SQL type of each type family
+// (as TypeName2CQLType does for Cassandra), so data points can be widened
+// without altering columns. Columns are NOT NULL with the zero value of the
+// type as default, so rows saved before a data point was added read it as
+// the zero value.
+type Dialect string
+
+const (
+	MySQL Dialect = "mysql"
+	SQLite Dialect = "sqlite3"
+	PostgreSQL Dialect = "postgres"
+)
+
+func GetDialect(name string) (Dialect, error) {
+	switch d := Dialect(name); d {
+	case MySQL, SQLite, PostgreSQL:
+		return d, nil
+	}
+	return "", ErrUnknownStore
+}
+
+func (d Dialect) Quote(name string) string {
+	if d == MySQL {
+		return "`" + name + "`"
+	}
+	return `"` + name + `"`
+}
+
+//Placeholder of the i-th (from 1) argument of a statement
+func (d Dialect) Placeholder(i int) string {
+	if d == PostgreSQL {
+		return fmt.Sprintf("$%d", i)
+	}
+	return "?"
+}
+
+//Placeholders of n arguments from the i-th, separated by commas
+func (d Dialect) Placeholders(i int, n int) string {
+	p := make([]string, n)
+	for j := range p {
+		p[j] = d.Placeholder(i + j)
+	}
+	return strings.Join(p, ", ")
+}
+
+//From type name to the column type of the dialect
+func (d Dialect) SQLType(t string) (string, error) {
+	zv, err := TypeName2ZeroValue(t)
+	if err != nil {
+		return "", err
+	}
+	switch zv.(type) {
+	case int64:
+		if d == SQLite {
+			return "INTEGER", nil
+		}
+		return "BIGINT", nil
+	case uint64:
+		switch d {
+		case MySQL:
+			return "BIGINT UNSIGNED", nil
+		case PostgreSQL:
+			//no unsigned types
+			return "NUMERIC(20)", nil
+		}
+		//saved as the int64 of the same bits, see sqlArg
+		return "INTEGER", nil
+	case float64:
+		switch d {
+		case MySQL:
+			return "DOUBLE", nil
+		case PostgreSQL:
+			return "DOUBLE PRECISION", nil
+		}
+		return "REAL", nil
+	case bool:
+		return "BOOLEAN", nil
+	default:
+		//time.Time
+		if t == "timestamp" || t == "datetime" {
+			switch d {
+			case MySQL:
+				//microseconds, as TIMESTAMP of postgres
+				return "DATETIME(6)", nil
+			case PostgreSQL:
+				return "TIMESTAMP", nil
+			}
+			return "DATETIME", nil
+		}
+		//string, mysql does not allow defaults of TEXT
+		if d == MySQL {
+			return "VARCHAR(255)", nil
+		}
+		return "TEXT", nil
+	}
+}
+
+//Default value (SQL literal) of columns of type name t, the zero value of
+// the type (see TypeName2ZeroValue)
+func (d Dialect) DefaultValue(t string) (string, error) {
+	zv, err := TypeName2ZeroValue(t)
+	if err != nil {
+		return "", err
+	}
+	switch zv.(type) {
+	case bool:
+		if d == SQLite {
+			return "0", nil
+		}
+		return "FALSE", nil
+	case string:
+		return "''", nil
+	case int64, uint64, float64:
+		return "0", nil
+	}
+	return "'1970-01-01 00:00:00'", nil
+}
+
+//Column definition of a data point
+func (d Dialect) Column(name string, t string) (string, error) {
+	st, err := d.SQLType(t)
+	if err != nil {
+		return "", err
+	}
+	dv, err := d.DefaultValue(t)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s %s NOT NULL DEFAULT %s", d.Quote(name), st, dv), nil
+}
+
+//Definition of the auto increment primary key column
+func (d Dialect) AutoIncrementColumn(name string) string {
+	switch d {
+	case MySQL:
+		return d.Quote(name) + " BIGINT NOT NULL PRIMARY KEY AUTO_INCREMENT"
+	case PostgreSQL:
+		return d.Quote(name) + " BIGSERIAL PRIMARY KEY"
+	}
+	//only INTEGER can be an alias of rowid
+	return d.Quote(name) + " INTEGER PRIMARY KEY AUTOINCREMENT"
+}
+
+//Statements to create table with column definitions, an index on each of
+// indexed and a unique index on each of unique. Mysql defines indexes within
+// CREATE TABLE, the others need CREATE INDEX statements.
+func (d Dialect) CreateTableSQL(table string, columns []string, indexed []string, unique []string) []string {
+	definitions := append([]string{}, columns...)
+	if d == MySQL {
+		for _, column := range indexed {
+			definitions = append(definitions, fmt.Sprintf("INDEX %s (%s)",
+				d.Quote(d.indexName("IDX", table, column)), d.Quote(column)))
+		}
+		for _, column := range unique {
+			definitions = append(definitions, fmt.Sprintf("UNIQUE INDEX %s (%s)",
+				d.Quote(d.indexName("UQE", table, column)), d.Quote(column)))
+		}
+	}
+	statements := []string{fmt.Sprintf("CREATE TABLE %s (%s)", d.Quote(table), strings.Join(definitions, ", "))}
+	if d != MySQL {
+		for _, column := range indexed {
+			statements = append(statements, fmt.Sprintf("CREATE INDEX %s ON %s (%s)",
+				d.Quote(d.indexName("IDX", table, column)), d.Quote(table), d.Quote(column)))
+		}
+		for _, column := range unique {
+			statements = append(statements, fmt.Sprintf("CREATE UNIQUE INDEX %s ON %s (%s)",
+				d.Quote(d.indexName("UQE", table, column)), d.Quote(table), d.Quote(column)))
+		}
+	}
+	return statements
+}
+
+//Index names are unique per database in postgres and sqlite, so they are
+// prefixed by the table as xorm does (IDX or UQE for unique indexes)
+func (d Dialect) indexName(prefix string, table string, column string) string {
+	return fmt.Sprintf("%s_%s_%s", prefix, table, column)
+}
+
+//Whether err of the driver of d is a violated unique index
+func (d Dialect) IsUniqueViolation(err error) bool {
+	switch e := err.(type) {
+	case *mysql.MySQLError:
+		//ER_DUP_ENTRY
+		return d == MySQL && e.Number == 1062
+	case *pq.Error:
+		//unique_violation
+		return d == PostgreSQL && e.Code == "23505"
+	case sqlite3.Error:
+		return d == SQLite && (e.ExtendedCode == sqlite3.ErrConstraintUnique ||
+			e.ExtendedCode == sqlite3.ErrConstraintPrimaryKey)
+	}
+	return false
+}
+
+//Statement to add a column (definition from Column) to table
+func (d Dialect) AddColumnSQL(table string, column string) string {
+	return fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s", d.Quote(table), column)
+}
+
+//Statement of which the first column is the number of tables named table
+// (one argument, the name)
+func (d Dialect) TableExistsSQL() string {
+	switch d {
+	case MySQL:
+		return "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name = ?"
+	case PostgreSQL:
+		return "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = $1"
+	}
+	return "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?"
+}
@@ -0,0 +1,75 @@
+package data
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDialect(t *testing.T) {
+	if _, err := GetDialect("oracle"); err != ErrUnknownStore {
+		t.Errorf("unknown dialect should be rejected, got %v", err)
+	}
+	types := []struct {
+		t string
+		mysql string
+		sqlite string
+		postgres string
+	}{
+		{"int16", "BIGINT", "INTEGER", "BIGINT"},
+		{"uint64", "BIGINT UNSIGNED", "INTEGER", "NUMERIC(20)"},
+		{"float32", "DOUBLE", "REAL", "DOUBLE PRECISION"},
+		{"bool", "BOOLEAN", "BOOLEAN", "BOOLEAN"},
+		{"timestamp", "DATETIME(6)", "DATETIME", "TIMESTAMP"},
+		{"string", "VARCHAR(255)", "TEXT", "TEXT"},
+	}
+	for _, c := range types {
+		for d, want := range map[Dialect]string{MySQL: c.mysql, SQLite: c.sqlite, PostgreSQL: c.postgres} {
+			if got, err := d.SQLType(c.t); err != nil || got != want {
+				t.Errorf("%s type of %s should be %s, got %s %v", d, c.t, want, got, err)
+			}
+		}
+	}
+	if _, err := SQLite.SQLType("complex64"); err != ErrInvalidType {
+		t.Errorf("unknown type should be rejected, got %v", err)
+	}
+
+	column, _ := PostgreSQL.Column("dp1", "bool")
+	if column != `"dp1" BOOLEAN NOT NULL DEFAULT FALSE` {
+		t.Errorf("postgres column not match, got %s", column)
+	}
+	column, _ = MySQL.Column("dp2", "string")
+	if column != "`dp2` VARCHAR(255) NOT NULL DEFAULT ''" {
+		t.Errorf("mysql column not match, got %s", column)
+	}
+	if PostgreSQL.Placeholders(2, 3) != "$2, $3, $4" || SQLite.Placeholders(1, 2) != "?, ?" {
+		t.Errorf("placeholders not match")
+	}
+}
+
+func TestDialectCreateTable(t *testing.T) {
+	columns := []string{MySQL.AutoIncrementColumn("id"), "t BIGINT NOT NULL"}
+	want := []string{"CREATE TABLE `data_1` (`id` BIGINT NOT NULL PRIMARY KEY AUTO_INCREMENT, t BIGINT NOT NULL, " +
+		"INDEX `IDX_data_1_t` (`t`))"}
+	if got := MySQL.CreateTableSQL("data_1", columns, []string{"t"}, nil); !reflect.DeepEqual(got, want) {
+		t.Errorf("mysql statements not match, got %v", got)
+	}
+
+	columns = []string{PostgreSQL.AutoIncrementColumn("id"), "t BIGINT NOT NULL"}
+	want = []string{
+		`CREATE TABLE "data_1" ("id" BIGSERIAL PRIMARY KEY, t BIGINT NOT NULL)`,
+		`CREATE INDEX "IDX_data_1_t" ON "data_1" ("t")`,
+	}
+	if got := PostgreSQL.CreateTableSQL("data_1", columns, []string{"t"}, nil); !reflect.DeepEqual(got, want) {
+		t.Errorf("postgres statements not match, got %v", got)
+	}
+	want = []string{
+		`CREATE TABLE "data_1" ("id" BIGSERIAL PRIMARY KEY, t BIGINT NOT NULL)`,
+		`CREATE UNIQUE INDEX "UQE_data_1_t" ON "data_1" ("t")`,
+	}
+	if got := PostgreSQL.CreateTableSQL("data_1", columns, nil, []string{"t"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("postgres unique statements not match, got %v", got)
+	}
+	if SQLite.AutoIncrementColumn("id") != `"id" INTEGER PRIMARY KEY AUTOINCREMENT` {
+		t.Errorf("sqlite auto increment not match")
+	}
+}
@@ -0,0 +1,769 @@
+package data
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"github.com/heartsg/dasea/common"
+	"github.com/heartsg/dasea/storage/meta"
+)
+
+// EmbeddedStore saves data points in append-only segment files on local disk,
+// so that it runs without any external database.
+//
+// Layout:
+//   <dir>/<dataStreamId>/attribute.json   attribute used to create the stream
+//   <dir>/<dataStreamId>/<seq>.seg        segment files
+//
+// Each Append writes one frame to the last segment, a new segment is started
+// once the last one exceeds SegmentSize. A frame is,
+//   uint32 (little endian) payload length
+//   uint32 (little endian) crc32 of payload
+//   payload, protobuf encoded as
+//     message Frame {
+//         uint64 count = 1;
+//         sint64 min_time = 2; //unix nano
+//         sint64 max_time = 3; //unix nano
+//         bytes block = 5; //records in compressed columns, see block.go
+//     }
+// Frame headers (count, min/max time) are indexed in memory so that range reads
+// only need to touch the frames that overlap.
+// A torn frame at the end of a segment (e.g. crash while writing) is truncated
+// when the stream is loaded.
+// Unless the write mode is append, Append reads the frames overlapping the batch
+// to find records of the same time, records replaced (last write wins) are
+// removed by rewriting their segments.
+type EmbeddedStore struct {
+	dir string
+	// Maximum size of a segment file before rolling over to a new one
+	SegmentSize int64
+
+	mutex sync.Mutex
+	streams map[int64]*embeddedStream
+}
+
+type embeddedStream struct {
+	mutex sync.RWMutex
+	dir string
+	segments []*embeddedSegment
+}
+
+type embeddedSegment struct {
+	seq int64
+	path string
+	size int64
+	frames []*embeddedFrame
+}
+
+type embeddedFrame struct {
+	offset int64
+	length int64
+	count int64
+	minTime int64
+	maxTime int64
+}
+
+const (
+	embeddedFrameHeaderSize = 8
+	embeddedSegmentExt = ".seg"
+	embeddedAttributeFile = "attribute.json"
+	DefaultSegmentSize = 8 * 1024 * 1024
+)
+
+func NewEmbeddedStore(dir string) (*EmbeddedStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &EmbeddedStore{
+		dir: dir,
+		SegmentSize: DefaultSegmentSize,
+		streams: make(map[int64]*embeddedStream),
+	}, nil
+}
+
+func (e *EmbeddedStore) streamDir(dataStreamId int64) string {
+	return filepath.Join(e.dir, fmt.Sprintf("%d", dataStreamId))
+}
+
+func (e *EmbeddedStore) CreateStream(dataStreamId int64, a *meta.DataStreamAttribute) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	dir := e.streamDir(dataStreamId)
+	if _, err := os.Stat(dir); err == nil {
+		return ErrStreamExists
+	}
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	attribute, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, embeddedAttributeFile), attribute, 0644)
+	if err != nil {
+		return err
+	}
+	e.streams[dataStreamId] = &embeddedStream{dir: dir}
+	return nil
+}
+
+func (e *EmbeddedStore) DropStream(dataStreamId int64, a *meta.DataStreamAttribute) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	dir := e.streamDir(dataStreamId)
+	if _, err := os.Stat(dir); err != nil {
+		return ErrStreamNotFound
+	}
+	if s, ok := e.streams[dataStreamId]; ok {
+		//wait for readers/writers
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		delete(e.streams, dataStreamId)
+	}
+	return os.RemoveAll(dir)
+}
+
+// Frames are decoded with the new attribute as they are, only the attribute
+// file is replaced
+func (e *EmbeddedStore) AlterStream(dataStreamId int64, a *meta.DataStreamAttribute) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	dir := e.streamDir(dataStreamId)
+	if _, err := os.Stat(dir); err != nil {
+		return ErrStreamNotFound
+	}
+	attribute, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, embeddedAttributeFile+".tmp")
+	if err = ioutil.WriteFile(tmp, attribute, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, embeddedAttributeFile))
+}
+
+func (e *EmbeddedStore) stream(dataStreamId int64) (*embeddedStream, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if s, ok := e.streams[dataStreamId]; ok {
+		return s, nil
+	}
+	dir := e.streamDir(dataStreamId)
+	if _, err := os.Stat(dir); err != nil {
+		return nil, ErrStreamNotFound
+	}
+	s := &embeddedStream{dir: dir}
+	err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	e.streams[dataStreamId] = s
+	return s, nil
+}
+
+func (e *EmbeddedStore) Append(dataStreamId int64, a *meta.DataStreamAttribute, records []*Record) error {
+	records, err := dedupeRecords(a, records)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	s, err := e.stream(dataStreamId)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	mode := a.Mode()
+	var saved map[int64]bool
+	var replaced []*embeddedSegment
+	if mode != meta.WriteModeAppend {
+		saved, replaced, err = s.find(a, recordTimes(records))
+		if err != nil {
+			return err
+		}
+		switch {
+		case len(saved) == 0:
+		case mode == meta.WriteModeReject:
+			return ErrDuplicateRecord
+		case mode == meta.WriteModeFirst:
+			kept := make([]*Record, 0, len(records))
+			for _, r := range records {
+				if !saved[r.Time.UnixNano()] {
+					kept = append(kept, r)
+				}
+			}
+			if records, replaced = kept, nil; len(records) == 0 {
+				return nil
+			}
+		}
+	}
+	frame, err := encodeEmbeddedFrame(a, records)
+	if err != nil {
+		return err
+	}
+
+	var last *embeddedSegment
+	if len(s.segments) > 0 {
+		last = s.segments[len(s.segments)-1]
+	}
+	if last == nil || (last.size > 0 && last.size+int64(len(frame)) > e.SegmentSize) {
+		seq := int64(1)
+		if last != nil {
+			seq = last.seq + 1
+		}
+		last = &embeddedSegment{seq: seq, path: filepath.Join(s.dir, fmt.Sprintf("%016d%s", seq, embeddedSegmentExt))}
+		s.segments = append(s.segments, last)
+	}
+	if err = last.append(frame); err != nil {
+		return err
+	}
+	if len(replaced) == 0 {
+		return nil
+	}
+
+	//last write wins, the new records are saved before the old ones are
+	// removed so that a crash in between keeps both rather than none
+	added := last.frames[len(last.frames)-1]
+	for _, segment := range replaced {
+		err = segment.rewrite(a, func(f *embeddedFrame, r *Record) bool {
+			return f == added || !saved[r.Time.UnixNano()]
+		})
+		if err != nil {
+			return err
+		}
+	}
+	segments := make([]*embeddedSegment, 0, len(s.segments))
+	for _, segment := range s.segments {
+		if len(segment.frames) == 0 {
+			if err = os.Remove(segment.path); err != nil {
+				return err
+			}
+			continue
+		}
+		segments = append(segments, segment)
+	}
+	s.segments = segments
+	return nil
+}
+
+func (e *EmbeddedStore) Range(dataStreamId int64, a *meta.DataStreamAttribute, start time.Time, end time.Time,
+	descending bool, limit int) ([]*Record, error) {
+	s, err := e.stream(dataStreamId)
+	if err != nil {
+		return nil, err
+	}
+	startNano, endNano := start.UnixNano(), end.UnixNano()
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	//frames are visited from the nearest end of the range, so that with
+	// a limit we can stop once no remaining frame can contain a closer record
+	frames := make([]*embeddedFrameRef, 0)
+	for _, segment := range s.segments {
+		for _, frame := range segment.frames {
+			if frame.overlaps(startNano, endNano) {
+				frames = append(frames, &embeddedFrameRef{segment: segment, frame: frame})
+			}
+		}
+	}
+	sort.Stable(embeddedFramesByTime{frames, descending})
+
+	records := make([]*Record, 0)
+	files := make(map[*embeddedSegment]*os.File)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, ref := range frames {
+		if limit > 0 && len(records) >= limit {
+			sortRecords(records, descending)
+			records = records[:limit]
+			last := records[limit-1].Time.UnixNano()
+			if (!descending && ref.frame.minTime > last) || (descending && ref.frame.maxTime < last) {
+				break
+			}
+		}
+		f, ok := files[ref.segment]
+		if !ok {
+			f, err = os.Open(ref.segment.path)
+			if err != nil {
+				return nil, err
+			}
+			files[ref.segment] = f
+		}
+		_, payload, err := readEmbeddedFrame(f, ref.frame.offset)
+		if err != nil {
+			return nil, err
+		}
+		err = decodeEmbeddedFrame(a, payload, func(r *Record) {
+			t := r.Time.UnixNano()
+			if t >= startNano && t < endNano {
+				records = append(records, r)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sortRecords(records, descending)
+	if limit > 0 && len(records) > limit {
+		records = records[:limit]
+	}
+	return records, nil
+}
+
+func (e *EmbeddedStore) Delete(dataStreamId int64, a *meta.DataStreamAttribute, start time.Time, end time.Time) error {
+	s, err := e.stream(dataStreamId)
+	if err != nil {
+		return err
+	}
+	startNano, endNano := start.UnixNano(), end.UnixNano()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	segments := make([]*embeddedSegment, 0, len(s.segments))
+	for _, segment := range s.segments {
+		if !segment.overlaps(startNano, endNano) {
+			segments = append(segments, segment)
+			continue
+		}
+		//expired segments are removed without reading them
+		if segment.within(startNano, endNano) {
+			if err = os.Remove(segment.path); err != nil {
+				return err
+			}
+			continue
+		}
+		err = segment.rewrite(a, func(f *embeddedFrame, r *Record) bool {
+			t := r.Time.UnixNano()
+			return t < startNano || t >= endNano
+		})
+		if err != nil {
+			return err
+		}
+		if len(segment.frames) == 0 {
+			if err = os.Remove(segment.path); err != nil {
+				return err
+			}
+			continue
+		}
+		segments = append(segments, segment)
+	}
+	s.segments = segments
+	return nil
+}
+
+func (e *EmbeddedStore) Close() error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.streams = make(map[int64]*embeddedStream)
+	return nil
+}
+
+// Times of records already saved, and the segments having them. Only frames
+// overlapping the times are read.
+func (s *embeddedStream) find(a *meta.DataStreamAttribute, times map[int64]bool) (map[int64]bool, []*embeddedSegment, error) {
+	var minTime, maxTime int64
+	first := true
+	for t := range times {
+		if first || t < minTime {
+			minTime = t
+		}
+		if first || t > maxTime {
+			maxTime = t
+		}
+		first = false
+	}
+	saved := make(map[int64]bool)
+	segments := make([]*embeddedSegment, 0)
+	for _, segment := range s.segments {
+		found := false
+		var f *os.File
+		for _, frame := range segment.frames {
+			if !frame.overlaps(minTime, maxTime+1) {
+				continue
+			}
+			if f == nil {
+				var err error
+				if f, err = os.Open(segment.path); err != nil {
+					return nil, nil, err
+				}
+				defer f.Close()
+			}
+			_, payload, err := readEmbeddedFrame(f, frame.offset)
+			if err != nil {
+				return nil, nil, err
+			}
+			err = decodeEmbeddedFrame(a, payload, func(r *Record) {
+				t := r.Time.UnixNano()
+				if times[t] {
+					saved[t] = true
+					found = true
+				}
+			})
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		if found {
+			segments = append(segments, segment)
+		}
+	}
+	return saved, segments, nil
+}
+
+// load segment files and index frames
+func (s *embeddedStream) load() error {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasSuffix(name, embeddedSegmentExt) {
+			continue
+		}
+		var seq int64
+		if _, err = fmt.Sscanf(strings.TrimSuffix(name, embeddedSegmentExt), "%d", &seq); err != nil {
+			continue
+		}
+		segment := &embeddedSegment{seq: seq, path: filepath.Join(s.dir, name)}
+		if err = segment.load(); err != nil {
+			return err
+		}
+		s.segments = append(s.segments, segment)
+	}
+	sort.Sort(segmentsBySeq(s.segments))
+	return nil
+}
+
+func (s *embeddedSegment) load() error {
+	f, err := os.OpenFile(s.path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s.frames = nil
+	s.size = 0
+	for {
+		frame, payload, err := readEmbeddedFrame(f, s.size)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			//torn or corrupt frame, drop everything after the last good frame
+			return f.Truncate(s.size)
+		}
+		if err = frame.decodeHeader(payload); err != nil {
+			return f.Truncate(s.size)
+		}
+		s.frames = append(s.frames, frame)
+		s.size += embeddedFrameHeaderSize + frame.length
+	}
+	return nil
+}
+
+func (s *embeddedSegment) append(frame []byte) error {
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	indexed := &embeddedFrame{offset: s.size, length: int64(len(frame) - embeddedFrameHeaderSize)}
+	if err = indexed.decodeHeader(frame[embeddedFrameHeaderSize:]); err != nil {
+		return err
+	}
+	_, err = f.Write(frame)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		//the write is reported as failed, so do not leave the frame (or a
+		// partial one) behind to shift the offsets of later frames
+		f.Truncate(s.size)
+		return err
+	}
+	s.frames = append(s.frames, indexed)
+	s.size += int64(len(frame))
+	return nil
+}
+
+func (s *embeddedSegment) within(start int64, end int64) bool {
+	for _, frame := range s.frames {
+		if frame.minTime < start || frame.maxTime >= end {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *embeddedSegment) overlaps(start int64, end int64) bool {
+	for _, frame := range s.frames {
+		if frame.overlaps(start, end) {
+			return true
+		}
+	}
+	return false
+}
+
+// rewrite the segment keeping only records (of a frame) that keep returns true,
+// the new segment is written to a temporary file and renamed over
+// the old one so that a crash never loses the old segment
+func (s *embeddedSegment) rewrite(a *meta.DataStreamAttribute, keep func(*embeddedFrame, *Record) bool) error {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	frames := make([][]byte, 0, len(s.frames))
+	for _, frame := range s.frames {
+		_, payload, err := readEmbeddedFrame(f, frame.offset)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		records := make([]*Record, 0, frame.count)
+		err = decodeEmbeddedFrame(a, payload, func(r *Record) {
+			if keep(frame, r) {
+				records = append(records, r)
+			}
+		})
+		if err != nil {
+			f.Close()
+			return err
+		}
+		if len(records) == 0 {
+			continue
+		}
+		if int64(len(records)) == frame.count {
+			frames = append(frames, append(encodeEmbeddedFrameHeader(payload), payload...))
+			continue
+		}
+		encoded, err := encodeEmbeddedFrame(a, records)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		frames = append(frames, encoded)
+	}
+	f.Close()
+
+	if len(frames) == 0 {
+		s.frames = nil
+		s.size = 0
+		return nil
+	}
+	tmp := s.path + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	for _, frame := range frames {
+		if _, err = out.Write(frame); err != nil {
+			out.Close()
+			os.Remove(tmp)
+			return err
+		}
+	}
+	if err = out.Sync(); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	out.Close()
+	if err = os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	return s.load()
+}
+
+func (f *embeddedFrame) overlaps(start int64, end int64) bool {
+	return f.maxTime >= start && f.minTime < end
+}
+
+// only decode the header fields (1-3), records are not touched
+func (f *embeddedFrame) decodeHeader(payload []byte) error {
+	b := common.NewProtoBuffer(payload)
+	for i := uint64(1); i <= 3; i++ {
+		wire, tag, err := b.DecodeKey()
+		if err != nil {
+			return err
+		}
+		if wire != common.WireVarint || tag != i {
+			return ErrCorruptFrame
+		}
+		v, err := b.DecodeVarint()
+		if err != nil {
+			return err
+		}
+		switch tag {
+		case 1:
+			f.count = int64(v)
+		case 2:
+			f.minTime = zigzagDecode(v)
+		case 3:
+			f.maxTime = zigzagDecode(v)
+		}
+	}
+	return nil
+}
+
+func readEmbeddedFrame(f *os.File, offset int64) (*embeddedFrame, []byte, error) {
+	header := make([]byte, embeddedFrameHeaderSize)
+	n, err := f.ReadAt(header, offset)
+	if n == 0 && err == io.EOF {
+		return nil, nil, io.EOF
+	}
+	if n != embeddedFrameHeaderSize {
+		return nil, nil, ErrCorruptFrame
+	}
+	length := int64(binary.LittleEndian.Uint32(header[0:4]))
+	checksum := binary.LittleEndian.Uint32(header[4:8])
+	payload := make([]byte, length)
+	n, _ = f.ReadAt(payload, offset+embeddedFrameHeaderSize)
+	if int64(n) != length || crc32.ChecksumIEEE(payload) != checksum {
+		return nil, nil, ErrCorruptFrame
+	}
+	return &embeddedFrame{offset: offset, length: length}, payload, nil
+}
+
+func encodeEmbeddedFrameHeader(payload []byte) []byte {
+	header := make([]byte, embeddedFrameHeaderSize, embeddedFrameHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(header[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(header[4:8], crc32.ChecksumIEEE(payload))
+	return header
+}
+
+func encodeEmbeddedFrame(a *meta.DataStreamAttribute, records []*Record) ([]byte, error) {
+	minTime, maxTime := records[0].Time.UnixNano(), records[0].Time.UnixNano()
+	for _, r := range records {
+		t := r.Time.UnixNano()
+		if t < minTime {
+			minTime = t
+		}
+		if t > maxTime {
+			maxTime = t
+		}
+	}
+	b := common.NewProtoBuffer(nil)
+	b.EncodeKey(common.WireVarint, 1)
+	b.EncodeVarint(uint64(len(records)))
+	b.EncodeKey(common.WireVarint, 2)
+	b.EncodeZigzag64(uint64(minTime))
+	b.EncodeKey(common.WireVarint, 3)
+	b.EncodeZigzag64(uint64(maxTime))
+	block, err := EncodeBlock(a, records)
+	if err != nil {
+		return nil, err
+	}
+	b.EncodeKey(common.WireLengthDelimited, 5)
+	b.EncodeRawBytes(block)
+	payload := b.Bytes()
+	return append(encodeEmbeddedFrameHeader(payload), payload...), nil
+}
+
+func decodeEmbeddedFrame(a *meta.DataStreamAttribute, payload []byte, fn func(*Record)) error {
+	b := common.NewProtoBuffer(payload)
+	for !b.DecodeComplete() {
+		wire, tag, err := b.DecodeKey()
+		if err != nil {
+			return err
+		}
+		if wire == common.WireVarint {
+			//header fields
+			if _, err = b.DecodeVarint(); err != nil {
+				return err
+			}
+			continue
+		}
+		if wire != common.WireLengthDelimited || tag != 5 {
+			return ErrCorruptFrame
+		}
+		raw, err := b.DecodeRawBytes(false)
+		if err != nil {
+			return err
+		}
+		records, err := DecodeBlock(a, raw)
+		if err != nil {
+			return err
+		}
+		for _, r := range records {
+			fn(r)
+		}
+	}
+	return nil
+}
+
+func zigzagDecode(x uint64) int64 {
+	return int64((x >> 1) ^ uint64((int64(x&1)<<63)>>63))
+}
+
+type recordsByTime []*Record
+
+func (r recordsByTime) Len() int { return len(r) }
+func (r recordsByTime) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r recordsByTime) Less(i, j int) bool { return r[i].Time.Before(r[j].Time) }
+
+type recordsByTimeDesc []*Record
+
+func (r recordsByTimeDesc) Len() int { return len(r) }
+func (r recordsByTimeDesc) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r recordsByTimeDesc) Less(i, j int) bool { return r[i].Time.After(r[j].Time) }
+
+//Records of the same time keep their order, ascending or descending
+func sortRecords(records []*Record, descending bool) {
+	if descending {
+		sort.Stable(recordsByTimeDesc(records))
+	} else {
+		sort.Stable(recordsByTime(records))
+	}
+}
+
+type embeddedFrameRef struct {
+	segment *embeddedSegment
+	frame *embeddedFrame
+}
+
+type embeddedFramesByTime struct {
+	frames []*embeddedFrameRef
+	descending bool
+}
+
+func (f embeddedFramesByTime) Len() int { return len(f.frames) }
+func (f embeddedFramesByTime) Swap(i, j int) { f.frames[i], f.frames[j] = f.frames[j], f.frames[i] }
+func (f embeddedFramesByTime) Less(i, j int) bool {
+	if f.descending {
+		return f.frames[i].frame.maxTime > f.frames[j].frame.maxTime
+	}
+	return f.frames[i].frame.minTime < f.frames[j].frame.minTime
+}
+
+type segmentsBySeq []*embeddedSegment
+
+func (s segmentsBySeq) Len() int { return len(s) }
+func (s segmentsBySeq) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s segmentsBySeq) Less(i, j int) bool { return s[i].seq < s[j].seq }
@@ -0,0 +1,243 @@
+package data
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"github.com/heartsg/dasea/common"
+	"github.com/heartsg/dasea/storage/meta"
+)
+
+var testAttribute = &meta.DataStreamAttribute{
+	Id: 1,
+	Description: "radar data",
+	NumDataPoints: 4,
+	DataPointNames: []string{"radar", "dummy", "temperature", "time"},
+	DataPointTypes: []string{"int8", "sint32", "float64", "timestamp"},
+	DataPointUnits: []int64{meta.UUnit, meta.UUnit, meta.UDegreeCelsius, meta.UUnit},
+}
+
+// encode records the same way as a device does
+func testProtobufData(radar []int64) []byte {
+	buf := common.NewProtoBuffer(nil)
+	for i, r := range radar {
+		record := common.NewProtoBuffer(nil)
+		record.EncodeKey(common.WireVarint, 1)
+		record.EncodeVarint(uint64(r))
+		//dummy is omitted as zero value
+		record.EncodeKey(common.WireFixed64, 3)
+		record.EncodeFloat64(float64(i) + 0.5)
+		record.EncodeKey(common.WireLengthDelimited, 4)
+		record.EncodeTimestamp(time.Unix(1000+int64(i), 0))
+		buf.EncodeKey(common.WireLengthDelimited, 1)
+		buf.EncodeRawBytes(record.Bytes())
+	}
+	return buf.Bytes()
+}
+
+func TestDecodeProtobuf(t *testing.T) {
+	now := time.Now()
+	records, err := DecodeProtobufRecords(testAttribute, testProtobufData([]int64{100, -100}), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("should decode 2 records, got %d", len(records))
+	}
+	r := records[1]
+	if r.Values[0].(int64) != -100 || r.Values[1].(int64) != 0 || r.Values[2].(float64) != 1.5 ||
+		!r.Values[3].(time.Time).Equal(time.Unix(1001, 0)) || !r.Time.Equal(now) {
+		t.Errorf("decoded values not match, got %v", r.Values)
+	}
+
+	//int8 out of range
+	_, err = DecodeProtobufRecords(testAttribute, testProtobufData([]int64{1000}), now)
+	if err != ErrInvalidData {
+		t.Errorf("out of range value should be rejected, got %v", err)
+	}
+
+	//encode and decode back
+	raw, err := EncodeProtobufRecord(testAttribute, r.Values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := DecodeProtobufRecord(testAttribute, raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range values {
+		if i == 3 {
+			if !values[i].(time.Time).Equal(r.Values[i].(time.Time)) {
+				t.Errorf("value %d not match", i)
+			}
+			continue
+		}
+		if values[i] != r.Values[i] {
+			t.Errorf("value %d not match, want %v, got %v", i, r.Values[i], values[i])
+		}
+	}
+}
+
+func testRecords(start time.Time, n int) []*Record {
+	records := make([]*Record, n)
+	for i := 0; i < n; i++ {
+		records[i] = &Record{
+			Time: start.Add(time.Duration(i) * time.Second),
+			Values: []interface{}{int64(i % 100), int64(-i), float64(i) / 2, start},
+		}
+	}
+	return records
+}
+
+func TestEmbeddedStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dasea-embedded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewEmbeddedStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//small segments to test rolling over
+	store.SegmentSize = 1024
+
+	err = store.Append(1, testAttribute, testRecords(time.Unix(0, 0), 1))
+	if err != ErrStreamNotFound {
+		t.Errorf("append to a non-existent stream should fail, got %v", err)
+	}
+	if err = store.CreateStream(1, testAttribute); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.CreateStream(1, testAttribute); err != ErrStreamExists {
+		t.Errorf("create an existing stream should fail, got %v", err)
+	}
+
+	start := time.Unix(10000, 0)
+	records := testRecords(start, 200)
+	for i := 0; i < 200; i += 20 {
+		if err = store.Append(1, testAttribute, records[i:i+20]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	segments, _ := filepath.Glob(filepath.Join(dir, "1", "*"+embeddedSegmentExt))
+	if len(segments) < 2 {
+		t.Errorf("segments should roll over, got %d segment files", len(segments))
+	}
+
+	got, err := store.Range(1, testAttribute, start.Add(50*time.Second), start.Add(150*time.Second), false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 100 {
+		t.Fatalf("should get 100 records, got %d", len(got))
+	}
+	for i, r := range got {
+		if !r.Time.Equal(start.Add(time.Duration(50+i) * time.Second)) || r.Values[1].(int64) != int64(-50-i) {
+			t.Fatalf("record %d not match, got %v %v", i, r.Time, r.Values)
+		}
+	}
+
+	//delete and reopen, deleted records must not come back
+	err = store.Delete(1, testAttribute, start, start.Add(100*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	store, err = NewEmbeddedStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = store.Range(1, testAttribute, time.Unix(0, 0), start.Add(time.Hour), false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 100 || !got[0].Time.Equal(start.Add(100*time.Second)) {
+		t.Fatalf("should get the last 100 records after delete, got %d", len(got))
+	}
+
+	if err = store.DropStream(1, testAttribute); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.Range(1, testAttribute, start, start.Add(time.Hour), false, 0); err != ErrStreamNotFound {
+		t.Errorf("stream should be dropped, got %v", err)
+	}
+}
+
+func TestEmbeddedStoreTornFrame(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dasea-embedded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewEmbeddedStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.CreateStream(1, testAttribute); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Unix(10000, 0)
+	if err = store.Append(1, testAttribute, testRecords(start, 10)); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	//simulate a crash in the middle of writing a frame
+	segments, _ := filepath.Glob(filepath.Join(dir, "1", "*"+embeddedSegmentExt))
+	f, err := os.OpenFile(segments[0], os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{100, 0, 0, 0, 1, 2, 3, 4, 5})
+	f.Close()
+
+	store, err = NewEmbeddedStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.Range(1, testAttribute, start, start.Add(time.Hour), false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 10 {
+		t.Fatalf("should get 10 records, got %d", len(got))
+	}
+	if err = store.Append(1, testAttribute, testRecords(start.Add(10*time.Second), 10)); err != nil {
+		t.Fatal(err)
+	}
+	got, err = store.Range(1, testAttribute, start, start.Add(time.Hour), false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 20 {
+		t.Fatalf("should get 20 records after append, got %d", len(got))
+	}
+}
+
+func TestDecodeEmbeddedFrame(t *testing.T) {
+	start := time.Unix(10000, 0)
+	frame, err := encodeEmbeddedFrame(testAttribute, testRecords(start, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	if err = decodeEmbeddedFrame(testAttribute, frame[embeddedFrameHeaderSize:], func(*Record) { n++ }); err != nil || n != 10 {
+		t.Fatalf("should decode 10 records, got %d %v", n, err)
+	}
+
+	//only blocks carry records
+	b := common.NewProtoBuffer(nil)
+	b.EncodeKey(common.WireVarint, 1)
+	b.EncodeVarint(1)
+	b.EncodeKey(common.WireLengthDelimited, 4)
+	b.EncodeRawBytes([]byte{8, 2})
+	if err = decodeEmbeddedFrame(testAttribute, b.Bytes(), func(*Record) {}); err != ErrCorruptFrame {
+		t.Errorf("frame without a block should be corrupt, got %v", err)
+	}
+}
@@ -0,0 +1,191 @@
+package data
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+	"github.com/heartsg/dasea/storage/meta"
+)
+
+//Json data from gateways are either a single record or an array of records,
+// each record is an object keyed by DataPointNames,
+//
+//  {"radar": 100, "temperature": 25.5, "time": "2016-01-02T15:04:05Z"}
+//  [{"radar": 100, ...}, {"radar": 101, ...}]
+//
+//Missing or null data points are filled with default values (the same as omitted
+// tags in protobuf). Previous names of renamed data points are accepted, values
+// of retired data points are dropped. Unlike protobuf, a bad record does not fail the whole batch,
+// it is reported by a RecordError and the rest of the batch is still saved.
+
+// Time formats accepted for timestamp and datetime data points, besides
+// numbers which are taken as unix seconds.
+var JsonTimeFormats = []string{
+	time.RFC3339Nano,
+	"2006-1-2 15:04:05",
+	"2006-1-2",
+}
+
+// RecordError reports why the record at Index of a batch is rejected.
+type RecordError struct {
+	Index int
+	Err error
+}
+
+func (e *RecordError) Error() string {
+	return fmt.Sprintf("record %d: %v", e.Index, e.Err)
+}
+
+//Decode a single record or an array of records, records are stamped with t
+// unless the time is given by a TimestampDataPoint (see newRecord).
+//An error is returned only if buf is not valid json, bad records are
+// skipped and reported in the returned RecordErrors.
+func DecodeJsonRecords(a *meta.DataStreamAttribute, buf []byte, t time.Time) ([]*Record, []*RecordError, error) {
+	raws := make([]json.RawMessage, 0)
+	trimmed := bytes.TrimSpace(buf)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &raws); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		var raw json.RawMessage
+		if err := json.Unmarshal(trimmed, &raw); err != nil {
+			return nil, nil, err
+		}
+		raws = append(raws, raw)
+	}
+
+	records := make([]*Record, 0, len(raws))
+	recordErrors := make([]*RecordError, 0)
+	for i, raw := range raws {
+		values, err := DecodeJsonRecord(a, raw)
+		if err != nil {
+			recordErrors = append(recordErrors, &RecordError{Index: i, Err: err})
+			continue
+		}
+		records = append(records, newRecord(a, values, t))
+	}
+	return records, recordErrors, nil
+}
+
+//Decode one json object into normalised values (see TypeName2ZeroValue).
+func DecodeJsonRecord(a *meta.DataStreamAttribute, buf []byte) ([]interface{}, error) {
+	fields := make(map[string]json.RawMessage)
+	decoder := json.NewDecoder(bytes.NewReader(buf))
+	decoder.UseNumber()
+	if err := decoder.Decode(&fields); err != nil {
+		return nil, err
+	}
+	if fields == nil {
+		return nil, ErrInvalidData
+	}
+
+	values := make([]interface{}, a.NumDataPoints)
+	for name, raw := range fields {
+		//previous names of renamed data points are accepted as well, unknown
+		// names are most likely typos, reject rather than silently drop
+		i := a.DataPointIndex(name)
+		if i < 0 || values[i] != nil {
+			return nil, fmt.Errorf("%s: %v", name, ErrInvalidData)
+		}
+		t := a.DataPointTypes[i]
+		if string(raw) == "null" || a.IsRetired(i) {
+			continue
+		}
+		v, err := decodeJsonValue(raw, t)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		if err = TypeNameCheckRange(t, v); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		values[i] = v
+	}
+	for i, v := range values {
+		if v != nil {
+			continue
+		}
+		dv, err := TypeName2ZeroValue(a.DataPointTypes[i])
+		if err != nil {
+			return nil, err
+		}
+		values[i] = dv
+	}
+	return values, nil
+}
+
+//Encode normalised values as one json object, it is the reverse of
+// DecodeJsonRecord
+func EncodeJsonRecord(a *meta.DataStreamAttribute, values []interface{}) ([]byte, error) {
+	if len(values) != int(a.NumDataPoints) {
+		return nil, ErrInvalidData
+	}
+	fields := make(map[string]interface{})
+	for i, v := range values {
+		t := a.DataPointTypes[i]
+		if err := TypeNameCheckRange(t, v); err != nil {
+			return nil, err
+		}
+		if tv, ok := v.(time.Time); ok {
+			v = tv.UTC().Format(time.RFC3339Nano)
+		}
+		fields[a.DataPointNames[i]] = v
+	}
+	return json.Marshal(fields)
+}
+
+func decodeJsonValue(raw json.RawMessage, t string) (interface{}, error) {
+	var v interface{}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(&v); err != nil {
+		return nil, err
+	}
+	zv, err := TypeName2ZeroValue(t)
+	if err != nil {
+		return nil, err
+	}
+
+	switch zv.(type) {
+	case int64:
+		if n, ok := v.(json.Number); ok {
+			return strconv.ParseInt(string(n), 10, 64)
+		}
+	case uint64:
+		if n, ok := v.(json.Number); ok {
+			return strconv.ParseUint(string(n), 10, 64)
+		}
+	case float64:
+		if n, ok := v.(json.Number); ok {
+			return n.Float64()
+		}
+	case bool:
+		if b, ok := v.(bool); ok {
+			return b, nil
+		}
+	case time.Time:
+		switch tv := v.(type) {
+		case json.Number:
+			f, err := tv.Float64()
+			if err != nil {
+				return nil, err
+			}
+			sec := int64(f)
+			return time.Unix(sec, int64((f-float64(sec))*1e9)).UTC(), nil
+		case string:
+			for _, format := range JsonTimeFormats {
+				tt, err := time.Parse(format, tv)
+				if err == nil {
+					return tt.UTC(), nil
+				}
+			}
+		}
+	case string:
+		if s, ok := v.(string); ok {
+			return s, nil
+		}
+	}
+	return nil, ErrInvalidData
+}
@@ -0,0 +1,74 @@
+package data
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDecodeJson(t *testing.T) {
+	now := time.Now()
+	buf := []byte(`[
+		{"radar": 100, "dummy": -5, "temperature": 25.5, "time": "2016-01-02T15:04:05Z"},
+		{"radar": 1000},
+		{"radar": "abc"},
+		{"radr": 1},
+		{"temperature": 1, "time": 1000.5},
+		{"radar": null, "time": "2016-1-2 15:04:05"}
+	]`)
+	records, recordErrors, err := DecodeJsonRecords(testAttribute, buf, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("should decode 3 records, got %d", len(records))
+	}
+	if len(recordErrors) != 3 || recordErrors[0].Index != 1 || recordErrors[1].Index != 2 || recordErrors[2].Index != 3 {
+		t.Fatalf("records 1, 2, 3 should be rejected, got %v", recordErrors)
+	}
+	if recordErrors[2].Err.Error() != "radr: "+ErrInvalidData.Error() {
+		t.Errorf("unknown field should be named, got %v", recordErrors[2].Err)
+	}
+
+	r := records[0]
+	if r.Values[0].(int64) != 100 || r.Values[1].(int64) != -5 || r.Values[2].(float64) != 25.5 ||
+		!r.Values[3].(time.Time).Equal(time.Date(2016, 1, 2, 15, 4, 5, 0, time.UTC)) || !r.Time.Equal(now) {
+		t.Errorf("decoded values not match, got %v", r.Values)
+	}
+	r = records[1]
+	if r.Values[0].(int64) != 0 || r.Values[2].(float64) != 1 || !r.Values[3].(time.Time).Equal(time.Unix(1000, 5e8)) {
+		t.Errorf("missing values should be defaults, got %v", r.Values)
+	}
+	if !records[2].Values[3].(time.Time).Equal(time.Date(2016, 1, 2, 15, 4, 5, 0, time.UTC)) {
+		t.Errorf("datetime format not parsed, got %v", records[2].Values[3])
+	}
+
+	//single record
+	records, _, err = DecodeJsonRecords(testAttribute, []byte(`{"radar": 1}`), now)
+	if err != nil || len(records) != 1 {
+		t.Errorf("single record should be decoded, got %d %v", len(records), err)
+	}
+	if _, _, err = DecodeJsonRecords(testAttribute, []byte(`{"radar": `), now); err == nil {
+		t.Errorf("invalid json should fail the batch")
+	}
+
+	//encode and decode back
+	raw, err := EncodeJsonRecord(testAttribute, records[0].Values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := DecodeJsonRecord(testAttribute, raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range values {
+		if i == 3 {
+			if !values[i].(time.Time).Equal(records[0].Values[i].(time.Time)) {
+				t.Errorf("value %d not match", i)
+			}
+			continue
+		}
+		if values[i] != records[0].Values[i] {
+			t.Errorf("value %d not match, want %v, got %v", i, records[0].Values[i], values[i])
+		}
+	}
+}
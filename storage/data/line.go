@@ -0,0 +1,376 @@
+package data
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"github.com/heartsg/dasea/storage/meta"
+)
+
+//InfluxDB line protocol, as written by Telegraf and other collectors
+//
+//  measurement[,tag=value...] field=value[,field=value...] [timestamp]
+//  weather,device=station-1 temperature=25.5,humidity=60i,ok=true 1465839830100400200
+//
+//Field values are floats (25.5, -1e3), signed integers (60i), unsigned
+// integers (60u), booleans (t, true, f, false ...) or double quoted strings.
+// Commas, spaces and equal signs in names and tags are escaped by
+// backslashes, as are double quotes and backslashes in strings. Empty lines
+// and lines starting with # are skipped.
+//
+//Which data stream a line goes to is up to the caller (e.g. the measurement
+// names the DataStreamAttribute and a tag the Device). Fields are then keyed
+// by DataPointNames like json records and their types must match the
+// DataPointTypes: integers fit int, uint and float data points, floats only
+// float data points, strings string data points and timestamps (as json
+// strings, see JsonTimeFormats), integers and floats are taken as unix seconds
+// for timestamps. Tags named as string data points fill them, other tags are
+// ignored. As json, a bad line does not fail the whole batch, it is reported
+// by a RecordError.
+
+var (
+	ErrInvalidLine = errors.New("Invalid line protocol.")
+	ErrInvalidPrecision = errors.New("Invalid timestamp precision, must be ns, us, ms, s, m or h.")
+	ErrTypeMismatch = errors.New("Field type does not match the data point type.")
+)
+
+type Line struct {
+	//0-based line number in the batch, the Index of its RecordError
+	Index int
+	Measurement string
+	Tags map[string]string
+	Fields []LineField
+	//zero if not given, the record is stamped when it arrives
+	Time time.Time
+}
+
+type LineField struct {
+	Key string
+	//int64, uint64, float64, bool or string
+	Value interface{}
+}
+
+//Unit of line timestamps, by the precision names of InfluxDB 1.x and 2.x.
+// Nanoseconds if p is empty.
+func LinePrecision(p string) (time.Duration, error) {
+	switch p {
+	case "", "n", "ns":
+		return time.Nanosecond, nil
+	case "u", "us":
+		return time.Microsecond, nil
+	case "ms":
+		return time.Millisecond, nil
+	case "s":
+		return time.Second, nil
+	case "m":
+		return time.Minute, nil
+	case "h":
+		return time.Hour, nil
+	}
+	return 0, ErrInvalidPrecision
+}
+
+//Parse a batch of lines with timestamps in precision, bad lines are skipped
+// and reported in the returned RecordErrors.
+func ParseLines(buf []byte, precision time.Duration) ([]*Line, []*RecordError) {
+	lines := make([]*Line, 0)
+	recordErrors := make([]*RecordError, 0)
+	for i, raw := range bytes.Split(buf, []byte("\n")) {
+		s := strings.TrimSpace(string(raw))
+		if s == "" || s[0] == '#' {
+			continue
+		}
+		l, err := ParseLine(s, precision)
+		if err != nil {
+			recordErrors = append(recordErrors, &RecordError{Index: i, Err: err})
+			continue
+		}
+		l.Index = i
+		lines = append(lines, l)
+	}
+	return lines, recordErrors
+}
+
+func ParseLine(s string, precision time.Duration) (*Line, error) {
+	l := &Line{Tags: make(map[string]string)}
+	var i int
+	l.Measurement, i = readLineToken(s, 0, ", ")
+	if l.Measurement == "" {
+		return nil, ErrInvalidLine
+	}
+
+	for i < len(s) && s[i] == ',' {
+		var key, value string
+		key, i = readLineToken(s, i+1, "=, ")
+		if key == "" || i >= len(s) || s[i] != '=' {
+			return nil, ErrInvalidLine
+		}
+		value, i = readLineToken(s, i+1, ", ")
+		if _, ok := l.Tags[key]; ok || value == "" {
+			return nil, ErrInvalidLine
+		}
+		l.Tags[key] = value
+	}
+	if i >= len(s) || s[i] != ' ' {
+		return nil, ErrInvalidLine
+	}
+
+	keys := make(map[string]bool)
+	for {
+		var key string
+		key, i = readLineToken(s, i+1, "=, ")
+		if key == "" || keys[key] || i >= len(s) || s[i] != '=' {
+			return nil, ErrInvalidLine
+		}
+		keys[key] = true
+		var value interface{}
+		var err error
+		if value, i, err = readLineValue(s, i+1); err != nil {
+			return nil, err
+		}
+		l.Fields = append(l.Fields, LineField{Key: key, Value: value})
+		if i >= len(s) || s[i] != ',' {
+			break
+		}
+	}
+
+	if rest := strings.TrimSpace(s[i:]); rest != "" {
+		ts, err := strconv.ParseInt(rest, 10, 64)
+		if err != nil {
+			return nil, ErrInvalidLine
+		}
+		if ts > math.MaxInt64/int64(precision) || ts < math.MinInt64/int64(precision) {
+			return nil, ErrInvalidLine
+		}
+		l.Time = time.Unix(0, ts*int64(precision)).UTC()
+	}
+	return l, nil
+}
+
+//Unescaped name or tag starting at i up to one of stops, with the index of
+// the stop (len(s) if none)
+func readLineToken(s string, i int, stops string) (string, int) {
+	var b []byte
+	for ; i < len(s); i++ {
+		c := s[i]
+		if c == '\\' && i+1 < len(s) && strings.IndexByte(`, ="\`, s[i+1]) >= 0 {
+			i++
+			b = append(b, s[i])
+			continue
+		}
+		if strings.IndexByte(stops, c) >= 0 {
+			break
+		}
+		b = append(b, c)
+	}
+	return string(b), i
+}
+
+var lineBools = map[string]bool{
+	"t": true, "T": true, "true": true, "True": true, "TRUE": true,
+	"f": false, "F": false, "false": false, "False": false, "FALSE": false,
+}
+
+//Field value starting at i, with the index after it
+func readLineValue(s string, i int) (interface{}, int, error) {
+	if i < len(s) && s[i] == '"' {
+		var b []byte
+		for i++; i < len(s); i++ {
+			c := s[i]
+			if c == '\\' && i+1 < len(s) && (s[i+1] == '"' || s[i+1] == '\\') {
+				i++
+				b = append(b, s[i])
+				continue
+			}
+			if c == '"' {
+				return string(b), i + 1, nil
+			}
+			b = append(b, c)
+		}
+		return nil, i, ErrInvalidLine
+	}
+
+	start := i
+	for i < len(s) && s[i] != ',' && s[i] != ' ' {
+		i++
+	}
+	v := s[start:i]
+	if v == "" {
+		return nil, i, ErrInvalidLine
+	}
+	if b, ok := lineBools[v]; ok {
+		return b, i, nil
+	}
+	switch v[len(v)-1] {
+	case 'i':
+		n, err := strconv.ParseInt(v[:len(v)-1], 10, 64)
+		if err != nil {
+			return nil, i, ErrInvalidLine
+		}
+		return n, i, nil
+	case 'u':
+		n, err := strconv.ParseUint(v[:len(v)-1], 10, 64)
+		if err != nil {
+			return nil, i, ErrInvalidLine
+		}
+		return n, i, nil
+	}
+	//ParseFloat also takes inf and nan, which line protocol does not
+	if strings.IndexByte("+-.0123456789", v[0]) < 0 {
+		return nil, i, ErrInvalidLine
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || math.IsInf(f, 0) || math.IsNaN(f) {
+		return nil, i, ErrInvalidLine
+	}
+	return f, i, nil
+}
+
+//Decode the fields (and string tags) of a line into normalised values (see
+// TypeName2ZeroValue).
+func DecodeLineRecord(a *meta.DataStreamAttribute, l *Line) ([]interface{}, error) {
+	values := make([]interface{}, a.NumDataPoints)
+	for _, f := range l.Fields {
+		//unknown fields are most likely typos, reject rather than silently drop
+		i := a.DataPointIndex(f.Key)
+		if i < 0 || values[i] != nil {
+			return nil, fmt.Errorf("%s: %v", f.Key, ErrInvalidData)
+		}
+		if a.IsRetired(i) {
+			continue
+		}
+		t := a.DataPointTypes[i]
+		v, err := decodeLineValue(f.Value, t)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", f.Key, err)
+		}
+		if err = TypeNameCheckRange(t, v); err != nil {
+			return nil, fmt.Errorf("%s: %v", f.Key, err)
+		}
+		values[i] = v
+	}
+	for key, tag := range l.Tags {
+		i := a.DataPointIndex(key)
+		if i >= 0 && values[i] == nil && !a.IsRetired(i) && a.DataPointTypes[i] == "string" {
+			values[i] = tag
+		}
+	}
+	for i, v := range values {
+		if v != nil {
+			continue
+		}
+		dv, err := TypeName2ZeroValue(a.DataPointTypes[i])
+		if err != nil {
+			return nil, err
+		}
+		values[i] = dv
+	}
+	return values, nil
+}
+
+func decodeLineValue(v interface{}, t string) (interface{}, error) {
+	zv, err := TypeName2ZeroValue(t)
+	if err != nil {
+		return nil, err
+	}
+
+	switch zv.(type) {
+	case int64:
+		switch n := v.(type) {
+		case int64:
+			return n, nil
+		case uint64:
+			if n <= math.MaxInt64 {
+				return int64(n), nil
+			}
+			return nil, ErrInvalidData
+		}
+	case uint64:
+		switch n := v.(type) {
+		case uint64:
+			return n, nil
+		case int64:
+			if n >= 0 {
+				return uint64(n), nil
+			}
+			return nil, ErrInvalidData
+		}
+	case float64:
+		switch n := v.(type) {
+		case float64:
+			return n, nil
+		case int64:
+			return float64(n), nil
+		case uint64:
+			return float64(n), nil
+		}
+	case bool:
+		if b, ok := v.(bool); ok {
+			return b, nil
+		}
+	case time.Time:
+		switch tv := v.(type) {
+		case int64:
+			return time.Unix(tv, 0).UTC(), nil
+		case uint64:
+			if tv <= math.MaxInt64 {
+				return time.Unix(int64(tv), 0).UTC(), nil
+			}
+			return nil, ErrInvalidData
+		case float64:
+			sec := int64(tv)
+			return time.Unix(sec, int64((tv-float64(sec))*1e9)).UTC(), nil
+		case string:
+			for _, format := range JsonTimeFormats {
+				tt, err := time.Parse(format, tv)
+				if err == nil {
+					return tt.UTC(), nil
+				}
+			}
+			return nil, ErrInvalidData
+		}
+	case string:
+		if s, ok := v.(string); ok {
+			return s, nil
+		}
+	}
+	return nil, ErrTypeMismatch
+}
+
+//Decode lines of one data stream, lines without a timestamp are stamped
+// with t unless the time is given by a TimestampDataPoint (see newRecord).
+func DecodeLineRecords(a *meta.DataStreamAttribute, lines []*Line, t time.Time) ([]*Record, []*RecordError) {
+	records := make([]*Record, 0, len(lines))
+	recordErrors := make([]*RecordError, 0)
+	for _, l := range lines {
+		values, err := DecodeLineRecord(a, l)
+		if err != nil {
+			recordErrors = append(recordErrors, &RecordError{Index: l.Index, Err: err})
+			continue
+		}
+		arrival := t
+		if !l.Time.IsZero() {
+			arrival = l.Time
+		}
+		records = append(records, newRecord(a, values, arrival))
+	}
+	return records, recordErrors
+}
+
+//Insert parsed lines into a data store, good lines are saved even if some
+// are bad, the bad ones are returned as RecordErrors (see PutDataPointsFromJson).
+func PutDataPointsFromLines(dataStreamId int64, lines []*Line) ([]*RecordError, error) {
+	if Store == nil {
+		return nil, ErrStoreNotInitialized
+	}
+	a, err := meta.GetDataStreamAttributeByDataStreamId(dataStreamId)
+	if err != nil {
+		return nil, err
+	}
+	records, recordErrors := DecodeLineRecords(a, lines, time.Now())
+	return recordErrors, appendRecords(dataStreamId, a, records)
+}
@@ -0,0 +1,132 @@
+package data
+
+import (
+	"testing"
+	"time"
+	"github.com/heartsg/dasea/storage/meta"
+)
+
+func TestParseLine(t *testing.T) {
+	l, err := ParseLine(`radar\ data,device=station\,1,site=a\=b radar=100i,temperature=25.5,ok=t,u=7u,note="say \"hi\", ok" 1465839830100400200`, time.Nanosecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Measurement != "radar data" || len(l.Tags) != 2 || l.Tags["device"] != "station,1" || l.Tags["site"] != "a=b" {
+		t.Errorf("measurement and tags not unescaped, got %q %v", l.Measurement, l.Tags)
+	}
+	want := []LineField{
+		{"radar", int64(100)},
+		{"temperature", 25.5},
+		{"ok", true},
+		{"u", uint64(7)},
+		{"note", `say "hi", ok`},
+	}
+	if len(l.Fields) != len(want) {
+		t.Fatalf("fields should be %v, got %v", want, l.Fields)
+	}
+	for i := range want {
+		if l.Fields[i] != want[i] {
+			t.Errorf("field %d should be %v, got %v", i, want[i], l.Fields[i])
+		}
+	}
+	if !l.Time.Equal(time.Unix(0, 1465839830100400200)) {
+		t.Errorf("time not parsed, got %v", l.Time)
+	}
+
+	l, err = ParseLine("cpu usage=1e2 1465839830", time.Second)
+	if err != nil || l.Fields[0].Value != 100.0 || !l.Time.Equal(time.Unix(1465839830, 0)) {
+		t.Errorf("time in seconds not parsed, got %v %v", l, err)
+	}
+	if l, err = ParseLine("cpu usage=1", time.Second); err != nil || !l.Time.IsZero() {
+		t.Errorf("time should be zero if not given, got %v %v", l, err)
+	}
+
+	bad := []string{
+		"cpu",
+		"cpu ",
+		",host=a usage=1",
+		"cpu,host usage=1",
+		"cpu,host= usage=1",
+		"cpu,host=a,host=b usage=1",
+		"cpu usage=",
+		"cpu usage=1,usage=2",
+		`cpu note="open`,
+		"cpu usage=abc",
+		"cpu usage=NaN",
+		"cpu usage=1.5i",
+		"cpu usage=-1u",
+		"cpu usage=1 abc",
+		"cpu usage=1 9223372036854775807",
+	}
+	for _, s := range bad {
+		if _, err = ParseLine(s, time.Second); err != ErrInvalidLine {
+			t.Errorf("%q should be invalid, got %v", s, err)
+		}
+	}
+}
+
+func TestParseLines(t *testing.T) {
+	buf := []byte("# comment\n\ncpu usage=1 1\r\ncpu usage=\ncpu usage=2 2\n")
+	lines, recordErrors := ParseLines(buf, time.Second)
+	if len(lines) != 2 || lines[0].Index != 2 || lines[1].Index != 4 {
+		t.Fatalf("lines 2 and 4 should be parsed, got %v", lines)
+	}
+	if len(recordErrors) != 1 || recordErrors[0].Index != 3 || recordErrors[0].Err != ErrInvalidLine {
+		t.Errorf("line 3 should be rejected, got %v", recordErrors)
+	}
+	for _, p := range []string{"", "n", "ns", "u", "us", "ms", "s", "m", "h"} {
+		if _, err := LinePrecision(p); err != nil {
+			t.Errorf("precision %q should be valid, got %v", p, err)
+		}
+	}
+	if _, err := LinePrecision("d"); err != ErrInvalidPrecision {
+		t.Errorf("precision d should be invalid, got %v", err)
+	}
+}
+
+func TestDecodeLines(t *testing.T) {
+	a := &meta.DataStreamAttribute{
+		NumDataPoints: 5,
+		DataPointNames: []string{"radar", "count", "temperature", "time", "site"},
+		DataPointTypes: []string{"int8", "uint16", "float32", "timestamp", "string"},
+		TimestampDataPoint: 4,
+	}
+	now := time.Now()
+	buf := []byte(`radar radar=100i,count=3i,temperature=25i,time="2016-01-02T15:04:05Z"
+radar,site=north radar=1i 1465839830
+radar radar=1000i
+radar radar=1.5
+radar count=-1i
+radar temperature="warm"
+radar radr=1i
+radar,site=north site="south",time=1000.5
+radar ok=`)
+	lines, recordErrors := ParseLines(buf, time.Second)
+	records, decodeErrors := DecodeLineRecords(a, lines, now)
+	recordErrors = append(recordErrors, decodeErrors...)
+	if len(records) != 3 {
+		t.Fatalf("should decode 3 records, got %d", len(records))
+	}
+	if len(recordErrors) != 6 {
+		t.Fatalf("lines 2 to 6 and 8 should be rejected, got %v", recordErrors)
+	}
+	for i, index := range []int{8, 2, 3, 4, 5, 6} {
+		if recordErrors[i].Index != index {
+			t.Errorf("error %d should be of line %d, got %v", i, index, recordErrors[i])
+		}
+	}
+
+	r := records[0]
+	if r.Values[0].(int64) != 100 || r.Values[1].(uint64) != 3 || r.Values[2].(float64) != 25 ||
+		!r.Time.Equal(time.Date(2016, 1, 2, 15, 4, 5, 0, time.UTC)) || r.Values[4].(string) != "" {
+		t.Errorf("decoded values not match, got %v %v", r.Time, r.Values)
+	}
+	r = records[1]
+	if !r.Time.Equal(time.Unix(1465839830, 0)) || !r.Values[3].(time.Time).Equal(r.Time) || r.Values[4].(string) != "north" {
+		t.Errorf("line time should stamp the record and tags fill string data points, got %v %v", r.Time, r.Values)
+	}
+	r = records[2]
+	if !r.Time.Equal(time.Unix(1000, 5e8)) || r.Values[4].(string) != "south" {
+		t.Errorf("fields should take precedence over tags, got %v %v", r.Time, r.Values)
+	}
+}
@@ -0,0 +1,303 @@
+package data
+
+import (
+	"errors"
+	"sync"
+	"time"
+	"github.com/heartsg/dasea/storage/meta"
+)
+
+var (
+	ErrPipelineFull = errors.New("Ingestion pipeline is full, try again later.")
+	ErrPipelineClosed = errors.New("Ingestion pipeline is closed.")
+)
+
+const (
+	DefaultPipelineBatchSize = 1000
+	DefaultPipelineDelay = time.Second
+	DefaultPipelineQueueSize = 100000
+	DefaultPipelineWorkers = 4
+)
+
+// Pipeline buffers decoded records and writes them to the DataStore in bulk.
+//
+// Records are grouped per DataStream and a DataStream is flushed once it has
+// BatchSize records or its oldest record has waited for Delay. At most
+// QueueSize records (queued or being written) are held, Put fails with
+// ErrPipelineFull beyond that so that callers can back off (the storage
+// service answers 429). Close flushes everything that is queued.
+//
+// DataStreams are assigned to Workers by id, so records of one DataStream
+// are always written in the order they are put. If a coalesced batch is
+// rejected for duplicates (see meta.WriteModeReject), the puts are written
+// one by one so that only those with duplicates fail.
+type Pipeline struct {
+	Store DataStore
+	BatchSize int
+	Delay time.Duration
+	QueueSize int
+	Workers int
+
+	mutex sync.Mutex
+	streams map[int64]*pipelineStream
+	queued int
+	closed bool
+
+	// held for reading while sending to workers, so that Close does not
+	// close the channels in the middle
+	sending sync.RWMutex
+	flushes []chan int64
+	stop chan struct{}
+	wg sync.WaitGroup
+}
+
+type pipelineStream struct {
+	a *meta.DataStreamAttribute
+	records []*Record
+	puts []*pipelinePut
+	since time.Time
+	// an id is in the channel of the worker already
+	scheduled bool
+}
+
+type pipelinePut struct {
+	count int
+	done func(error)
+}
+
+// Similar to Store, initialized in main. Nil means records are written
+// directly by PutDataPoints*.
+var Ingest *Pipeline
+
+func NewPipeline(store DataStore) *Pipeline {
+	return &Pipeline{
+		Store: store,
+		BatchSize: DefaultPipelineBatchSize,
+		Delay: DefaultPipelineDelay,
+		QueueSize: DefaultPipelineQueueSize,
+		Workers: DefaultPipelineWorkers,
+		streams: make(map[int64]*pipelineStream),
+	}
+}
+
+// Start the workers, must be called before Put
+func (p *Pipeline) Start() {
+	p.stop = make(chan struct{})
+	p.flushes = make([]chan int64, p.Workers)
+	for i := range p.flushes {
+		p.flushes[i] = make(chan int64, p.BatchSize)
+		p.wg.Add(1)
+		go p.work(p.flushes[i])
+	}
+	p.wg.Add(1)
+	go p.tick()
+}
+
+// Queue records of a DataStream, done (if not nil) is called with the result
+// of the write once the records are in the DataStore. Either ErrPipelineFull
+// or ErrPipelineClosed is returned (and done is not called) if the records
+// cannot be queued.
+func (p *Pipeline) Put(dataStreamId int64, a *meta.DataStreamAttribute, records []*Record, done func(error)) error {
+	if len(records) == 0 {
+		if done != nil {
+			done(nil)
+		}
+		return nil
+	}
+	p.sending.RLock()
+	defer p.sending.RUnlock()
+
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		return ErrPipelineClosed
+	}
+	if p.queued+len(records) > p.QueueSize {
+		p.mutex.Unlock()
+		return ErrPipelineFull
+	}
+	s, ok := p.streams[dataStreamId]
+	if !ok {
+		s = &pipelineStream{a: a, since: time.Now()}
+		p.streams[dataStreamId] = s
+	}
+	//the attribute may evolve while records are queued, the batch is
+	// written with the latest version
+	if a.Version > s.a.Version {
+		s.a = a
+	}
+	s.records = append(s.records, records...)
+	s.puts = append(s.puts, &pipelinePut{count: len(records), done: done})
+	p.queued += len(records)
+	schedule := len(s.records) >= p.BatchSize && !s.scheduled
+	if schedule {
+		s.scheduled = true
+	}
+	p.mutex.Unlock()
+
+	if schedule && !p.trySchedule(dataStreamId) {
+		//the worker is busy, the ticker schedules the stream again rather
+		// than the caller waiting here
+		p.mutex.Lock()
+		s.scheduled = false
+		p.mutex.Unlock()
+	}
+	return nil
+}
+
+// Queue and wait until the records are in the DataStore
+func (p *Pipeline) PutWait(dataStreamId int64, a *meta.DataStreamAttribute, records []*Record) error {
+	result := make(chan error, 1)
+	err := p.Put(dataStreamId, a, records, func(err error) {
+		result <- err
+	})
+	if err != nil {
+		return err
+	}
+	return <-result
+}
+
+// Number of records queued or being written
+func (p *Pipeline) Queued() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.queued
+}
+
+func (p *Pipeline) schedule(dataStreamId int64) {
+	p.flushes[uint64(dataStreamId)%uint64(len(p.flushes))] <- dataStreamId
+}
+
+// Schedule without waiting, false if the channel of the worker is full
+func (p *Pipeline) trySchedule(dataStreamId int64) bool {
+	select {
+	case p.flushes[uint64(dataStreamId)%uint64(len(p.flushes))] <- dataStreamId:
+		return true
+	default:
+		return false
+	}
+}
+
+// schedule DataStreams that have waited for Delay
+func (p *Pipeline) tick() {
+	defer p.wg.Done()
+	interval := p.Delay / 2
+	if interval <= 0 {
+		interval = time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case now := <-ticker.C:
+			p.scheduleAll(func(s *pipelineStream) bool {
+				return now.Sub(s.since) >= p.Delay
+			})
+		}
+	}
+}
+
+func (p *Pipeline) scheduleAll(due func(*pipelineStream) bool) {
+	p.sending.RLock()
+	defer p.sending.RUnlock()
+	ids := make([]int64, 0)
+	p.mutex.Lock()
+	for id, s := range p.streams {
+		if !s.scheduled && len(s.records) > 0 && due(s) {
+			s.scheduled = true
+			ids = append(ids, id)
+		}
+	}
+	p.mutex.Unlock()
+	if p.flushes == nil {
+		//closed, nothing is left to schedule
+		return
+	}
+	for _, id := range ids {
+		p.schedule(id)
+	}
+}
+
+func (p *Pipeline) work(flushes chan int64) {
+	defer p.wg.Done()
+	for id := range flushes {
+		p.flush(id)
+	}
+}
+
+func (p *Pipeline) flush(dataStreamId int64) {
+	p.mutex.Lock()
+	s, ok := p.streams[dataStreamId]
+	if !ok || len(s.records) == 0 {
+		if ok {
+			s.scheduled = false
+		}
+		p.mutex.Unlock()
+		return
+	}
+	//records put from now on wait for the next flush
+	delete(p.streams, dataStreamId)
+	p.mutex.Unlock()
+
+	errs := make([]error, len(s.puts))
+	err := p.write(dataStreamId, s.a, s.records)
+	if err == ErrDuplicateRecord && len(s.puts) > 1 {
+		//rejected by the write mode, only the puts having duplicates
+		// should fail, so write them one by one
+		offset := 0
+		for i, put := range s.puts {
+			errs[i] = p.write(dataStreamId, s.a, s.records[offset:offset+put.count])
+			offset += put.count
+		}
+	} else {
+		for i := range errs {
+			errs[i] = err
+		}
+	}
+
+	p.mutex.Lock()
+	p.queued -= len(s.records)
+	p.mutex.Unlock()
+	for i, put := range s.puts {
+		if put.done != nil {
+			put.done(errs[i])
+		}
+	}
+}
+
+func (p *Pipeline) write(dataStreamId int64, a *meta.DataStreamAttribute, records []*Record) error {
+	err := p.Store.Append(dataStreamId, a, upgradeRecords(a, records))
+	if err == nil && Rollups != nil {
+		Rollups.Touch(dataStreamId, records)
+	}
+	return err
+}
+
+// Stop accepting records, flush everything queued and wait for the writes
+func (p *Pipeline) Close() error {
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		return nil
+	}
+	p.closed = true
+	p.mutex.Unlock()
+	if p.stop == nil {
+		return nil
+	}
+
+	close(p.stop)
+	p.scheduleAll(func(*pipelineStream) bool {
+		return true
+	})
+	p.sending.Lock()
+	for _, flushes := range p.flushes {
+		close(flushes)
+	}
+	p.flushes = nil
+	p.sending.Unlock()
+	p.wg.Wait()
+	return nil
+}
@@ -0,0 +1,185 @@
+package data
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+	"github.com/heartsg/dasea/storage/meta"
+)
+
+// counts Append calls, blocks Append while gate is locked
+type testCountingStore struct {
+	DataStore
+	mutex sync.Mutex
+	appends int
+	gate sync.RWMutex
+}
+
+func (s *testCountingStore) Append(dataStreamId int64, a *meta.DataStreamAttribute, records []*Record) error {
+	s.gate.RLock()
+	defer s.gate.RUnlock()
+	s.mutex.Lock()
+	s.appends++
+	s.mutex.Unlock()
+	return s.DataStore.Append(dataStreamId, a, records)
+}
+
+func testPipelineStore(t *testing.T) (*testCountingStore, func()) {
+	dir, err := ioutil.TempDir("", "dasea-pipeline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewEmbeddedStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []int64{1, 2} {
+		if err = store.CreateStream(id, testAttribute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &testCountingStore{DataStore: store}, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	store, clean := testPipelineStore(t)
+	defer clean()
+
+	p := NewPipeline(store)
+	p.BatchSize = 100
+	p.Delay = time.Hour
+	p.Start()
+
+	//coalesced, at least 100 records per write
+	start := time.Unix(10000, 0)
+	records := testRecords(start, 1000)
+	var wg sync.WaitGroup
+	errs := make(chan error, len(records))
+	for _, r := range records {
+		wg.Add(1)
+		err := p.Put(1, testAttribute, []*Record{r}, func(err error) {
+			errs <- err
+			wg.Done()
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if store.appends == 0 || store.appends > 10 {
+		t.Errorf("1000 records should be written in at most 10 batches, got %d", store.appends)
+	}
+	if p.Queued() != 0 {
+		t.Errorf("nothing should be queued, got %d", p.Queued())
+	}
+
+	//not a full batch, written on close
+	if err := p.Put(2, testAttribute, testRecords(start, 10), nil); err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+	got, err := store.Range(2, testAttribute, start, start.Add(time.Hour), false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 10 {
+		t.Errorf("queued records should be flushed on close, got %d", len(got))
+	}
+	if err = p.Put(2, testAttribute, testRecords(start, 1), nil); err != ErrPipelineClosed {
+		t.Errorf("put after close should fail, got %v", err)
+	}
+}
+
+func TestPipelineBackpressure(t *testing.T) {
+	store, clean := testPipelineStore(t)
+	defer clean()
+
+	p := NewPipeline(store)
+	p.BatchSize = 10
+	p.QueueSize = 50
+	p.Delay = 10 * time.Millisecond
+	p.Start()
+	defer p.Close()
+
+	//writes are stuck, records being written still count
+	store.gate.Lock()
+	start := time.Unix(10000, 0)
+	for i := 0; i < 5; i++ {
+		if err := p.Put(1, testAttribute, testRecords(start, 10), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.Put(1, testAttribute, testRecords(start, 1), nil); err != ErrPipelineFull {
+		t.Errorf("put should fail when the queue is full, got %v", err)
+	}
+	store.gate.Unlock()
+	for p.Queued() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	//flushed by time
+	if err := p.PutWait(2, testAttribute, testRecords(start, 3)); err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.Range(2, testAttribute, start, start.Add(time.Hour), false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 {
+		t.Errorf("records should be flushed after delay, got %d", len(got))
+	}
+}
+
+func TestPipelineBusyWorker(t *testing.T) {
+	store, clean := testPipelineStore(t)
+	defer clean()
+
+	p := NewPipeline(store)
+	p.BatchSize = 1
+	p.Workers = 1
+	p.Delay = 10 * time.Millisecond
+	p.Start()
+	defer p.Close()
+
+	//the worker is stuck and its channel is full, puts must not wait for it
+	store.gate.Lock()
+	start := time.Unix(10000, 0)
+	returned := make(chan error, 1)
+	go func() {
+		for i := 0; i < 4; i++ {
+			if err := p.Put(int64(i%2+1), testAttribute, testRecords(start.Add(time.Duration(i)*time.Hour), 1), nil); err != nil {
+				returned <- err
+				return
+			}
+		}
+		returned <- nil
+	}()
+	select {
+	case err := <-returned:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("put should not block on a busy worker")
+	}
+	store.gate.Unlock()
+
+	//streams not scheduled by put are picked up by the ticker
+	deadline := time.Now().Add(5 * time.Second)
+	for p.Queued() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d records are never written", p.Queued())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,254 @@
+package data
+
+import (
+	"time"
+	"github.com/heartsg/dasea/common"
+	"github.com/heartsg/dasea/storage/meta"
+)
+
+//Protobuf data from devices are encoded as,
+//
+//  message Data {
+//      message Record {
+//          <type 1> <name 1> = 1;
+//          <type 2> <name 2> = 2;
+//          ...
+//      }
+//      repeated Record record = 1;
+//  }
+//
+// where types and names are defined by DataStreamAttribute.
+//We cannot use Unmarshal from protobuf.proto because we do not know the structure
+// in static form, we only know the structure in memory, so we rely on dasea/common/protobuf.go
+// to decode raw data.
+
+//Decode a batch of records, records are stamped with t unless the time is
+// given by a TimestampDataPoint (see newRecord)
+func DecodeProtobufRecords(a *meta.DataStreamAttribute, buf []byte, t time.Time) ([]*Record, error) {
+	records := make([]*Record, 0)
+	dataBuffer := common.NewProtoBuffer(buf)
+	for !dataBuffer.DecodeComplete() {
+		err := dataBuffer.DecodeCheckKey(common.WireLengthDelimited, 1)
+		if err != nil {
+			return nil, err
+		}
+		raw, err := dataBuffer.DecodeRawBytes(false)
+		if err != nil {
+			return nil, err
+		}
+		values, err := DecodeProtobufRecord(a, raw)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, newRecord(a, values, t))
+	}
+	return records, nil
+}
+
+//Decode one record into normalised values (see TypeName2ZeroValue).
+//Tags will normally be in sequence, but if the value is 0 or nil
+// it will be omitted by the encoder, so omitted tags are filled
+// with default values. Records of devices using an older version of the
+// DataStreamAttribute are accepted as well (see meta.DataStreamAttribute.Evolve).
+func DecodeProtobufRecord(a *meta.DataStreamAttribute, buf []byte) ([]interface{}, error) {
+	values := make([]interface{}, a.NumDataPoints)
+	recordBuffer := common.NewProtoBuffer(buf)
+	for !recordBuffer.DecodeComplete() {
+		wire, tag, err := recordBuffer.DecodeKey()
+		if err != nil {
+			return nil, err
+		}
+		//check whether tag is valid
+		if tag == 0 || tag > uint64(a.NumDataPoints) {
+			return nil, ErrInvalidData
+		}
+		//check whether wire is valid, devices which are not upgraded yet
+		// may still send a type the data point is widened from. Types of
+		// the same wire but another encoding (e.g. int16 widened to sint64
+		// before widening checked encodings) cannot be told apart, reject
+		// rather than guess.
+		t := ""
+		for _, candidate := range a.DataPointTypesOf(int(tag - 1)) {
+			wireCheck, err := TypeName2ProtobufWireType(candidate)
+			if err != nil {
+				return nil, err
+			}
+			if wireCheck != wire {
+				continue
+			}
+			if t == "" {
+				t = candidate
+			} else if !meta.SameEncoding(t, candidate) {
+				return nil, ErrInvalidData
+			}
+		}
+		if t == "" {
+			return nil, ErrInvalidData
+		}
+		v, err := decodeProtobufValue(recordBuffer, t)
+		if err != nil {
+			return nil, err
+		}
+		if err = TypeNameCheckRange(t, v); err != nil {
+			return nil, err
+		}
+		//values of retired data points are dropped
+		if !a.IsRetired(int(tag - 1)) {
+			values[tag-1] = v
+		}
+	}
+	for i, v := range values {
+		if v != nil {
+			continue
+		}
+		dv, err := TypeName2ZeroValue(a.DataPointTypes[i])
+		if err != nil {
+			return nil, err
+		}
+		values[i] = dv
+	}
+	return values, nil
+}
+
+//Encode normalised values as one record, it is the reverse of
+// DecodeProtobufRecord
+func EncodeProtobufRecord(a *meta.DataStreamAttribute, values []interface{}) ([]byte, error) {
+	if len(values) != int(a.NumDataPoints) {
+		return nil, ErrInvalidData
+	}
+	recordBuffer := common.NewProtoBuffer(nil)
+	for i, v := range values {
+		t := a.DataPointTypes[i]
+		wire, err := TypeName2ProtobufWireType(t)
+		if err != nil {
+			return nil, err
+		}
+		if err = TypeNameCheckRange(t, v); err != nil {
+			return nil, err
+		}
+		recordBuffer.EncodeKey(wire, uint64(i+1))
+		if err = encodeProtobufValue(recordBuffer, t, v); err != nil {
+			return nil, err
+		}
+	}
+	return recordBuffer.Bytes(), nil
+}
+
+func decodeProtobufValue(b *common.ProtoBuffer, t string) (interface{}, error) {
+	switch t {
+	case "bool":
+		v, err := b.DecodeVarint()
+		if err != nil {
+			return nil, err
+		}
+		return v != 0, nil
+	case "uint", "uint8", "uint16", "uint32", "uint64":
+		v, err := b.DecodeVarint()
+		if err != nil {
+			return nil, err
+		}
+		return v, nil
+	case "int", "int8", "int16", "int32", "int64":
+		v, err := b.DecodeVarint()
+		if err != nil {
+			return nil, err
+		}
+		return int64(v), nil
+	case "sint", "sint8", "sint16", "sint32":
+		v, err := b.DecodeZigzag32()
+		if err != nil {
+			return nil, err
+		}
+		return int64(int32(v)), nil
+	case "sint64":
+		v, err := b.DecodeZigzag64()
+		if err != nil {
+			return nil, err
+		}
+		return int64(v), nil
+	case "fixed64":
+		v, err := b.DecodeFixed64()
+		if err != nil {
+			return nil, err
+		}
+		return v, nil
+	case "sfixed64":
+		v, err := b.DecodeFixed64()
+		if err != nil {
+			return nil, err
+		}
+		return int64(v), nil
+	case "double", "float64":
+		v, err := b.DecodeFloat64()
+		if err != nil {
+			return nil, err
+		}
+		return v, nil
+	case "fixed32":
+		v, err := b.DecodeFixed32()
+		if err != nil {
+			return nil, err
+		}
+		return v, nil
+	case "sfixed32":
+		v, err := b.DecodeFixed32()
+		if err != nil {
+			return nil, err
+		}
+		return int64(int32(v)), nil
+	case "float", "float32":
+		v, err := b.DecodeFloat32()
+		if err != nil {
+			return nil, err
+		}
+		return float64(v), nil
+	case "timestamp", "datetime":
+		v, err := b.DecodeTimestamp()
+		if err != nil {
+			return nil, err
+		}
+		return v.UTC(), nil
+	case "string":
+		v, err := b.DecodeStringBytes()
+		if err != nil {
+			return nil, err
+		}
+		return v, nil
+	}
+	return nil, ErrInvalidType
+}
+
+func encodeProtobufValue(b *common.ProtoBuffer, t string, v interface{}) error {
+	switch t {
+	case "bool":
+		if v.(bool) {
+			return b.EncodeVarint(1)
+		}
+		return b.EncodeVarint(0)
+	case "uint", "uint8", "uint16", "uint32", "uint64":
+		return b.EncodeVarint(v.(uint64))
+	case "int", "int8", "int16", "int32", "int64":
+		return b.EncodeVarint(uint64(v.(int64)))
+	case "sint", "sint8", "sint16", "sint32":
+		return b.EncodeZigzag32(uint64(v.(int64)))
+	case "sint64":
+		return b.EncodeZigzag64(uint64(v.(int64)))
+	case "fixed64":
+		return b.EncodeFixed64(v.(uint64))
+	case "sfixed64":
+		return b.EncodeFixed64(uint64(v.(int64)))
+	case "double", "float64":
+		return b.EncodeFloat64(v.(float64))
+	case "fixed32":
+		return b.EncodeFixed32(v.(uint64))
+	case "sfixed32":
+		return b.EncodeFixed32(uint64(uint32(int32(v.(int64)))))
+	case "float", "float32":
+		return b.EncodeFloat32(float32(v.(float64)))
+	case "timestamp", "datetime":
+		return b.EncodeTimestamp(v.(time.Time))
+	case "string":
+		return b.EncodeStringBytes(v.(string))
+	}
+	return ErrInvalidType
+}
@@ -0,0 +1,223 @@
+package data
+
+import (
+	"encoding/base64"
+	"fmt"
+	"time"
+	"github.com/heartsg/dasea/storage/meta"
+)
+
+const (
+	// Limit used when Query.Limit is not given
+	DefaultQueryLimit = 1000
+	// Larger limits are reduced to MaxQueryLimit, use the cursor to get the rest
+	MaxQueryLimit = 10000
+)
+
+// Query for data points of a DataStream within [Start, End).
+//
+// Large ranges are read page by page, each Result carries a NextCursor which
+// is passed as Cursor of the next Query (with the same Start, End and
+// Descending) until NextCursor is empty.
+type Query struct {
+	Start time.Time
+	End time.Time
+	// DataPointNames to return, in the given order. Empty means all but
+	// retired data points.
+	Columns []string
+	// Latest records first
+	Descending bool
+	// Maximum number of records to return, see DefaultQueryLimit and MaxQueryLimit
+	Limit int
+	// NextCursor of the previous page
+	Cursor string
+	// Unit (meta.U*) to convert each of Columns to (all data points if Columns
+	// is empty), 0 keeps the unit. Only numeric data points can be converted,
+	// currencies (meta.Currency*) with the exchange rates at the record time.
+	Units []int64
+	// Unit system (meta.UnitSystem*) for columns without a unit in Units
+	UnitSystem string
+}
+
+// Result of a Query, Values of Records are normalised (see TypeName2ZeroValue)
+// and ordered as Columns.
+type Result struct {
+	Columns []string
+	Types []string
+	// Units of Columns after conversion
+	Units []int64
+	Records []*Record
+	// Empty if there are no more records
+	NextCursor string
+}
+
+// Position of a cursor: the time of the last returned record and how
+// many records of exactly that time have been returned, since records
+// of the same time cannot be told apart by time alone. Cursors come from
+// clients, skip is at most MaxQueryLimit so that a page never reads more
+// than 2*MaxQueryLimit+1 records; paging fails with ErrInvalidQuery if
+// more records than that share a time.
+type queryCursor struct {
+	time int64
+	skip int
+	descending bool
+}
+
+func (c *queryCursor) encode() string {
+	direction := 0
+	if c.descending {
+		direction = 1
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%d:%d", c.time, c.skip, direction)))
+}
+
+func decodeQueryCursor(s string) (*queryCursor, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	c := &queryCursor{}
+	direction := 0
+	n, err := fmt.Sscanf(string(buf), "%d:%d:%d", &c.time, &c.skip, &direction)
+	if err != nil || n != 3 || c.skip <= 0 || c.skip > MaxQueryLimit || direction < 0 || direction > 1 {
+		return nil, ErrInvalidCursor
+	}
+	c.descending = direction == 1
+	return c, nil
+}
+
+// Map Columns to indexes of DataPointNames
+func (q *Query) columns(a *meta.DataStreamAttribute) ([]int, error) {
+	if len(q.Columns) == 0 {
+		indexes := make([]int, 0, a.NumDataPoints)
+		for i := 0; i < int(a.NumDataPoints); i++ {
+			if !a.IsRetired(i) {
+				indexes = append(indexes, i)
+			}
+		}
+		return indexes, nil
+	}
+	indexes := make([]int, len(q.Columns))
+	for i, column := range q.Columns {
+		found := false
+		for j, name := range a.DataPointNames {
+			if name == column {
+				indexes[i] = j
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, ErrInvalidQuery
+		}
+	}
+	return indexes, nil
+}
+
+// Run the query against a DataStore, normally called through GetDataPointsByTime
+func (q *Query) Run(store DataStore, dataStreamId int64, a *meta.DataStreamAttribute) (*Result, error) {
+	if !q.Start.Before(q.End) {
+		return nil, ErrInvalidQuery
+	}
+	indexes, err := q.columns(a)
+	if err != nil {
+		return nil, err
+	}
+	conversions, currencies, units, err := columnConversions(a, indexes, q.Units, q.UnitSystem)
+	if err != nil {
+		return nil, err
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = DefaultQueryLimit
+	}
+	if limit > MaxQueryLimit {
+		limit = MaxQueryLimit
+	}
+
+	start, end := q.Start, q.End
+	var cursor *queryCursor
+	if q.Cursor != "" {
+		cursor, err = decodeQueryCursor(q.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		if cursor.descending != q.Descending {
+			return nil, ErrInvalidCursor
+		}
+		t := time.Unix(0, cursor.time)
+		if q.Descending {
+			end = t.Add(time.Nanosecond)
+		} else {
+			start = t
+		}
+		if !start.Before(end) || start.Before(q.Start) || end.After(q.End) {
+			return nil, ErrInvalidCursor
+		}
+	}
+
+	//one more record to tell whether there is a next page
+	skip := 0
+	if cursor != nil {
+		skip = cursor.skip
+	}
+	records, err := store.Range(dataStreamId, a, start, end, q.Descending, skip+limit+1)
+	if err != nil {
+		return nil, err
+	}
+	if cursor != nil {
+		n := 0
+		for n < skip && n < len(records) && records[n].Time.UnixNano() == cursor.time {
+			n++
+		}
+		records = records[n:]
+	}
+
+	result := &Result{
+		Columns: make([]string, len(indexes)),
+		Types: make([]string, len(indexes)),
+		Units: units,
+	}
+	for i, index := range indexes {
+		result.Columns[i] = a.DataPointNames[index]
+		result.Types[i] = a.DataPointTypes[index]
+		if conversions[i] != nil || currencies[i] != nil {
+			result.Types[i] = "float64"
+		}
+	}
+	if len(records) > limit {
+		records = records[:limit]
+		last := records[limit-1].Time.UnixNano()
+		next := &queryCursor{time: last, descending: q.Descending}
+		for i := limit - 1; i >= 0 && records[i].Time.UnixNano() == last; i-- {
+			next.skip++
+		}
+		if cursor != nil && cursor.time == last {
+			next.skip += skip
+		}
+		if next.skip > MaxQueryLimit {
+			return nil, ErrInvalidQuery
+		}
+		result.NextCursor = next.encode()
+	}
+
+	result.Records = make([]*Record, len(records))
+	for i, r := range records {
+		values := make([]interface{}, len(indexes))
+		for j, index := range indexes {
+			values[j] = r.Values[index]
+			if conversions[j] != nil {
+				v, _ := numericValue(values[j])
+				values[j] = conversions[j].Convert(v)
+			}
+			if currencies[j] != nil {
+				v, _ := numericValue(values[j])
+				if values[j], err = currencies[j].Convert(v, r.Time); err != nil {
+					return nil, err
+				}
+			}
+		}
+		result.Records[i] = &Record{Time: r.Time, Values: values}
+	}
+	return result, nil
+}
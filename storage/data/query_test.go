@@ -0,0 +1,115 @@
+package data
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+	"time"
+)
+
+// page through all records with the given limit
+func testQueryPages(t *testing.T, store DataStore, q *Query) []*Record {
+	all := make([]*Record, 0)
+	for i := 0; i < 1000; i++ {
+		result, err := q.Run(store, 1, testAttribute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result.Records) > q.Limit {
+			t.Fatalf("page should have at most %d records, got %d", q.Limit, len(result.Records))
+		}
+		all = append(all, result.Records...)
+		if result.NextCursor == "" {
+			return all
+		}
+		q.Cursor = result.NextCursor
+	}
+	t.Fatalf("paging does not stop")
+	return nil
+}
+
+func TestQuery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dasea-query")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewEmbeddedStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.SegmentSize = 1024
+	if err = store.CreateStream(1, testAttribute); err != nil {
+		t.Fatal(err)
+	}
+
+	//appended out of order, and 5 records share each time
+	start := time.Unix(10000, 0)
+	for _, offset := range []int{50, 0, 100, 25} {
+		records := testRecords(start, 25)
+		for i, r := range records {
+			r.Time = start.Add(time.Duration((offset+i)/5*5) * time.Second)
+		}
+		if err = store.Append(1, testAttribute, records); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	q := &Query{Start: start, End: start.Add(time.Hour), Limit: 7}
+	all := testQueryPages(t, store, q)
+	if len(all) != 100 {
+		t.Fatalf("should get 100 records, got %d", len(all))
+	}
+	seen := make(map[[2]int64]bool)
+	for i, r := range all {
+		if i > 0 && r.Time.Before(all[i-1].Time) {
+			t.Fatalf("records should be ascending, %v before %v", all[i-1].Time, r.Time)
+		}
+		key := [2]int64{r.Time.Unix(), r.Values[1].(int64)}
+		if seen[key] {
+			t.Fatalf("record returned twice %v", key)
+		}
+		seen[key] = true
+	}
+
+	q = &Query{Start: start, End: start.Add(100 * time.Second), Limit: 3, Descending: true,
+		Columns: []string{"temperature", "radar"}}
+	all = testQueryPages(t, store, q)
+	if len(all) != 75 {
+		t.Fatalf("should get 75 records, got %d", len(all))
+	}
+	for i, r := range all {
+		if i > 0 && r.Time.After(all[i-1].Time) {
+			t.Fatalf("records should be descending, %v before %v", all[i-1].Time, r.Time)
+		}
+		if len(r.Values) != 2 {
+			t.Fatalf("only 2 columns should be returned, got %v", r.Values)
+		}
+		if _, ok := r.Values[0].(float64); !ok {
+			t.Fatalf("temperature should be the first column, got %v", r.Values)
+		}
+	}
+
+	q = &Query{Start: start, End: start.Add(time.Hour), Columns: []string{"humidity"}}
+	if _, err = q.Run(store, 1, testAttribute); err != ErrInvalidQuery {
+		t.Errorf("unknown column should be rejected, got %v", err)
+	}
+	q = &Query{Start: start, End: start.Add(time.Hour), Cursor: "abc"}
+	if _, err = q.Run(store, 1, testAttribute); err != ErrInvalidCursor {
+		t.Errorf("bad cursor should be rejected, got %v", err)
+	}
+	//forged cursors must not make the store read unbounded (or overflowing) limits
+	for _, skip := range []int{MaxQueryLimit + 1, math.MaxInt64} {
+		forged := &queryCursor{time: start.UnixNano(), skip: skip}
+		q = &Query{Start: start, End: start.Add(time.Hour), Cursor: forged.encode()}
+		if _, err = q.Run(store, 1, testAttribute); err != ErrInvalidCursor {
+			t.Errorf("cursor skipping %d records should be rejected, got %v", skip, err)
+		}
+	}
+	q = &Query{Start: start, End: start}
+	if _, err = q.Run(store, 1, testAttribute); err != ErrInvalidQuery {
+		t.Errorf("empty range should be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,112 @@
+package data
+
+import (
+	"log"
+	"math"
+	"sync"
+	"time"
+	"github.com/heartsg/dasea/storage/meta"
+)
+
+// Interval used by the storage service if not configured
+const DefaultSweepInterval = time.Hour
+
+//Delete data points older than keep (relative to now), keep 0 means forever
+func Expire(store DataStore, dataStreamId int64, a *meta.DataStreamAttribute, keep time.Duration, now time.Time) error {
+	if keep <= 0 {
+		return nil
+	}
+	return store.Delete(dataStreamId, a, time.Unix(0, math.MinInt64), now.Add(-keep))
+}
+
+// Sweeper applies meta.RetentionPolicy to all DataStreams periodically.
+type Sweeper struct {
+	Store DataStore
+	Interval time.Duration
+
+	stop chan struct{}
+	wg sync.WaitGroup
+}
+
+func NewSweeper(store DataStore, interval time.Duration) *Sweeper {
+	if interval <= 0 {
+		interval = DefaultSweepInterval
+	}
+	return &Sweeper{Store: store, Interval: interval}
+}
+
+// Sweep in background until Stop is called, the first sweep runs immediately
+func (s *Sweeper) Start() {
+	s.stop = make(chan struct{})
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(s.Interval)
+		defer ticker.Stop()
+		for {
+			if err := s.Sweep(time.Now()); err != nil {
+				log.Printf("Retention sweep failed: %v", err)
+			}
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (s *Sweeper) Stop() {
+	if s.stop == nil {
+		return
+	}
+	close(s.stop)
+	s.wg.Wait()
+	s.stop = nil
+}
+
+//Expire all DataStreams that have a retention policy once. A failed
+// DataStream does not stop the others, the last error is returned.
+func (s *Sweeper) Sweep(now time.Time) error {
+	policies, err := meta.GetAllRetentionPolicies()
+	if err != nil {
+		return err
+	}
+	//policies of DataStreams override policies of attributes
+	keeps := make(map[int64]time.Duration)
+	for _, p := range policies {
+		if p.DataStreamId != 0 {
+			keeps[p.DataStreamId] = p.Keep()
+		}
+	}
+	for _, p := range policies {
+		if p.DataStreamId != 0 {
+			continue
+		}
+		streams, err := meta.GetDataStreamsByAttributeId(p.DataStreamAttributeId)
+		if err != nil {
+			return err
+		}
+		for _, stream := range streams {
+			if _, ok := keeps[stream.Id]; !ok {
+				keeps[stream.Id] = p.Keep()
+			}
+		}
+	}
+
+	var last error
+	for dataStreamId, keep := range keeps {
+		if keep <= 0 {
+			continue
+		}
+		a, err := meta.GetDataStreamAttributeByDataStreamId(dataStreamId)
+		if err == nil {
+			err = Expire(s.Store, dataStreamId, a, keep, now)
+		}
+		if err != nil && err != meta.ErrNotFound && err != ErrStreamNotFound {
+			log.Printf("Retention of data stream %d failed: %v", dataStreamId, err)
+			last = err
+		}
+	}
+	return last
+}
@@ -0,0 +1,63 @@
+package data
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExpire(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dasea-retention")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewEmbeddedStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.SegmentSize = 1024
+	if err = store.CreateStream(1, testAttribute); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Unix(10000, 0)
+	records := testRecords(start, 200)
+	for i := 0; i < 200; i += 20 {
+		if err = store.Append(1, testAttribute, records[i:i+20]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before, _ := filepath.Glob(filepath.Join(dir, "1", "*"+embeddedSegmentExt))
+
+	//keep forever
+	now := start.Add(250 * time.Second)
+	if err = Expire(store, 1, testAttribute, 0, now); err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.Range(1, testAttribute, start, now, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 200 {
+		t.Fatalf("nothing should expire, got %d records", len(got))
+	}
+
+	//keep the last 100 seconds, records older than now - 100s expire
+	if err = Expire(store, 1, testAttribute, 100*time.Second, now); err != nil {
+		t.Fatal(err)
+	}
+	got, err = store.Range(1, testAttribute, time.Unix(0, 0), now, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 50 || !got[0].Time.Equal(start.Add(150*time.Second)) {
+		t.Fatalf("should keep the last 50 records, got %d", len(got))
+	}
+	after, _ := filepath.Glob(filepath.Join(dir, "1", "*"+embeddedSegmentExt))
+	if len(after) >= len(before) {
+		t.Errorf("expired segments should be removed, %d segments before, %d after", len(before), len(after))
+	}
+}
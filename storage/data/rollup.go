@@ -0,0 +1,506 @@
+package data
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+	"github.com/heartsg/dasea/storage/meta"
+)
+
+// Statistics saved for each numeric data point of the source DataStream, all
+// aggregate functions can be derived from them (m2 is the sum of squared
+// differences from the mean, see aggregateState).
+var RollupStatistics = []string{"count", "sum", "min", "max", "first", "last", "m2"}
+
+// Interval used by the storage service to flush rollups if not configured
+const DefaultRollupFlushInterval = time.Minute
+
+// The DataStreamAttribute of rollups of a, for each numeric data point <name>
+// of a there are data points <name>_count, <name>_sum, ... (see RollupStatistics).
+// Id is the id of the saved attribute, 0 if not saved yet.
+func RollupAttribute(a *meta.DataStreamAttribute, id int64) *meta.DataStreamAttribute {
+	ra := &meta.DataStreamAttribute{
+		Id: id,
+		Description: fmt.Sprintf("rollup of %s", a.Description),
+		DataPointNames: make([]string, 0),
+		DataPointTypes: make([]string, 0),
+		DataPointUnits: make([]int64, 0),
+		ProjectId: a.ProjectId,
+		DomainId: a.DomainId,
+	}
+	for _, index := range rollupColumns(a) {
+		for _, statistic := range RollupStatistics {
+			ra.DataPointNames = append(ra.DataPointNames, a.DataPointNames[index]+"_"+statistic)
+			switch statistic {
+			case "count":
+				ra.DataPointTypes = append(ra.DataPointTypes, "int64")
+				ra.DataPointUnits = append(ra.DataPointUnits, meta.UUnit)
+			case "m2":
+				ra.DataPointTypes = append(ra.DataPointTypes, "float64")
+				ra.DataPointUnits = append(ra.DataPointUnits, meta.UUnit)
+			default:
+				ra.DataPointTypes = append(ra.DataPointTypes, "float64")
+				ra.DataPointUnits = append(ra.DataPointUnits, a.DataPointUnits[index])
+			}
+		}
+	}
+	ra.NumDataPoints = int16(len(ra.DataPointNames))
+	return ra
+}
+
+// indexes of numeric data points, retired ones are kept so that columns of
+// the rollup never move
+func rollupColumns(a *meta.DataStreamAttribute) []int {
+	return numericColumns(a)
+}
+
+func rollupRecord(start time.Time, states []*aggregateState) *Record {
+	values := make([]interface{}, 0, len(states)*len(RollupStatistics))
+	for _, s := range states {
+		values = append(values, s.count, s.sum, s.min, s.max, s.first, s.last, s.m2)
+	}
+	return &Record{Time: start, Values: values}
+}
+
+func rollupState(values []interface{}) *aggregateState {
+	s := &aggregateState{
+		count: values[0].(int64),
+		sum: values[1].(float64),
+		min: values[2].(float64),
+		max: values[3].(float64),
+		first: values[4].(float64),
+		last: values[5].(float64),
+		m2: values[6].(float64),
+	}
+	if s.count > 0 {
+		s.mean = s.sum / float64(s.count)
+	}
+	return s
+}
+
+func floorTime(t time.Time, d time.Duration) time.Time {
+	return time.Unix(0, floorDiv(t.UnixNano(), int64(d))*int64(d)).UTC()
+}
+
+func ceilTime(t time.Time, d time.Duration) time.Time {
+	floor := floorTime(t, d)
+	if floor.Before(t) {
+		return floor.Add(d)
+	}
+	return floor
+}
+
+// Whether buckets of g are made of whole buckets of rollup r, i.e. the
+// interval of g is a multiple of the rollup interval and the time zone
+// offset does not split rollup buckets.
+func RollupUsable(r *meta.Rollup, g *Aggregate) bool {
+	d := r.Interval()
+	if d <= 0 {
+		return false
+	}
+	switch {
+	case g.Interval.Duration > 0:
+		if g.Interval.Duration%d != 0 {
+			return false
+		}
+	case g.Interval.Days > 0, g.Interval.Months > 0:
+		if (24*time.Hour)%d != 0 {
+			return false
+		}
+	default:
+		return false
+	}
+	loc := g.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	for _, t := range []time.Time{g.Start, g.End} {
+		_, offset := t.In(loc).Zone()
+		if (time.Duration(offset)*time.Second)%d != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// The part of [start, end) that is covered by materialised buckets of r
+func rollupRange(r *meta.Rollup, start time.Time, end time.Time) (time.Time, time.Time) {
+	d := r.Interval()
+	rollupStart, rollupEnd := ceilTime(start, d), floorTime(end, d)
+	watermark := time.Unix(0, r.Watermark).UTC()
+	if watermark.Before(rollupEnd) {
+		rollupEnd = watermark
+	}
+	if !rollupStart.Before(rollupEnd) {
+		//nothing covered, all raw
+		return start, start
+	}
+	return rollupStart, rollupEnd
+}
+
+// feed rollup buckets of r within [start, end) to the aggregator, indexes
+// are data points of the source attribute a
+func (ag *aggregator) rollup(store DataStore, r *meta.Rollup, a *meta.DataStreamAttribute, indexes []int,
+	start time.Time, end time.Time) error {
+	ra := RollupAttribute(a, r.TargetDataStreamAttributeId)
+	positions := make(map[int]int)
+	for i, index := range rollupColumns(a) {
+		positions[index] = i * len(RollupStatistics)
+	}
+	q := &Query{Start: start, End: end, Limit: MaxQueryLimit}
+	for {
+		page, err := q.Run(store, r.TargetDataStreamId, ra)
+		if err != nil {
+			return err
+		}
+		for _, record := range page.Records {
+			states := ag.at(record.Time)
+			for i, index := range indexes {
+				p := positions[index]
+				states[i].merge(rollupState(record.Values[p : p+len(RollupStatistics)]))
+			}
+		}
+		if page.NextCursor == "" {
+			return nil
+		}
+		q.Cursor = page.NextCursor
+	}
+}
+
+// Recompute buckets of rollup r within [start, end) (aligned to the rollup
+// interval) from raw data points of the source DataStream (attribute a).
+func RebuildRollup(store DataStore, r *meta.Rollup, a *meta.DataStreamAttribute, start time.Time, end time.Time) error {
+	d := r.Interval()
+	start, end = floorTime(start, d), ceilTime(end, d)
+	if !start.Before(end) {
+		return nil
+	}
+	ra := RollupAttribute(a, r.TargetDataStreamAttributeId)
+	indexes := rollupColumns(a)
+	records := make([]*Record, 0)
+	ag := &aggregator{
+		interval: Interval{Duration: d},
+		loc: time.UTC,
+		columns: len(indexes),
+		emit: func(start time.Time, states []*aggregateState) {
+			records = append(records, rollupRecord(start, states))
+		},
+	}
+	if err := ag.raw(store, r.DataStreamId, a, indexes, start, end); err != nil {
+		return err
+	}
+	ag.flush()
+
+	if err := store.Delete(r.TargetDataStreamId, ra, start, end); err != nil {
+		return err
+	}
+	return store.Append(r.TargetDataStreamId, ra, records)
+}
+
+// Roller maintains rollups incrementally: Touch marks the buckets that new data
+// points fall in, and Flush rebuilds marked buckets once they are closed (the
+// bucket end has passed). Marks are kept in memory only, buckets after the
+// watermark are rebuilt by Load after a restart, late data points (before the
+// watermark) that are not flushed before a crash are only in raw data.
+type Roller struct {
+	Store DataStore
+	Interval time.Duration
+
+	mutex sync.Mutex
+	rollups map[int64][]*meta.Rollup //by source DataStream
+	dirty map[int64]*rollupDirty //by rollup id
+
+	stop chan struct{}
+	wg sync.WaitGroup
+}
+
+type rollupDirty struct {
+	start time.Time
+	end time.Time
+}
+
+// Similar to Store, initialized in main, nil means rollups are not maintained
+var Rollups *Roller
+
+func NewRoller(store DataStore, interval time.Duration) *Roller {
+	if interval <= 0 {
+		interval = DefaultRollupFlushInterval
+	}
+	return &Roller{
+		Store: store,
+		Interval: interval,
+		rollups: make(map[int64][]*meta.Rollup),
+		dirty: make(map[int64]*rollupDirty),
+	}
+}
+
+// Load all rollups from meta and mark buckets after their watermarks
+func (r *Roller) Load(now time.Time) error {
+	rollups, err := meta.GetAllRollups()
+	if err != nil {
+		return err
+	}
+	for _, rollup := range rollups {
+		r.Add(rollup, now)
+	}
+	return nil
+}
+
+// Maintain rollup, buckets between its watermark and now are marked
+func (r *Roller) Add(rollup *meta.Rollup, now time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.rollups[rollup.DataStreamId] = append(r.rollups[rollup.DataStreamId], rollup)
+	watermark := time.Unix(0, rollup.Watermark).UTC()
+	if watermark.Before(now) {
+		r.mark(rollup, watermark, now)
+	}
+}
+
+func (r *Roller) Remove(id int64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for dataStreamId, rollups := range r.rollups {
+		for i, rollup := range rollups {
+			if rollup.Id == id {
+				r.rollups[dataStreamId] = append(rollups[:i], rollups[i+1:]...)
+				break
+			}
+		}
+	}
+	delete(r.dirty, id)
+}
+
+// mutex must be held
+func (r *Roller) mark(rollup *meta.Rollup, start time.Time, end time.Time) {
+	dirty, ok := r.dirty[rollup.Id]
+	if !ok {
+		r.dirty[rollup.Id] = &rollupDirty{start: start, end: end}
+		return
+	}
+	if start.Before(dirty.start) {
+		dirty.start = start
+	}
+	if end.After(dirty.end) {
+		dirty.end = end
+	}
+}
+
+// Mark buckets of records appended to a DataStream
+func (r *Roller) Touch(dataStreamId int64, records []*Record) {
+	if len(records) == 0 {
+		return
+	}
+	start, end := records[0].Time, records[0].Time
+	for _, record := range records {
+		if record.Time.Before(start) {
+			start = record.Time
+		}
+		if record.Time.After(end) {
+			end = record.Time
+		}
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, rollup := range r.rollups[dataStreamId] {
+		r.mark(rollup, start, end.Add(time.Nanosecond))
+	}
+}
+
+// Rebuild marked buckets that are closed before now and move watermarks
+func (r *Roller) Flush(now time.Time) error {
+	type job struct {
+		rollup *meta.Rollup
+		start time.Time
+		end time.Time
+		closed time.Time
+	}
+	jobs := make([]*job, 0)
+	r.mutex.Lock()
+	for _, rollups := range r.rollups {
+		for _, rollup := range rollups {
+			closed := floorTime(now, rollup.Interval())
+			j := &job{rollup: rollup, start: closed, end: closed, closed: closed}
+			if dirty, ok := r.dirty[rollup.Id]; ok && dirty.start.Before(closed) {
+				j.start = dirty.start
+				j.end = ceilTime(dirty.end, rollup.Interval())
+				if j.end.After(closed) {
+					j.end = closed
+					dirty.start = closed
+				} else {
+					delete(r.dirty, rollup.Id)
+				}
+			}
+			jobs = append(jobs, j)
+		}
+	}
+	r.mutex.Unlock()
+
+	var last error
+	for _, j := range jobs {
+		var err error
+		if j.start.Before(j.end) {
+			var a *meta.DataStreamAttribute
+			a, err = meta.GetDataStreamAttributeByDataStreamId(j.rollup.DataStreamId)
+			if err == nil {
+				err = RebuildRollup(r.Store, j.rollup, a, j.start, j.end)
+			}
+		}
+		if err != nil {
+			log.Printf("Rollup %d failed: %v", j.rollup.Id, err)
+			r.mutex.Lock()
+			r.mark(j.rollup, j.start, j.end)
+			r.mutex.Unlock()
+			last = err
+			continue
+		}
+		//nothing before the closed end is marked any more
+		watermark := j.closed.UnixNano()
+		if watermark > j.rollup.Watermark {
+			if err = meta.UpdateRollupWatermark(j.rollup.Id, watermark); err != nil {
+				last = err
+				continue
+			}
+			j.rollup.Watermark = watermark
+		}
+	}
+	return last
+}
+
+// Flush in background until Stop is called
+func (r *Roller) Start() {
+	r.stop = make(chan struct{})
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		ticker := time.NewTicker(r.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-ticker.C:
+				if err := r.Flush(time.Now()); err != nil {
+					log.Printf("Rollup flush failed: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// Stop flushing, buckets that are closed are flushed before return
+func (r *Roller) Stop() error {
+	if r.stop == nil {
+		return nil
+	}
+	close(r.stop)
+	r.wg.Wait()
+	r.stop = nil
+	return r.Flush(time.Now())
+}
+
+// Create a rollup of a DataStream with buckets of interval (whole seconds),
+// the rollup DataStream keeps data points for keep (0 means forever).
+func CreateRollup(dataStreamId int64, interval time.Duration, keep time.Duration) (*meta.Rollup, error) {
+	if Store == nil {
+		return nil, ErrStoreNotInitialized
+	}
+	if interval < time.Second || interval%time.Second != 0 {
+		return nil, ErrInvalidInterval
+	}
+	s, err := meta.GetDataStream(dataStreamId)
+	if err != nil {
+		return nil, err
+	}
+	a, err := meta.GetDataStreamAttribute(s.DataStreamAttributeId)
+	if err != nil {
+		return nil, err
+	}
+	if len(rollupColumns(a)) == 0 {
+		return nil, ErrNotNumeric
+	}
+	ra := RollupAttribute(a, 0)
+	ra, err = meta.CreateDataStreamAttribute(ra.ProjectId, ra.DomainId,
+		fmt.Sprintf("rollup %v of data stream %d", interval, dataStreamId),
+		ra.NumDataPoints, ra.DataPointNames, ra.DataPointTypes, ra.DataPointUnits)
+	if err != nil {
+		return nil, err
+	}
+	target, err := meta.CreateDataStream(s.DeviceId, ra.Id)
+	if err != nil {
+		return nil, err
+	}
+	if err = Store.CreateStream(target.Id, ra); err != nil {
+		return nil, err
+	}
+	if keep > 0 {
+		if _, err = meta.SetDataStreamRetentionPolicy(target.Id, keep); err != nil {
+			return nil, err
+		}
+	}
+
+	//existing data points are rolled up from the first one
+	now := time.Now()
+	watermark := floorTime(now, interval)
+	first, err := Store.Range(dataStreamId, a, time.Unix(0, math.MinInt64), now, false, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(first) > 0 {
+		watermark = floorTime(first[0].Time, interval)
+	}
+	rollup := &meta.Rollup{
+		DataStreamId: dataStreamId,
+		TargetDataStreamId: target.Id,
+		TargetDataStreamAttributeId: ra.Id,
+		IntervalSeconds: int64(interval / time.Second),
+		Watermark: watermark.UnixNano(),
+		ProjectId: a.ProjectId,
+		DomainId: a.DomainId,
+	}
+	if err = meta.InsertRollup(rollup); err != nil {
+		return nil, err
+	}
+	if Rollups != nil {
+		Rollups.Add(rollup, now)
+	}
+	return rollup, nil
+}
+
+// Delete a rollup and its DataStream
+func DeleteRollup(id int64) error {
+	if Store == nil {
+		return ErrStoreNotInitialized
+	}
+	rollup, err := meta.GetRollup(id)
+	if err != nil {
+		return err
+	}
+	if Rollups != nil {
+		Rollups.Remove(id)
+	}
+	ra, err := meta.GetDataStreamAttribute(rollup.TargetDataStreamAttributeId)
+	if err != nil {
+		return err
+	}
+	err = Store.DropStream(rollup.TargetDataStreamId, ra)
+	if err != nil && err != ErrStreamNotFound {
+		return err
+	}
+	p, err := meta.GetDataStreamRetentionPolicy(rollup.TargetDataStreamId)
+	if err == nil {
+		err = meta.DeleteRetentionPolicy(p.Id)
+	}
+	if err != nil && err != meta.ErrNotFound {
+		return err
+	}
+	if err = meta.DeleteDataStream(rollup.TargetDataStreamId); err != nil {
+		return err
+	}
+	if err = meta.DeleteDataStreamAttribute(ra.Id); err != nil {
+		return err
+	}
+	return meta.DeleteRollup(id)
+}
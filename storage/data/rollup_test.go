@@ -0,0 +1,104 @@
+package data
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+	"time"
+	"github.com/heartsg/dasea/storage/meta"
+)
+
+func TestRollup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dasea-rollup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewEmbeddedStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.CreateStream(1, testAttribute); err != nil {
+		t.Fatal(err)
+	}
+	ra := RollupAttribute(testAttribute, 2)
+	if ra.NumDataPoints != 3*int16(len(RollupStatistics)) || ra.DataPointNames[7] != "dummy_count" {
+		t.Fatalf("rollup attribute not match, got %v", ra.DataPointNames)
+	}
+	if err = store.CreateStream(2, ra); err != nil {
+		t.Fatal(err)
+	}
+
+	//one record per second for 30 minutes
+	start := time.Unix(6000, 0)
+	if err = store.Append(1, testAttribute, testRecords(start, 1800)); err != nil {
+		t.Fatal(err)
+	}
+	r := &meta.Rollup{Id: 1, DataStreamId: 1, TargetDataStreamId: 2, TargetDataStreamAttributeId: 2, IntervalSeconds: 60}
+	if err = RebuildRollup(store, r, testAttribute, start, start.Add(20*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	r.Watermark = start.Add(20 * time.Minute).UnixNano()
+	//rebuild again must not duplicate buckets
+	if err = RebuildRollup(store, r, testAttribute, start, start.Add(20*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	rolled, err := store.Range(2, ra, start, start.Add(time.Hour), false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rolled) != 20 {
+		t.Fatalf("should get 20 rollup buckets, got %d", len(rolled))
+	}
+
+	//not aligned to rollup buckets, so raw data points are read at both ends
+	g := &Aggregate{Start: start.Add(90 * time.Second), End: start.Add(29 * time.Minute), Interval: Interval{Duration: 5 * time.Minute}}
+	if !RollupUsable(r, g) {
+		t.Fatalf("rollup should be usable")
+	}
+	want, err := g.Run(store, 1, testAttribute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := g.RunWithRollup(store, 1, testAttribute, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Buckets) != len(want.Buckets) {
+		t.Fatalf("should get %d buckets, got %d", len(want.Buckets), len(got.Buckets))
+	}
+	for i := range want.Buckets {
+		for j := range want.Buckets[i].Values {
+			for k, f := range want.Functions {
+				w, v := want.Buckets[i].Values[j][k], got.Buckets[i].Values[j][k]
+				if math.Abs(w-v) > 1e-6*math.Max(1, math.Abs(w)) {
+					t.Errorf("bucket %d column %d %s should be %v, got %v", i, j, f, w, v)
+				}
+			}
+		}
+	}
+
+	//raw data points covered by the rollup are no longer needed
+	if err = store.Delete(1, testAttribute, start.Add(5*time.Minute), start.Add(10*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	got, err = g.RunWithRollup(store, 1, testAttribute, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Buckets[1].Values[0][4] != 300 {
+		t.Errorf("count should come from the rollup, got %v", got.Buckets[1].Values[0][4])
+	}
+
+	//rollup buckets are split by the time zone offset
+	g.Location = time.FixedZone("IST", 5*3600+1800)
+	g.Interval = Interval{Days: 1}
+	if RollupUsable(&meta.Rollup{IntervalSeconds: 3600}, g) {
+		t.Errorf("hourly rollup should not be usable for +05:30")
+	}
+	if !RollupUsable(r, g) {
+		t.Errorf("minute rollup should be usable for +05:30")
+	}
+}
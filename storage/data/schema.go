@@ -0,0 +1,108 @@
+package data
+
+import (
+	"github.com/heartsg/dasea/storage/meta"
+)
+
+//Data points are saved by position and positions never change when a
+// DataStreamAttribute evolves (see meta.DataStreamAttribute.Evolve), so
+// records saved with an older version are read with the new one: added data
+// points are read as zero values, renamed, retired and widened ones as they
+// are. Rollups follow the numeric data points of their source.
+
+// Apply changes to a DataStreamAttribute and alter the storage of all its
+// DataStreams and their rollups
+func EvolveDataStreamAttribute(id int64, changes []*meta.DataPointChange) (*meta.DataStreamAttribute, error) {
+	if Store == nil {
+		return nil, ErrStoreNotInitialized
+	}
+	_, a, err := meta.EvolveDataStreamAttribute(id, changes)
+	if err != nil {
+		return nil, err
+	}
+	streams, err := meta.GetDataStreamsByAttributeId(id)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range streams {
+		err = Store.AlterStream(s.Id, a)
+		if err != nil && err != ErrStreamNotFound {
+			return nil, err
+		}
+		rollups, err := meta.GetRollupsByDataStreamId(s.Id)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range rollups {
+			if err = evolveRollup(r, a); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return a, nil
+}
+
+// Bring the saved attribute of rollup r in line with RollupAttribute of the
+// evolved source attribute a
+func evolveRollup(r *meta.Rollup, a *meta.DataStreamAttribute) error {
+	saved, err := meta.GetDataStreamAttribute(r.TargetDataStreamAttributeId)
+	if err != nil {
+		return err
+	}
+	ra := RollupAttribute(a, saved.Id)
+	changes := rollupChanges(saved, ra)
+	if len(changes) == 0 {
+		return nil
+	}
+	if _, saved, err = meta.EvolveDataStreamAttribute(saved.Id, changes); err != nil {
+		return err
+	}
+	return Store.AlterStream(r.TargetDataStreamId, saved)
+}
+
+// Changes from the saved rollup attribute to ra, data points are renamed
+// after their source and added for added numeric data points
+func rollupChanges(saved *meta.DataStreamAttribute, ra *meta.DataStreamAttribute) []*meta.DataPointChange {
+	changes := make([]*meta.DataPointChange, 0)
+	for i, name := range ra.DataPointNames {
+		if i < int(saved.NumDataPoints) {
+			if saved.DataPointNames[i] != name {
+				changes = append(changes, &meta.DataPointChange{Op: meta.DataPointRename,
+					Name: saved.DataPointNames[i], NewName: name})
+			}
+			continue
+		}
+		changes = append(changes, &meta.DataPointChange{Op: meta.DataPointAdd, Name: name,
+			Type: ra.DataPointTypes[i], Unit: ra.DataPointUnits[i]})
+	}
+	return changes
+}
+
+// Records decoded or queued with an older version of a have fewer values,
+// the added data points are filled with zero values. records is not changed.
+func upgradeRecords(a *meta.DataStreamAttribute, records []*Record) []*Record {
+	n := int(a.NumDataPoints)
+	var upgraded []*Record
+	for i, r := range records {
+		if len(r.Values) >= n {
+			if upgraded != nil {
+				upgraded[i] = r
+			}
+			continue
+		}
+		if upgraded == nil {
+			upgraded = make([]*Record, len(records))
+			copy(upgraded, records[:i])
+		}
+		values := make([]interface{}, n)
+		copy(values, r.Values)
+		for j := len(r.Values); j < n; j++ {
+			values[j], _ = TypeName2ZeroValue(a.DataPointTypes[j])
+		}
+		upgraded[i] = &Record{Time: r.Time, Values: values}
+	}
+	if upgraded == nil {
+		return records
+	}
+	return upgraded
+}
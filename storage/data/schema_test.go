@@ -0,0 +1,221 @@
+package data
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+	"github.com/heartsg/dasea/common"
+	"github.com/heartsg/dasea/storage/meta"
+)
+
+var testSchemaAttribute = &meta.DataStreamAttribute{
+	Id: 1,
+	NumDataPoints: 3,
+	DataPointNames: []string{"level", "temp", "time"},
+	DataPointTypes: []string{"int16", "float32", "timestamp"},
+	DataPointUnits: []int64{meta.UUnit, meta.UDegreeCelsius, meta.UUnit},
+	Version: 1,
+}
+
+func testSchemaRecords(start time.Time, n int) []*Record {
+	records := make([]*Record, n)
+	for i := 0; i < n; i++ {
+		records[i] = &Record{
+			Time: start.Add(time.Duration(i) * time.Second),
+			Values: []interface{}{int64(i), float64(i) + 0.5, start},
+		}
+	}
+	return records
+}
+
+func TestEvolveStream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dasea-schema")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewEmbeddedStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1 := testSchemaAttribute
+	if err = store.CreateStream(1, v1); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Unix(10000, 0)
+	if err = store.Append(1, v1, testSchemaRecords(start, 10)); err != nil {
+		t.Fatal(err)
+	}
+
+	v2, err := v1.Evolve([]*meta.DataPointChange{
+		{Op: meta.DataPointRename, Name: "temp", NewName: "temperature"},
+		{Op: meta.DataPointWiden, Name: "temperature", Type: "float64"},
+		{Op: meta.DataPointRetire, Name: "level"},
+		{Op: meta.DataPointAdd, Name: "humidity", Type: "float32", Unit: meta.URelativeHumidity},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.AlterStream(1, v2); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.AlterStream(2, v2); err != ErrStreamNotFound {
+		t.Errorf("alter a non-existent stream should fail, got %v", err)
+	}
+
+	//records queued with v1 are upgraded on write
+	records := upgradeRecords(v2, testSchemaRecords(start.Add(10*time.Second), 5))
+	if len(records[0].Values) != 4 || records[0].Values[3].(float64) != 0 {
+		t.Fatalf("added data point should be zero, got %v", records[0].Values)
+	}
+	records = append(records, &Record{Time: start.Add(15 * time.Second),
+		Values: []interface{}{int64(0), 100.25, start, 55.5}})
+	if err = store.Append(1, v2, records); err != nil {
+		t.Fatal(err)
+	}
+
+	//store reopened, the attribute is read back
+	store.Close()
+	store, err = NewEmbeddedStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.Range(1, v2, start, start.Add(time.Hour), false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 16 {
+		t.Fatalf("should get 16 records, got %d", len(got))
+	}
+	if got[0].Values[0].(int64) != 0 || got[0].Values[1].(float64) != 0.5 || got[0].Values[3].(float64) != 0 {
+		t.Errorf("v1 records should be read with v2, got %v", got[0].Values)
+	}
+	if got[15].Values[1].(float64) != 100.25 || got[15].Values[3].(float64) != 55.5 {
+		t.Errorf("v2 record not match, got %v", got[15].Values)
+	}
+
+	//retired data points are not returned by default
+	q := &Query{Start: start, End: start.Add(time.Hour), Limit: 100}
+	result, err := q.Run(store, 1, v2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Columns) != 3 || result.Columns[0] != "temperature" || result.Columns[2] != "humidity" {
+		t.Errorf("retired data point should be skipped, got %v", result.Columns)
+	}
+	q = &Query{Start: start, End: start.Add(time.Hour), Limit: 100, Columns: []string{"level"}}
+	if result, err = q.Run(store, 1, v2); err != nil || result.Records[3].Values[0].(int64) != 3 {
+		t.Errorf("retired data point can still be read, got %v", err)
+	}
+}
+
+func TestDecodeEvolved(t *testing.T) {
+	v2, err := testSchemaAttribute.Evolve([]*meta.DataPointChange{
+		{Op: meta.DataPointRename, Name: "temp", NewName: "temperature"},
+		{Op: meta.DataPointWiden, Name: "temperature", Type: "float64"},
+		{Op: meta.DataPointRetire, Name: "level"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//a device not upgraded yet sends level and float32 temp
+	record := common.NewProtoBuffer(nil)
+	record.EncodeKey(common.WireVarint, 1)
+	record.EncodeVarint(7)
+	record.EncodeKey(common.WireFixed32, 2)
+	record.EncodeFloat32(20.5)
+	values, err := DecodeProtobufRecord(v2, record.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values[0].(int64) != 0 || values[1].(float64) != 20.5 {
+		t.Errorf("old protobuf should be accepted, got %v", values)
+	}
+	record = common.NewProtoBuffer(nil)
+	record.EncodeKey(common.WireFixed64, 2)
+	record.EncodeFloat64(20.25)
+	if values, err = DecodeProtobufRecord(v2, record.Bytes()); err != nil || values[1].(float64) != 20.25 {
+		t.Errorf("new protobuf should be accepted, got %v %v", values, err)
+	}
+
+	//an int16 widened to int64 is still a plain varint
+	v3, err := testSchemaAttribute.Evolve([]*meta.DataPointChange{
+		{Op: meta.DataPointWiden, Name: "level", Type: "int64"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	record = common.NewProtoBuffer(nil)
+	record.EncodeKey(common.WireVarint, 1)
+	level := int64(-7)
+	record.EncodeVarint(uint64(level))
+	if values, err = DecodeProtobufRecord(v3, record.Bytes()); err != nil || values[0].(int64) != -7 {
+		t.Errorf("old int16 should be decoded after widening, got %v %v", values, err)
+	}
+	if _, err = testSchemaAttribute.Evolve([]*meta.DataPointChange{
+		{Op: meta.DataPointWiden, Name: "level", Type: "sint64"},
+	}); err != meta.ErrInvalidDataPointChange {
+		t.Errorf("int16 should not be widened to a zigzag varint, got %v", err)
+	}
+	//attributes widened so before the check cannot decode the varint
+	widened := *testSchemaAttribute
+	widened.DataPointTypes = []string{"sint64", "float32", "timestamp"}
+	widened.DataPointPreviousTypes = [][]string{{"int16"}, nil, nil}
+	if _, err = DecodeProtobufRecord(&widened, record.Bytes()); err != ErrInvalidData {
+		t.Errorf("ambiguous varint should be rejected, got %v", err)
+	}
+
+	values, err = DecodeJsonRecord(v2, []byte(`{"level": 7, "temp": 20.5}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values[0].(int64) != 0 || values[1].(float64) != 20.5 {
+		t.Errorf("old json should be accepted, got %v", values)
+	}
+	_, err = DecodeJsonRecord(v2, []byte(`{"temp": 20.5, "temperature": 20.5}`))
+	if err == nil || !strings.HasSuffix(err.Error(), ": "+ErrInvalidData.Error()) {
+		t.Errorf("a data point given twice should be rejected, got %v", err)
+	}
+}
+
+func TestRollupChanges(t *testing.T) {
+	v2, err := testSchemaAttribute.Evolve([]*meta.DataPointChange{
+		{Op: meta.DataPointRename, Name: "temp", NewName: "temperature"},
+		{Op: meta.DataPointAdd, Name: "humidity", Type: "float32", Unit: meta.URelativeHumidity},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := RollupAttribute(testSchemaAttribute, 2)
+	ra := RollupAttribute(v2, 2)
+	changes := rollupChanges(saved, ra)
+	n := len(RollupStatistics)
+	if len(changes) != 2*n {
+		t.Fatalf("should rename and add %d data points, got %d", n, len(changes))
+	}
+	for i, c := range changes {
+		if i < n && (c.Op != meta.DataPointRename || c.Name != "temp_"+RollupStatistics[i] ||
+			c.NewName != "temperature_"+RollupStatistics[i]) {
+			t.Errorf("change %d should rename, got %v", i, c)
+		}
+		if i >= n && (c.Op != meta.DataPointAdd || c.Name != "humidity_"+RollupStatistics[i-n]) {
+			t.Errorf("change %d should add, got %v", i, c)
+		}
+	}
+	evolved, err := saved.Evolve(changes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range ra.DataPointNames {
+		if evolved.DataPointNames[i] != name {
+			t.Errorf("data point %d should be %s, got %s", i, name, evolved.DataPointNames[i])
+		}
+	}
+	if len(rollupChanges(evolved, ra)) != 0 {
+		t.Errorf("nothing should change")
+	}
+}
@@ -0,0 +1,475 @@
+package data
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/heartsg/dasea/storage/meta"
+)
+
+// SQLStore saves data points in a relational database (mysql, sqlite3 or
+// postgres, see Dialect) via database/sql.
+//
+// Each DataStream has its own table,
+//   CREATE TABLE data_<stream id> (
+//       id <auto increment>,  //keeps records of the same time in order
+//       t BIGINT,             //record time, unix nano
+//       dp1 <sql type>,       //data points, in the order of DataPointNames
+//       ...
+//   )
+// with an index on t, which is unique if records of the same time are kept
+// once (meta.WriteModeFirst and WriteModeReject), so that concurrent
+// writers cannot save the same time twice.
+//
+// As in CassandraStore, data point columns are named by position, so that
+// renamed data points keep their columns and user defined names never need
+// quoting. Timestamp data points are saved in microseconds by mysql and
+// postgres.
+type SQLStore struct {
+	db *sql.DB
+	dialect Dialect
+}
+
+//Keep IN lists short
+const sqlMaxIn = 100
+
+//Open the database of dataSourceName with the driver of dialect. SQLite
+// databases must be files, each connection to ":memory:" is a new database.
+func NewSQLStore(dialect string, dataSourceName string) (*SQLStore, error) {
+	d, err := GetDialect(dialect)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open(string(d), dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	if d == SQLite {
+		//sqlite allows one writer at a time
+		db.SetMaxOpenConns(1)
+	}
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLStore{db: db, dialect: d}, nil
+}
+
+func (s *SQLStore) Dialect() Dialect {
+	return s.dialect
+}
+
+func (s *SQLStore) table(dataStreamId int64) string {
+	return s.dialect.Quote(fmt.Sprintf("data_%d", dataStreamId))
+}
+
+func (s *SQLStore) exists(dataStreamId int64) error {
+	var n int
+	err := s.db.QueryRow(s.dialect.TableExistsSQL(), fmt.Sprintf("data_%d", dataStreamId)).Scan(&n)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrStreamNotFound
+	}
+	return nil
+}
+
+func (s *SQLStore) CreateStream(dataStreamId int64, a *meta.DataStreamAttribute) error {
+	err := s.exists(dataStreamId)
+	if err == nil {
+		return ErrStreamExists
+	}
+	if err != ErrStreamNotFound {
+		return err
+	}
+	columns := []string{s.dialect.AutoIncrementColumn("id"), "t BIGINT NOT NULL"}
+	for i, t := range a.DataPointTypes {
+		column, err := s.dialect.Column(fmt.Sprintf("dp%d", i+1), t)
+		if err != nil {
+			return err
+		}
+		columns = append(columns, column)
+	}
+	table := fmt.Sprintf("data_%d", dataStreamId)
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	indexed, unique := []string{"t"}, []string(nil)
+	switch a.Mode() {
+	case meta.WriteModeFirst, meta.WriteModeReject:
+		indexed, unique = nil, indexed
+	}
+	//postgres and sqlite drop the table again if the index fails
+	for _, statement := range s.dialect.CreateTableSQL(table, columns, indexed, unique) {
+		if _, err = tx.Exec(statement); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLStore) DropStream(dataStreamId int64, a *meta.DataStreamAttribute) error {
+	if err := s.exists(dataStreamId); err != nil {
+		return err
+	}
+	_, err := s.db.Exec("DROP TABLE " + s.table(dataStreamId))
+	return err
+}
+
+// Add the columns of data points added to the attribute. Renamed and widened
+// data points keep their columns, see Dialect.
+func (s *SQLStore) AlterStream(dataStreamId int64, a *meta.DataStreamAttribute) error {
+	if err := s.exists(dataStreamId); err != nil {
+		return err
+	}
+	rows, err := s.db.Query(fmt.Sprintf("SELECT * FROM %s WHERE 1 = 0", s.table(dataStreamId)))
+	if err != nil {
+		return err
+	}
+	names, err := rows.Columns()
+	rows.Close()
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]bool, len(names))
+	for _, name := range names {
+		existing[name] = true
+	}
+	for i, t := range a.DataPointTypes {
+		name := fmt.Sprintf("dp%d", i+1)
+		if existing[name] {
+			continue
+		}
+		column, err := s.dialect.Column(name, t)
+		if err != nil {
+			return err
+		}
+		if _, err = s.db.Exec(s.dialect.AddColumnSQL(fmt.Sprintf("data_%d", dataStreamId), column)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sqlColumns(a *meta.DataStreamAttribute) []string {
+	columns := make([]string, a.NumDataPoints)
+	for i := range columns {
+		columns[i] = fmt.Sprintf("dp%d", i+1)
+	}
+	return columns
+}
+
+//Records are written in one transaction, so a failed batch writes nothing
+func (s *SQLStore) Append(dataStreamId int64, a *meta.DataStreamAttribute, records []*Record) error {
+	records, err := dedupeRecords(a, records)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	if err = s.exists(dataStreamId); err != nil {
+		return err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err = s.append(tx, dataStreamId, a, records); err != nil {
+		tx.Rollback()
+		if s.dialect.IsUniqueViolation(err) {
+			//saved by another writer since savedTimes
+			return ErrDuplicateRecord
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLStore) append(tx *sql.Tx, dataStreamId int64, a *meta.DataStreamAttribute, records []*Record) error {
+	switch a.Mode() {
+	case meta.WriteModeLast:
+		if err := s.deleteTimes(tx, dataStreamId, recordTimes(records)); err != nil {
+			return err
+		}
+	case meta.WriteModeFirst, meta.WriteModeReject:
+		saved, err := s.savedTimes(tx, dataStreamId, recordTimes(records))
+		if err != nil {
+			return err
+		}
+		if len(saved) > 0 && a.Mode() == meta.WriteModeReject {
+			return ErrDuplicateRecord
+		}
+		kept := make([]*Record, 0, len(records))
+		for _, r := range records {
+			if !saved[r.Time.UnixNano()] {
+				kept = append(kept, r)
+			}
+		}
+		records = kept
+	}
+
+	columns := append([]string{"t"}, sqlColumns(a)...)
+	stmt, err := tx.Prepare(fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", s.table(dataStreamId),
+		strings.Join(columns, ", "), s.dialect.Placeholders(1, len(columns))))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, r := range records {
+		args, err := s.args(a, r)
+		if err != nil {
+			return err
+		}
+		if _, err = stmt.Exec(args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//times in lists of at most sqlMaxIn, as arguments of IN
+func sqlTimeLists(times map[int64]bool) [][]interface{} {
+	lists := make([][]interface{}, 0, len(times)/sqlMaxIn+1)
+	list := make([]interface{}, 0, sqlMaxIn)
+	for t := range times {
+		list = append(list, t)
+		if len(list) == sqlMaxIn {
+			lists = append(lists, list)
+			list = make([]interface{}, 0, sqlMaxIn)
+		}
+	}
+	if len(list) > 0 {
+		lists = append(lists, list)
+	}
+	return lists
+}
+
+//Which of times have saved records
+func (s *SQLStore) savedTimes(tx *sql.Tx, dataStreamId int64, times map[int64]bool) (map[int64]bool, error) {
+	saved := make(map[int64]bool)
+	for _, list := range sqlTimeLists(times) {
+		rows, err := tx.Query(fmt.Sprintf("SELECT t FROM %s WHERE t IN (%s)", s.table(dataStreamId),
+			s.dialect.Placeholders(1, len(list))), list...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var t int64
+			if err = rows.Scan(&t); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			saved[t] = true
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return saved, nil
+}
+
+func (s *SQLStore) deleteTimes(tx *sql.Tx, dataStreamId int64, times map[int64]bool) error {
+	for _, list := range sqlTimeLists(times) {
+		_, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE t IN (%s)", s.table(dataStreamId),
+			s.dialect.Placeholders(1, len(list))), list...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Values of an INSERT, in the order of the columns
+func (s *SQLStore) args(a *meta.DataStreamAttribute, r *Record) ([]interface{}, error) {
+	if len(r.Values) != int(a.NumDataPoints) {
+		return nil, ErrInvalidData
+	}
+	args := make([]interface{}, 0, len(r.Values)+1)
+	args = append(args, r.Time.UnixNano())
+	for i, v := range r.Values {
+		if err := TypeNameCheckRange(a.DataPointTypes[i], v); err != nil {
+			return nil, err
+		}
+		args = append(args, s.arg(v))
+	}
+	return args, nil
+}
+
+//Normalised value as an argument the driver takes
+func (s *SQLStore) arg(v interface{}) interface{} {
+	switch value := v.(type) {
+	case uint64:
+		switch s.dialect {
+		case PostgreSQL:
+			return strconv.FormatUint(value, 10)
+		case SQLite:
+			return int64(value)
+		}
+	case time.Time:
+		return value.UTC()
+	}
+	return v
+}
+
+func (s *SQLStore) Range(dataStreamId int64, a *meta.DataStreamAttribute, start time.Time, end time.Time,
+	descending bool, limit int) ([]*Record, error) {
+	if err := s.exists(dataStreamId); err != nil {
+		return nil, err
+	}
+	order := "ASC"
+	if descending {
+		order = "DESC"
+	}
+	statement := fmt.Sprintf("SELECT t, %s FROM %s WHERE t >= %s AND t < %s ORDER BY t %s, id %s",
+		strings.Join(sqlColumns(a), ", "), s.table(dataStreamId), s.dialect.Placeholder(1), s.dialect.Placeholder(2),
+		order, order)
+	if limit > 0 {
+		statement = statement + fmt.Sprintf(" LIMIT %d", limit)
+	}
+	rows, err := s.db.Query(statement, start.UnixNano(), end.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := make([]*Record, 0)
+	for rows.Next() {
+		var t int64
+		values := make([]sqlValue, a.NumDataPoints)
+		dest := make([]interface{}, len(values)+1)
+		dest[0] = &t
+		for i := range values {
+			if values[i].zero, err = TypeName2ZeroValue(a.DataPointTypes[i]); err != nil {
+				return nil, err
+			}
+			dest[i+1] = &values[i]
+		}
+		if err = rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		r := &Record{Time: time.Unix(0, t).UTC(), Values: make([]interface{}, len(values))}
+		for i := range values {
+			r.Values[i] = values[i].value
+		}
+		records = append(records, r)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+func (s *SQLStore) Delete(dataStreamId int64, a *meta.DataStreamAttribute, start time.Time, end time.Time) error {
+	if err := s.exists(dataStreamId); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE t >= %s AND t < %s", s.table(dataStreamId),
+		s.dialect.Placeholder(1), s.dialect.Placeholder(2)), start.UnixNano(), end.UnixNano())
+	return err
+}
+
+func (s *SQLStore) Close() error {
+	return s.db.Close()
+}
+
+//Scans a column into the normalised type of zero, drivers return different
+// types for the same column type (e.g. []byte for NUMERIC of postgres)
+type sqlValue struct {
+	zero interface{}
+	value interface{}
+}
+
+//Layouts of timestamps returned as text
+var sqlTimeLayouts = []string{
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02T15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05",
+}
+
+func (v *sqlValue) Scan(src interface{}) error {
+	if b, ok := src.([]byte); ok {
+		src = string(b)
+	}
+	var err error
+	switch v.zero.(type) {
+	case int64:
+		switch x := src.(type) {
+		case int64:
+			v.value = x
+		case string:
+			v.value, err = strconv.ParseInt(x, 10, 64)
+		default:
+			err = ErrInvalidData
+		}
+	case uint64:
+		switch x := src.(type) {
+		case int64:
+			//sqlite saves the int64 of the same bits
+			v.value = uint64(x)
+		case uint64:
+			v.value = x
+		case string:
+			v.value, err = strconv.ParseUint(x, 10, 64)
+		default:
+			err = ErrInvalidData
+		}
+	case float64:
+		switch x := src.(type) {
+		case float64:
+			v.value = x
+		case int64:
+			v.value = float64(x)
+		case string:
+			v.value, err = strconv.ParseFloat(x, 64)
+		default:
+			err = ErrInvalidData
+		}
+	case bool:
+		switch x := src.(type) {
+		case bool:
+			v.value = x
+		case int64:
+			v.value = x != 0
+		case string:
+			v.value, err = strconv.ParseBool(x)
+		default:
+			err = ErrInvalidData
+		}
+	case time.Time:
+		switch x := src.(type) {
+		case time.Time:
+			v.value = x.UTC()
+		case string:
+			err = ErrInvalidData
+			for _, layout := range sqlTimeLayouts {
+				if t, parseErr := time.Parse(layout, x); parseErr == nil {
+					v.value, err = t.UTC(), nil
+					break
+				}
+			}
+		default:
+			err = ErrInvalidData
+		}
+	case string:
+		switch x := src.(type) {
+		case string:
+			v.value = x
+		default:
+			err = ErrInvalidData
+		}
+	}
+	return err
+}
@@ -0,0 +1,234 @@
+package data
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"github.com/heartsg/dasea/storage/meta"
+)
+
+// SQLStore on a sqlite file, no database server is needed
+func testSQLStore(t *testing.T) (*SQLStore, func()) {
+	dir, err := ioutil.TempDir("", "dasea-sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewSQLStore("sqlite3", filepath.Join(dir, "data.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return store, func() {
+		store.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSQLStore(t *testing.T) {
+	store, done := testSQLStore(t)
+	defer done()
+
+	err := store.Append(1, testAttribute, testRecords(time.Unix(0, 0), 1))
+	if err != ErrStreamNotFound {
+		t.Errorf("append to a non-existent stream should fail, got %v", err)
+	}
+	if err = store.CreateStream(1, testAttribute); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.CreateStream(1, testAttribute); err != ErrStreamExists {
+		t.Errorf("create an existing stream should fail, got %v", err)
+	}
+
+	start := time.Unix(10000, 0)
+	if err = store.Append(1, testAttribute, testRecords(start, 200)); err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.Range(1, testAttribute, start.Add(50*time.Second), start.Add(150*time.Second), false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 100 {
+		t.Fatalf("should get 100 records, got %d", len(got))
+	}
+	for i, r := range got {
+		if !r.Time.Equal(start.Add(time.Duration(50+i)*time.Second)) || r.Values[1].(int64) != int64(-50-i) ||
+			r.Values[2].(float64) != float64(50+i)/2 || !r.Values[3].(time.Time).Equal(start) {
+			t.Fatalf("record %d not match, got %v %v", i, r.Time, r.Values)
+		}
+	}
+	got, err = store.Range(1, testAttribute, start, start.Add(time.Hour), true, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 10 || !got[0].Time.Equal(start.Add(199*time.Second)) {
+		t.Errorf("should get the latest 10 records, got %d", len(got))
+	}
+
+	if err = store.Delete(1, testAttribute, start, start.Add(100*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	got, err = store.Range(1, testAttribute, time.Unix(0, 0), start.Add(time.Hour), false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 100 || !got[0].Time.Equal(start.Add(100*time.Second)) {
+		t.Fatalf("should get the last 100 records after delete, got %d", len(got))
+	}
+
+	if err = store.DropStream(1, testAttribute); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.Range(1, testAttribute, start, start.Add(time.Hour), false, 0); err != ErrStreamNotFound {
+		t.Errorf("stream should be dropped, got %v", err)
+	}
+}
+
+func TestSQLStoreTypes(t *testing.T) {
+	store, done := testSQLStore(t)
+	defer done()
+
+	a := &meta.DataStreamAttribute{
+		Id: 2,
+		NumDataPoints: 4,
+		DataPointNames: []string{"counter", "on", "label", "taken"},
+		DataPointTypes: []string{"uint64", "bool", "string", "timestamp"},
+		DataPointUnits: []int64{meta.UUnit, meta.UUnit, meta.UUnit, meta.UUnit},
+	}
+	if err := store.CreateStream(1, a); err != nil {
+		t.Fatal(err)
+	}
+	taken := time.Unix(1000, 123456789)
+	records := []*Record{
+		{Time: time.Unix(1, 0), Values: []interface{}{uint64(1<<64 - 1), true, "it's", taken}},
+		{Time: time.Unix(2, 0), Values: []interface{}{uint64(7), false, "", time.Unix(0, 0).UTC()}},
+	}
+	if err := store.Append(1, a, records); err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.Range(1, a, time.Unix(0, 0), time.Unix(10, 0), false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("should get 2 records, got %d", len(got))
+	}
+	for i, r := range got {
+		for j, v := range r.Values {
+			if j == 3 {
+				if !v.(time.Time).Equal(records[i].Values[j].(time.Time)) {
+					t.Errorf("record %d time not match, got %v", i, v)
+				}
+			} else if v != records[i].Values[j] {
+				t.Errorf("record %d value %d should be %v, got %v", i, j, records[i].Values[j], v)
+			}
+		}
+	}
+}
+
+func TestSQLWriteMode(t *testing.T) {
+	store, done := testSQLStore(t)
+	defer done()
+
+	start := time.Unix(10000, 0)
+	counts := map[string]int{
+		meta.WriteModeAppend: 30,
+		meta.WriteModeLast: 20,
+		meta.WriteModeFirst: 20,
+		meta.WriteModeReject: 10,
+	}
+	for i, mode := range []string{meta.WriteModeAppend, meta.WriteModeLast, meta.WriteModeFirst, meta.WriteModeReject} {
+		id := int64(i + 1)
+		a := testWriteModeAttribute(mode)
+		if err := store.CreateStream(id, a); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Append(id, a, testTimedRecords(start, 10, 1)); err != nil {
+			t.Fatal(err)
+		}
+		//resent, overlaps the last 10 seconds, plus 10 new seconds
+		err := store.Append(id, a, testTimedRecords(start, 20, 2))
+		if mode == meta.WriteModeReject {
+			if err != ErrDuplicateRecord {
+				t.Errorf("duplicates should be rejected, got %v", err)
+			}
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		got, err := store.Range(id, a, start, start.Add(time.Hour), false, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != counts[mode] {
+			t.Fatalf("%s: should get %d records, got %d", mode, counts[mode], len(got))
+		}
+		want := int64(1)
+		if mode == meta.WriteModeLast {
+			want = 2
+		}
+		if got[0].Values[0] != want {
+			t.Errorf("%s: first record should be %d, got %v", mode, want, got[0].Values[0])
+		}
+	}
+
+	//the same times saved by another writer since they were checked
+	a := testWriteModeAttribute(meta.WriteModeFirst)
+	if err := store.CreateStream(5, a); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Append(5, a, testTimedRecords(start, 10, 1)); err != nil {
+		t.Fatal(err)
+	}
+	unchecked := testWriteModeAttribute(meta.WriteModeAppend)
+	if err := store.Append(5, unchecked, testTimedRecords(start, 1, 2)); err != ErrDuplicateRecord {
+		t.Errorf("unique index should reject the same time, got %v", err)
+	}
+}
+
+func TestSQLAlterStream(t *testing.T) {
+	store, done := testSQLStore(t)
+	defer done()
+
+	v1 := testSchemaAttribute
+	if err := store.CreateStream(1, v1); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Unix(10000, 0)
+	if err := store.Append(1, v1, testSchemaRecords(start, 10)); err != nil {
+		t.Fatal(err)
+	}
+	v2, err := v1.Evolve([]*meta.DataPointChange{
+		{Op: meta.DataPointWiden, Name: "temp", Type: "float64"},
+		{Op: meta.DataPointAdd, Name: "humidity", Type: "float32", Unit: meta.URelativeHumidity},
+		{Op: meta.DataPointAdd, Name: "note", Type: "string", Unit: meta.UUnit},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.AlterStream(1, v2); err != nil {
+		t.Fatal(err)
+	}
+	//columns exist already
+	if err = store.AlterStream(1, v2); err != nil {
+		t.Fatal(err)
+	}
+	err = store.Append(1, v2, []*Record{{Time: start.Add(10 * time.Second),
+		Values: []interface{}{int64(10), 100.25, start, 55.5, "new"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.Range(1, v2, start, start.Add(time.Hour), false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 11 {
+		t.Fatalf("should get 11 records, got %d", len(got))
+	}
+	if got[0].Values[3].(float64) != 0 || got[0].Values[4].(string) != "" {
+		t.Errorf("added data points of older records should be zero, got %v", got[0].Values)
+	}
+	if got[10].Values[3].(float64) != 55.5 || got[10].Values[4].(string) != "new" {
+		t.Errorf("new record not match, got %v", got[10].Values)
+	}
+}
@@ -7,18 +7,18 @@
 package data
 
 import (
-	"errors"
+	"math"
+	"time"
 	"github.com/go-xorm/core"
-	"dasea/common"
+	"github.com/heartsg/dasea/common"
 )
 
+
 //Xorm provides Type2SQL which converts from golang type to sql type
 //We consider the golang type in string to sql type
 //Note that xorm uses dialect to map various core.SQLType to the type that
-// is really supported by that dialect, we don't do this currently, because we
-// do not rely on xorm. We map directly to the type that we will support for the
-// database that we use (currently mysql, and later we will move to oceanbase). 
-//Such dialect support may be added later
+// is really supported by that dialect. Data tables do not rely on xorm, the
+// column types of each supported database are given by Dialect.SQLType.
 func TypeName2SQLType(t string) (core.SQLType, error) {
 	var st core.SQLType
 	switch t {
@@ -42,7 +42,7 @@ func TypeName2SQLType(t string) (core.SQLType, error) {
 	case "datetime", "timestamp":
 		st = core.SQLType{core.DateTime, 0, 0}
 	default:
-		return core.SQLType{"UNKNOWN", 0, 0}, errors.New("Invalid type")
+		return core.SQLType{"UNKNOWN", 0, 0}, ErrInvalidType
 	}
 	return st, nil	
 }
@@ -61,11 +61,12 @@ func TypeName2ProtobufWireType(t string) (uint64, error) {
 	case "string", "bytes", "timestamp", "datetime":
 		pt = common.WireLengthDelimited
 	default:
-		return 0, errors.New("Invalid type")
+		return 0, ErrInvalidType
 	}
 	return pt, nil		
 }
 
+//Default value in mysql, see Dialect.DefaultValue for other databases
 func TypeName2DefaultValue(t string) (string, error) {
 	var dv string
 	switch t {
@@ -79,7 +80,99 @@ func TypeName2DefaultValue(t string) (string, error) {
 	case "timestamp", "datetime":
 		dv = "\"2015-1-1 00:00:00\""
 	default:
-		return "", errors.New("Invalid type")
+		return "", ErrInvalidType
 	}
 	return dv, nil		
-}
\ No newline at end of file
+}
+
+//Data points are kept in memory (and passed between the decoders and
+// the DataStore) in a normalised form, so that the storage engines only
+// need to care about a few golang types:
+//   - int, int8, int16, int32, int64, sint*, sfixed*: int64
+//   - uint, uint8, uint16, uint32, uint64, fixed32, fixed64: uint64
+//   - float, float32, double, float64: float64
+//   - bool: bool
+//   - timestamp, datetime: time.Time
+//   - string: string
+func TypeName2ZeroValue(t string) (interface{}, error) {
+	var zv interface{}
+	switch t {
+	case "int", "int8", "int16", "int32", "int64", "sint", "sint8", "sint16", "sint32", "sint64",
+		"sfixed32", "sfixed64":
+		zv = int64(0)
+	case "uint", "uint8", "uint16", "uint32", "uint64", "fixed32", "fixed64":
+		zv = uint64(0)
+	case "float", "float32", "double", "float64":
+		zv = float64(0)
+	case "bool":
+		zv = false
+	case "timestamp", "datetime":
+		zv = time.Unix(0, 0).UTC()
+	case "string":
+		zv = ""
+	default:
+		return nil, ErrInvalidType
+	}
+	return zv, nil
+}
+
+//Check whether a normalised value fits in the range of type t
+func TypeNameCheckRange(t string, v interface{}) error {
+	switch t {
+	case "int8", "sint8":
+		if i, ok := v.(int64); !ok || i < math.MinInt8 || i > math.MaxInt8 {
+			return ErrInvalidData
+		}
+	case "int16", "sint16":
+		if i, ok := v.(int64); !ok || i < math.MinInt16 || i > math.MaxInt16 {
+			return ErrInvalidData
+		}
+	case "int", "int32", "sint", "sint32", "sfixed32":
+		if i, ok := v.(int64); !ok || i < math.MinInt32 || i > math.MaxInt32 {
+			return ErrInvalidData
+		}
+	case "int64", "sint64", "sfixed64":
+		if _, ok := v.(int64); !ok {
+			return ErrInvalidData
+		}
+	case "uint8":
+		if u, ok := v.(uint64); !ok || u > math.MaxUint8 {
+			return ErrInvalidData
+		}
+	case "uint16":
+		if u, ok := v.(uint64); !ok || u > math.MaxUint16 {
+			return ErrInvalidData
+		}
+	case "uint", "uint32", "fixed32":
+		if u, ok := v.(uint64); !ok || u > math.MaxUint32 {
+			return ErrInvalidData
+		}
+	case "uint64", "fixed64":
+		if _, ok := v.(uint64); !ok {
+			return ErrInvalidData
+		}
+	case "float", "float32":
+		if f, ok := v.(float64); !ok || (!math.IsInf(f, 0) && !math.IsNaN(f) && math.Abs(f) > math.MaxFloat32) {
+			return ErrInvalidData
+		}
+	case "double", "float64":
+		if _, ok := v.(float64); !ok {
+			return ErrInvalidData
+		}
+	case "bool":
+		if _, ok := v.(bool); !ok {
+			return ErrInvalidData
+		}
+	case "timestamp", "datetime":
+		if _, ok := v.(time.Time); !ok {
+			return ErrInvalidData
+		}
+	case "string":
+		if _, ok := v.(string); !ok {
+			return ErrInvalidData
+		}
+	default:
+		return ErrInvalidType
+	}
+	return nil
+}
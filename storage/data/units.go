@@ -0,0 +1,104 @@
+package data
+
+import (
+	"math"
+	"github.com/heartsg/dasea/storage/meta"
+)
+
+//Values are saved in the units of DataStreamAttribute.DataPointUnits, queries
+// may ask for other units of the same category, either per column (a unit id)
+// or for all columns (a unit system, see meta.UnitOfSystem). Converted values
+// are float64.
+//
+// Currencies are converted to other currencies with the exchange rates valid
+// at the time of each record (see meta.CurrencyConversion), they are not in
+// any unit system.
+
+// Unit and currency conversions of columns (indexes of DataPointNames) and the
+// units of the columns after conversion. targets is empty or one unit per
+// column, 0 keeps the unit unless system is given. Conversions are nil for
+// columns kept as is, a column has at most one of both.
+func columnConversions(a *meta.DataStreamAttribute, indexes []int, targets []int64,
+	system string) ([]*meta.UnitConversion, []*meta.CurrencyConversion, []int64, error) {
+	if len(targets) != 0 && len(targets) != len(indexes) {
+		return nil, nil, nil, ErrInvalidQuery
+	}
+	if system != "" && system != meta.UnitSystemMetric && system != meta.UnitSystemUS && system != meta.UnitSystemUK {
+		return nil, nil, nil, meta.ErrUnknownUnitSystem
+	}
+	conversions := make([]*meta.UnitConversion, len(indexes))
+	currencies := make([]*meta.CurrencyConversion, len(indexes))
+	units := make([]int64, len(indexes))
+	for i, index := range indexes {
+		var from int64
+		if index < len(a.DataPointUnits) {
+			from = a.DataPointUnits[index]
+		}
+		units[i] = from
+		var to int64
+		if len(targets) > 0 {
+			to = targets[i]
+		}
+		zv, err := TypeName2ZeroValue(a.DataPointTypes[index])
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if _, ok := numericValue(zv); !ok {
+			if to != 0 && to != from {
+				return nil, nil, nil, ErrNotNumeric
+			}
+			continue
+		}
+		if meta.IsCurrency(from) || meta.IsCurrency(to) {
+			if to == 0 || to == from {
+				continue
+			}
+			if !meta.IsCurrency(from) || !meta.IsCurrency(to) {
+				return nil, nil, nil, meta.ErrIncompatibleUnits
+			}
+			if currencies[i], err = meta.NewCurrencyConversion(from, to); err != nil {
+				return nil, nil, nil, err
+			}
+			units[i] = to
+			continue
+		}
+		if to == 0 && system != "" {
+			if to, err = meta.UnitOfSystem(from, system); err != nil {
+				//unknown source units are shown as they are
+				continue
+			}
+		}
+		if to == 0 || to == from {
+			continue
+		}
+		if conversions[i], err = meta.NewUnitConversion(from, to); err != nil {
+			return nil, nil, nil, err
+		}
+		units[i] = to
+	}
+	return conversions, currencies, units, nil
+}
+
+// Whether aggregate function f can be converted after aggregation, which
+// needs a linear conversion except for order based functions
+func aggregateConvertible(c *meta.UnitConversion, f string) bool {
+	switch f {
+	case "avg", "sum", "stddev":
+		return c.Linear
+	}
+	return true
+}
+
+// Convert the value of aggregate function f over count data points
+func convertAggregate(c *meta.UnitConversion, f string, v float64, count int64) float64 {
+	switch f {
+	case "count":
+		return v
+	case "sum":
+		//every data point carries the offset
+		return v*c.Factor + c.Offset*float64(count)
+	case "stddev":
+		return v * math.Abs(c.Factor)
+	}
+	return c.Convert(v)
+}
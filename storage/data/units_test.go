@@ -0,0 +1,212 @@
+package data
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+	"time"
+	"github.com/heartsg/dasea/storage/meta"
+)
+
+var testUnitAttribute = &meta.DataStreamAttribute{
+	Id: 3,
+	Description: "car",
+	NumDataPoints: 3,
+	DataPointNames: []string{"odometer", "speed", "plate"},
+	DataPointTypes: []string{"uint32", "float64", "string"},
+	DataPointUnits: []int64{meta.UKilometer, meta.UMilePerHour, meta.UUnit},
+}
+
+func TestUnitConversion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dasea-units")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewEmbeddedStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := testUnitAttribute
+	if err = store.CreateStream(1, a); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Unix(10000, 0)
+	records := make([]*Record, 10)
+	for i := range records {
+		records[i] = &Record{Time: start.Add(time.Duration(i) * time.Second),
+			Values: []interface{}{uint64(1000 + i), float64(10 * i), "ABC"}}
+	}
+	if err = store.Append(1, a, records); err != nil {
+		t.Fatal(err)
+	}
+
+	q := &Query{Start: start, End: start.Add(time.Hour), Units: []int64{meta.UMeter, 0, 0}}
+	result, err := q.Run(store, 1, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Units[0] != meta.UMeter || result.Types[0] != "float64" || result.Units[1] != meta.UMilePerHour ||
+		result.Types[1] != "float64" || testValue(result, 1, 0) != 1001000.0 || testValue(result, 1, 1) != 10.0 {
+		t.Errorf("odometer should be converted to meters, got %v %v %v", result.Units, result.Types, result.Records[1].Values)
+	}
+
+	//metric system
+	q = &Query{Start: start, End: start.Add(time.Hour), Columns: []string{"speed", "plate"}, UnitSystem: meta.UnitSystemMetric}
+	result, err = q.Run(store, 1, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Units[0] != meta.UKilometerPerHour || math.Abs(testValue(result, 1, 0).(float64)-16.09344) > 1e-9 ||
+		testValue(result, 1, 1) != "ABC" {
+		t.Errorf("speed should be converted to km/h, got %v %v", result.Units, result.Records[1].Values)
+	}
+
+	bad := []*Query{
+		{Units: []int64{meta.UKilogram, 0, 0}},
+		{Units: []int64{0, 0, meta.UMeter}},
+		{Units: []int64{meta.UMeter}},
+		{UnitSystem: "imperial"},
+	}
+	for i, q := range bad {
+		q.Start, q.End = start, start.Add(time.Hour)
+		if _, err = q.Run(store, 1, a); err == nil {
+			t.Errorf("query %d should be rejected", i)
+		}
+	}
+	q = &Query{Start: start, End: start.Add(time.Hour), Units: []int64{meta.UKilogram, 0, 0}}
+	if _, err = q.Run(store, 1, a); err != meta.ErrIncompatibleUnits {
+		t.Errorf("conversion across categories should fail, got %v", err)
+	}
+
+	//aggregates, speed 0-90 mph
+	g := &Aggregate{Start: start, End: start.Add(time.Hour), Interval: Interval{Duration: time.Hour},
+		Columns: []string{"speed"}, Units: []int64{meta.UMeterPerSecond}}
+	got, err := g.Run(store, 1, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]float64{"min": 0, "max": 40.2336, "avg": 20.1168, "sum": 201.168, "count": 10, "first": 0,
+		"last": 40.2336, "stddev": 30.2765035409749 * 0.44704}
+	for j, f := range got.Functions {
+		if v := got.Buckets[0].Values[0][j]; math.Abs(v-want[f]) > 1e-9*math.Max(1, want[f]) {
+			t.Errorf("%s should be %v m/s, got %v", f, want[f], v)
+		}
+	}
+	if got.Units[0] != meta.UMeterPerSecond {
+		t.Errorf("unit should be m/s, got %v", got.Units)
+	}
+
+	//offsets, temperature 0-4.5 celsius
+	if err = store.CreateStream(2, testAttribute); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Append(2, testAttribute, testRecords(start, 10)); err != nil {
+		t.Fatal(err)
+	}
+	g = &Aggregate{Start: start, End: start.Add(time.Hour), Interval: Interval{Duration: time.Hour},
+		Columns: []string{"temperature"}, Functions: []string{"min", "avg", "sum", "stddev"},
+		Units: []int64{meta.UDegreeFahrenheit}}
+	got, err = g.Run(store, 2, testAttribute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for j, want := range []float64{32, 36.05, 360.5, 1.8 * 1.5138251770487} {
+		if v := got.Buckets[0].Values[0][j]; math.Abs(v-want) > 1e-9*want {
+			t.Errorf("%s should be %v fahrenheit, got %v", g.Functions[j], want, v)
+		}
+	}
+
+	//non-linear, only order based functions can be converted
+	rssi := *testAttribute
+	rssi.DataPointUnits = []int64{meta.UUnit, meta.UUnit, meta.UDbm, meta.UUnit}
+	g.Units = []int64{meta.URssiMilliwatt}
+	if _, err = g.Run(store, 2, &rssi); err != meta.ErrNotConvertible {
+		t.Errorf("average of dBm cannot be converted to milliwatts, got %v", err)
+	}
+	g.Functions = []string{"max"}
+	got, err = g.Run(store, 2, &rssi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := got.Buckets[0].Values[0][0]; math.Abs(v-math.Pow(10, 0.45)) > 1e-9 {
+		t.Errorf("max should be %v mW, got %v", math.Pow(10, 0.45), v)
+	}
+}
+
+// value of column j of record i
+func testValue(r *Result, i int, j int) interface{} {
+	return r.Records[i].Values[j]
+}
+
+func TestCurrencyConversion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dasea-currency")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewEmbeddedStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &meta.DataStreamAttribute{
+		Id: 4,
+		Description: "fuel",
+		NumDataPoints: 2,
+		DataPointNames: []string{"litres", "price"},
+		DataPointTypes: []string{"float64", "float64"},
+		DataPointUnits: []int64{meta.ULitre, meta.CurrencySGD},
+	}
+	if err = store.CreateStream(1, a); err != nil {
+		t.Fatal(err)
+	}
+	//one record a day, the rate changes on the third day
+	day := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	records := make([]*Record, 4)
+	for i := range records {
+		records[i] = &Record{Time: day.Add(time.Duration(i) * 24 * time.Hour), Values: []interface{}{float64(10), float64(20)}}
+	}
+	if err = store.Append(1, a, records); err != nil {
+		t.Fatal(err)
+	}
+	meta.CacheExchangeRates([]*meta.ExchangeRate{
+		{CurrencyId: meta.CurrencySGD, Rate: 1.25, ValidFrom: day},
+		{CurrencyId: meta.CurrencySGD, Rate: 1.6, ValidFrom: day.Add(48 * time.Hour)},
+	})
+
+	q := &Query{Start: day, End: day.Add(96 * time.Hour), Units: []int64{0, meta.CurrencyUSD}}
+	result, err := q.Run(store, 1, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Units[1] != meta.CurrencyUSD || result.Types[1] != "float64" {
+		t.Errorf("price should be in USD, got %v %v", result.Units, result.Types)
+	}
+	for i, want := range []float64{16, 16, 12.5, 12.5} {
+		if v := testValue(result, i, 1); v != want {
+			t.Errorf("price of day %d should be %v USD, got %v", i, want, v)
+		}
+	}
+
+	//unit systems leave currencies alone
+	q = &Query{Start: day, End: day.Add(96 * time.Hour), UnitSystem: meta.UnitSystemUS}
+	if result, err = q.Run(store, 1, a); err != nil || result.Units[1] != meta.CurrencySGD {
+		t.Errorf("price should stay in SGD, got %v %v", result, err)
+	}
+	q = &Query{Start: day, End: day.Add(96 * time.Hour), Units: []int64{meta.CurrencyUSD, 0}}
+	if _, err = q.Run(store, 1, a); err != meta.ErrIncompatibleUnits {
+		t.Errorf("litres cannot be converted to USD, got %v", err)
+	}
+	q = &Query{Start: day.Add(-time.Hour), End: day.Add(96 * time.Hour), Units: []int64{0, meta.CurrencyEUR}}
+	if _, err = q.Run(store, 1, a); err != meta.ErrNoExchangeRate {
+		t.Errorf("EUR has no rate, got %v", err)
+	}
+	g := &Aggregate{Start: day, End: day.Add(96 * time.Hour), Interval: Interval{Duration: 96 * time.Hour},
+		Columns: []string{"price"}, Units: []int64{meta.CurrencyUSD}}
+	if _, err = g.Run(store, 1, a); err != meta.ErrNotConvertible {
+		t.Errorf("aggregates cannot be converted to other currencies, got %v", err)
+	}
+}
@@ -0,0 +1,76 @@
+package data
+
+import (
+	"time"
+	"github.com/heartsg/dasea/storage/meta"
+)
+
+//Aggregation devices buffer records while they are offline and resend them
+// after reconnecting, so the same record may arrive more than once and
+// long after it was taken. With a TimestampDataPoint in the DataStreamAttribute
+// the time of a record is the one taken by the device instead of the time
+// it arrives, so a resent record has the same time as the first copy and the
+// write mode (see meta.WriteMode*) decides which copy is kept:
+//   - append: both are kept
+//   - last: the resent record replaces the saved one
+//   - first: the resent record is dropped
+//   - reject: the batch fails with ErrDuplicateRecord
+//Late records are saved in time order as any other records, so queries and
+// rollups (which rebuild the buckets touched) see them in the right place.
+
+//Make a record of decoded values, arrival is used as the time of the record
+// unless the DataStreamAttribute has a TimestampDataPoint. An omitted timestamp
+// (zero value) is also set to arrival.
+func newRecord(a *meta.DataStreamAttribute, values []interface{}, arrival time.Time) *Record {
+	if a.TimestampDataPoint <= 0 || int(a.TimestampDataPoint) > len(values) {
+		return &Record{Time: arrival, Values: values}
+	}
+	i := a.TimestampDataPoint - 1
+	t, ok := values[i].(time.Time)
+	if !ok || t.UnixNano() == 0 {
+		values[i] = arrival.UTC()
+		return &Record{Time: arrival, Values: values}
+	}
+	return &Record{Time: t, Values: values}
+}
+
+//Resolve records of the same time within a batch by the write mode, records
+// keep their order in the batch.
+func dedupeRecords(a *meta.DataStreamAttribute, records []*Record) ([]*Record, error) {
+	mode := a.Mode()
+	if mode == meta.WriteModeAppend {
+		return records, nil
+	}
+	//index of the record kept for each time
+	kept := make(map[int64]int, len(records))
+	for i, r := range records {
+		t := r.Time.UnixNano()
+		if _, ok := kept[t]; ok {
+			switch mode {
+			case meta.WriteModeReject:
+				return nil, ErrDuplicateRecord
+			case meta.WriteModeFirst:
+				continue
+			}
+		}
+		kept[t] = i
+	}
+	if len(kept) == len(records) {
+		return records, nil
+	}
+	deduped := make([]*Record, 0, len(kept))
+	for i, r := range records {
+		if kept[r.Time.UnixNano()] == i {
+			deduped = append(deduped, r)
+		}
+	}
+	return deduped, nil
+}
+
+func recordTimes(records []*Record) map[int64]bool {
+	times := make(map[int64]bool, len(records))
+	for _, r := range records {
+		times[r.Time.UnixNano()] = true
+	}
+	return times
+}
@@ -0,0 +1,194 @@
+package data
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+	"github.com/heartsg/dasea/storage/meta"
+)
+
+// testAttribute with the time data point as the time of records
+func testWriteModeAttribute(mode string) *meta.DataStreamAttribute {
+	a := *testAttribute
+	a.TimestampDataPoint = 4
+	a.WriteMode = mode
+	return &a
+}
+
+// records taken by a device every second, value is the radar data point
+func testTimedRecords(start time.Time, n int, value int64) []*Record {
+	records := make([]*Record, n)
+	for i := range records {
+		t := start.Add(time.Duration(i) * time.Second)
+		records[i] = &Record{Time: t, Values: []interface{}{value, int64(i), float64(i), t}}
+	}
+	return records
+}
+
+func TestRecordTime(t *testing.T) {
+	a := testWriteModeAttribute(meta.WriteModeLast)
+	now := time.Unix(5000, 0)
+	records, err := DecodeProtobufRecords(a, testProtobufData([]int64{1, 2}), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !records[0].Time.Equal(time.Unix(1000, 0)) || !records[1].Time.Equal(time.Unix(1001, 0)) {
+		t.Errorf("records should be stamped by the time data point, got %v %v", records[0].Time, records[1].Time)
+	}
+
+	//omitted time falls back to arrival
+	records, recordErrors, err := DecodeJsonRecords(a, []byte(`[{"radar": 1}, {"radar": 2, "time": 1000}]`), now)
+	if err != nil || len(recordErrors) != 0 {
+		t.Fatal(err, recordErrors)
+	}
+	if !records[0].Time.Equal(now) || !records[0].Values[3].(time.Time).Equal(now) || !records[1].Time.Equal(time.Unix(1000, 0)) {
+		t.Errorf("records not stamped correctly, got %v %v", records[0].Time, records[1].Time)
+	}
+
+	records, err = dedupeRecords(a, append(testTimedRecords(now, 3, 1), testTimedRecords(now, 2, 2)...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || records[0].Values[0] != int64(1) || records[1].Values[0] != int64(2) {
+		t.Errorf("the last record of each time should be kept in order, got %d", len(records))
+	}
+	a.WriteMode = meta.WriteModeReject
+	if _, err = dedupeRecords(a, testTimedRecords(now, 2, 1)); err != nil {
+		t.Errorf("records of different times should be accepted, got %v", err)
+	}
+	if _, err = dedupeRecords(a, append(testTimedRecords(now, 2, 1), testTimedRecords(now, 1, 2)...)); err != ErrDuplicateRecord {
+		t.Errorf("duplicates in a batch should be rejected, got %v", err)
+	}
+}
+
+func TestEmbeddedWriteMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dasea-writemode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewEmbeddedStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//a few frames per segment
+	store.SegmentSize = 512
+	start := time.Unix(10000, 0)
+	modes := []string{meta.WriteModeAppend, meta.WriteModeLast, meta.WriteModeFirst, meta.WriteModeReject}
+	for i, mode := range modes {
+		id := int64(i + 1)
+		a := testWriteModeAttribute(mode)
+		if err = store.CreateStream(id, a); err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < 10; j++ {
+			if err = store.Append(id, a, testTimedRecords(start.Add(time.Duration(j)*10*time.Second), 10, 1)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		//resent after reconnecting, overlaps the last 30 seconds, plus 10 new seconds
+		err = store.Append(id, a, testTimedRecords(start.Add(70*time.Second), 40, 2))
+		if mode == meta.WriteModeReject {
+			if err != ErrDuplicateRecord {
+				t.Errorf("duplicates should be rejected, got %v", err)
+			}
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		//late records before everything
+		if err = store.Append(id, a, testTimedRecords(start.Add(-5*time.Second), 5, 3)); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := store.Range(id, a, start.Add(-time.Hour), start.Add(time.Hour), false, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		count := map[string]int{
+			meta.WriteModeAppend: 145,
+			meta.WriteModeLast: 115,
+			meta.WriteModeFirst: 115,
+			meta.WriteModeReject: 105,
+		}[mode]
+		if len(got) != count {
+			t.Fatalf("%s: should get %d records, got %d", mode, count, len(got))
+		}
+		if !got[0].Time.Equal(start.Add(-5 * time.Second)) || got[0].Values[0] != int64(3) {
+			t.Errorf("%s: late records should come first, got %v", mode, got[0].Time)
+		}
+		for k := 1; k < len(got); k++ {
+			if got[k].Time.Before(got[k-1].Time) {
+				t.Fatalf("%s: records should be ordered by time", mode)
+			}
+			if mode != meta.WriteModeAppend && got[k].Time.Equal(got[k-1].Time) {
+				t.Fatalf("%s: records should be unique by time", mode)
+			}
+		}
+		for _, r := range got {
+			if r.Time.Before(start.Add(70*time.Second)) || r.Time.After(start.Add(99*time.Second)) || mode == meta.WriteModeAppend {
+				continue
+			}
+			want := int64(2)
+			if mode != meta.WriteModeLast {
+				want = 1
+			}
+			if r.Values[0] != want {
+				t.Fatalf("%s: record at %v should be %d, got %v", mode, r.Time, want, r.Values[0])
+			}
+		}
+	}
+
+	//replaced records stay replaced after reloading from disk
+	store.Close()
+	a := testWriteModeAttribute(meta.WriteModeLast)
+	got, err := store.Range(2, a, start.Add(70*time.Second), start.Add(80*time.Second), false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 10 || got[0].Values[0] != int64(2) {
+		t.Errorf("should get 10 replaced records after reload, got %d", len(got))
+	}
+}
+
+func TestPipelineWriteMode(t *testing.T) {
+	store, clean := testPipelineStore(t)
+	defer clean()
+	a := testWriteModeAttribute(meta.WriteModeReject)
+
+	start := time.Unix(10000, 0)
+	if err := store.Append(1, a, testTimedRecords(start, 10, 1)); err != nil {
+		t.Fatal(err)
+	}
+	p := NewPipeline(store)
+	p.Delay = time.Hour
+	p.Start()
+
+	//coalesced into one batch, only the duplicated put fails
+	errs := make([]error, 2)
+	done := make(chan int, 2)
+	for i, r := range [][]*Record{testTimedRecords(start.Add(5*time.Second), 10, 2), testTimedRecords(start.Add(time.Hour), 10, 2)} {
+		i := i
+		err := p.Put(1, a, r, func(err error) {
+			errs[i] = err
+			done <- i
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.Close()
+	<-done
+	<-done
+	if errs[0] != ErrDuplicateRecord || errs[1] != nil {
+		t.Errorf("only the first put should be rejected, got %v", errs)
+	}
+	got, err := store.Range(1, a, start, start.Add(2*time.Hour), false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 20 {
+		t.Errorf("should get 20 records, got %d", len(got))
+	}
+}
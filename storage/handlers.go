@@ -0,0 +1,1033 @@
+package storage
+
+import (
+    "encoding/json"
+    "errors"
+    "io"
+    "io/ioutil"
+    "log"
+    "math"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+    "github.com/heartsg/dasea/keystone/keystoneclient/client"
+    "github.com/heartsg/dasea/keystone/keystoneclient/types"
+    "github.com/heartsg/dasea/keystone/keystonemiddleware"
+    "github.com/heartsg/dasea/router"
+    "github.com/heartsg/dasea/storage/data"
+    "github.com/heartsg/dasea/storage/meta"
+    "golang.org/x/net/context"
+)
+
+var (
+    ErrUnauthorized = errors.New("Authentication required.")
+    ErrForbidden = errors.New("Not allowed by policy.")
+    ErrInvalidParameter = errors.New("Invalid request parameter.")
+    ErrInvalidBody = errors.New("Invalid request body.")
+    ErrBodyTooLarge = errors.New("Request body too large.")
+)
+
+const (
+    ruleGet = "storage.get"
+    rulePut = "storage.put"
+
+    // Middleware param of the meta.Scope of the token
+    ScopeKey = "StorageScope"
+    // Middleware param of the *meta.DeviceToken of requests authenticated
+    // by a device token
+    DeviceTokenKey = "StorageDeviceToken"
+
+    // Header of device tokens (see meta.IssueDeviceToken)
+    DeviceTokenHeader = "X-Device-Token"
+
+    // Seconds a client should wait when the ingestion pipeline is full
+    retryAfter = "1"
+)
+
+// Authentication of routes open to devices: a device token is checked when
+// the request has no keystone token, everything else goes to Auth
+func (s *Server) authenticateDevice(ctx context.Context, w http.ResponseWriter, r *http.Request) context.Context {
+    token := r.Header.Get(DeviceTokenHeader)
+    if token == "" || r.Header.Get("X-Auth-Token") != "" {
+        return s.Auth.ServeHTTPContext(ctx, w, r)
+    }
+    t, err := meta.AuthenticateDeviceToken(token, time.Now())
+    if err != nil {
+        writeError(w, err)
+        return nil
+    }
+    scope, err := meta.ScopeFromDevice(t.DeviceId)
+    if err == meta.ErrNotFound {
+        //the device was deleted
+        err = meta.ErrInvalidToken
+    }
+    if err != nil {
+        writeError(w, err)
+        return nil
+    }
+    ctx = router.SetMiddlewareParam(ctx, DeviceTokenKey, t)
+    return router.SetMiddlewareParam(ctx, ScopeKey, scope)
+}
+
+// Policy check of the token authenticated by keystonemiddleware, the
+// meta.Scope of the token is passed on to the handler. Device tokens are
+// not checked against the policy, they are limited to the data streams of
+// their device instead (see scopedStreamId).
+func (s *Server) authorize(rule string) router.Middleware {
+    return router.MiddlewareFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) context.Context {
+        if deviceTokenOf(ctx) != nil {
+            return ctx
+        }
+        access, _ := router.MiddlewareParam(ctx, keystonemiddleware.UserAccessInfoKey).(*client.AccessInfo)
+        if access == nil || access.TokenInfo == nil {
+            writeError(w, ErrUnauthorized)
+            return nil
+        }
+        scope, err := meta.ScopeFromToken(access.TokenInfo)
+        if err != nil {
+            writeError(w, err)
+            return nil
+        }
+        target := map[string]interface{}{
+            "project_id": scope.ProjectId,
+            "domain_id": scope.DomainId,
+        }
+        if !s.Enforcer.Enforce(rule, target, credentials(access.TokenInfo, scope)) {
+            writeError(w, ErrForbidden)
+            return nil
+        }
+        return router.SetMiddlewareParam(ctx, ScopeKey, scope)
+    })
+}
+
+// Policy credentials of a token
+func credentials(token *types.Token, scope *meta.Scope) map[string]interface{} {
+    roles := make([]string, 0, len(token.Roles))
+    for _, role := range token.Roles {
+        if role != nil {
+            roles = append(roles, role.Name)
+        }
+    }
+    creds := map[string]interface{}{
+        "roles": roles,
+        "project_id": scope.ProjectId,
+        "domain_id": scope.DomainId,
+    }
+    if token.User != nil {
+        creds["user_id"] = token.User.Id
+    }
+    return creds
+}
+
+func scopeOf(ctx context.Context) *meta.Scope {
+    scope, _ := router.MiddlewareParam(ctx, ScopeKey).(*meta.Scope)
+    return scope
+}
+
+// nil unless the request is authenticated by a device token
+func deviceTokenOf(ctx context.Context) *meta.DeviceToken {
+    t, _ := router.MiddlewareParam(ctx, DeviceTokenKey).(*meta.DeviceToken)
+    return t
+}
+
+// HTTP status of an error returned by meta, data or the handlers
+func errorStatus(err error) int {
+    switch err {
+    case ErrUnauthorized, meta.ErrInvalidToken:
+        return http.StatusUnauthorized
+    case ErrForbidden, meta.ErrNoScope:
+        return http.StatusForbidden
+    case meta.ErrNotFound, data.ErrStreamNotFound:
+        return http.StatusNotFound
+    case data.ErrDuplicateRecord, data.ErrStreamExists, meta.ErrVersionConflict:
+        return http.StatusConflict
+    case ErrBodyTooLarge:
+        return http.StatusRequestEntityTooLarge
+    case data.ErrPipelineFull:
+        return http.StatusTooManyRequests
+    case data.ErrPipelineClosed, data.ErrStoreNotInitialized:
+        return http.StatusServiceUnavailable
+    case ErrInvalidParameter, ErrInvalidBody, ErrInvalidTopic, ErrInvalidResource, ErrNoDeviceTag,
+            meta.ErrInvalidListOpts, meta.ErrInvalidDataPoints, meta.ErrInvalidWriteMode,
+            meta.ErrProjectMismatch, meta.ErrAmbiguousDevice, meta.ErrUnknownUnit, meta.ErrUnknownUnitSystem,
+            meta.ErrIncompatibleUnits, meta.ErrNotConvertible, meta.ErrUnknownCurrency,
+            meta.ErrNoExchangeRate, meta.ErrInvalidRetention,
+            data.ErrInvalidData, data.ErrInvalidType, data.ErrInvalidQuery, data.ErrInvalidCursor,
+            data.ErrNotNumeric, data.ErrInvalidInterval, data.ErrInvalidFunction,
+            data.ErrInvalidLine, data.ErrInvalidPrecision, data.ErrTypeMismatch:
+        return http.StatusBadRequest
+    }
+    return http.StatusInternalServerError
+}
+
+// Marshalled before the status is written, values which cannot be
+// marshalled (e.g. NaN data points) are answered 500 instead of a
+// truncated body
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+    buf, err := json.Marshal(v)
+    if err != nil {
+        log.Printf("storage: %v", err)
+        status = http.StatusInternalServerError
+        buf, _ = json.Marshal(map[string]string{"error": http.StatusText(status)})
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    w.Write(append(buf, '\n'))
+}
+
+func writeError(w http.ResponseWriter, err error) {
+    status := errorStatus(err)
+    if status == http.StatusTooManyRequests {
+        w.Header().Set("Retry-After", retryAfter)
+    }
+    writeJson(w, status, map[string]string{"error": publicError(err).Error()})
+}
+
+// Error as told to clients, errors of the server (5xx) may reveal database
+// details, they are logged and replaced by the status text
+func publicError(err error) error {
+    status := errorStatus(err)
+    if status < http.StatusInternalServerError {
+        return err
+    }
+    log.Printf("storage: %v", err)
+    return errors.New(http.StatusText(status))
+}
+
+// Decode a json request body into v, fields not in the body are kept
+func readJson(r *http.Request, v interface{}) error {
+    if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+        return bodyError(err)
+    }
+    return nil
+}
+
+// Request body failing with ErrBodyTooLarge past max bytes (see
+// http.MaxBytesReader, which also closes the connection)
+type limitedBody struct {
+    io.ReadCloser
+    max int64
+    read int64
+}
+
+func limitBody(w http.ResponseWriter, body io.ReadCloser, max int64) io.ReadCloser {
+    return &limitedBody{ReadCloser: http.MaxBytesReader(w, body, max), max: max}
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+    n, err := b.ReadCloser.Read(p)
+    b.read += int64(n)
+    if err != nil && err != io.EOF && b.read >= b.max {
+        err = ErrBodyTooLarge
+    }
+    return n, err
+}
+
+// Error of reading a request body, ErrBodyTooLarge or ErrInvalidBody
+func bodyError(err error) error {
+    if err == ErrBodyTooLarge {
+        return err
+    }
+    return ErrInvalidBody
+}
+
+func intParam(ctx context.Context, name string) (int64, error) {
+    id, err := strconv.ParseInt(router.PathParam(ctx, name), 10, 64)
+    if err != nil {
+        return 0, meta.ErrNotFound
+    }
+    return id, nil
+}
+
+// RFC3339 or unix seconds
+func parseTime(s string) (time.Time, error) {
+    if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+        return t, nil
+    }
+    sec, err := strconv.ParseInt(s, 10, 64)
+    if err != nil {
+        return time.Time{}, ErrInvalidParameter
+    }
+    return time.Unix(sec, 0), nil
+}
+
+// Comma separated values, nil if s is empty
+func splitParam(s string) []string {
+    if s == "" {
+        return nil
+    }
+    return strings.Split(s, ",")
+}
+
+// Comma separated unit ids
+func parseUnits(s string) ([]int64, error) {
+    values := splitParam(s)
+    if values == nil {
+        return nil, nil
+    }
+    units := make([]int64, len(values))
+    for i, v := range values {
+        u, err := strconv.ParseInt(v, 10, 64)
+        if err != nil {
+            return nil, ErrInvalidParameter
+        }
+        units[i] = u
+    }
+    return units, nil
+}
+
+// ListOpts from the query of list requests:
+//  description_prefix, created_since, created_before, updated_since,
+//  updated_before, limit, marker, aggregation_device_id, device_id,
+//  data_stream_attribute_id
+func parseListOpts(r *http.Request) (*meta.ListOpts, error) {
+    q := r.URL.Query()
+    o := &meta.ListOpts{
+        DescriptionPrefix: q.Get("description_prefix"),
+        Marker: q.Get("marker"),
+        AggregationDeviceId: q.Get("aggregation_device_id"),
+    }
+    times := map[string]*time.Time{
+        "created_since": &o.CreatedSince,
+        "created_before": &o.CreatedBefore,
+        "updated_since": &o.UpdatedSince,
+        "updated_before": &o.UpdatedBefore,
+    }
+    for name, t := range times {
+        if v := q.Get(name); v != "" {
+            parsed, err := parseTime(v)
+            if err != nil {
+                return nil, err
+            }
+            *t = parsed
+        }
+    }
+    ints := map[string]*int64{
+        "device_id": &o.DeviceId,
+        "data_stream_attribute_id": &o.DataStreamAttributeId,
+    }
+    for name, i := range ints {
+        if v := q.Get(name); v != "" {
+            parsed, err := strconv.ParseInt(v, 10, 64)
+            if err != nil {
+                return nil, ErrInvalidParameter
+            }
+            *i = parsed
+        }
+    }
+    if v := q.Get("limit"); v != "" {
+        limit, err := strconv.Atoi(v)
+        if err != nil || limit < 0 {
+            return nil, ErrInvalidParameter
+        }
+        o.Limit = limit
+    }
+    return o, nil
+}
+
+// Time range of the start and end query parameters, end defaults to now
+func parseRange(r *http.Request) (time.Time, time.Time, error) {
+    q := r.URL.Query()
+    var start, end time.Time
+    var err error
+    if v := q.Get("start"); v != "" {
+        if start, err = parseTime(v); err != nil {
+            return start, end, err
+        }
+    }
+    end = time.Now()
+    if v := q.Get("end"); v != "" {
+        if end, err = parseTime(v); err != nil {
+            return start, end, err
+        }
+    }
+    return start, end, nil
+}
+
+//
+// Aggregation devices
+//
+func listAggregationDevices(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+    o, err := parseListOpts(r)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    items, err := scopeOf(ctx).ListAggregationDevices(o)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    writeJson(w, http.StatusOK, items)
+}
+// The Id is the keystone user id of the aggregation device
+func createAggregationDevice(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+    a := &meta.AggregationDevice{}
+    if err := readJson(r, a); err != nil {
+        writeError(w, err)
+        return
+    }
+    if a.Id == "" {
+        writeError(w, ErrInvalidBody)
+        return
+    }
+    if err := scopeOf(ctx).InsertAggregationDevice(a); err != nil {
+        writeError(w, err)
+        return
+    }
+    writeJson(w, http.StatusCreated, a)
+}
+func getAggregationDevice(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+    a, err := scopeOf(ctx).GetAggregationDevice(router.PathParam(ctx, "id"))
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    writeJson(w, http.StatusOK, a)
+}
+func updateAggregationDevice(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+    scope := scopeOf(ctx)
+    a, err := scope.GetAggregationDevice(router.PathParam(ctx, "id"))
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    id := a.Id
+    if err = readJson(r, a); err != nil {
+        writeError(w, err)
+        return
+    }
+    a.Id = id
+    if err = scope.UpdateAggregationDevice(a); err != nil {
+        writeError(w, err)
+        return
+    }
+    writeJson(w, http.StatusOK, a)
+}
+func deleteAggregationDevice(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+    if err := scopeOf(ctx).DeleteAggregationDevice(router.PathParam(ctx, "id")); err != nil {
+        writeError(w, err)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+//
+// Devices
+//
+func listDevices(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+    o, err := parseListOpts(r)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    items, err := scopeOf(ctx).ListDevices(o)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    writeJson(w, http.StatusOK, items)
+}
+func createDevice(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+    d := &meta.Device{}
+    if err := readJson(r, d); err != nil {
+        writeError(w, err)
+        return
+    }
+    d.Id = 0
+    if err := scopeOf(ctx).InsertDevice(d); err != nil {
+        writeError(w, err)
+        return
+    }
+    writeJson(w, http.StatusCreated, d)
+}
+func getDevice(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+    id, err := intParam(ctx, "id")
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    d, err := scopeOf(ctx).GetDevice(id)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    writeJson(w, http.StatusOK, d)
+}
+func updateDevice(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+    scope := scopeOf(ctx)
+    id, err := intParam(ctx, "id")
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    d, err := scope.GetDevice(id)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    if err = readJson(r, d); err != nil {
+        writeError(w, err)
+        return
+    }
+    d.Id = id
+    if err = scope.UpdateDevice(d); err != nil {
+        writeError(w, err)
+        return
+    }
+    writeJson(w, http.StatusOK, d)
+}
+func deleteDevice(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+    id, err := intParam(ctx, "id")
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    if err = scopeOf(ctx).DeleteDevice(id); err != nil {
+        writeError(w, err)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// Token issued for ttl seconds (query parameter, see
+// meta.DefaultDeviceTokenTTL), the token is only returned here
+type issuedDeviceToken struct {
+    Token string
+    *meta.DeviceToken
+}
+func parseTTL(r *http.Request) (time.Duration, error) {
+    v := r.URL.Query().Get("ttl")
+    if v == "" {
+        return 0, nil
+    }
+    seconds, err := strconv.ParseInt(v, 10, 64)
+    if err != nil || seconds < 0 {
+        return 0, ErrInvalidParameter
+    }
+    return time.Duration(seconds) * time.Second, nil
+}
+func listDeviceTokens(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+    id, err := intParam(ctx, "id")
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    tokens, err := scopeOf(ctx).ListDeviceTokens(id)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    writeJson(w, http.StatusOK, tokens)
+}
+func issueDeviceToken(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+    writeDeviceToken(ctx, w, r, scopeOf(ctx).IssueDeviceToken)
+}
+// Issue a token and revoke all other tokens of the device
+func rotateDeviceToken(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+    writeDeviceToken(ctx, w, r, scopeOf(ctx).RotateDeviceToken)
+}
+func writeDeviceToken(ctx context.Context, w http.ResponseWriter, r *http.Request,
+        issue func(int64, time.Duration) (string, *meta.DeviceToken, error)) {
+    id, err := intParam(ctx, "id")
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    ttl, err := parseTTL(r)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    token, t, err := issue(id, ttl)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    writeJson(w, http.StatusCreated, &issuedDeviceToken{Token: token, DeviceToken: t})
+}
+func revokeDeviceToken(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+    id, err := intParam(ctx, "id")
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    tokenId, err := intParam(ctx, "token_id")
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    if err = scopeOf(ctx).RevokeDeviceToken(id, tokenId); err != nil {
+        writeError(w, err)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+func revokeDeviceTokens(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+    id, err := intParam(ctx, "id")
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    if err = scopeOf(ctx).RevokeDeviceTokens(id); err != nil {
+        writeError(w, err)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+//
+// Data stream attributes, data points are changed through schema evolution
+// (meta.EvolveDataStreamAttribute) rather than updates
+//
+func listDataStreamAttributes(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+    o, err := parseListOpts(r)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    items, err := scopeOf(ctx).ListDataStreamAttributes(o)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    writeJson(w, http.StatusOK, items)
+}
+// Description and data points, optionally TimestampDataPoint and WriteMode
+func createDataStreamAttribute(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+    req := &meta.DataStreamAttribute{}
+    if err := readJson(r, req); err != nil {
+        writeError(w, err)
+        return
+    }
+    a, err := scopeOf(ctx).CreateDataStreamAttributeWriteMode(req.Description, req.NumDataPoints, req.DataPointNames,
+        req.DataPointTypes, req.DataPointUnits, req.TimestampDataPoint, req.WriteMode)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    writeJson(w, http.StatusCreated, a)
+}
+func getDataStreamAttribute(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+    id, err := intParam(ctx, "id")
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    a, err := scopeOf(ctx).GetDataStreamAttribute(id)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    writeJson(w, http.StatusOK, a)
+}
+// Only the description is updated
+func updateDataStreamAttribute(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+    scope := scopeOf(ctx)
+    id, err := intParam(ctx, "id")
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    a, err := scope.GetDataStreamAttribute(id)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    req := &meta.DataStreamAttribute{Description: a.Description}
+    if err = readJson(r, req); err != nil {
+        writeError(w, err)
+        return
+    }
+    a.Description = req.Description
+    if err = scope.UpdateDataStreamAttribute(a); err != nil {
+        writeError(w, err)
+        return
+    }
+    writeJson(w, http.StatusOK, a)
+}
+func deleteDataStreamAttribute(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+    id, err := intParam(ctx, "id")
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    if err = scopeOf(ctx).DeleteDataStreamAttribute(id); err != nil {
+        writeError(w, err)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+//
+// Data streams
+//
+func listDataStreams(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+    o, err := parseListOpts(r)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    items, err := scopeOf(ctx).ListDataStreams(o)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    writeJson(w, http.StatusOK, items)
+}
+// DeviceId and DataStreamAttributeId, the data of the stream is created in
+// the data store as well
+func createDataStream(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+    scope := scopeOf(ctx)
+    req := &meta.DataStream{}
+    if err := readJson(r, req); err != nil {
+        writeError(w, err)
+        return
+    }
+    ds, err := scope.CreateDataStream(req.DeviceId, req.DataStreamAttributeId)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    if err = data.CreateData(ds.Id); err != nil {
+        meta.DeleteDataStream(ds.Id)
+        writeError(w, err)
+        return
+    }
+    writeJson(w, http.StatusCreated, ds)
+}
+func getDataStream(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+    id, err := intParam(ctx, "id")
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    ds, err := scopeOf(ctx).GetDataStream(id)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    writeJson(w, http.StatusOK, ds)
+}
+// Move the stream to another device (DeviceId)
+func updateDataStream(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+    scope := scopeOf(ctx)
+    id, err := intParam(ctx, "id")
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    ds, err := scope.GetDataStream(id)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    attributeId := ds.DataStreamAttributeId
+    if err = readJson(r, ds); err != nil {
+        writeError(w, err)
+        return
+    }
+    ds.Id = id
+    ds.DataStreamAttributeId = attributeId
+    if err = scope.UpdateDataStream(ds); err != nil {
+        writeError(w, err)
+        return
+    }
+    writeJson(w, http.StatusOK, ds)
+}
+// Delete the data of the stream, then the stream
+func deleteDataStream(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+    scope := scopeOf(ctx)
+    id, err := intParam(ctx, "id")
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    if _, err = scope.GetDataStream(id); err != nil {
+        writeError(w, err)
+        return
+    }
+    if err = data.DeleteData(id); err != nil && err != data.ErrStreamNotFound {
+        writeError(w, err)
+        return
+    }
+    if err = scope.DeleteDataStream(id); err != nil {
+        writeError(w, err)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+//
+// Data points
+//
+
+// Id of a data stream in the scope, of the device of a device token
+func listRetentionPolicies(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+    policies, err := scopeOf(ctx).ListRetentionPolicies()
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    writeJson(w, http.StatusOK, policies)
+}
+// Policy that applies to the stream, KeepSeconds 0 keeps data points forever
+func getStreamRetention(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+    id, err := intParam(ctx, "id")
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    p, err := scopeOf(ctx).GetDataStreamRetentionPolicy(id)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    writeJson(w, http.StatusOK, p)
+}
+// Only KeepSeconds is taken from the body
+func setStreamRetention(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+    id, err := intParam(ctx, "id")
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    keep, err := readRetention(r)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    p, err := scopeOf(ctx).SetDataStreamRetentionPolicy(id, keep)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    writeJson(w, http.StatusOK, p)
+}
+func getAttributeRetention(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+    id, err := intParam(ctx, "id")
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    p, err := scopeOf(ctx).GetDataStreamAttributeRetentionPolicy(id)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    writeJson(w, http.StatusOK, p)
+}
+func setAttributeRetention(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+    id, err := intParam(ctx, "id")
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    keep, err := readRetention(r)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    p, err := scopeOf(ctx).SetDataStreamAttributeRetentionPolicy(id, keep)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    writeJson(w, http.StatusOK, p)
+}
+// KeepSeconds of a RetentionPolicy body
+func readRetention(r *http.Request) (time.Duration, error) {
+    req := &meta.RetentionPolicy{}
+    if err := readJson(r, req); err != nil {
+        return 0, err
+    }
+    if req.KeepSeconds < 0 || req.KeepSeconds > math.MaxInt64/int64(time.Second) {
+        return 0, meta.ErrInvalidRetention
+    }
+    return time.Duration(req.KeepSeconds) * time.Second, nil
+}
+
+func scopedStreamId(ctx context.Context) (int64, error) {
+    id, err := intParam(ctx, "id")
+    if err != nil {
+        return 0, err
+    }
+    if err = checkStream(scopeOf(ctx), deviceTokenOf(ctx), id); err != nil {
+        return 0, err
+    }
+    return id, nil
+}
+// ErrNotFound unless data stream id is in scope and, for a device token
+// (may be nil), of its device
+func checkStream(scope *meta.Scope, device *meta.DeviceToken, id int64) error {
+    ds, err := scope.GetDataStream(id)
+    if err != nil {
+        return err
+    }
+    if device != nil && device.DeviceId != ds.DeviceId {
+        return meta.ErrNotFound
+    }
+    return nil
+}
+
+// Records in protobuf (Content-Type application/x-protobuf) or json. A bad
+// protobuf record fails the whole batch, bad json records are skipped and
+// reported as {"errors": [{"index": i, "error": "..."}]}.
+func putDataPoints(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+    id, err := scopedStreamId(ctx)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    buf, err := ioutil.ReadAll(r.Body)
+    if err != nil {
+        writeError(w, bodyError(err))
+        return
+    }
+    if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-protobuf") {
+        if err = data.PutDataPointsFromProtobuf(id, buf); err != nil {
+            writeError(w, err)
+            return
+        }
+        w.WriteHeader(http.StatusNoContent)
+        return
+    }
+    recordErrors, err := data.PutDataPointsFromJson(id, buf)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    writeJson(w, http.StatusOK, map[string]interface{}{"errors": recordErrorsJson(recordErrors)})
+}
+
+type recordError struct {
+    Index int `json:"index"`
+    Error string `json:"error"`
+}
+
+func recordErrorsJson(recordErrors []*data.RecordError) []recordError {
+    errs := make([]recordError, len(recordErrors))
+    for i, e := range recordErrors {
+        errs[i] = recordError{Index: e.Index, Error: e.Err.Error()}
+    }
+    return errs
+}
+
+// start, end, columns, descending, limit, cursor, units, unit_system
+func getDataPoints(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+    id, err := scopedStreamId(ctx)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    q, err := parseQuery(r)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    result, err := data.GetDataPointsByTime(id, q)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    writeJson(w, http.StatusOK, result)
+}
+func parseQuery(r *http.Request) (*data.Query, error) {
+    start, end, err := parseRange(r)
+    if err != nil {
+        return nil, err
+    }
+    v := r.URL.Query()
+    q := &data.Query{
+        Start: start,
+        End: end,
+        Columns: splitParam(v.Get("columns")),
+        Cursor: v.Get("cursor"),
+        UnitSystem: v.Get("unit_system"),
+    }
+    if s := v.Get("descending"); s != "" {
+        if q.Descending, err = strconv.ParseBool(s); err != nil {
+            return nil, ErrInvalidParameter
+        }
+    }
+    if s := v.Get("limit"); s != "" {
+        if q.Limit, err = strconv.Atoi(s); err != nil {
+            return nil, ErrInvalidParameter
+        }
+    }
+    if q.Units, err = parseUnits(v.Get("units")); err != nil {
+        return nil, err
+    }
+    return q, nil
+}
+
+// start, end, interval, tz, columns, functions, units, unit_system
+func aggregateDataPoints(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+    id, err := scopedStreamId(ctx)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    g, err := parseAggregate(r)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    result, err := data.AggregateDataPoints(id, g)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    writeJson(w, http.StatusOK, result)
+}
+func parseAggregate(r *http.Request) (*data.Aggregate, error) {
+    start, end, err := parseRange(r)
+    if err != nil {
+        return nil, err
+    }
+    v := r.URL.Query()
+    g := &data.Aggregate{
+        Start: start,
+        End: end,
+        Columns: splitParam(v.Get("columns")),
+        Functions: splitParam(v.Get("functions")),
+        UnitSystem: v.Get("unit_system"),
+    }
+    if g.Interval, err = data.ParseInterval(v.Get("interval")); err != nil {
+        return nil, err
+    }
+    if tz := v.Get("tz"); tz != "" {
+        if g.Location, err = time.LoadLocation(tz); err != nil {
+            return nil, ErrInvalidParameter
+        }
+    }
+    if g.Units, err = parseUnits(v.Get("units")); err != nil {
+        return nil, err
+    }
+    return g, nil
+}
+
+// Data points in [start, end), both are required
+func deleteDataPoints(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+    id, err := scopedStreamId(ctx)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    v := r.URL.Query()
+    if v.Get("start") == "" || v.Get("end") == "" {
+        writeError(w, ErrInvalidParameter)
+        return
+    }
+    start, end, err := parseRange(r)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    if err = data.DeleteDataPointsByTime(id, start, end); err != nil {
+        writeError(w, err)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,193 @@
+package storage
+
+// InfluxDB line protocol writes (see data.ParseLines)
+//
+// Collectors such as Telegraf write to
+//
+//   POST /v1/write?precision=s
+//
+// with a keystone token (storage.put) or a device token. The measurement of
+// a line is the description of a DataStreamAttribute and the tag "device"
+// (or "host", which Telegraf adds to every metric) the description of a
+// Device, the line is written to the data stream of the device with the
+// attribute. Lines of device tokens go to data streams of their own device,
+// which is taken if the line has no device tag.
+//
+// Bodies are limited to Opts.MaxBodySize, gzip bodies (Content-Encoding
+// gzip) once decompressed as well.
+//
+// The response is 204 if all lines are written. Bad lines are skipped and
+// the rest are written, the response is then 400 "partial write" (as
+// InfluxDB, so that collectors do not send the batch again) with
+// {"errors": [{"index": line, "error": "..."}]}, lines counted from 0.
+// Lines of a data stream which cannot be written (e.g. the ingestion
+// pipeline is full) are reported the same way once lines of another stream
+// are written, the batch fails only if nothing is written.
+import (
+    "compress/gzip"
+    "errors"
+    "io"
+    "io/ioutil"
+    "net/http"
+    "sort"
+    "strconv"
+    "github.com/heartsg/dasea/storage/data"
+    "github.com/heartsg/dasea/storage/meta"
+    "golang.org/x/net/context"
+)
+
+var ErrNoDeviceTag = errors.New("Line has no device or host tag.")
+
+const (
+    LineDeviceTag = "device"
+    LineHostTag = "host"
+)
+
+func (s *Server) writeLines(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+    precision, err := data.LinePrecision(r.URL.Query().Get("precision"))
+    if err != nil {
+        writeError(w, ErrInvalidParameter)
+        return
+    }
+    var body io.Reader = r.Body
+    if r.Header.Get("Content-Encoding") == "gzip" {
+        if body, err = gzip.NewReader(r.Body); err != nil {
+            writeError(w, bodyError(err))
+            return
+        }
+        if max := s.Opts.MaxBodySize; max > 0 {
+            body = io.LimitReader(body, max+1)
+        }
+    }
+    buf, err := ioutil.ReadAll(body)
+    if err != nil {
+        writeError(w, bodyError(err))
+        return
+    }
+    if max := s.Opts.MaxBodySize; max > 0 && int64(len(buf)) > max {
+        writeError(w, ErrBodyTooLarge)
+        return
+    }
+
+    lines, recordErrors := data.ParseLines(buf, precision)
+    ids, streams, resolveErrors, err := resolveLines(scopeOf(ctx), deviceTokenOf(ctx), lines)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    recordErrors = append(recordErrors, resolveErrors...)
+    var writeErr error
+    written := false
+    for _, id := range ids {
+        lineErrors, err := data.PutDataPointsFromLines(id, streams[id])
+        if err != nil {
+            recordErrors = append(recordErrors, failedLines(streams[id], lineErrors, err)...)
+            if writeErr == nil {
+                writeErr = err
+            }
+            continue
+        }
+        recordErrors = append(recordErrors, lineErrors...)
+        written = true
+    }
+    if writeErr != nil && !written {
+        //nothing written, the whole batch can be sent again
+        writeError(w, writeErr)
+        return
+    }
+
+    if len(recordErrors) == 0 {
+        w.WriteHeader(http.StatusNoContent)
+        return
+    }
+    sort.Slice(recordErrors, func(i, j int) bool {
+        return recordErrors[i].Index < recordErrors[j].Index
+    })
+    writeJson(w, http.StatusBadRequest, map[string]interface{}{
+        "error": "partial write: " + strconv.Itoa(len(recordErrors)) + " lines rejected",
+        "errors": recordErrorsJson(recordErrors),
+    })
+}
+
+// RecordErrors of the lines of a data stream which is not written, lines
+// rejected already keep their own error (server errors are not told, see
+// publicError)
+func failedLines(lines []*data.Line, lineErrors []*data.RecordError, err error) []*data.RecordError {
+    err = publicError(err)
+    rejected := make(map[int]bool)
+    for _, e := range lineErrors {
+        rejected[e.Index] = true
+    }
+    recordErrors := append(make([]*data.RecordError, 0, len(lines)), lineErrors...)
+    for _, l := range lines {
+        if !rejected[l.Index] {
+            recordErrors = append(recordErrors, &data.RecordError{Index: l.Index, Err: err})
+        }
+    }
+    return recordErrors
+}
+
+// Group lines by data stream, in the order streams are first seen. Lines
+// of streams which are not found are reported as RecordErrors, other errors
+// fail the whole batch.
+func resolveLines(scope *meta.Scope, device *meta.DeviceToken, lines []*data.Line) ([]int64, map[int64][]*data.Line,
+        []*data.RecordError, error) {
+    type key struct {
+        measurement string
+        device string
+    }
+    type resolved struct {
+        id int64
+        err error
+    }
+    cache := make(map[key]resolved)
+    ids := make([]int64, 0)
+    streams := make(map[int64][]*data.Line)
+    recordErrors := make([]*data.RecordError, 0)
+    for _, l := range lines {
+        k := key{l.Measurement, l.Tags[LineDeviceTag]}
+        if k.device == "" {
+            k.device = l.Tags[LineHostTag]
+        }
+        res, ok := cache[k]
+        if !ok {
+            res.id, res.err = resolveLine(scope, device, k.measurement, k.device)
+            if res.err != nil && res.err != meta.ErrNotFound && res.err != ErrNoDeviceTag {
+                return nil, nil, nil, res.err
+            }
+            cache[k] = res
+        }
+        if res.err != nil {
+            recordErrors = append(recordErrors, &data.RecordError{Index: l.Index, Err: res.err})
+            continue
+        }
+        if _, ok = streams[res.id]; !ok {
+            ids = append(ids, res.id)
+        }
+        streams[res.id] = append(streams[res.id], l)
+    }
+    return ids, streams, recordErrors, nil
+}
+
+// Data stream of a measurement and a device description, device tokens
+// (may be nil) default to their own device
+func resolveLine(scope *meta.Scope, device *meta.DeviceToken, measurement string, deviceDesc string) (int64, error) {
+    if deviceDesc == "" {
+        if device == nil {
+            return 0, ErrNoDeviceTag
+        }
+        d, err := meta.GetDevice(device.DeviceId)
+        if err != nil {
+            return 0, err
+        }
+        deviceDesc = d.Description
+    }
+    ds, err := scope.FindDataStream(deviceDesc, measurement)
+    if err != nil {
+        return 0, err
+    }
+    if err = checkStream(scope, device, ds.Id); err != nil {
+        return 0, err
+    }
+    return ds.Id, nil
+}
@@ -0,0 +1,108 @@
+package storage
+
+import (
+    "bytes"
+    "compress/gzip"
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "github.com/heartsg/dasea/storage/data"
+)
+
+func TestWriteLines(t *testing.T) {
+    s := testServer(testToken("admin"))
+    w := httptest.NewRecorder()
+    s.ServeHTTP(w, httptest.NewRequest("POST", "/v1/write?precision=d", strings.NewReader("cpu usage=1")))
+    if w.Code != http.StatusBadRequest {
+        t.Errorf("unknown precision should be rejected, got status %d", w.Code)
+    }
+
+    //lines without a device are not written, bad lines are reported by line
+    var gz bytes.Buffer
+    zw := gzip.NewWriter(&gz)
+    zw.Write([]byte("cpu usage=1 1\ncpu usage=\n\ncpu,region=east usage=2i 2\n"))
+    zw.Close()
+    r := httptest.NewRequest("POST", "/v1/write?precision=s", &gz)
+    r.Header.Set("Content-Encoding", "gzip")
+    w = httptest.NewRecorder()
+    s.ServeHTTP(w, r)
+    if w.Code != http.StatusBadRequest {
+        t.Fatalf("partial write should be status 400, got %d", w.Code)
+    }
+    var resp struct {
+        Error string
+        Errors []recordError
+    }
+    if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+        t.Fatal(err)
+    }
+    want := []recordError{
+        {0, ErrNoDeviceTag.Error()},
+        {1, data.ErrInvalidLine.Error()},
+        {3, ErrNoDeviceTag.Error()},
+    }
+    if !strings.HasPrefix(resp.Error, "partial write") || len(resp.Errors) != len(want) {
+        t.Fatalf("errors should be %v, got %v", want, resp)
+    }
+    for i := range want {
+        if resp.Errors[i] != want[i] {
+            t.Errorf("error %d should be %v, got %v", i, want[i], resp.Errors[i])
+        }
+    }
+
+    w = httptest.NewRecorder()
+    s.ServeHTTP(w, httptest.NewRequest("POST", "/v1/write", strings.NewReader("# nothing\n")))
+    if w.Code != http.StatusNoContent {
+        t.Errorf("empty batch should be status 204, got %d", w.Code)
+    }
+
+    //gzip bodies are limited once decompressed
+    s.Opts.MaxBodySize = 1024
+    gz.Reset()
+    zw = gzip.NewWriter(&gz)
+    zw.Write(bytes.Repeat([]byte("# padding\n"), 1000))
+    zw.Close()
+    if gz.Len() > 1024 {
+        t.Fatalf("compressed body should fit the limit, got %d bytes", gz.Len())
+    }
+    r = httptest.NewRequest("POST", "/v1/write", &gz)
+    r.Header.Set("Content-Encoding", "gzip")
+    w = httptest.NewRecorder()
+    s.ServeHTTP(w, r)
+    if w.Code != http.StatusRequestEntityTooLarge {
+        t.Errorf("decompressed body over the limit should be status 413, got %d", w.Code)
+    }
+
+    s = testServer(testToken("reader"))
+    w = httptest.NewRecorder()
+    s.ServeHTTP(w, httptest.NewRequest("POST", "/v1/write", strings.NewReader("cpu usage=1")))
+    if w.Code != http.StatusForbidden {
+        t.Errorf("readers should not write, got status %d", w.Code)
+    }
+}
+
+func TestFailedLines(t *testing.T) {
+    lines := []*data.Line{{Index: 1}, {Index: 3}, {Index: 4}}
+    lineErrors := []*data.RecordError{{Index: 3, Err: data.ErrTypeMismatch}}
+    recordErrors := failedLines(lines, lineErrors, data.ErrPipelineFull)
+    want := []recordError{
+        {3, data.ErrTypeMismatch.Error()},
+        {1, data.ErrPipelineFull.Error()},
+        {4, data.ErrPipelineFull.Error()},
+    }
+    got := recordErrorsJson(recordErrors)
+    if len(got) != len(want) {
+        t.Fatalf("errors should be %v, got %v", want, got)
+    }
+    for i := range want {
+        if got[i] != want[i] {
+            t.Errorf("error %d should be %v, got %v", i, want[i], got[i])
+        }
+    }
+    recordErrors = failedLines(lines, nil, data.ErrCorruptBlock)
+    if len(recordErrors) != 3 || recordErrors[0].Err.Error() != "Internal Server Error" {
+        t.Errorf("server errors should not be told, got %v", recordErrors)
+    }
+}
@@ -0,0 +1,176 @@
+package meta
+
+import (
+    "math"
+)
+
+// Unit conversion
+//
+// Values are converted through the conversion base of the category,
+//   value in base = value * ConversionFactor + ConversionOffset
+// so units can only be converted within the same UnitCategory. Units that
+// are not linear to the base (e.g. milliwatts to dBm) have ToBase and FromBase
+// functions instead.
+//
+// Example:
+//  miles, err := meta.Convert(10, meta.UKilometer, meta.UMile)
+
+// Unit systems, see UnitOfSystem
+const (
+    UnitSystemMetric = "metric"
+    UnitSystemUS = "US"
+    UnitSystemUK = "UK"
+)
+
+// Built-in or custom unit by id, see customunit.go
+func GetUnit(id int64) (*Unit, error) {
+    u, ok := units[int(id)]
+    if !ok {
+        return getCustomUnit(id)
+    }
+    return u, nil
+}
+
+func (u *Unit) InSystem(system string) bool {
+    switch system {
+    case UnitSystemMetric:
+        return u.IsMetricSystem
+    case UnitSystemUS:
+        return u.IsUSSystem
+    case UnitSystemUK:
+        return u.IsUKSystem
+    }
+    return false
+}
+
+// Conversion of values from one unit to another, build it once and apply
+// it to many values
+type UnitConversion struct {
+    From *Unit
+    To *Unit
+    // value in To = value in From * Factor + Offset, only if Linear
+    Factor float64
+    Offset float64
+    Linear bool
+}
+
+func (u *Unit) linear() bool {
+    return u.ToBase == nil && u.FromBase == nil
+}
+
+func (u *Unit) toBase(v float64) float64 {
+    if u.ToBase != nil {
+        return u.ToBase(v)
+    }
+    return v*u.ConversionFactor + u.ConversionOffset
+}
+
+func (u *Unit) fromBase(v float64) float64 {
+    if u.FromBase != nil {
+        return u.FromBase(v)
+    }
+    return (v - u.ConversionOffset) / u.ConversionFactor
+}
+
+// Plug in conversion functions of a non-linear unit at start up (before any
+// conversion), toBase and fromBase must be the inverse of each other and
+// increasing (so that min and max still hold after conversion). Units without
+// functions use ConversionFactor and ConversionOffset.
+func SetUnitConversionFuncs(id int64, toBase func(float64) float64, fromBase func(float64) float64) error {
+    u, err := GetUnit(id)
+    if err != nil {
+        return err
+    }
+    if (toBase == nil) != (fromBase == nil) {
+        return ErrNotConvertible
+    }
+    u.ToBase, u.FromBase = toBase, fromBase
+    return nil
+}
+
+func milliwattToDbm(v float64) float64 {
+    return 10 * math.Log10(v)
+}
+
+func dbmToMilliwatt(v float64) float64 {
+    return math.Pow(10, v/10)
+}
+
+func NewUnitConversion(fromUnitId int64, toUnitId int64) (*UnitConversion, error) {
+    from, err := GetUnit(fromUnitId)
+    if err != nil {
+        return nil, err
+    }
+    to, err := GetUnit(toUnitId)
+    if err != nil {
+        return nil, err
+    }
+    if from.CategoryId != to.CategoryId {
+        return nil, ErrIncompatibleUnits
+    }
+    if (from.linear() && from.ConversionFactor == 0) || (to.linear() && to.ConversionFactor == 0) {
+        return nil, ErrNotConvertible
+    }
+    c := &UnitConversion{From: from, To: to}
+    if from.linear() && to.linear() {
+        c.Linear = true
+        c.Factor = from.ConversionFactor / to.ConversionFactor
+        c.Offset = (from.ConversionOffset - to.ConversionOffset) / to.ConversionFactor
+    }
+    return c, nil
+}
+
+func (c *UnitConversion) Convert(value float64) float64 {
+    if c.Linear {
+        return value*c.Factor + c.Offset
+    }
+    return c.To.fromBase(c.From.toBase(value))
+}
+
+// Convert a value of unit fromUnitId to unit toUnitId
+func Convert(value float64, fromUnitId int64, toUnitId int64) (float64, error) {
+    if fromUnitId == toUnitId {
+        return value, nil
+    }
+    c, err := NewUnitConversion(fromUnitId, toUnitId)
+    if err != nil {
+        return 0, err
+    }
+    return c.Convert(value), nil
+}
+
+// Unit of the same category in a unit system (metric, US or UK) to show values
+// of unitId. It is unitId itself if unitId is already in the system or no unit of
+// the category is in the system (e.g. time). Otherwise it is the unit closest in
+// magnitude, e.g. inches are shown as centimeters and miles as kilometers.
+func UnitOfSystem(unitId int64, system string) (int64, error) {
+    if system != UnitSystemMetric && system != UnitSystemUS && system != UnitSystemUK {
+        return 0, ErrUnknownUnitSystem
+    }
+    u, err := GetUnit(unitId)
+    if err != nil {
+        return 0, err
+    }
+    if u.InSystem(system) {
+        return unitId, nil
+    }
+    var best *Unit
+    distance := math.Inf(1)
+    for _, candidate := range units {
+        if candidate.CategoryId != u.CategoryId || !candidate.InSystem(system) {
+            continue
+        }
+        d := math.Inf(1)
+        if candidate.ConversionFactor > 0 && u.ConversionFactor > 0 {
+            d = math.Abs(math.Log(candidate.ConversionFactor / u.ConversionFactor))
+        }
+        //map order is random, ties go to the smaller id
+        if best == nil || d < distance || (d == distance && candidate.Id < best.Id) {
+            best, distance = candidate, d
+        }
+    }
+    if best == nil {
+        return unitId, nil
+    }
+    return best.Id, nil
+}
@@ -0,0 +1,208 @@
+package meta
+
+import (
+    "math"
+    "testing"
+)
+
+func TestConvert(t *testing.T) {
+    v, err := Convert(10, UKilometer, UMile)
+    if err != nil || math.Abs(v-6.213712) > 1e-6 {
+        t.Errorf("10 km should be 6.213712 miles, got %v %v", v, err)
+    }
+    v, err = Convert(1, UHour, USecond)
+    if err != nil || v != 3600 {
+        t.Errorf("1 hour should be 3600 seconds, got %v %v", v, err)
+    }
+    v, err = Convert(42, UPascal, UPascal)
+    if err != nil || v != 42 {
+        t.Errorf("same unit should not change, got %v %v", v, err)
+    }
+    if _, err = Convert(1, UKilometer, UKilogram); err != ErrIncompatibleUnits {
+        t.Errorf("length cannot be converted to mass, got %v", err)
+    }
+    if _, err = Convert(1, UKilometer, 12345); err != ErrUnknownUnit {
+        t.Errorf("unknown unit should be rejected, got %v", err)
+    }
+}
+
+func TestUnitOfSystem(t *testing.T) {
+    cases := []struct {
+        unit int64
+        system string
+        want int64
+    }{
+        {UInch, UnitSystemMetric, UCentimeter},
+        {UMile, UnitSystemMetric, UKilometer},
+        {UKilometer, UnitSystemUS, UMile},
+        {UPound, UnitSystemMetric, UKilogram},
+        {UPoundPerSquareInch, UnitSystemMetric, UKilopascal},
+        {UMilePerHour, UnitSystemMetric, UKilometerPerHour},
+        {UGallonUSLiquid, UnitSystemUK, UGallonUK},
+        //already in the system
+        {UMeter, UnitSystemMetric, UMeter},
+        //no unit of time is in any system
+        {UHour, UnitSystemUS, UHour},
+    }
+    for _, c := range cases {
+        got, err := UnitOfSystem(c.unit, c.system)
+        if err != nil || got != c.want {
+            t.Errorf("unit %d in %s should be %d, got %d %v", c.unit, c.system, c.want, got, err)
+        }
+    }
+    if _, err := UnitOfSystem(UMeter, "imperial"); err != ErrUnknownUnitSystem {
+        t.Errorf("unknown system should be rejected, got %v", err)
+    }
+}
+
+// every category has exactly one conversion base, every unit can be converted
+func TestUnitCatalog(t *testing.T) {
+    bases := make(map[int64]int)
+    for id, u := range units {
+        if int64(id) != u.Id {
+            t.Errorf("unit %d is saved as %d", u.Id, id)
+        }
+        if _, ok := unitCategories[int(u.CategoryId)]; !ok {
+            t.Errorf("unit %d has unknown category %d", u.Id, u.CategoryId)
+        }
+        if u.IsConversionBase {
+            bases[u.CategoryId]++
+            if u.ConversionFactor != 1 || u.ConversionOffset != 0 || !u.linear() {
+                t.Errorf("conversion base %d should have factor 1 and no offset", u.Id)
+            }
+        }
+        if u.linear() && u.ConversionFactor <= 0 {
+            t.Errorf("unit %d has no conversion factor", u.Id)
+        }
+    }
+    for _, c := range unitCategories {
+        if hasUnits(c.Id) && bases[c.Id] != 1 {
+            t.Errorf("category %s should have one conversion base, got %d", c.Name, bases[c.Id])
+        }
+    }
+}
+
+func hasUnits(categoryId int64) bool {
+    for _, u := range units {
+        if u.CategoryId == categoryId {
+            return true
+        }
+    }
+    return false
+}
+
+// converting to any unit of the category and back gives the same value
+func TestConvertRoundTrip(t *testing.T) {
+    for _, from := range units {
+        for _, to := range units {
+            c, err := NewUnitConversion(from.Id, to.Id)
+            if from.CategoryId != to.CategoryId {
+                if err != ErrIncompatibleUnits {
+                    t.Fatalf("%s to %s should fail, got %v", from.Name, to.Name, err)
+                }
+                continue
+            }
+            if err != nil {
+                t.Fatalf("%s to %s: %v", from.Name, to.Name, err)
+            }
+            back, err := NewUnitConversion(to.Id, from.Id)
+            if err != nil {
+                t.Fatal(err)
+            }
+            for _, v := range []float64{0.5, 1, 25.5, 1000} {
+                got := back.Convert(c.Convert(v))
+                if math.Abs(got-v) > 1e-9*v {
+                    t.Errorf("%v %s to %s and back should be %v, got %v", v, from.Name, to.Name, v, got)
+                }
+            }
+        }
+    }
+}
+
+// known values for every category having more than one unit
+func TestConvertKnownValues(t *testing.T) {
+    cases := []struct {
+        value float64
+        from int64
+        to int64
+        want float64
+    }{
+        {1, UKilometer, UMeter, 1000},
+        {1, UFoot, UInch, 12},
+        {1, UNauticalMile, UMeter, 1852},
+        {1, UPound, UOunce, 16},
+        {1, UOunce, UGram, 28.349523125},
+        {1, UTonUS, UPound, 2000},
+        {1, UTonUK, UPound, 2240},
+        {1, UDay, UMinute, 1440},
+        {1, UMillisecond, UMicrosecond, 1000},
+        {1, UAmpere, UMilliampere, 1000},
+        {0, UDegreeCelsius, UDegreeFahrenheit, 32},
+        {100, UDegreeCelsius, UDegreeFahrenheit, 212},
+        {-40, UDegreeFahrenheit, UDegreeCelsius, -40},
+        {0, UKelvin, UDegreeCelsius, -273.15},
+        {0, UDegreeFahrenheit, UKelvin, 255.37222222222222},
+        {180, UDegree, URadian, math.Pi},
+        {1, UStandardAtmosphere, UMillibar, 1013.25},
+        {1, UBar, UKilopascal, 100},
+        {1, UPoundPerSquareInch, UPascal, 6894.757},
+        {1, UKilowattHour, UMegajoule, 3.6},
+        {1, UCalorieThermochemical, UJoule, 4.184},
+        {1, UGigawatt, UMegawatt, 1000},
+        {1, UKilowatt, UWatt, 1000},
+        {1, UHorsepowerMetric, UWatt, 735.499},
+        {1, UKilonewton, UNewton, 1000},
+        {1, UPoundForce, UNewton, 4.448222},
+        {1, UVolt, UMillivolt, 1000},
+        {1, UMicrofarad, UPicofarad, 1000000},
+        {1, UGigahertz, UKilohertz, 1000000},
+        {1, USquareKilometer, USquareMeter, 1000000},
+        {1, UAcre, USquareFoot, 43560},
+        {1, ULitre, UCubicCentimeter, 1000},
+        {1, UCubicFoot, UCubicInch, 1728},
+        {1, UGallonUSLiquid, UCubicInch, 231},
+        {1, UKilogramPerLitre, UKilogramPerCubicMeter, 1000},
+        {1, UKnot, UKilometerPerHour, 1.852},
+        {36, UKilometerPerHour, UMeterPerSecond, 10},
+        {1, UPoundForceFoot, UPoundForceInch, 12},
+        {1, UPoundForceFoot, UNewtonMeterTorque, 1.3558179483314004},
+        {0, UDbm, URssiMilliwatt, 1},
+        {30, UDbm, URssiMilliwatt, 1000},
+        {0.001, URssiMilliwatt, UDbm, -30},
+        {0, UDbw, UDbm, 30},
+        {1000, URssiMilliwatt, UDbw, 0},
+    }
+    covered := make(map[int64]bool)
+    for _, c := range cases {
+        got, err := Convert(c.value, c.from, c.to)
+        if err != nil {
+            t.Errorf("%v from %d to %d: %v", c.value, c.from, c.to, err)
+            continue
+        }
+        if math.Abs(got-c.want) > 1e-6*math.Max(1, math.Abs(c.want)) {
+            t.Errorf("%v from %d to %d should be %v, got %v", c.value, c.from, c.to, c.want, got)
+        }
+        covered[units[int(c.from)].CategoryId] = true
+    }
+    count := make(map[int64]int)
+    for _, u := range units {
+        count[u.CategoryId]++
+    }
+    for category, n := range count {
+        if n > 1 && !covered[category] {
+            t.Errorf("category %s has no known value", unitCategories[int(category)].Name)
+        }
+    }
+
+    c, err := NewUnitConversion(UDegreeCelsius, UDegreeFahrenheit)
+    if err != nil || !c.Linear || math.Abs(c.Factor-1.8) > 1e-9 || math.Abs(c.Offset-32) > 1e-9 {
+        t.Errorf("celsius to fahrenheit should be linear, got %v %v", c, err)
+    }
+    c, err = NewUnitConversion(UDbm, URssiMilliwatt)
+    if err != nil || c.Linear {
+        t.Errorf("dBm to milliwatt should not be linear, got %v %v", c, err)
+    }
+    if err = SetUnitConversionFuncs(URssiMilliwatt, milliwattToDbm, nil); err != ErrNotConvertible {
+        t.Errorf("both conversion functions should be given, got %v", err)
+    }
+}
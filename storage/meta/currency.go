@@ -0,0 +1,503 @@
+package meta
+
+// Currencies and exchange rates
+//
+// Currencies are ISO 4217 circulating currencies, a currency is used as the
+// unit of a data point (DataPointUnits) like any other unit. The id of a
+// currency is UcCirculatingCurrency * 10000 + its ISO 4217 numeric code, e.g.
+// CurrencyUSD is 1010840.
+//
+// Exchange rates change over time, an ExchangeRate is valid from ValidFrom
+// until the next rate of the same currency. Values are converted with the
+// rates valid at their own time (see CurrencyConversion), through
+// BaseCurrency which has no rates.
+//
+// Example:
+//  n, err := meta.ImportExchangeRatesCSV(file)
+//  sgd, err := meta.ConvertCurrency(100, meta.CurrencyUSD, meta.CurrencySGD, t)
+import (
+    "encoding/csv"
+    "io"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+type Currency struct {
+	Id int64
+	CategoryId int64 `xorm:"index notnull"`
+	Name string `xorm:"varchar(64) notnull"`
+	ISOCode string `xorm:"varchar(8) notnull unique iso_code"`
+	NumericCode int `xorm:"notnull"`
+	Symbol string `xorm:"varchar(8) notnull"`
+	State string `xorm:"varchar(64) notnull"`
+	CreatedAt time.Time `xorm:"created"`
+	UpdatedAt time.Time `xorm:"updated"`
+	DeletedAt time.Time `xorm:"deleted"`
+}
+
+func CreateCurrency() error {
+    c := &Currency{}
+	created, err := syncTable(c)
+    //built-in rows are inserted only into a new table
+    if err != nil || !created {
+        return err
+    }
+	for _, currency := range currencies {
+		err = seedRow(currency, currency.Id, &Currency{})
+        if err != nil {
+            return err
+        }
+	}
+    return nil
+}
+func GetCurrenciesCache() map[int]*Currency {
+    return currencies
+}
+func GetCurrency(id int64) (*Currency, error) {
+    c, ok := currencies[int(id)]
+    if !ok {
+        return nil, ErrUnknownCurrency
+    }
+    return c, nil
+}
+// Currency by ISO 4217 code, e.g. "USD"
+func GetCurrencyByCode(code string) (*Currency, error) {
+    c, ok := currenciesByCode[strings.ToUpper(code)]
+    if !ok {
+        return nil, ErrUnknownCurrency
+    }
+    return c, nil
+}
+// Whether a unit id (e.g. of DataPointUnits) is a currency
+func IsCurrency(id int64) bool {
+    _, ok := currencies[int(id)]
+    return ok
+}
+
+func isCurrencyCategory(categoryId int64) bool {
+    return categoryId >= UcCirculatingCurrency && categoryId <= UcFictionalCurrency
+}
+
+type ExchangeRate struct {
+	Id int64
+	CurrencyId int64 `xorm:"notnull unique(currency_valid_from)"`
+	//units of the currency per one unit of BaseCurrency
+	Rate float64 `xorm:"notnull"`
+	ValidFrom time.Time `xorm:"notnull unique(currency_valid_from)"`
+	CreatedAt time.Time `xorm:"created"`
+}
+
+// Rates of all currencies are against BaseCurrency
+const BaseCurrency = CurrencyUSD
+
+var (
+    exchangeRatesLock sync.RWMutex
+    //rates of each currency sorted by ValidFrom
+    exchangeRates = make(map[int64][]*ExchangeRate)
+)
+
+func CreateExchangeRateTable() error {
+    r := &ExchangeRate{}
+	_, err := syncTable(r)
+    return err
+}
+
+func cacheExchangeRate(r *ExchangeRate) {
+    exchangeRatesLock.Lock()
+    defer exchangeRatesLock.Unlock()
+    rates := exchangeRates[r.CurrencyId]
+    i := sort.Search(len(rates), func(i int) bool { return !rates[i].ValidFrom.Before(r.ValidFrom) })
+    if i < len(rates) && rates[i].ValidFrom.Equal(r.ValidFrom) {
+        rates[i] = r
+        return
+    }
+    rates = append(rates, nil)
+    copy(rates[i+1:], rates[i:])
+    rates[i] = r
+    exchangeRates[r.CurrencyId] = rates
+}
+
+// Use rates without saving them, e.g. rates of a live feed
+func CacheExchangeRates(rates []*ExchangeRate) {
+    for _, r := range rates {
+        cacheExchangeRate(r)
+    }
+}
+
+// Load all exchange rates into the cache, normally at start up and after
+// rates are imported by another node
+func LoadExchangeRates() error {
+    rates := make([]*ExchangeRate, 0)
+    err := primary().Asc("valid_from").Find(&rates)
+    if err != nil {
+        return err
+    }
+    CacheExchangeRates(rates)
+    return nil
+}
+
+// Set the rate of a currency from validFrom on, replacing the rate with the
+// same validFrom if any
+func SetExchangeRate(currencyId int64, validFrom time.Time, rate float64) (*ExchangeRate, error) {
+    if _, err := GetCurrency(currencyId); err != nil {
+        return nil, err
+    }
+    if currencyId == BaseCurrency || !(rate > 0) || validFrom.IsZero() {
+        return nil, ErrInvalidExchangeRate
+    }
+    validFrom = validFrom.UTC()
+    r := &ExchangeRate{CurrencyId: currencyId, Rate: rate, ValidFrom: validFrom}
+    _, err := primary().Where("currency_id = ? and valid_from = ?", currencyId, validFrom).Delete(&ExchangeRate{})
+    if err != nil {
+        return nil, err
+    }
+    _, err = primary().Insert(r)
+    if err != nil {
+        return nil, err
+    }
+    cacheExchangeRate(r)
+    return r, nil
+}
+
+// Rates of a currency within [start, end), sorted by ValidFrom
+func GetExchangeRates(currencyId int64, start time.Time, end time.Time) ([]*ExchangeRate, error) {
+    rates := make([]*ExchangeRate, 0)
+    err := primary().Where("currency_id = ? and valid_from >= ? and valid_from < ?", currencyId, start.UTC(), end.UTC()).
+        Asc("valid_from").Find(&rates)
+    return rates, err
+}
+
+// Parse exchange rates in CSV, one rate per line as
+//  valid from,ISO code,rate
+// e.g. "2016-01-04,SGD,1.4235". Valid from is a date (UTC) or RFC 3339 time,
+// rate is units of the currency per one unit of BaseCurrency. A first line
+// not starting with a time is taken as header.
+func ParseExchangeRatesCSV(r io.Reader) ([]*ExchangeRate, error) {
+    reader := csv.NewReader(r)
+    reader.FieldsPerRecord = 3
+    reader.TrimLeadingSpace = true
+    rates := make([]*ExchangeRate, 0)
+    for line := 0; ; line++ {
+        fields, err := reader.Read()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return nil, ErrInvalidExchangeRate
+        }
+        validFrom, err := parseValidFrom(fields[0])
+        if err != nil {
+            if line == 0 {
+                continue
+            }
+            return nil, ErrInvalidExchangeRate
+        }
+        c, err := GetCurrencyByCode(fields[1])
+        if err != nil {
+            return nil, err
+        }
+        rate, err := strconv.ParseFloat(fields[2], 64)
+        if err != nil || !(rate > 0) || c.Id == BaseCurrency {
+            return nil, ErrInvalidExchangeRate
+        }
+        rates = append(rates, &ExchangeRate{CurrencyId: c.Id, Rate: rate, ValidFrom: validFrom})
+    }
+    return rates, nil
+}
+
+func parseValidFrom(s string) (time.Time, error) {
+    if t, err := time.Parse("2006-01-02", s); err == nil {
+        return t, nil
+    }
+    t, err := time.Parse(time.RFC3339, s)
+    if err != nil {
+        return time.Time{}, err
+    }
+    return t.UTC(), nil
+}
+
+// Import exchange rates in CSV (see ParseExchangeRatesCSV), nothing is saved
+// if any line is invalid. Returns the number of rates saved.
+func ImportExchangeRatesCSV(r io.Reader) (int, error) {
+    rates, err := ParseExchangeRatesCSV(r)
+    if err != nil {
+        return 0, err
+    }
+    for i, rate := range rates {
+        if _, err = SetExchangeRate(rate.CurrencyId, rate.ValidFrom, rate.Rate); err != nil {
+            return i, err
+        }
+    }
+    return len(rates), nil
+}
+
+// Rate of a currency valid at t, from the cache
+func ExchangeRateAt(currencyId int64, t time.Time) (float64, error) {
+    if currencyId == BaseCurrency {
+        return 1, nil
+    }
+    exchangeRatesLock.RLock()
+    defer exchangeRatesLock.RUnlock()
+    rates := exchangeRates[currencyId]
+    i := sort.Search(len(rates), func(i int) bool { return rates[i].ValidFrom.After(t) })
+    if i == 0 {
+        return 0, ErrNoExchangeRate
+    }
+    return rates[i-1].Rate, nil
+}
+
+// Conversion of values from one currency to another, the rates depend on
+// the time of each value
+type CurrencyConversion struct {
+    From *Currency
+    To *Currency
+}
+
+func NewCurrencyConversion(fromCurrencyId int64, toCurrencyId int64) (*CurrencyConversion, error) {
+    from, err := GetCurrency(fromCurrencyId)
+    if err != nil {
+        return nil, err
+    }
+    to, err := GetCurrency(toCurrencyId)
+    if err != nil {
+        return nil, err
+    }
+    return &CurrencyConversion{From: from, To: to}, nil
+}
+
+// Convert a value of time t, ErrNoExchangeRate if either currency has no rate
+// valid at t
+func (c *CurrencyConversion) Convert(value float64, t time.Time) (float64, error) {
+    if c.From.Id == c.To.Id {
+        return value, nil
+    }
+    from, err := ExchangeRateAt(c.From.Id, t)
+    if err != nil {
+        return 0, err
+    }
+    to, err := ExchangeRateAt(c.To.Id, t)
+    if err != nil {
+        return 0, err
+    }
+    return value / from * to, nil
+}
+
+// Convert a value of currency fromCurrencyId at time t to currency toCurrencyId
+func ConvertCurrency(value float64, fromCurrencyId int64, toCurrencyId int64, t time.Time) (float64, error) {
+    c, err := NewCurrencyConversion(fromCurrencyId, toCurrencyId)
+    if err != nil {
+        return 0, err
+    }
+    return c.Convert(value, t)
+}
+
+func currencyId(numericCode int) int64 {
+    return UcCirculatingCurrency*10000 + int64(numericCode)
+}
+
+// Ids of commonly used currencies, see GetCurrencyByCode for the others
+const (
+    CurrencyUSD = UcCirculatingCurrency*10000 + 840
+    CurrencyEUR = UcCirculatingCurrency*10000 + 978
+    CurrencyGBP = UcCirculatingCurrency*10000 + 826
+    CurrencyJPY = UcCirculatingCurrency*10000 + 392
+    CurrencyCNY = UcCirculatingCurrency*10000 + 156
+    CurrencyCHF = UcCirculatingCurrency*10000 + 756
+    CurrencyAUD = UcCirculatingCurrency*10000 + 36
+    CurrencyCAD = UcCirculatingCurrency*10000 + 124
+    CurrencyHKD = UcCirculatingCurrency*10000 + 344
+    CurrencySGD = UcCirculatingCurrency*10000 + 702
+    CurrencyMYR = UcCirculatingCurrency*10000 + 458
+    CurrencyINR = UcCirculatingCurrency*10000 + 356
+)
+
+var (
+    currencies = make(map[int]*Currency)
+    currenciesByCode = make(map[string]*Currency)
+)
+
+func init() {
+    for _, c := range iso4217 {
+        currency := &Currency{
+            Id: currencyId(c.numeric),
+            CategoryId: UcCirculatingCurrency,
+            Name: c.name,
+            ISOCode: c.code,
+            NumericCode: c.numeric,
+            Symbol: c.symbol,
+            State: c.state,
+        }
+        if currency.Symbol == "" {
+            currency.Symbol = c.code
+        }
+        currencies[int(currency.Id)] = currency
+        currenciesByCode[c.code] = currency
+    }
+}
+
+// ISO 4217 circulating currencies, the symbol is the code if not given
+var iso4217 = []struct {
+    code string
+    numeric int
+    name string
+    symbol string
+    state string
+}{
+    {"AED", 784, "UAE Dirham", "", "United Arab Emirates"},
+    {"AFN", 971, "Afghani", "؋", "Afghanistan"},
+    {"ALL", 8, "Lek", "L", "Albania"},
+    {"AMD", 51, "Armenian Dram", "֏", "Armenia"},
+    {"AOA", 973, "Kwanza", "Kz", "Angola"},
+    {"ARS", 32, "Argentine Peso", "$", "Argentina"},
+    {"AUD", 36, "Australian Dollar", "$", "Australia"},
+    {"AWG", 533, "Aruban Florin", "ƒ", "Aruba"},
+    {"AZN", 944, "Azerbaijan Manat", "₼", "Azerbaijan"},
+    {"BAM", 977, "Convertible Mark", "KM", "Bosnia and Herzegovina"},
+    {"BBD", 52, "Barbados Dollar", "$", "Barbados"},
+    {"BDT", 50, "Taka", "৳", "Bangladesh"},
+    {"BHD", 48, "Bahraini Dinar", "", "Bahrain"},
+    {"BIF", 108, "Burundi Franc", "", "Burundi"},
+    {"BMD", 60, "Bermudian Dollar", "$", "Bermuda"},
+    {"BND", 96, "Brunei Dollar", "$", "Brunei Darussalam"},
+    {"BOB", 68, "Boliviano", "Bs", "Bolivia"},
+    {"BRL", 986, "Brazilian Real", "R$", "Brazil"},
+    {"BSD", 44, "Bahamian Dollar", "$", "Bahamas"},
+    {"BTN", 64, "Ngultrum", "", "Bhutan"},
+    {"BWP", 72, "Pula", "P", "Botswana"},
+    {"BYN", 933, "Belarusian Ruble", "Br", "Belarus"},
+    {"BZD", 84, "Belize Dollar", "$", "Belize"},
+    {"CAD", 124, "Canadian Dollar", "$", "Canada"},
+    {"CDF", 976, "Congolese Franc", "", "Congo, Democratic Republic"},
+    {"CHF", 756, "Swiss Franc", "", "Switzerland"},
+    {"CLP", 152, "Chilean Peso", "$", "Chile"},
+    {"CNY", 156, "Yuan Renminbi", "¥", "China"},
+    {"COP", 170, "Colombian Peso", "$", "Colombia"},
+    {"CRC", 188, "Costa Rican Colon", "₡", "Costa Rica"},
+    {"CUP", 192, "Cuban Peso", "$", "Cuba"},
+    {"CVE", 132, "Cabo Verde Escudo", "", "Cabo Verde"},
+    {"CZK", 203, "Czech Koruna", "Kč", "Czechia"},
+    {"DJF", 262, "Djibouti Franc", "", "Djibouti"},
+    {"DKK", 208, "Danish Krone", "kr", "Denmark"},
+    {"DOP", 214, "Dominican Peso", "$", "Dominican Republic"},
+    {"DZD", 12, "Algerian Dinar", "", "Algeria"},
+    {"EGP", 818, "Egyptian Pound", "£", "Egypt"},
+    {"ERN", 232, "Nakfa", "", "Eritrea"},
+    {"ETB", 230, "Ethiopian Birr", "", "Ethiopia"},
+    {"EUR", 978, "Euro", "€", "European Union"},
+    {"FJD", 242, "Fiji Dollar", "$", "Fiji"},
+    {"FKP", 238, "Falkland Islands Pound", "£", "Falkland Islands"},
+    {"GBP", 826, "Pound Sterling", "£", "United Kingdom"},
+    {"GEL", 981, "Lari", "₾", "Georgia"},
+    {"GHS", 936, "Ghana Cedi", "₵", "Ghana"},
+    {"GIP", 292, "Gibraltar Pound", "£", "Gibraltar"},
+    {"GMD", 270, "Dalasi", "", "Gambia"},
+    {"GNF", 324, "Guinean Franc", "", "Guinea"},
+    {"GTQ", 320, "Quetzal", "Q", "Guatemala"},
+    {"GYD", 328, "Guyana Dollar", "$", "Guyana"},
+    {"HKD", 344, "Hong Kong Dollar", "$", "Hong Kong"},
+    {"HNL", 340, "Lempira", "L", "Honduras"},
+    {"HTG", 332, "Gourde", "", "Haiti"},
+    {"HUF", 348, "Forint", "Ft", "Hungary"},
+    {"IDR", 360, "Rupiah", "Rp", "Indonesia"},
+    {"ILS", 376, "New Israeli Sheqel", "₪", "Israel"},
+    {"INR", 356, "Indian Rupee", "₹", "India"},
+    {"IQD", 368, "Iraqi Dinar", "", "Iraq"},
+    {"IRR", 364, "Iranian Rial", "", "Iran"},
+    {"ISK", 352, "Iceland Krona", "kr", "Iceland"},
+    {"JMD", 388, "Jamaican Dollar", "$", "Jamaica"},
+    {"JOD", 400, "Jordanian Dinar", "", "Jordan"},
+    {"JPY", 392, "Yen", "¥", "Japan"},
+    {"KES", 404, "Kenyan Shilling", "", "Kenya"},
+    {"KGS", 417, "Som", "", "Kyrgyzstan"},
+    {"KHR", 116, "Riel", "៛", "Cambodia"},
+    {"KMF", 174, "Comorian Franc", "", "Comoros"},
+    {"KPW", 408, "North Korean Won", "₩", "Korea, Democratic People's Republic"},
+    {"KRW", 410, "Won", "₩", "Korea, Republic"},
+    {"KWD", 414, "Kuwaiti Dinar", "", "Kuwait"},
+    {"KYD", 136, "Cayman Islands Dollar", "$", "Cayman Islands"},
+    {"KZT", 398, "Tenge", "₸", "Kazakhstan"},
+    {"LAK", 418, "Lao Kip", "₭", "Lao People's Democratic Republic"},
+    {"LBP", 422, "Lebanese Pound", "", "Lebanon"},
+    {"LKR", 144, "Sri Lanka Rupee", "", "Sri Lanka"},
+    {"LRD", 430, "Liberian Dollar", "$", "Liberia"},
+    {"LSL", 426, "Loti", "", "Lesotho"},
+    {"LYD", 434, "Libyan Dinar", "", "Libya"},
+    {"MAD", 504, "Moroccan Dirham", "", "Morocco"},
+    {"MDL", 498, "Moldovan Leu", "", "Moldova"},
+    {"MGA", 969, "Malagasy Ariary", "Ar", "Madagascar"},
+    {"MKD", 807, "Denar", "", "North Macedonia"},
+    {"MMK", 104, "Kyat", "K", "Myanmar"},
+    {"MNT", 496, "Tugrik", "₮", "Mongolia"},
+    {"MOP", 446, "Pataca", "", "Macao"},
+    {"MRU", 929, "Ouguiya", "", "Mauritania"},
+    {"MUR", 480, "Mauritius Rupee", "", "Mauritius"},
+    {"MVR", 462, "Rufiyaa", "", "Maldives"},
+    {"MWK", 454, "Malawi Kwacha", "", "Malawi"},
+    {"MXN", 484, "Mexican Peso", "$", "Mexico"},
+    {"MYR", 458, "Malaysian Ringgit", "RM", "Malaysia"},
+    {"MZN", 943, "Mozambique Metical", "", "Mozambique"},
+    {"NAD", 516, "Namibia Dollar", "$", "Namibia"},
+    {"NGN", 566, "Naira", "₦", "Nigeria"},
+    {"NIO", 558, "Cordoba Oro", "C$", "Nicaragua"},
+    {"NOK", 578, "Norwegian Krone", "kr", "Norway"},
+    {"NPR", 524, "Nepalese Rupee", "", "Nepal"},
+    {"NZD", 554, "New Zealand Dollar", "$", "New Zealand"},
+    {"OMR", 512, "Rial Omani", "", "Oman"},
+    {"PAB", 590, "Balboa", "B/.", "Panama"},
+    {"PEN", 604, "Sol", "S/", "Peru"},
+    {"PGK", 598, "Kina", "K", "Papua New Guinea"},
+    {"PHP", 608, "Philippine Peso", "₱", "Philippines"},
+    {"PKR", 586, "Pakistan Rupee", "", "Pakistan"},
+    {"PLN", 985, "Zloty", "zł", "Poland"},
+    {"PYG", 600, "Guarani", "₲", "Paraguay"},
+    {"QAR", 634, "Qatari Rial", "", "Qatar"},
+    {"RON", 946, "Romanian Leu", "lei", "Romania"},
+    {"RSD", 941, "Serbian Dinar", "", "Serbia"},
+    {"RUB", 643, "Russian Ruble", "₽", "Russian Federation"},
+    {"RWF", 646, "Rwanda Franc", "", "Rwanda"},
+    {"SAR", 682, "Saudi Riyal", "", "Saudi Arabia"},
+    {"SBD", 90, "Solomon Islands Dollar", "$", "Solomon Islands"},
+    {"SCR", 690, "Seychelles Rupee", "", "Seychelles"},
+    {"SDG", 938, "Sudanese Pound", "", "Sudan"},
+    {"SEK", 752, "Swedish Krona", "kr", "Sweden"},
+    {"SGD", 702, "Singapore Dollar", "$", "Singapore"},
+    {"SHP", 654, "Saint Helena Pound", "£", "Saint Helena"},
+    {"SLE", 925, "Leone", "", "Sierra Leone"},
+    {"SOS", 706, "Somali Shilling", "", "Somalia"},
+    {"SRD", 968, "Surinam Dollar", "$", "Suriname"},
+    {"SSP", 728, "South Sudanese Pound", "£", "South Sudan"},
+    {"STN", 930, "Dobra", "Db", "Sao Tome and Principe"},
+    {"SVC", 222, "El Salvador Colon", "₡", "El Salvador"},
+    {"SYP", 760, "Syrian Pound", "£", "Syrian Arab Republic"},
+    {"SZL", 748, "Lilangeni", "", "Eswatini"},
+    {"THB", 764, "Baht", "฿", "Thailand"},
+    {"TJS", 972, "Somoni", "", "Tajikistan"},
+    {"TMT", 934, "Turkmenistan New Manat", "", "Turkmenistan"},
+    {"TND", 788, "Tunisian Dinar", "", "Tunisia"},
+    {"TOP", 776, "Pa'anga", "T$", "Tonga"},
+    {"TRY", 949, "Turkish Lira", "₺", "Türkiye"},
+    {"TTD", 780, "Trinidad and Tobago Dollar", "$", "Trinidad and Tobago"},
+    {"TWD", 901, "New Taiwan Dollar", "$", "Taiwan"},
+    {"TZS", 834, "Tanzanian Shilling", "", "Tanzania"},
+    {"UAH", 980, "Hryvnia", "₴", "Ukraine"},
+    {"UGX", 800, "Uganda Shilling", "", "Uganda"},
+    {"USD", 840, "US Dollar", "$", "United States"},
+    {"UYU", 858, "Peso Uruguayo", "$", "Uruguay"},
+    {"UZS", 860, "Uzbekistan Sum", "", "Uzbekistan"},
+    {"VES", 928, "Bolivar Soberano", "Bs.", "Venezuela"},
+    {"VND", 704, "Dong", "₫", "Viet Nam"},
+    {"VUV", 548, "Vatu", "", "Vanuatu"},
+    {"WST", 882, "Tala", "", "Samoa"},
+    {"XAF", 950, "CFA Franc BEAC", "", "Central African CFA franc zone"},
+    {"XCD", 951, "East Caribbean Dollar", "$", "Eastern Caribbean Currency Union"},
+    {"XCG", 532, "Caribbean Guilder", "", "Curaçao and Sint Maarten"},
+    {"XOF", 952, "CFA Franc BCEAO", "", "West African CFA franc zone"},
+    {"XPF", 953, "CFP Franc", "", "French Pacific territories"},
+    {"YER", 886, "Yemeni Rial", "", "Yemen"},
+    {"ZAR", 710, "Rand", "R", "South Africa"},
+    {"ZMW", 967, "Zambian Kwacha", "", "Zambia"},
+    {"ZWG", 924, "Zimbabwe Gold", "", "Zimbabwe"},
+}
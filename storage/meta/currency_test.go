@@ -0,0 +1,168 @@
+package meta
+
+import (
+    "math"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestCurrencyCatalog(t *testing.T) {
+    numerics := make(map[int]bool)
+    for id, c := range currencies {
+        if int64(id) != c.Id || c.Id != currencyId(c.NumericCode) {
+            t.Errorf("currency %s is saved as %d", c.ISOCode, id)
+        }
+        if len(c.ISOCode) != 3 || strings.ToUpper(c.ISOCode) != c.ISOCode || c.Symbol == "" || c.Name == "" {
+            t.Errorf("currency %d is incomplete: %v", c.Id, c)
+        }
+        if numerics[c.NumericCode] {
+            t.Errorf("numeric code %d is used twice", c.NumericCode)
+        }
+        numerics[c.NumericCode] = true
+        if _, ok := units[id]; ok {
+            t.Errorf("currency %s has the id of a unit", c.ISOCode)
+        }
+    }
+    for code, id := range map[string]int64{"USD": CurrencyUSD, "eur": CurrencyEUR, "SGD": CurrencySGD, "JPY": CurrencyJPY} {
+        c, err := GetCurrencyByCode(code)
+        if err != nil || c.Id != id {
+            t.Errorf("%s should be %d, got %v %v", code, id, c, err)
+        }
+    }
+    if _, err := GetCurrencyByCode("XXX"); err != ErrUnknownCurrency {
+        t.Errorf("unknown code should be rejected, got %v", err)
+    }
+    if !IsCurrency(CurrencyGBP) || IsCurrency(UMeter) {
+        t.Errorf("only currencies should be currencies")
+    }
+}
+
+func TestParseExchangeRatesCSV(t *testing.T) {
+    rates, err := ParseExchangeRatesCSV(strings.NewReader(
+        "valid_from,currency,rate\n2016-01-04,SGD,1.4235\n2016-01-05T08:00:00+08:00, eur, 0.92\n"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(rates) != 2 || rates[0].CurrencyId != CurrencySGD || rates[0].Rate != 1.4235 ||
+        !rates[0].ValidFrom.Equal(time.Date(2016, 1, 4, 0, 0, 0, 0, time.UTC)) ||
+        rates[1].CurrencyId != CurrencyEUR || !rates[1].ValidFrom.Equal(time.Date(2016, 1, 5, 0, 0, 0, 0, time.UTC)) {
+        t.Errorf("rates are not parsed, got %v", rates)
+    }
+    bad := []string{
+        "2016-01-04,SGD,1.4235\nyesterday,SGD,1.42\n",
+        "2016-01-04,SGD,0\n",
+        "2016-01-04,SGD,-1\n",
+        "2016-01-04,SGD\n",
+        "2016-01-04,USD,1\n",
+        "2016-01-04,SGD,a lot\n",
+    }
+    for _, csv := range bad {
+        if _, err = ParseExchangeRatesCSV(strings.NewReader(csv)); err != ErrInvalidExchangeRate {
+            t.Errorf("%q should be rejected, got %v", csv, err)
+        }
+    }
+    if _, err = ParseExchangeRatesCSV(strings.NewReader("2016-01-04,XXX,1\n")); err != ErrUnknownCurrency {
+        t.Errorf("unknown currency should be rejected, got %v", err)
+    }
+}
+
+// rates in the cache, no DB
+func TestConvertCurrency(t *testing.T) {
+    day := func(d int) time.Time {
+        return time.Date(2016, 1, d, 0, 0, 0, 0, time.UTC)
+    }
+    CacheExchangeRates([]*ExchangeRate{
+        {CurrencyId: CurrencyMYR, Rate: 4.4, ValidFrom: day(5)},
+        {CurrencyId: CurrencyMYR, Rate: 4.0, ValidFrom: day(1)},
+        {CurrencyId: CurrencyINR, Rate: 66, ValidFrom: day(1)},
+    })
+    defer func() {
+        exchangeRatesLock.Lock()
+        delete(exchangeRates, CurrencyMYR)
+        delete(exchangeRates, CurrencyINR)
+        exchangeRatesLock.Unlock()
+    }()
+
+    cases := []struct {
+        value float64
+        from int64
+        to int64
+        at time.Time
+        want float64
+    }{
+        {100, CurrencyUSD, CurrencyMYR, day(1), 400},
+        {100, CurrencyUSD, CurrencyMYR, day(4).Add(23 * time.Hour), 400},
+        {100, CurrencyUSD, CurrencyMYR, day(5), 440},
+        {440, CurrencyMYR, CurrencyUSD, day(30), 100},
+        {4, CurrencyMYR, CurrencyINR, day(2), 66},
+        {5, CurrencyMYR, CurrencyMYR, day(2), 5},
+    }
+    for _, c := range cases {
+        got, err := ConvertCurrency(c.value, c.from, c.to, c.at)
+        if err != nil || math.Abs(got-c.want) > 1e-9 {
+            t.Errorf("%v from %d to %d at %v should be %v, got %v %v", c.value, c.from, c.to, c.at, c.want, got, err)
+        }
+    }
+    if _, err := ConvertCurrency(1, CurrencyUSD, CurrencyMYR, day(1).Add(-time.Second)); err != ErrNoExchangeRate {
+        t.Errorf("no rate before the first one, got %v", err)
+    }
+    if _, err := ConvertCurrency(1, CurrencyUSD, UMeter, day(2)); err != ErrUnknownCurrency {
+        t.Errorf("units are not currencies, got %v", err)
+    }
+
+    //replaced rate
+    CacheExchangeRates([]*ExchangeRate{{CurrencyId: CurrencyMYR, Rate: 4.2, ValidFrom: day(5)}})
+    if got, err := ExchangeRateAt(CurrencyMYR, day(6)); err != nil || got != 4.2 {
+        t.Errorf("rate should be replaced, got %v %v", got, err)
+    }
+}
+
+// test DB
+func TestExchangeRate(t *testing.T) {
+    InitEngine("mysql", []string{"dasea:dasea@tcp(127.0.0.1:3306)/dasea?charset=utf8"})
+    err := CreateCurrency()
+    if err != nil {
+        t.Error(err)
+    }
+    err = CreateExchangeRateTable()
+    if err != nil {
+        t.Error(err)
+    }
+    c := make([]*Currency, 0)
+    err = Engine.Find(&c)
+    if err != nil || len(c) != len(currencies) {
+        t.Errorf("len of currency should be %d, got: %d %v", len(currencies), len(c), err)
+    }
+
+    n, err := ImportExchangeRatesCSV(strings.NewReader("2016-01-04,SGD,1.4235\n2016-01-05,SGD,1.43\n2016-01-04,EUR,0.92\n"))
+    if err != nil || n != 3 {
+        t.Errorf("3 rates should be imported, got %d %v", n, err)
+    }
+    //import again, the same rates are replaced
+    n, err = ImportExchangeRatesCSV(strings.NewReader("2016-01-05,SGD,1.44\n"))
+    if err != nil || n != 1 {
+        t.Errorf("1 rate should be imported, got %d %v", n, err)
+    }
+    rates, err := GetExchangeRates(CurrencySGD, time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2016, 2, 1, 0, 0, 0, 0, time.UTC))
+    if err != nil || len(rates) != 2 || rates[1].Rate != 1.44 {
+        t.Errorf("SGD should have 2 rates, got %v %v", rates, err)
+    }
+    if _, err = SetExchangeRate(CurrencyUSD, time.Now(), 1); err != ErrInvalidExchangeRate {
+        t.Errorf("base currency has no rates, got %v", err)
+    }
+
+    exchangeRatesLock.Lock()
+    exchangeRates = make(map[int64][]*ExchangeRate)
+    exchangeRatesLock.Unlock()
+    if err = LoadExchangeRates(); err != nil {
+        t.Error(err)
+    }
+    v, err := ConvertCurrency(144, CurrencySGD, CurrencyUSD, time.Date(2016, 1, 6, 0, 0, 0, 0, time.UTC))
+    if err != nil || math.Abs(v-100) > 1e-9 {
+        t.Errorf("144 SGD should be 100 USD, got %v %v", v, err)
+    }
+
+    Engine.DropTables("currency")
+    Engine.DropTables("exchange_rate")
+}
@@ -0,0 +1,366 @@
+package meta
+
+// Custom units, units and unit categories defined by a project (e.g. strain
+// of its own gauges) in addition to the built-in catalog.
+//
+// Custom ids are taken from ranges reserved for them, so they never shadow a
+// built-in id even when the catalog grows. A custom unit belongs to a built-in
+// category or to a custom category of the same project, the first unit of a
+// custom category is its conversion base. Custom units are linear (factor and
+// offset) and are not in any unit system.
+//
+// Custom units are cached once loaded, either all at start up with
+// LoadCustomUnits or one by one on first use (see GetUnit).
+//
+// Example:
+//  c, err := meta.CreateCustomUnitCategory(projectId, domainId, "Strain of gauge X")
+//  u, err := meta.CreateCustomUnit(projectId, domainId, c.Id, "tick", "ticks", "tk", 1, 0)
+import (
+    "sync"
+)
+
+// Ids below are reserved for built-in categories and units
+const (
+    CustomUnitCategoryIdMin = 100000
+    CustomUnitIdMin = 1000000000
+)
+
+var (
+    customUnitsLock sync.RWMutex
+    customUnitCategories = make(map[int]*UnitCategory)
+    customUnits = make(map[int]*Unit)
+)
+
+func isCustomUnitCategoryId(id int64) bool {
+    return id >= CustomUnitCategoryIdMin && id < CustomUnitIdMin
+}
+
+func isCustomUnitId(id int64) bool {
+    return id >= CustomUnitIdMin
+}
+
+// Ids outside the reserved ranges are never cached, so built-in ones cannot
+// be shadowed
+func cacheCustomUnitCategory(c *UnitCategory) {
+    if !isCustomUnitCategoryId(c.Id) {
+        return
+    }
+    customUnitsLock.Lock()
+    defer customUnitsLock.Unlock()
+    customUnitCategories[int(c.Id)] = c
+}
+
+func cacheCustomUnit(u *Unit) {
+    if !isCustomUnitId(u.Id) {
+        return
+    }
+    customUnitsLock.Lock()
+    defer customUnitsLock.Unlock()
+    customUnits[int(u.Id)] = u
+}
+
+func uncacheCustomUnitCategory(id int64) {
+    customUnitsLock.Lock()
+    defer customUnitsLock.Unlock()
+    delete(customUnitCategories, int(id))
+}
+
+func uncacheCustomUnit(id int64) {
+    customUnitsLock.Lock()
+    defer customUnitsLock.Unlock()
+    delete(customUnits, int(id))
+}
+
+// Load all custom categories and units into the caches, normally at start up
+func LoadCustomUnits() error {
+    categories := make([]*UnitCategory, 0)
+    err := primary().Where("id >= ?", CustomUnitCategoryIdMin).Find(&categories)
+    if err != nil {
+        return err
+    }
+    all := make([]*Unit, 0)
+    err = primary().Where("id >= ?", CustomUnitIdMin).Find(&all)
+    if err != nil {
+        return err
+    }
+    for _, c := range categories {
+        if c.ProjectId != "" {
+            cacheCustomUnitCategory(c)
+        }
+    }
+    for _, u := range all {
+        if u.ProjectId != "" {
+            cacheCustomUnit(u)
+        }
+    }
+    return nil
+}
+
+// Built-in or custom category by id, custom ones are loaded from database
+// if not cached yet
+func GetUnitCategory(id int64) (*UnitCategory, error) {
+    if c, ok := unitCategories[int(id)]; ok {
+        return c, nil
+    }
+    if !isCustomUnitCategoryId(id) {
+        return nil, ErrNotFound
+    }
+    customUnitsLock.RLock()
+    c, ok := customUnitCategories[int(id)]
+    customUnitsLock.RUnlock()
+    if ok {
+        return c, nil
+    }
+    if Group == nil {
+        return nil, ErrNotFound
+    }
+    c = &UnitCategory{}
+    has, err := primary().Id(id).Get(c)
+    if err != nil {
+        return nil, err
+    }
+    if !has || c.ProjectId == "" {
+        return nil, ErrNotFound
+    }
+    cacheCustomUnitCategory(c)
+    return c, nil
+}
+
+// Custom unit by id, loaded from database if not cached yet
+func getCustomUnit(id int64) (*Unit, error) {
+    if !isCustomUnitId(id) {
+        return nil, ErrUnknownUnit
+    }
+    customUnitsLock.RLock()
+    u, ok := customUnits[int(id)]
+    customUnitsLock.RUnlock()
+    if ok {
+        return u, nil
+    }
+    if Group == nil {
+        return nil, ErrUnknownUnit
+    }
+    u = &Unit{}
+    has, err := primary().Id(id).Get(u)
+    if err != nil {
+        return nil, err
+    }
+    if !has || u.ProjectId == "" {
+        return nil, ErrUnknownUnit
+    }
+    cacheCustomUnit(u)
+    return u, nil
+}
+
+// Whether the category can be used by projectId, built-in categories can be
+// used by every project
+func (c *UnitCategory) VisibleTo(projectId string) bool {
+    return c.ProjectId == "" || c.ProjectId == projectId
+}
+
+// Whether the unit can be used by projectId, built-in units can be used by
+// every project
+func (u *Unit) VisibleTo(projectId string) bool {
+    return u.ProjectId == "" || u.ProjectId == projectId
+}
+
+// Units of data points must be built-in units, currencies or custom units of
+// the project of the DataStreamAttribute, 0 means no unit
+func checkDataPointUnits(projectId string, unitIds []int64) error {
+    for _, id := range unitIds {
+        if id == 0 || IsCurrency(id) {
+            continue
+        }
+        u, err := GetUnit(id)
+        if err != nil {
+            return err
+        }
+        if !u.VisibleTo(projectId) {
+            return ErrUnknownUnit
+        }
+    }
+    return nil
+}
+
+// An empty row of a custom table with a pointer to its Id
+type customIdBean func() (interface{}, *int64)
+
+// Times an insert is tried when other storage services take the ids first
+const customIdAttempts = 5
+
+// Next free id from min, ids of deleted rows are not reused since data points
+// may still refer to them
+func nextCustomId(newBean customIdBean, min int64) (int64, error) {
+    bean, id := newBean()
+    has, err := primary().Unscoped().Where("id >= ?", min).Desc("id").Get(bean)
+    if err != nil {
+        return 0, err
+    }
+    if !has || *id < min {
+        return min, nil
+    }
+    return *id + 1, nil
+}
+
+// Insert bean (whose Id is id) with the next free id from min. The id is
+// read before the insert, so another storage service may insert the same id
+// first, the insert is then tried again with the next one.
+func insertCustomId(bean interface{}, id *int64, newBean customIdBean, min int64, valid func(int64) bool) error {
+    for attempt := 1; ; attempt++ {
+        next, err := nextCustomId(newBean, min)
+        if err != nil {
+            return err
+        }
+        if !valid(next) {
+            return ErrInvalidUnit
+        }
+        *id = next
+        _, err = primary().Insert(bean)
+        if err == nil || attempt == customIdAttempts {
+            return err
+        }
+        taken, _ := newBean()
+        has, getErr := primary().Unscoped().Id(next).Get(taken)
+        if getErr != nil || !has {
+            //not a conflict on the id
+            return err
+        }
+    }
+}
+
+func CreateCustomUnitCategory(projectId string, domainId string, name string) (*UnitCategory, error) {
+    if projectId == "" || name == "" {
+        return nil, ErrInvalidUnit
+    }
+    c := &UnitCategory{
+        Name: name,
+        ProjectId: projectId,
+        DomainId: domainId,
+    }
+    err := insertCustomId(c, &c.Id, func() (interface{}, *int64) {
+        last := &UnitCategory{}
+        return last, &last.Id
+    }, CustomUnitCategoryIdMin, isCustomUnitCategoryId)
+    if err != nil {
+        return nil, err
+    }
+    cacheCustomUnitCategory(c)
+    return c, nil
+}
+
+// value in conversion base of the category = value * factor + offset
+func CreateCustomUnit(projectId string, domainId string, categoryId int64, name string, pluralName string,
+        symbol string, factor float64, offset float64) (*Unit, error) {
+    if projectId == "" || name == "" || factor <= 0 || isCurrencyCategory(categoryId) {
+        return nil, ErrInvalidUnit
+    }
+    c, err := GetUnitCategory(categoryId)
+    if err == ErrNotFound {
+        return nil, ErrInvalidUnit
+    }
+    if err != nil {
+        return nil, err
+    }
+    if !c.VisibleTo(projectId) {
+        return nil, ErrInvalidUnit
+    }
+    u := &Unit{
+        CategoryId: categoryId,
+        Name: name,
+        PluralName: pluralName,
+        Symbol: symbol,
+        ConversionFactor: factor,
+        ConversionOffset: offset,
+        ProjectId: projectId,
+        DomainId: domainId,
+    }
+    if c.ProjectId != "" {
+        n, err := primary().Where("category_id = ?", categoryId).Count(&Unit{})
+        if err != nil {
+            return nil, err
+        }
+        if n == 0 {
+            if factor != 1 || offset != 0 {
+                return nil, ErrInvalidUnit
+            }
+            u.IsConversionBase = true
+        }
+    }
+    err = insertCustomId(u, &u.Id, func() (interface{}, *int64) {
+        last := &Unit{}
+        return last, &last.Id
+    }, CustomUnitIdMin, isCustomUnitId)
+    if err != nil {
+        return nil, err
+    }
+    cacheCustomUnit(u)
+    return u, nil
+}
+
+// Custom categories of a project
+func GetCustomUnitCategories(projectId string) ([]*UnitCategory, error) {
+    categories := make([]*UnitCategory, 0)
+    err := primary().Where("project_id = ?", projectId).Find(&categories)
+    return categories, err
+}
+
+// Custom units of a project
+func GetCustomUnits(projectId string) ([]*Unit, error) {
+    all := make([]*Unit, 0)
+    err := primary().Where("project_id = ?", projectId).Find(&all)
+    return all, err
+}
+
+// Only empty categories can be deleted
+func DeleteCustomUnitCategory(projectId string, id int64) error {
+    c, err := GetUnitCategory(id)
+    if err != nil {
+        return err
+    }
+    if c.ProjectId == "" || c.ProjectId != projectId {
+        return ErrNotFound
+    }
+    n, err := primary().Where("category_id = ?", id).Count(&Unit{})
+    if err != nil {
+        return err
+    }
+    if n > 0 {
+        return ErrInvalidUnit
+    }
+    _, err = primary().Id(id).Delete(&UnitCategory{})
+    if err != nil {
+        return err
+    }
+    uncacheCustomUnitCategory(id)
+    return nil
+}
+
+// Data points saved in a deleted unit cannot be converted any more. The
+// conversion base of a category can only be deleted after the other units.
+func DeleteCustomUnit(projectId string, id int64) error {
+    u, err := getCustomUnit(id)
+    if err == ErrUnknownUnit {
+        return ErrNotFound
+    }
+    if err != nil {
+        return err
+    }
+    if u.ProjectId != projectId {
+        return ErrNotFound
+    }
+    if u.IsConversionBase {
+        n, err := primary().Where("category_id = ?", u.CategoryId).Count(&Unit{})
+        if err != nil {
+            return err
+        }
+        if n > 1 {
+            return ErrInvalidUnit
+        }
+    }
+    _, err = primary().Id(id).Delete(&Unit{})
+    if err != nil {
+        return err
+    }
+    uncacheCustomUnit(id)
+    return nil
+}
@@ -0,0 +1,194 @@
+package meta
+
+import (
+    "math"
+    "strconv"
+    "testing"
+)
+
+// custom units in the caches, no DB
+func TestCustomUnitCache(t *testing.T) {
+    category := &UnitCategory{Id: CustomUnitCategoryIdMin, Name: "Strain of gauge X", ProjectId: "p1"}
+    base := &Unit{Id: CustomUnitIdMin, CategoryId: category.Id, Name: "tick", IsConversionBase: true,
+        ConversionFactor: 1, ProjectId: "p1"}
+    chain := &Unit{Id: CustomUnitIdMin + 1, CategoryId: UcLength, Name: "chain", ConversionFactor: 20.1168,
+        ProjectId: "p1"}
+    cacheCustomUnitCategory(category)
+    cacheCustomUnit(base)
+    cacheCustomUnit(chain)
+    defer func() {
+        uncacheCustomUnitCategory(category.Id)
+        uncacheCustomUnit(base.Id)
+        uncacheCustomUnit(chain.Id)
+    }()
+
+    v, err := Convert(1, chain.Id, UFoot)
+    if err != nil || math.Abs(v-66) > 1e-9 {
+        t.Errorf("1 chain should be 66 feet, got %v %v", v, err)
+    }
+    if _, err = Convert(1, chain.Id, base.Id); err != ErrIncompatibleUnits {
+        t.Errorf("chains cannot be converted to ticks, got %v", err)
+    }
+    if u := GetUnitsCache()[int(chain.Id)]; u != chain {
+        t.Errorf("units cache should have the custom unit, got %v", u)
+    }
+    if GetUnitsCache()[UKilometer] != units[UKilometer] {
+        t.Errorf("units cache should keep the built-in units")
+    }
+    if c, err := GetUnitCategory(category.Id); err != nil || c != category {
+        t.Errorf("custom category should be found, got %v %v", c, err)
+    }
+    if c := GetUnitCategoriesCache()[UcLength]; c != unitCategories[UcLength] {
+        t.Errorf("categories cache should keep the built-in categories, got %v", c)
+    }
+
+    if err = checkDataPointUnits("p1", []int64{UMeter, chain.Id, 0}); err != nil {
+        t.Errorf("custom units of the project should be accepted, got %v", err)
+    }
+    if err = checkDataPointUnits("p2", []int64{UMeter, chain.Id}); err != ErrUnknownUnit {
+        t.Errorf("custom units of another project should be rejected, got %v", err)
+    }
+    if err = checkDataPointUnits("p1", []int64{12345}); err != ErrUnknownUnit {
+        t.Errorf("unknown units should be rejected, got %v", err)
+    }
+}
+
+// built-in ids stay below the reserved ranges
+func TestCustomUnitIds(t *testing.T) {
+    for id, c := range unitCategories {
+        if id >= CustomUnitCategoryIdMin || c.ProjectId != "" {
+            t.Errorf("built-in category %d is in the custom range", id)
+        }
+    }
+    for id, u := range units {
+        if id >= CustomUnitIdMin || u.ProjectId != "" {
+            t.Errorf("built-in unit %d is in the custom range", id)
+        }
+    }
+    //cached custom units cannot shadow built-in ones
+    cacheCustomUnit(&Unit{Id: UMeter, CategoryId: UcLength, Name: "fake", ConversionFactor: 2, ProjectId: "p1"})
+    defer uncacheCustomUnit(UMeter)
+    if u, err := GetUnit(UMeter); err != nil || u != units[UMeter] || GetUnitsCache()[UMeter] != units[UMeter] {
+        t.Errorf("built-in unit should win, got %v %v", u, err)
+    }
+}
+
+// test DB
+func TestCustomUnit(t *testing.T) {
+    InitEngine("mysql", []string{"dasea:dasea@tcp(127.0.0.1:3306)/dasea?charset=utf8"})
+    err := CreateUnitCategoryTable()
+    if err != nil {
+        t.Error(err)
+    }
+    err = CreateUnitTable()
+    if err != nil {
+        t.Error(err)
+    }
+    err = CreateDataStreamAttributeTable()
+    if err != nil {
+        t.Error(err)
+    }
+
+    c, err := CreateCustomUnitCategory("test", "test", "Strain of gauge X")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if c.Id != CustomUnitCategoryIdMin {
+        t.Errorf("first custom category should be %d, got %d", CustomUnitCategoryIdMin, c.Id)
+    }
+    //the first unit is the base
+    if _, err = CreateCustomUnit("test", "test", c.Id, "kilotick", "kiloticks", "ktk", 1000, 0); err != ErrInvalidUnit {
+        t.Errorf("base must have factor 1, got %v", err)
+    }
+    tick, err := CreateCustomUnit("test", "test", c.Id, "tick", "ticks", "tk", 1, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !tick.IsConversionBase || tick.Id != CustomUnitIdMin {
+        t.Errorf("tick should be the base with id %d, got %v", CustomUnitIdMin, tick)
+    }
+    kilotick, err := CreateCustomUnit("test", "test", c.Id, "kilotick", "kiloticks", "ktk", 1000, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if v, err := Convert(2, kilotick.Id, tick.Id); err != nil || v != 2000 {
+        t.Errorf("2 kiloticks should be 2000 ticks, got %v %v", v, err)
+    }
+    if _, err = CreateCustomUnit("other", "test", c.Id, "tock", "tocks", "to", 1, 0); err != ErrInvalidUnit {
+        t.Errorf("category of another project should be rejected, got %v", err)
+    }
+    if _, err = CreateCustomUnit("test", "test", UcLength, "chain", "chains", "ch", 20.1168, 0); err != nil {
+        t.Error(err)
+    }
+
+    //reload from DB
+    uncacheCustomUnit(kilotick.Id)
+    if err = LoadCustomUnits(); err != nil {
+        t.Error(err)
+    }
+    if _, ok := GetUnitsCache()[int(kilotick.Id)]; !ok {
+        t.Errorf("kilotick should be loaded")
+    }
+    list, err := GetCustomUnits("test")
+    if err != nil || len(list) != 3 {
+        t.Errorf("project should have 3 custom units, got %d %v", len(list), err)
+    }
+
+    _, err = CreateDataStreamAttribute("test", "test", "gauge", 1, []string{"strain"}, []string{"float64"}, []int64{kilotick.Id})
+    if err != nil {
+        t.Error(err)
+    }
+    _, err = CreateDataStreamAttribute("other", "test", "gauge 2", 1, []string{"strain"}, []string{"float64"}, []int64{kilotick.Id})
+    if err != ErrUnknownUnit {
+        t.Errorf("custom unit of another project should be rejected, got %v", err)
+    }
+
+    if err = DeleteCustomUnitCategory("test", c.Id); err != ErrInvalidUnit {
+        t.Errorf("category with units should not be deleted, got %v", err)
+    }
+    if err = DeleteCustomUnit("test", tick.Id); err != ErrInvalidUnit {
+        t.Errorf("base should be deleted last, got %v", err)
+    }
+    if err = DeleteCustomUnit("other", kilotick.Id); err != ErrNotFound {
+        t.Errorf("unit of another project should not be deleted, got %v", err)
+    }
+    if err = DeleteCustomUnit("test", kilotick.Id); err != nil {
+        t.Error(err)
+    }
+    if err = DeleteCustomUnit("test", tick.Id); err != nil {
+        t.Error(err)
+    }
+    if err = DeleteCustomUnitCategory("test", c.Id); err != nil {
+        t.Error(err)
+    }
+    //deleted ids are not reused
+    c2, err := CreateCustomUnitCategory("test", "test", "Strain of gauge Y")
+    if err != nil || c2.Id != c.Id+1 {
+        t.Errorf("new category should be %d, got %v %v", c.Id+1, c2, err)
+    }
+
+    //concurrent creations take the next free ids
+    created := make(chan *UnitCategory, 4)
+    for i := 0; i < 4; i++ {
+        go func(i int) {
+            c, err := CreateCustomUnitCategory("test", "test", "concurrent "+strconv.Itoa(i))
+            if err != nil {
+                t.Error(err)
+            }
+            created <- c
+        }(i)
+    }
+    ids := make(map[int64]bool)
+    for i := 0; i < 4; i++ {
+        if c := <-created; c != nil {
+            ids[c.Id] = true
+        }
+    }
+    if len(ids) != 4 {
+        t.Errorf("concurrent categories should have 4 ids, got %v", ids)
+    }
+
+    Engine.DropTables("unit_category")
+    Engine.DropTables("unit")
+    Engine.DropTables("data_stream_attribute")
+}
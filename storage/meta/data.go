@@ -5,11 +5,13 @@ package meta
 //  - DataStream
 import (
     "time"
+    "github.com/go-xorm/xorm"
 )
 
 type DataStreamAttribute struct {
 	Id int64
-	Description string `xorm:"varchar(255) notnull unique"`
+	//unique per project
+	Description string `xorm:"varchar(255) notnull unique(project_description)"`
 	NumDataPoints int16
 	//User defined names for each data point (column)
 	DataPointNames []string
@@ -19,24 +21,95 @@ type DataStreamAttribute struct {
 	DataPointTypes []string
 	//an array of units id (refer to the unit table)
 	DataPointUnits []int64
+	//1-based index of a timestamp (or datetime) data point which gives the
+	// time of each record, 0 means records are stamped when they arrive
+	TimestampDataPoint int16
+	//how records with the same time are handled, see WriteMode*
+	WriteMode string `xorm:"varchar(16)"`
+	//schema version, data points are added, renamed, retired and widened
+	// in place (see schema.go)
+	Version int32
+	//retired data points are kept for old records but no longer written
+	DataPointRetired []bool
+	//previous names and types of each data point, still accepted from
+	// devices which are not upgraded yet
+	DataPointAliases [][]string
+	DataPointPreviousTypes [][]string
     
-    ProjectId string `xorm:"index"` //keystone project id
+    ProjectId string `xorm:"index unique(project_description)"` //keystone project id
     DomainId string `xorm:"index"` //keystone domain id
 	CreatedAt time.Time `xorm:"created"`
 	UpdateAt time.Time `xorm:"updated"`
 	DeleteAt time.Time `xorm:"deleted"`
 }
 
+// Write modes of a DataStreamAttribute. Devices resend buffered records after
+// reconnecting, with a TimestampDataPoint and any mode other than append the
+// resent records do not show up twice.
+const (
+	//every record is kept, even if there is one with the same time (default)
+	WriteModeAppend = "append"
+	//a record replaces the one with the same time
+	WriteModeLast = "last"
+	//a record with the same time as an existing one is dropped
+	WriteModeFirst = "first"
+	//a batch with any record of the same time as an existing one is rejected
+	WriteModeReject = "reject"
+)
+
+// Write mode with default applied
+func (a *DataStreamAttribute) Mode() string {
+    if a.WriteMode == "" {
+        return WriteModeAppend
+    }
+    return a.WriteMode
+}
+
+// Whether the write mode and timestamp data point are valid for the data
+// points of a, e.g. before a is created with them
+func (a *DataStreamAttribute) CheckWriteMode() error {
+    switch a.Mode() {
+    case WriteModeAppend, WriteModeLast, WriteModeFirst, WriteModeReject:
+    default:
+        return ErrInvalidWriteMode
+    }
+    if a.TimestampDataPoint < 0 || a.TimestampDataPoint > a.NumDataPoints ||
+            int(a.TimestampDataPoint) > len(a.DataPointTypes) {
+        return ErrInvalidWriteMode
+    }
+    if a.TimestampDataPoint > 0 {
+        t := a.DataPointTypes[a.TimestampDataPoint-1]
+        if t != "timestamp" && t != "datetime" {
+            return ErrInvalidWriteMode
+        }
+    }
+    return nil
+}
 
 func CreateDataStreamAttributeTable() error {
     a := &DataStreamAttribute{}
-	_ = Engine.DropTables(a)
-	err := Engine.CreateTables(a)
+	_, err := syncTable(a)
     return err
 }
 func GetDataStreamAttribute(id int64) (*DataStreamAttribute, error) {
+    return getDataStreamAttribute(replica(), id)
+}
+func getDataStreamAttribute(e *xorm.Engine, id int64) (*DataStreamAttribute, error) {
     a := &DataStreamAttribute{}
-    has, err := Engine.Id(id).Get(a)
+    has, err := e.Id(id).Get(a)
+    if err != nil {
+        return nil, err
+    }
+    if !has {
+        return nil, ErrNotFound
+    }
+    return a, nil
+}
+// DataStreamAttribute of a project by description (descriptions are unique
+// per project), e.g. the measurement of line protocol
+func GetDataStreamAttributeByDescription(projectId string, desc string) (*DataStreamAttribute, error) {
+    a := &DataStreamAttribute{}
+    has, err := replica().Where("project_id = ? AND description = ?", projectId, desc).Get(a)
     if err != nil {
         return nil, err
     }
@@ -46,11 +119,19 @@ func GetDataStreamAttribute(id int64) (*DataStreamAttribute, error) {
     return a, nil
 }
 func InsertDataStreamAttribute(a *DataStreamAttribute) error {
-    _, err := Engine.Insert(a)
+    _, err := primary().Insert(a)
     return err
 }
 func CreateDataStreamAttribute(projectId string, domainId string, desc string, numDataPoints int16, dataPointNames []string, 
         dataPointTypes []string, dataPointUnits []int64) (*DataStreamAttribute, error) {
+    return CreateDataStreamAttributeWriteMode(projectId, domainId, desc, numDataPoints, dataPointNames,
+        dataPointTypes, dataPointUnits, 0, WriteModeAppend)
+}
+// Create a DataStreamAttribute with the write mode set (see
+// SetDataStreamAttributeWriteMode), in one insert
+func CreateDataStreamAttributeWriteMode(projectId string, domainId string, desc string, numDataPoints int16,
+        dataPointNames []string, dataPointTypes []string, dataPointUnits []int64,
+        timestampDataPoint int16, mode string) (*DataStreamAttribute, error) {
 	if numDataPoints <= 0 || 
 		len(dataPointNames) != int(numDataPoints) || 
 		len(dataPointTypes) != int(numDataPoints) || 
@@ -63,27 +144,69 @@ func CreateDataStreamAttribute(projectId string, domainId string, desc string, n
 		DataPointNames: dataPointNames,
 		DataPointTypes: dataPointTypes,
 		DataPointUnits: dataPointUnits,
+        Version: 1,
         ProjectId: projectId,
         DomainId: domainId,
+        TimestampDataPoint: timestampDataPoint,
+        WriteMode: mode,
+	}
+	if err := a.CheckWriteMode(); err != nil {
+		return nil, err
+	}
+	if err := checkDataPointUnits(projectId, dataPointUnits); err != nil {
+		return nil, err
 	}
 
-	_, err := Engine.Insert(a)
+	_, err := primary().Insert(a)
 	if err != nil {
 		return nil, err
 	}
 	
 	return a, nil
 }
+// Change how the time of records is taken and how records with the same time
+// are handled, records already saved are not touched
+func SetDataStreamAttributeWriteMode(id int64, timestampDataPoint int16, mode string) (*DataStreamAttribute, error) {
+    a, err := getDataStreamAttribute(primary(), id)
+    if err != nil {
+        return nil, err
+    }
+    a.TimestampDataPoint = timestampDataPoint
+    a.WriteMode = mode
+    if err = a.CheckWriteMode(); err != nil {
+        return nil, err
+    }
+    _, err = primary().Id(id).Cols("timestamp_data_point", "write_mode").Update(a)
+    if err != nil {
+        return nil, err
+    }
+    return a, nil
+}
+// Update the description, data points are changed by EvolveDataStreamAttribute
+// and the write mode by SetDataStreamAttributeWriteMode
+func UpdateDataStreamAttribute(a *DataStreamAttribute) error {
+    n, err := primary().Id(a.Id).Cols("description").Update(a)
+    if err != nil {
+        return err
+    }
+    if n == 0 {
+        //mysql counts changed rows only, nothing changed or no such attribute
+        _, err = getDataStreamAttribute(primary(), a.Id)
+        return err
+    }
+    return nil
+}
 func DeleteDataStreamAttribute(id int64) error {
     a := &DataStreamAttribute{}
-    _, err := Engine.Id(id).Delete(a)
+    _, err := primary().Id(id).Delete(a)
     return err
 }
 
 
 
 // DeviceId links to AggregationDevice, the ProjectId & DomainId in AggregationDevice
-// should exactly match the ProjectId & DomainId in DataStreamAttribute
+// must exactly match the ProjectId & DomainId in DataStreamAttribute (checked by
+// CreateDataStream and UpdateDataStream)
 type DataStream struct {
 	Id int64
 	DeviceId int64
@@ -96,21 +219,25 @@ type DataStream struct {
 
 func CreateDataStreamTable() error {
     s := &DataStream{}
-	_ = Engine.DropTables(s)
-	err := Engine.CreateTables(s)
+	_, err := syncTable(s)
     return err   
 }
 func InsertDataStream(s *DataStream) error {
-    _, err := Engine.Insert(s)
+    _, err := primary().Insert(s)
     return err
 }
+// The device (through its AggregationDevice) and the DataStreamAttribute must
+// belong to the same project
 func CreateDataStream(deviceId int64, dataStreamAttributeId int64) (*DataStream, error) {
+	if err := checkDataStreamProject(deviceId, dataStreamAttributeId); err != nil {
+		return nil, err
+	}
 	s := &DataStream {
 		DeviceId: deviceId,
 		DataStreamAttributeId: dataStreamAttributeId,
 	}
 	
-	_, err := Engine.Insert(s)
+	_, err := primary().Insert(s)
 	if err != nil {
 		return nil, err
 	}
@@ -118,9 +245,29 @@ func CreateDataStream(deviceId int64, dataStreamAttributeId int64) (*DataStream,
 	return s, nil
 }
 
+// ErrProjectMismatch if the device and the DataStreamAttribute belong to
+// different projects
+func checkDataStreamProject(deviceId int64, dataStreamAttributeId int64) error {
+	agg, err := getDeviceOwner(primary(), deviceId)
+	if err != nil {
+		return err
+	}
+	a, err := getDataStreamAttribute(primary(), dataStreamAttributeId)
+	if err != nil {
+		return err
+	}
+	if agg.ProjectId != a.ProjectId || agg.DomainId != a.DomainId {
+		return ErrProjectMismatch
+	}
+	return nil
+}
+
 func GetDataStream(id int64) (*DataStream, error) {
+	return getDataStream(replica(), id)
+}
+func getDataStream(e *xorm.Engine, id int64) (*DataStream, error) {
 	dataStream := new(DataStream)
-	has, err := Engine.Id(id).Get(dataStream)
+	has, err := e.Id(id).Get(dataStream)
 	if err != nil {
 		return nil, err
 	}
@@ -138,8 +285,55 @@ func GetDataStreamAttributeByDataStreamId(dataStreamId int64) (*DataStreamAttrib
 	return GetDataStreamAttribute(s.DataStreamAttributeId)
 }
 
+// DataStreams sharing a DataStreamAttribute
+func GetDataStreamsByAttributeId(dataStreamAttributeId int64) ([]*DataStream, error) {
+    streams := make([]*DataStream, 0)
+    err := replica().Where("data_stream_attribute_id = ?", dataStreamAttributeId).Find(&streams)
+    if err != nil {
+        return nil, err
+    }
+    return streams, nil
+}
+
+// DataStream of a device with a DataStreamAttribute, the first one created
+// if the device has several
+func FindDataStream(deviceId int64, dataStreamAttributeId int64) (*DataStream, error) {
+    ds := &DataStream{}
+    has, err := replica().Where("device_id = ? AND data_stream_attribute_id = ?", deviceId, dataStreamAttributeId).
+        Asc("id").Get(ds)
+    if err != nil {
+        return nil, err
+    }
+    if !has {
+        return nil, ErrNotFound
+    }
+    return ds, nil
+}
+
+// Move a DataStream to another device of the same project, the
+// DataStreamAttribute never changes since data points are saved by attribute
+func UpdateDataStream(s *DataStream) error {
+    saved, err := getDataStream(primary(), s.Id)
+    if err != nil {
+        return err
+    }
+    if err = checkDataStreamProject(s.DeviceId, saved.DataStreamAttributeId); err != nil {
+        return err
+    }
+    n, err := primary().Id(s.Id).Cols("device_id").Update(s)
+    if err != nil {
+        return err
+    }
+    if n == 0 {
+        //mysql counts changed rows only, nothing changed or the stream is gone
+        _, err = getDataStream(primary(), s.Id)
+        return err
+    }
+    return nil
+}
+
 func DeleteDataStream(id int64) error {
     s := &DataStream{}
-    _, err := Engine.Id(id).Delete(s)
+    _, err := primary().Id(id).Delete(s)
     return err
 }
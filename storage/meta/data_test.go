@@ -16,6 +16,8 @@ func TestData(t *testing.T) {
     if err != nil {
         t.Error(err)
     }
+    //data streams need a device of the project of their attribute
+    testProjectDevice(t, "123", "test")
 
     err = InsertDataStreamAttribute(&DataStreamAttribute{
         Description: "test 1",
@@ -76,6 +78,27 @@ func TestData(t *testing.T) {
         t.Error("Something wrong with Get Attribute by stream id")
     }
 
+    if a2.Mode() != WriteModeAppend {
+        t.Error("Default write mode should be append")
+    }
+    _, err = SetDataStreamAttributeWriteMode(2, 0, WriteModeLast)
+    if err != nil {
+        t.Error(err)
+    }
+    a2, err = GetDataStreamAttribute(2)
+    if err != nil || a2.Mode() != WriteModeLast {
+        t.Error("Something wrong with set write mode")
+    }
+    //data is uint16, cannot be the time of records
+    _, err = SetDataStreamAttributeWriteMode(2, 1, WriteModeLast)
+    if err != ErrInvalidWriteMode {
+        t.Error("Timestamp data point must be a timestamp")
+    }
+    _, err = SetDataStreamAttributeWriteMode(2, 0, "latest")
+    if err != ErrInvalidWriteMode {
+        t.Error("Unknown write mode should be rejected")
+    }
+
     err = DeleteDataStreamAttribute(1)
     if err != nil {
         t.Error(err)
@@ -118,4 +141,6 @@ func TestData(t *testing.T) {
     Engine.Id(2).Unscoped().Delete(a1)
     Engine.DropTables("data_stream_attribute")
     Engine.DropTables("data_stream")
+    Engine.DropTables("device")
+    Engine.DropTables("aggregation_device")
 }
\ No newline at end of file
@@ -7,6 +7,7 @@ package meta
 // Note that aggregation device is a Keystone user with username/password
 import (
     "time"
+    "github.com/go-xorm/xorm"
 )
 
 type AggregationDevice struct {
@@ -23,13 +24,15 @@ type AggregationDevice struct {
 
 func CreateAggregationDeviceTable() error {
     a := &AggregationDevice{}
-	_ = Engine.DropTables(a)
-	err := Engine.CreateTables(a)
+	_, err := syncTable(a)
     return err
 }
 func GetAggregationDevice(id string) (*AggregationDevice, error) {
+    return getAggregationDevice(replica(), id)
+}
+func getAggregationDevice(e *xorm.Engine, id string) (*AggregationDevice, error) {
     a := &AggregationDevice{}
-    has, err := Engine.Id(id).Get(a)
+    has, err := e.Id(id).Get(a)
     if err != nil {
         return nil, err
     }
@@ -39,19 +42,33 @@ func GetAggregationDevice(id string) (*AggregationDevice, error) {
     return a, nil
 }
 func InsertAggregationDevice(a *AggregationDevice) error {
-    _, err := Engine.Insert(a)
+    _, err := primary().Insert(a)
     return err
 }
+// Update description and location, Id, ProjectId and DomainId never change
+func UpdateAggregationDevice(a *AggregationDevice) error {
+    n, err := primary().Id(a.Id).Cols("description", "latitude", "longitude").Update(a)
+    if err != nil {
+        return err
+    }
+    if n == 0 {
+        //mysql counts changed rows only, nothing changed or no such device
+        _, err = getAggregationDevice(primary(), a.Id)
+        return err
+    }
+    return nil
+}
 func DeleteAggregationDevice(id string) error {
     a := &AggregationDevice{}
-    _, err := Engine.Id(id).Delete(a)
+    _, err := primary().Id(id).Delete(a)
     return err
 }
 
 type Device struct {
 	Id int64
-	AggregationDeviceId string `xorm:"index"`
-	Description string `xorm:"varchar(255) notnull unique"`
+	AggregationDeviceId string `xorm:"index unique(aggregation_description)"`
+	//unique per AggregationDevice
+	Description string `xorm:"varchar(255) notnull unique(aggregation_description)"`
 	Latitude float64
 	Longitude float64
 	CreateAt time.Time `xorm:"created"`
@@ -62,13 +79,15 @@ type Device struct {
 
 func CreateDeviceTable() error {
     d := &Device{}
-	_ = Engine.DropTables(d)
-	err := Engine.CreateTables(d)
+	_, err := syncTable(d)
     return err
 }
 func GetDevice(id int64) (*Device, error) {
+    return getDevice(replica(), id)
+}
+func getDevice(e *xorm.Engine, id int64) (*Device, error) {
     d := &Device{}
-    has, err := Engine.Id(id).Get(d)
+    has, err := e.Id(id).Get(d)
     if err != nil {
         return nil, err
     }
@@ -77,12 +96,72 @@ func GetDevice(id int64) (*Device, error) {
     }
     return d, nil
 }
+// Device of a project by description, e.g. the device tag of line protocol.
+// Descriptions are unique per AggregationDevice, ErrAmbiguousDevice if
+// several AggregationDevices of the project have a device of desc.
+func GetDeviceByDescription(projectId string, desc string) (*Device, error) {
+    devices := make([]*Device, 0, 2)
+    err := replica().Where("description = ?", desc).
+        And("aggregation_device_id IN (SELECT id FROM aggregation_device WHERE project_id = ? AND delete_at IS NULL)", projectId).
+        Limit(2).Find(&devices)
+    if err != nil {
+        return nil, err
+    }
+    if len(devices) == 0 {
+        return nil, ErrNotFound
+    }
+    if len(devices) > 1 {
+        return nil, ErrAmbiguousDevice
+    }
+    return devices[0], nil
+}
+// AggregationDevice of a Device, which gives its project and domain
+func getDeviceOwner(e *xorm.Engine, deviceId int64) (*AggregationDevice, error) {
+    d, err := getDevice(e, deviceId)
+    if err != nil {
+        return nil, err
+    }
+    return getAggregationDevice(e, d.AggregationDeviceId)
+}
 func InsertDevice(d *Device) error {
-    _, err := Engine.Insert(d)
+    _, err := primary().Insert(d)
     return err
 }
+// Update the aggregation device, description and location. The device
+// can only move to an aggregation device of the same project.
+func UpdateDevice(d *Device) error {
+    if err := checkDeviceProject(d.Id, d.AggregationDeviceId); err != nil {
+        return err
+    }
+    n, err := primary().Id(d.Id).Cols("aggregation_device_id", "description", "latitude", "longitude").Update(d)
+    if err != nil {
+        return err
+    }
+    if n == 0 {
+        //mysql counts changed rows only, nothing changed or no such device
+        _, err = getDevice(primary(), d.Id)
+        return err
+    }
+    return nil
+}
+// ErrProjectMismatch if the device and the aggregation device belong to
+// different projects
+func checkDeviceProject(deviceId int64, aggregationDeviceId string) error {
+    owner, err := getDeviceOwner(primary(), deviceId)
+    if err != nil {
+        return err
+    }
+    agg, err := getAggregationDevice(primary(), aggregationDeviceId)
+    if err != nil {
+        return err
+    }
+    if owner.ProjectId != agg.ProjectId || owner.DomainId != agg.DomainId {
+        return ErrProjectMismatch
+    }
+    return nil
+}
 func DeleteDevice(id int64) error {
     d := &Device{}
-    _, err := Engine.Id(id).Delete(d)
+    _, err := primary().Id(id).Delete(d)
     return err
 }
@@ -47,6 +47,17 @@ func TestDevice(t *testing.T) {
         t.Error("Something wrong with insert and get")
     }
 
+    //nothing changed is not a missing row
+    if err = UpdateAggregationDevice(a1); err != nil {
+        t.Errorf("unchanged aggregation device should be updated, got %v", err)
+    }
+    if err = UpdateDevice(d1); err != nil {
+        t.Errorf("unchanged device should be updated, got %v", err)
+    }
+    if err = UpdateDevice(&Device{Id: 999, AggregationDeviceId: "123"}); err != ErrNotFound {
+        t.Errorf("missing device should not be found, got %v", err)
+    }
+
     err = DeleteDevice(1)
     if err != nil {
         t.Error(err)
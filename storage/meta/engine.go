@@ -0,0 +1,194 @@
+package meta
+
+// Meta database hosts
+//
+// The first host (in the order of the configured hosts) is the primary,
+// which takes all writes, the other healthy hosts serve reads of Get* and
+// List* functions as replicas. Hosts are pinged periodically. By default
+// the primary never changes, writes fail while it is down, which is what
+// asynchronous replicas need. With failover (SetFailover) the first healthy
+// host is the primary: when the primary fails the next healthy host takes
+// over, and the first host takes back once it is healthy again. This
+// requires hosts that all accept writes (e.g. MariaDB/Mysql with Galera).
+//
+// Reads from replicas may lag behind writes, functions which read in order
+// to write read from the primary.
+import (
+    "log"
+    "os"
+    "sync"
+    "sync/atomic"
+    "time"
+    "github.com/go-xorm/core"
+    "github.com/go-xorm/xorm"
+)
+
+// Interval of health checks started by InitEngine
+const DefaultHealthCheckInterval = 10 * time.Second
+
+type EngineGroup struct {
+    engines []*xorm.Engine
+    lock sync.RWMutex
+    healthy []bool
+    primary int
+    failover bool
+    //round robin over replicas
+    next uint32
+    stop chan struct{}
+    stopped sync.WaitGroup
+}
+
+// Engines of hosts (data source names of driver t) are opened without
+// connecting, all hosts are taken as healthy until the first Check.
+func NewEngineGroup(t string, hosts []string) (*EngineGroup, error) {
+    if len(hosts) == 0 {
+        return nil, ErrNoHosts
+    }
+    g := &EngineGroup{
+        engines: make([]*xorm.Engine, len(hosts)),
+        healthy: make([]bool, len(hosts)),
+    }
+    for i, host := range hosts {
+        e, err := xorm.NewEngine(t, host)
+        if err != nil {
+            g.Close()
+            return nil, err
+        }
+        logger := xorm.NewSimpleLogger(os.Stdout)
+        logger.SetLevel(core.LOG_OFF)
+        e.SetLogger(logger)
+        g.engines[i] = e
+        g.healthy[i] = true
+    }
+    return g, nil
+}
+
+// Engine of the primary
+func (g *EngineGroup) Primary() *xorm.Engine {
+    g.lock.RLock()
+    defer g.lock.RUnlock()
+    return g.engines[g.primary]
+}
+
+// Engine of a healthy replica, the primary if there is none
+func (g *EngineGroup) Replica() *xorm.Engine {
+    g.lock.RLock()
+    defer g.lock.RUnlock()
+    n := len(g.engines)
+    start := int(atomic.AddUint32(&g.next, 1))
+    for i := 0; i < n; i++ {
+        j := (start + i) % n
+        if j != g.primary && g.healthy[j] {
+            return g.engines[j]
+        }
+    }
+    return g.engines[g.primary]
+}
+
+// Writes move to the first healthy host when the primary is down (and back
+// to the first host), only for hosts that all accept writes
+func (g *EngineGroup) SetFailover(on bool) {
+    g.lock.Lock()
+    defer g.lock.Unlock()
+    g.failover = on
+    if !on {
+        g.primary = 0
+    }
+}
+
+// Ping all hosts and, with failover, fail over if the primary is down. The
+// primary is kept if no host is healthy. Returns the number of healthy hosts.
+func (g *EngineGroup) Check() int {
+    healthy := make([]bool, len(g.engines))
+    n := 0
+    for i, e := range g.engines {
+        healthy[i] = e.Ping() == nil
+        if healthy[i] {
+            n++
+        }
+    }
+    g.setHealthy(healthy)
+    return n
+}
+
+func (g *EngineGroup) setHealthy(healthy []bool) {
+    g.lock.Lock()
+    defer g.lock.Unlock()
+    primary := g.primary
+    for i, ok := range healthy {
+        if ok && g.failover {
+            primary = i
+            break
+        }
+    }
+    //data source names hold passwords, hosts are logged by index
+    if primary != g.primary {
+        log.Printf("meta: primary database fails over from host %d to host %d", g.primary, primary)
+    }
+    for i, ok := range healthy {
+        if ok != g.healthy[i] {
+            log.Printf("meta: database host %d healthy: %v", i, ok)
+        }
+    }
+    g.primary = primary
+    g.healthy = healthy
+}
+
+// Check hosts every interval until Close
+func (g *EngineGroup) StartHealthCheck(interval time.Duration) {
+    g.lock.Lock()
+    if g.stop != nil {
+        g.lock.Unlock()
+        return
+    }
+    g.stop = make(chan struct{})
+    stop := g.stop
+    g.lock.Unlock()
+
+    g.stopped.Add(1)
+    go func() {
+        defer g.stopped.Done()
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-ticker.C:
+                g.Check()
+            case <-stop:
+                return
+            }
+        }
+    }()
+}
+
+// Stop health checks and close all engines
+func (g *EngineGroup) Close() error {
+    g.lock.Lock()
+    if g.stop != nil {
+        close(g.stop)
+        g.stop = nil
+    }
+    g.lock.Unlock()
+    g.stopped.Wait()
+
+    var err error
+    for _, e := range g.engines {
+        if e == nil {
+            continue
+        }
+        if closeErr := e.Close(); closeErr != nil {
+            err = closeErr
+        }
+    }
+    return err
+}
+
+// Engine for writes and for reads which must see the latest writes
+func primary() *xorm.Engine {
+    return Group.Primary()
+}
+
+// Engine for reads which may lag behind writes
+func replica() *xorm.Engine {
+    return Group.Replica()
+}
@@ -0,0 +1,117 @@
+package meta
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+func TestEngineGroup(t *testing.T) {
+    if _, err := NewEngineGroup("mysql", nil); err != ErrNoHosts {
+        t.Errorf("no hosts should be rejected, got %v", err)
+    }
+    g, err := NewEngineGroup("mysql", []string{"dasea:dasea@tcp(127.0.0.1:3306)/dasea", "dasea:dasea@tcp(127.0.0.2:3306)/dasea",
+        "dasea:dasea@tcp(127.0.0.3:3306)/dasea"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer g.Close()
+
+    if g.Primary() != g.engines[0] {
+        t.Errorf("first host should be the primary")
+    }
+    replicas := make(map[int]bool)
+    for i := 0; i < 6; i++ {
+        r := g.Replica()
+        for j, e := range g.engines {
+            if e == r {
+                replicas[j] = true
+            }
+        }
+    }
+    if len(replicas) != 2 || replicas[0] {
+        t.Errorf("reads should go to hosts 1 and 2, got %v", replicas)
+    }
+
+    //asynchronous replicas never take writes
+    g.setHealthy([]bool{false, true, true})
+    if g.Primary() != g.engines[0] {
+        t.Errorf("first host should stay the primary without failover")
+    }
+    g.SetFailover(true)
+
+    //primary down, host 1 takes over
+    g.setHealthy([]bool{false, true, true})
+    if g.Primary() != g.engines[1] || g.Replica() != g.engines[2] {
+        t.Errorf("host 1 should be the primary and host 2 the replica")
+    }
+    //no replica left, reads go to the primary
+    g.setHealthy([]bool{false, true, false})
+    if g.Replica() != g.engines[1] {
+        t.Errorf("reads should go to the primary without replicas")
+    }
+    //all down, the primary is kept
+    g.setHealthy([]bool{false, false, false})
+    if g.Primary() != g.engines[1] {
+        t.Errorf("primary should be kept when all hosts are down")
+    }
+    //first host back
+    g.setHealthy([]bool{true, true, true})
+    if g.Primary() != g.engines[0] {
+        t.Errorf("first host should be the primary again")
+    }
+}
+
+// Meta on a sqlite file, no database server is needed
+func TestSQLite(t *testing.T) {
+    dir, err := ioutil.TempDir("", "dasea-meta")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    if err = InitEngine("sqlite3", []string{filepath.Join(dir, "meta.db")}); err != nil {
+        t.Fatal(err)
+    }
+    defer CloseEngine()
+
+    if err = MigrateToLatest(nil); err != nil {
+        t.Fatal(err)
+    }
+    if v, _ := CurrentSchemaVersion(); v != LatestSchemaVersion() {
+        t.Errorf("should be at version %d, got %d", LatestSchemaVersion(), v)
+    }
+    if n, err := primary().Count(&Unit{}); err != nil || n != int64(len(units)) {
+        t.Errorf("built-in units should be seeded, got %d %v", n, err)
+    }
+
+    created := make([]*DataStreamAttribute, 0)
+    for _, desc := range []string{"50%_off", "50 off"} {
+        a, err := CreateDataStreamAttribute("p1", "d1", desc, 1, []string{"temp"}, []string{"float32"},
+            []int64{UDegreeCelsius})
+        if err != nil {
+            t.Fatal(err)
+        }
+        created = append(created, a)
+    }
+    a, err := GetDataStreamAttribute(created[0].Id)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if a.Description != "50%_off" || len(a.DataPointNames) != 1 || a.DataPointNames[0] != "temp" ||
+            a.DataPointUnits[0] != UDegreeCelsius {
+        t.Errorf("attribute not saved, got %v", a)
+    }
+    //sqlite has no default LIKE escape
+    attributes, err := ListDataStreamAttributes(&ListOpts{DescriptionPrefix: "50%"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(attributes) != 1 || attributes[0].Id != created[0].Id {
+        t.Errorf("wildcards should be matched literally, got %v", attributes)
+    }
+
+    if err = Migrate(0, false, nil); err != nil {
+        t.Fatal(err)
+    }
+}
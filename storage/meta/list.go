@@ -0,0 +1,208 @@
+package meta
+
+// Listing of AggregationDevice, Device, DataStreamAttribute and DataStream
+//
+// Items are ordered by id and read page by page: the id of the last item of
+// a page is the Marker of the next one, a page with fewer than Limit items
+// is the last. Deleted items are never listed.
+//
+// Example (devices of a project created in 2016):
+//  devices, err := meta.ListDevices(&meta.ListOpts{
+//      ProjectId: "...",
+//      CreatedSince: time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC),
+//      CreatedBefore: time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC),
+//      Limit: 50,
+//  })
+import (
+    "strconv"
+    "strings"
+    "time"
+)
+
+const (
+    // Limit used when ListOpts.Limit is not given
+    DefaultListLimit = 100
+    // Larger limits are reduced to MaxListLimit
+    MaxListLimit = 1000
+)
+
+// Filters of List* functions, zero values do not filter. A filter a table
+// does not support is rejected rather than ignored.
+type ListOpts struct {
+    // Devices and DataStreams are matched by the project and domain of
+    // their AggregationDevice and DataStreamAttribute
+    ProjectId string
+    DomainId string
+    // Devices only
+    AggregationDeviceId string
+    // DataStreams only
+    DeviceId int64
+    DataStreamAttributeId int64
+    // All but DataStreams
+    DescriptionPrefix string
+    // [Since, Before)
+    CreatedSince time.Time
+    CreatedBefore time.Time
+    UpdatedSince time.Time
+    UpdatedBefore time.Time
+    Limit int
+    // Id of the last item of the previous page
+    Marker string
+}
+
+// Limit with default and maximum applied
+func (o *ListOpts) limit() int {
+    if o.Limit <= 0 {
+        return DefaultListLimit
+    }
+    if o.Limit > MaxListLimit {
+        return MaxListLimit
+    }
+    return o.Limit
+}
+
+// Columns and supported filters of a listed table
+type listTable struct {
+    created string
+    updated string
+    stringId bool
+    description bool
+    aggregationDeviceId bool
+    deviceId bool
+    dataStreamAttributeId bool
+    //condition on project_id or domain_id (%s) if the table has no such columns
+    scope string
+}
+
+// created/updated column names differ between tables
+var (
+    aggregationDeviceList = &listTable{created: "created_at", updated: "update_at", stringId: true, description: true}
+    deviceList = &listTable{created: "create_at", updated: "update_at", description: true, aggregationDeviceId: true,
+        scope: "aggregation_device_id IN (SELECT id FROM aggregation_device WHERE %s = ? AND delete_at IS NULL)"}
+    dataStreamAttributeList = &listTable{created: "created_at", updated: "update_at", description: true}
+    dataStreamList = &listTable{created: "created_at", updated: "update_at", deviceId: true, dataStreamAttributeId: true,
+        scope: "data_stream_attribute_id IN (SELECT id FROM data_stream_attribute WHERE %s = ? AND delete_at IS NULL)"}
+)
+
+type listCond struct {
+    query string
+    arg interface{}
+}
+
+// Conditions of o on table t, in the order they are applied
+func (o *ListOpts) conds(t *listTable) ([]*listCond, error) {
+    conds := make([]*listCond, 0)
+    scope := func(column string, value string) {
+        if value == "" {
+            return
+        }
+        if t.scope == "" {
+            conds = append(conds, &listCond{column + " = ?", value})
+        } else {
+            conds = append(conds, &listCond{strings.Replace(t.scope, "%s", column, 1), value})
+        }
+    }
+    scope("project_id", o.ProjectId)
+    scope("domain_id", o.DomainId)
+
+    if (o.AggregationDeviceId != "" && !t.aggregationDeviceId) || (o.DeviceId != 0 && !t.deviceId) ||
+        (o.DataStreamAttributeId != 0 && !t.dataStreamAttributeId) || (o.DescriptionPrefix != "" && !t.description) {
+        return nil, ErrInvalidListOpts
+    }
+    if o.AggregationDeviceId != "" {
+        conds = append(conds, &listCond{"aggregation_device_id = ?", o.AggregationDeviceId})
+    }
+    if o.DeviceId != 0 {
+        conds = append(conds, &listCond{"device_id = ?", o.DeviceId})
+    }
+    if o.DataStreamAttributeId != 0 {
+        conds = append(conds, &listCond{"data_stream_attribute_id = ?", o.DataStreamAttributeId})
+    }
+    if o.DescriptionPrefix != "" {
+        conds = append(conds, &listCond{"description LIKE ? ESCAPE '!'", likePrefix(o.DescriptionPrefix)})
+    }
+
+    times := []struct {
+        column string
+        op string
+        t time.Time
+    }{
+        {t.created, ">=", o.CreatedSince},
+        {t.created, "<", o.CreatedBefore},
+        {t.updated, ">=", o.UpdatedSince},
+        {t.updated, "<", o.UpdatedBefore},
+    }
+    for _, c := range times {
+        if !c.t.IsZero() {
+            conds = append(conds, &listCond{c.column + " " + c.op + " ?", c.t})
+        }
+    }
+
+    if o.Marker != "" {
+        if t.stringId {
+            conds = append(conds, &listCond{"id > ?", o.Marker})
+        } else {
+            marker, err := strconv.ParseInt(o.Marker, 10, 64)
+            if err != nil {
+                return nil, ErrInvalidListOpts
+            }
+            conds = append(conds, &listCond{"id > ?", marker})
+        }
+    }
+    return conds, nil
+}
+
+// LIKE pattern matching values starting with prefix, wildcards in prefix
+// are matched literally. The escape character is given explicitly, sqlite
+// has no default one and mysql takes backslashes in literals as escapes.
+func likePrefix(prefix string) string {
+    r := strings.NewReplacer(`!`, `!!`, `%`, `!%`, `_`, `!_`)
+    return r.Replace(prefix) + "%"
+}
+
+func (o *ListOpts) find(t *listTable, beans interface{}) error {
+    if o == nil {
+        o = &ListOpts{}
+    }
+    conds, err := o.conds(t)
+    if err != nil {
+        return err
+    }
+    s := replica().Asc("id").Limit(o.limit())
+    for _, c := range conds {
+        s = s.And(c.query, c.arg)
+    }
+    return s.Find(beans)
+}
+
+func ListAggregationDevices(opts *ListOpts) ([]*AggregationDevice, error) {
+    devices := make([]*AggregationDevice, 0)
+    if err := opts.find(aggregationDeviceList, &devices); err != nil {
+        return nil, err
+    }
+    return devices, nil
+}
+
+func ListDevices(opts *ListOpts) ([]*Device, error) {
+    devices := make([]*Device, 0)
+    if err := opts.find(deviceList, &devices); err != nil {
+        return nil, err
+    }
+    return devices, nil
+}
+
+func ListDataStreamAttributes(opts *ListOpts) ([]*DataStreamAttribute, error) {
+    attributes := make([]*DataStreamAttribute, 0)
+    if err := opts.find(dataStreamAttributeList, &attributes); err != nil {
+        return nil, err
+    }
+    return attributes, nil
+}
+
+func ListDataStreams(opts *ListOpts) ([]*DataStream, error) {
+    streams := make([]*DataStream, 0)
+    if err := opts.find(dataStreamList, &streams); err != nil {
+        return nil, err
+    }
+    return streams, nil
+}
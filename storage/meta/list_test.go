@@ -0,0 +1,148 @@
+package meta
+
+import (
+    "fmt"
+    "testing"
+    "time"
+)
+
+func TestListConds(t *testing.T) {
+    since := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+    conds, err := (&ListOpts{
+        ProjectId: "p",
+        AggregationDeviceId: "a",
+        DescriptionPrefix: "50%_off",
+        CreatedSince: since,
+        Marker: "10",
+    }).conds(deviceList)
+    if err != nil {
+        t.Fatal(err)
+    }
+    want := []string{
+        "aggregation_device_id IN (SELECT id FROM aggregation_device WHERE project_id = ? AND delete_at IS NULL) p",
+        "aggregation_device_id = ? a",
+        `description LIKE ? ESCAPE '!' 50!%!_off%`,
+        "create_at >= ? " + since.String(),
+        "id > ? 10",
+    }
+    if len(conds) != len(want) {
+        t.Fatalf("should have %d conditions, got %d", len(want), len(conds))
+    }
+    for i, c := range conds {
+        if got := fmt.Sprintf("%s %v", c.query, c.arg); got != want[i] {
+            t.Errorf("condition %d should be %q, got %q", i, want[i], got)
+        }
+    }
+    if _, ok := conds[4].arg.(int64); !ok {
+        t.Errorf("marker of int ids should be int64")
+    }
+
+    conds, err = (&ListOpts{DomainId: "d", UpdatedBefore: since, Marker: "abc"}).conds(aggregationDeviceList)
+    if err != nil || len(conds) != 3 || conds[0].query != "domain_id = ?" || conds[1].query != "update_at < ?" ||
+        conds[2].arg.(string) != "abc" {
+        t.Errorf("aggregation device conditions not match, got %v %v", conds, err)
+    }
+
+    bad := []struct {
+        opts *ListOpts
+        table *listTable
+    }{
+        {&ListOpts{Marker: "abc"}, deviceList},
+        {&ListOpts{DeviceId: 1}, deviceList},
+        {&ListOpts{AggregationDeviceId: "a"}, dataStreamList},
+        {&ListOpts{DescriptionPrefix: "a"}, dataStreamList},
+        {&ListOpts{DataStreamAttributeId: 1}, dataStreamAttributeList},
+    }
+    for i, c := range bad {
+        if _, err = c.opts.conds(c.table); err != ErrInvalidListOpts {
+            t.Errorf("opts %d should be rejected, got %v", i, err)
+        }
+    }
+
+    if (&ListOpts{}).limit() != DefaultListLimit || (&ListOpts{Limit: 5000}).limit() != MaxListLimit ||
+        (&ListOpts{Limit: 5}).limit() != 5 {
+        t.Errorf("limit defaults not applied")
+    }
+}
+
+// test DB
+func TestList(t *testing.T) {
+    InitEngine("mysql", []string{"dasea:dasea@tcp(127.0.0.1:3306)/dasea?charset=utf8"})
+    err := CreateAggregationDeviceTable()
+    if err != nil {
+        t.Error(err)
+    }
+    err = CreateDeviceTable()
+    if err != nil {
+        t.Error(err)
+    }
+    for i, project := range []string{"p1", "p1", "p2"} {
+        err = InsertAggregationDevice(&AggregationDevice{
+            Id: fmt.Sprintf("agg%d", i),
+            Description: fmt.Sprintf("gateway %d", i),
+            ProjectId: project,
+            DomainId: "d",
+        })
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+    for i := 0; i < 5; i++ {
+        err = InsertDevice(&Device{AggregationDeviceId: fmt.Sprintf("agg%d", i%3), Description: fmt.Sprintf("sensor %d", i)})
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    //page through the devices of p1
+    opts := &ListOpts{ProjectId: "p1", Limit: 2}
+    all := make([]*Device, 0)
+    for {
+        devices, err := ListDevices(opts)
+        if err != nil {
+            t.Fatal(err)
+        }
+        all = append(all, devices...)
+        if len(devices) < opts.Limit {
+            break
+        }
+        opts.Marker = fmt.Sprint(devices[len(devices)-1].Id)
+    }
+    if len(all) != 4 {
+        t.Errorf("p1 should have 4 devices, got %d", len(all))
+    }
+    aggs, err := ListAggregationDevices(&ListOpts{DescriptionPrefix: "gateway", DomainId: "d"})
+    if err != nil || len(aggs) != 3 {
+        t.Errorf("should list 3 aggregation devices, got %d %v", len(aggs), err)
+    }
+
+    d := all[0]
+    d.Description = "renamed"
+    d.Latitude = 1.5
+    if err = UpdateDevice(d); err != nil {
+        t.Error(err)
+    }
+    updated, err := GetDevice(d.Id)
+    if err != nil || updated.Description != "renamed" || updated.Latitude != 1.5 || !updated.CreateAt.Equal(d.CreateAt) {
+        t.Errorf("device should be updated, got %v %v", updated, err)
+    }
+    if err = DeleteDevice(d.Id); err != nil {
+        t.Error(err)
+    }
+    if err = UpdateDevice(d); err != ErrNotFound {
+        t.Errorf("deleted device should not be updated, got %v", err)
+    }
+    if devices, _ := ListDevices(&ListOpts{ProjectId: "p1"}); len(devices) != 3 {
+        t.Errorf("deleted device should not be listed, got %d", len(devices))
+    }
+    //devices of a deleted aggregation device are gone with it
+    if err = DeleteAggregationDevice("agg1"); err != nil {
+        t.Error(err)
+    }
+    if devices, _ := ListDevices(&ListOpts{ProjectId: "p1"}); len(devices) != 1 {
+        t.Errorf("devices of a deleted aggregation device should not be listed, got %d", len(devices))
+    }
+
+    Engine.DropTables("device")
+    Engine.DropTables("aggregation_device")
+}
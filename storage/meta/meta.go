@@ -1,33 +1,71 @@
 package meta
 
 import (
-	"os"
     "errors"
 	"github.com/go-xorm/xorm"
-	"github.com/go-xorm/core"
 	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
 )
 
+// Hosts of the meta database, set by InitEngine
+var Group *EngineGroup
+
+// Engine of the primary when InitEngine returns, it does not follow
+// failovers. Functions of this package go through Group.
 var Engine *xorm.Engine
 
 var (
     ErrNotFound = errors.New("Item not found in database.")
     ErrInvalidDataPoints = errors.New("Invalid data points.")
+    ErrInvalidRetention = errors.New("Invalid retention policy.")
+    ErrInvalidWriteMode = errors.New("Invalid write mode.")
+    ErrUnknownUnit = errors.New("Unknown unit.")
+    ErrUnknownUnitSystem = errors.New("Unknown unit system, must be metric, US or UK.")
+    ErrIncompatibleUnits = errors.New("Units of different categories cannot be converted.")
+    ErrNotConvertible = errors.New("Unit does not support conversion.")
+    ErrInvalidUnit = errors.New("Invalid custom unit or unit category.")
+    ErrUnknownCurrency = errors.New("Unknown currency.")
+    ErrInvalidExchangeRate = errors.New("Invalid exchange rate.")
+    ErrNoExchangeRate = errors.New("No exchange rate valid at the time.")
+    ErrInvalidDataPointChange = errors.New("Invalid data point change.")
+    ErrVersionConflict = errors.New("Data stream attribute was changed by someone else, try again.")
+    ErrInvalidMigration = errors.New("Invalid schema version to migrate to.")
+    ErrUnknownSchemaVersion = errors.New("Schema version of the database is newer than the known migrations.")
+    ErrInvalidListOpts = errors.New("Invalid list filter or marker.")
+    ErrNoHosts = errors.New("No meta database hosts.")
+    ErrProjectMismatch = errors.New("Device and data stream attribute (or aggregation device) belong to different projects.")
+    ErrAmbiguousDevice = errors.New("Several aggregation devices of the project have a device of the description.")
+    ErrNoScope = errors.New("Token is not scoped to a project.")
+    ErrInvalidToken = errors.New("Invalid, expired or revoked device token.")
 )
 
 // We cannot initialize xorm.Engine in init() function because Opts are
 // initialized in init function, and we cannot guarentee that Opts must be
 // initialized before any other init functions. So we intialize engine in main.
 // We must call meta.InitEngine in main before using it. 
-func InitEngine(t string, hosts []string) {
-	var err error
-    //currently we only use one host, we will switch to using
-    //2 alternatively in the future
-	Engine, err = xorm.NewEngine(t, hosts[0])
-	logger := xorm.NewSimpleLogger(os.Stdout)
-	logger.SetLevel(core.LOG_OFF)
-	Engine.SetLogger(logger)
-	if err != nil {
-		panic(err)
-	}
+//
+// t is the driver ("mysql", "postgres" or "sqlite3"), hosts are data source
+// names, the first one is the primary and the others are read replicas (see
+// EngineGroup). Health checks run until CloseEngine.
+func InitEngine(t string, hosts []string) error {
+    g, err := NewEngineGroup(t, hosts)
+    if err != nil {
+        return err
+    }
+    CloseEngine()
+    Group = g
+    Engine = g.Primary()
+    g.StartHealthCheck(DefaultHealthCheckInterval)
+    return nil
+}
+
+func CloseEngine() error {
+    if Group == nil {
+        return nil
+    }
+    err := Group.Close()
+    Group = nil
+    Engine = nil
+    return err
 }
@@ -0,0 +1,239 @@
+package meta
+
+// Schema migrations
+//
+// Tables of meta are created and changed by numbered migrations only, the
+// versions applied so far are saved in schema_version. The storage service
+// calls MigrateToLatest at startup, which never drops anything; going down
+// (e.g. to roll back a release) is an explicit Migrate to a lower version.
+//
+// To change the schema, append a Migration with the next version to
+// migrations (migrations.go), never change a migration which may have been
+// applied. Migrations work on snapshots of the tables as they were at their
+// version, not on the structs used by the rest of meta, so that they still
+// do the same when the structs change later.
+//
+// Example (print what would be done without touching the database):
+//  err := meta.Migrate(meta.LatestSchemaVersion(), true, os.Stdout)
+import (
+    "fmt"
+    "io"
+    "io/ioutil"
+    "strings"
+    "time"
+)
+
+type Migration struct {
+    Version int
+    Description string
+    Up func() error
+    Down func() error
+}
+
+// A migration applied to the database
+type SchemaVersion struct {
+	Version int `xorm:"pk"`
+	Description string `xorm:"varchar(255)"`
+	AppliedAt time.Time `xorm:"created"`
+}
+
+// A migration to run, Down is true when it is reverted
+type MigrationStep struct {
+    *Migration
+    Down bool
+}
+
+func (s *MigrationStep) String() string {
+    direction := "up"
+    if s.Down {
+        direction = "down"
+    }
+    return fmt.Sprintf("%s %d: %s", direction, s.Version, s.Description)
+}
+
+// Whether table has an index of the name, indexes are named by xorm as
+// IDX_<table>_<name> and UQE_<table>_<name>
+func indexExists(table string, index string) (bool, error) {
+    var query string
+    switch primary().DriverName() {
+    case "mysql":
+        query = "SELECT index_name FROM information_schema.statistics WHERE table_schema = DATABASE() AND table_name = ? AND index_name = ?"
+    case "postgres":
+        query = "SELECT indexname FROM pg_indexes WHERE tablename = ? AND indexname = ?"
+    default:
+        query = "SELECT name FROM sqlite_master WHERE type = 'index' AND tbl_name = ? AND name = ?"
+    }
+    rows, err := primary().Query(query, table, index)
+    if err != nil {
+        return false, err
+    }
+    return len(rows) > 0, nil
+}
+
+func dropIndex(table string, index string) error {
+    exists, err := indexExists(table, index)
+    if err != nil || !exists {
+        return err
+    }
+    sql := "DROP INDEX " + primary().Quote(index)
+    if primary().DriverName() == "mysql" {
+        sql += " ON " + primary().Quote(table)
+    }
+    _, err = primary().Exec(sql)
+    return err
+}
+
+func createUniqueIndex(table string, index string, columns ...string) error {
+    exists, err := indexExists(table, index)
+    if err != nil || exists {
+        return err
+    }
+    quoted := make([]string, len(columns))
+    for i, c := range columns {
+        quoted[i] = primary().Quote(c)
+    }
+    _, err = primary().Exec(fmt.Sprintf("CREATE UNIQUE INDEX %s ON %s (%s)", primary().Quote(index),
+        primary().Quote(table), strings.Join(quoted, ", ")))
+    return err
+}
+
+// Create the table of bean with its indexes, or add missing columns and
+// indexes if it exists. Nothing is dropped. Returns whether the table is new.
+func syncTable(bean interface{}) (bool, error) {
+    exists, err := primary().IsTableExist(bean)
+    if err != nil {
+        return false, err
+    }
+    if err = primary().Sync2(bean); err != nil {
+        //another storage service starting at the same time may have
+        // created it first, the table is then synced as an existing one
+        if existsNow, existErr := primary().IsTableExist(bean); exists || existErr != nil || !existsNow {
+            return false, err
+        }
+        return false, primary().Sync2(bean)
+    }
+    return !exists, nil
+}
+
+// Insert a built-in row of a new table, rows inserted already by another
+// storage service migrating at the same time are skipped. bean is an empty
+// row of the table.
+func seedRow(row interface{}, id int64, bean interface{}) error {
+    _, err := primary().Insert(row)
+    if err != nil {
+        has, getErr := primary().Unscoped().Id(id).Get(bean)
+        if getErr == nil && has {
+            return nil
+        }
+    }
+    return err
+}
+
+func LatestSchemaVersion() int {
+    return migrations[len(migrations)-1].Version
+}
+
+// Version of the database schema, 0 if no migration has been applied
+func CurrentSchemaVersion() (int, error) {
+    exists, err := primary().IsTableExist(&SchemaVersion{})
+    if err != nil || !exists {
+        return 0, err
+    }
+    v := &SchemaVersion{}
+    has, err := primary().Desc("version").Get(v)
+    if err != nil || !has {
+        return 0, err
+    }
+    return v.Version, nil
+}
+
+// Migrations to run in order to go from version current to target
+func planMigrations(migrations []*Migration, current int, target int) ([]*MigrationStep, error) {
+    latest := 0
+    if len(migrations) > 0 {
+        latest = migrations[len(migrations)-1].Version
+    }
+    if current > latest {
+        return nil, ErrUnknownSchemaVersion
+    }
+    if target < 0 || target > latest {
+        return nil, ErrInvalidMigration
+    }
+    steps := make([]*MigrationStep, 0)
+    if target >= current {
+        for _, m := range migrations {
+            if m.Version > current && m.Version <= target {
+                steps = append(steps, &MigrationStep{Migration: m})
+            }
+        }
+        return steps, nil
+    }
+    for i := len(migrations) - 1; i >= 0; i-- {
+        if m := migrations[i]; m.Version <= current && m.Version > target {
+            steps = append(steps, &MigrationStep{Migration: m, Down: true})
+        }
+    }
+    return steps, nil
+}
+
+// Migrate the database up or down to version target, each step is written
+// to out (may be nil). With dryRun the steps are only written.
+func Migrate(target int, dryRun bool, out io.Writer) error {
+    if out == nil {
+        out = ioutil.Discard
+    }
+    if _, err := syncTable(&SchemaVersion{}); err != nil {
+        return err
+    }
+    current, err := CurrentSchemaVersion()
+    if err != nil {
+        return err
+    }
+    steps, err := planMigrations(migrations, current, target)
+    if err != nil {
+        return err
+    }
+    if dryRun {
+        fmt.Fprintf(out, "dry run, schema version %d to %d\n", current, target)
+    } else {
+        fmt.Fprintf(out, "schema version %d to %d\n", current, target)
+    }
+    for _, s := range steps {
+        fmt.Fprintln(out, s)
+        if dryRun {
+            continue
+        }
+        if err = runMigrationStep(s); err != nil {
+            return fmt.Errorf("%s: %v", s, err)
+        }
+    }
+    return nil
+}
+
+// Apply all migrations not applied yet
+func MigrateToLatest(out io.Writer) error {
+    return Migrate(LatestSchemaVersion(), false, out)
+}
+
+func runMigrationStep(s *MigrationStep) error {
+    if s.Down {
+        if err := s.Migration.Down(); err != nil {
+            return err
+        }
+        _, err := primary().Delete(&SchemaVersion{Version: s.Version})
+        return err
+    }
+    if err := s.Migration.Up(); err != nil {
+        return err
+    }
+    _, err := primary().Insert(&SchemaVersion{Version: s.Version, Description: s.Description})
+    if err != nil {
+        //another storage service starting at the same time may have
+        // applied it, migrations are safe to run twice
+        has, getErr := primary().Get(&SchemaVersion{Version: s.Version})
+        if getErr == nil && has {
+            return nil
+        }
+    }
+    return err
+}
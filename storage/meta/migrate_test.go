@@ -0,0 +1,137 @@
+package meta
+
+import (
+    "bytes"
+    "strings"
+    "testing"
+)
+
+func TestMigrations(t *testing.T) {
+    for i, m := range migrations {
+        if m.Version != i+1 || m.Description == "" || m.Up == nil || m.Down == nil {
+            t.Errorf("migration %d is invalid: %v", i, m)
+        }
+    }
+}
+
+func TestPlanMigrations(t *testing.T) {
+    ms := []*Migration{{Version: 1}, {Version: 2}, {Version: 3}}
+    cases := []struct {
+        current int
+        target int
+        want string
+    }{
+        {0, 3, "up 1,up 2,up 3"},
+        {1, 3, "up 2,up 3"},
+        {3, 3, ""},
+        {3, 1, "down 3,down 2"},
+        {2, 0, "down 2,down 1"},
+    }
+    for _, c := range cases {
+        steps, err := planMigrations(ms, c.current, c.target)
+        if err != nil {
+            t.Fatal(err)
+        }
+        got := make([]string, len(steps))
+        for i, s := range steps {
+            got[i] = strings.SplitN(s.String(), ":", 2)[0]
+        }
+        if strings.Join(got, ",") != c.want {
+            t.Errorf("%d to %d should be %s, got %v", c.current, c.target, c.want, got)
+        }
+    }
+    if _, err := planMigrations(ms, 4, 3); err != ErrUnknownSchemaVersion {
+        t.Errorf("newer database should be rejected, got %v", err)
+    }
+    if _, err := planMigrations(ms, 0, 4); err != ErrInvalidMigration {
+        t.Errorf("unknown target should be rejected, got %v", err)
+    }
+}
+
+// test DB
+func TestMigrate(t *testing.T) {
+    InitEngine("mysql", []string{"dasea:dasea@tcp(127.0.0.1:3306)/dasea?charset=utf8"})
+    out := &bytes.Buffer{}
+    err := Migrate(LatestSchemaVersion(), true, out)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if v, _ := CurrentSchemaVersion(); v != 0 {
+        t.Errorf("dry run should not migrate, got version %d", v)
+    }
+    if !strings.Contains(out.String(), "up 1: create unit category and unit tables") {
+        t.Errorf("dry run should print the steps, got %s", out.String())
+    }
+
+    if err = MigrateToLatest(nil); err != nil {
+        t.Fatal(err)
+    }
+    if v, _ := CurrentSchemaVersion(); v != LatestSchemaVersion() {
+        t.Errorf("should be at version %d, got %d", LatestSchemaVersion(), v)
+    }
+    //data is kept when migrating again
+    a, err := CreateDataStreamAttribute("test", "test", "sensor", 1, []string{"temp"}, []string{"float32"}, []int64{UDegreeCelsius})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err = CreateDataStreamAttributeTable(); err != nil {
+        t.Error(err)
+    }
+    if err = MigrateToLatest(nil); err != nil {
+        t.Error(err)
+    }
+    if _, err = GetDataStreamAttribute(a.Id); err != nil {
+        t.Errorf("attribute should be kept, got %v", err)
+    }
+
+    if err = Migrate(0, false, nil); err != nil {
+        t.Fatal(err)
+    }
+    if v, _ := CurrentSchemaVersion(); v != 0 {
+        t.Errorf("should be at version 0, got %d", v)
+    }
+
+    //storage services starting together
+    errs := make(chan error, 2)
+    for i := 0; i < 2; i++ {
+        go func() {
+            errs <- MigrateToLatest(nil)
+        }()
+    }
+    for i := 0; i < 2; i++ {
+        if err = <-errs; err != nil {
+            t.Errorf("concurrent migration should succeed, got %v", err)
+        }
+    }
+    if n, err := primary().Count(&Unit{}); err != nil || n != int64(len(units)) {
+        t.Errorf("built-in units should be seeded once, got %d %v", n, err)
+    }
+    if n, err := primary().Count(&Currency{}); err != nil || n != int64(len(currencies)) {
+        t.Errorf("currencies should be seeded once, got %d %v", n, err)
+    }
+
+    //units seeded before the catalog was corrected
+    if _, err = primary().Id(UOunce).Cols("conversion_factor").Update(&Unit{ConversionFactor: 0.0311034768}); err != nil {
+        t.Fatal(err)
+    }
+    if _, err = primary().Exec("DELETE FROM unit WHERE id = ?", URssiMilliwatt); err != nil {
+        t.Fatal(err)
+    }
+    if err = Migrate(8, false, nil); err != nil {
+        t.Fatal(err)
+    }
+    if err = MigrateToLatest(nil); err != nil {
+        t.Fatal(err)
+    }
+    ounce := &Unit{}
+    if has, err := primary().Id(UOunce).Get(ounce); err != nil || !has || ounce.ConversionFactor != units[UOunce].ConversionFactor {
+        t.Errorf("ounce should be corrected, got %v %v", ounce.ConversionFactor, err)
+    }
+    if has, err := primary().Id(URssiMilliwatt).Get(&Unit{}); err != nil || !has {
+        t.Errorf("milliwatt should be seeded, got %v", err)
+    }
+    if err = Migrate(0, false, nil); err != nil {
+        t.Fatal(err)
+    }
+    Engine.DropTables("schema_version")
+}
@@ -0,0 +1,430 @@
+package meta
+
+// Migrations and the snapshots of the tables they work on
+//
+// A snapshot is named after the struct and the version it was taken at, and
+// is never changed once the migration may have been applied. Built-in rows
+// are copied from the live catalogs into the snapshot of the table.
+import (
+    "time"
+)
+
+// Tables are created by syncTable, so migrations adopt databases created
+// before migrations existed: existing tables are kept and only get missing
+// columns and indexes.
+var migrations = []*Migration{
+    {
+        Version: 1,
+        Description: "create unit category and unit tables",
+        Up: func() error {
+            created, err := syncTable(&unitCategoryV1{})
+            if err != nil {
+                return err
+            }
+            //built-in rows are inserted only into a new table
+            if created {
+                for _, c := range unitCategories {
+                    if err = seedRow(newUnitCategoryV1(c), c.Id, &unitCategoryV1{}); err != nil {
+                        return err
+                    }
+                }
+            }
+            if created, err = syncTable(&unitV1{}); err != nil || !created {
+                return err
+            }
+            for _, u := range units {
+                if err = seedRow(newUnitV1(u), u.Id, &unitV1{}); err != nil {
+                    return err
+                }
+            }
+            return nil
+        },
+        Down: func() error {
+            return primary().DropTables("unit", "unit_category")
+        },
+    },
+    {
+        Version: 2,
+        Description: "create aggregation device and device tables",
+        Up: func() error {
+            if _, err := syncTable(&aggregationDeviceV2{}); err != nil {
+                return err
+            }
+            _, err := syncTable(&deviceV2{})
+            return err
+        },
+        Down: func() error {
+            return primary().DropTables("device", "aggregation_device")
+        },
+    },
+    {
+        Version: 3,
+        Description: "create data stream attribute and data stream tables",
+        Up: func() error {
+            if _, err := syncTable(&dataStreamAttributeV3{}); err != nil {
+                return err
+            }
+            _, err := syncTable(&dataStreamV3{})
+            return err
+        },
+        Down: func() error {
+            return primary().DropTables("data_stream", "data_stream_attribute")
+        },
+    },
+    {
+        Version: 4,
+        Description: "create retention policy and rollup tables",
+        Up: func() error {
+            if _, err := syncTable(&retentionPolicyV4{}); err != nil {
+                return err
+            }
+            _, err := syncTable(&rollupV4{})
+            return err
+        },
+        Down: func() error {
+            return primary().DropTables("rollup", "retention_policy")
+        },
+    },
+    {
+        Version: 5,
+        Description: "create currency and exchange rate tables",
+        Up: func() error {
+            created, err := syncTable(&currencyV5{})
+            if err != nil {
+                return err
+            }
+            if created {
+                for _, c := range currencies {
+                    if err = seedRow(newCurrencyV5(c), c.Id, &currencyV5{}); err != nil {
+                        return err
+                    }
+                }
+            }
+            _, err = syncTable(&exchangeRateV5{})
+            return err
+        },
+        Down: func() error {
+            return primary().DropTables("exchange_rate", "currency")
+        },
+    },
+    {
+        Version: 6,
+        Description: "create data stream attribute version table",
+        Up: func() error {
+            _, err := syncTable(&dataStreamAttributeVersionV6{})
+            return err
+        },
+        Down: func() error {
+            return primary().DropTables("data_stream_attribute_version")
+        },
+    },
+    {
+        Version: 7,
+        Description: "create device token table",
+        Up: func() error {
+            _, err := syncTable(&deviceTokenV7{})
+            return err
+        },
+        Down: func() error {
+            return primary().DropTables("device_token")
+        },
+    },
+    {
+        Version: 8,
+        Description: "make descriptions unique per aggregation device and per project",
+        Up: func() error {
+            if err := dropIndex("device", "UQE_device_description"); err != nil {
+                return err
+            }
+            if err := createUniqueIndex("device", "UQE_device_aggregation_description",
+                    "aggregation_device_id", "description"); err != nil {
+                return err
+            }
+            if err := dropIndex("data_stream_attribute", "UQE_data_stream_attribute_description"); err != nil {
+                return err
+            }
+            return createUniqueIndex("data_stream_attribute", "UQE_data_stream_attribute_project_description",
+                "project_id", "description")
+        },
+        Down: func() error {
+            if err := dropIndex("device", "UQE_device_aggregation_description"); err != nil {
+                return err
+            }
+            if err := createUniqueIndex("device", "UQE_device_description", "description"); err != nil {
+                return err
+            }
+            if err := dropIndex("data_stream_attribute", "UQE_data_stream_attribute_project_description"); err != nil {
+                return err
+            }
+            return createUniqueIndex("data_stream_attribute", "UQE_data_stream_attribute_description", "description")
+        },
+    },
+    {
+        Version: 9,
+        Description: "correct factors, offsets and symbols of built-in units",
+        //databases seeded before the corrections keep the old rows
+        Up: func() error {
+            for _, id := range correctedUnitsV9 {
+                u := newUnitV1(units[int(id)])
+                n, err := primary().Id(id).Cols("category_id", "name", "plural_name", "symbol",
+                    "is_conversion_base", "conversion_factor", "conversion_offset").Update(u)
+                if err != nil {
+                    return err
+                }
+                if n > 0 {
+                    continue
+                }
+                //mysql counts changed rows only, the row may be correct already
+                if err = seedRow(u, id, &unitV1{}); err != nil {
+                    return err
+                }
+            }
+            return nil
+        },
+        //the old rows were wrong, they are not restored
+        Down: func() error {
+            return nil
+        },
+    },
+}
+
+// Built-in units corrected after they were first seeded, and the units added
+// along with the corrections
+var correctedUnitsV9 = []int64{
+    UOunce, UDegreeCelsius, UDegreeFahrenheit, UDegree, UGigawatt,
+    UKilogramPerMeter, UKilogramPerSquareMeter, UKilogramPerCubicMeter, UKilogramPerLitre,
+    UPoundForceFoot, UPoundForceInch, UDbw, URssiMilliwatt,
+}
+
+type unitCategoryV1 struct {
+	Id int64
+	Name string `xorm:"varchar(64) notnull"`
+
+    ProjectId string `xorm:"index"`
+    DomainId string `xorm:"index"`
+	CreatedAt time.Time `xorm:"created"`
+	UpdatedAt time.Time `xorm:"updated"`
+	DeletedAt time.Time `xorm:"deleted"`
+}
+
+func (unitCategoryV1) TableName() string {
+    return "unit_category"
+}
+func newUnitCategoryV1(c *UnitCategory) *unitCategoryV1 {
+    return &unitCategoryV1{Id: c.Id, Name: c.Name, ProjectId: c.ProjectId, DomainId: c.DomainId}
+}
+
+type unitV1 struct {
+	Id int64
+	CategoryId int64 `xorm:"index notnull"`
+	Name string `xorm:"varchar(64) notnull"`
+	PluralName string `xorm:"varchar(64) default NULL"`
+	Symbol string `xorm:"varchar(32) default NULL"`
+	IsConversionBase bool `xorm:"index"`
+	ConversionFactor float64 `xorm:"default 0"`
+	ConversionOffset float64 `xorm:"default 0"`
+	IsMetricSystem bool `xorm:"index default false"`
+	IsUSSystem bool `xorm:"index default false is_us_system"`
+	IsUKSystem bool `xorm:"index default false is_uk_system"`
+
+    ProjectId string `xorm:"index"`
+    DomainId string `xorm:"index"`
+	CreatedAt time.Time `xorm:"created"`
+	UpdatedAt time.Time `xorm:"updated"`
+	DeletedAt time.Time `xorm:"deleted"`
+}
+
+func (unitV1) TableName() string {
+    return "unit"
+}
+func newUnitV1(u *Unit) *unitV1 {
+    return &unitV1{
+        Id: u.Id,
+        CategoryId: u.CategoryId,
+        Name: u.Name,
+        PluralName: u.PluralName,
+        Symbol: u.Symbol,
+        IsConversionBase: u.IsConversionBase,
+        ConversionFactor: u.ConversionFactor,
+        ConversionOffset: u.ConversionOffset,
+        IsMetricSystem: u.IsMetricSystem,
+        IsUSSystem: u.IsUSSystem,
+        IsUKSystem: u.IsUKSystem,
+        ProjectId: u.ProjectId,
+        DomainId: u.DomainId,
+    }
+}
+
+type aggregationDeviceV2 struct {
+    Id string `xorm:"pk"`
+	Description string `xorm:"varchar(255) notnull"`
+	Latitude float64 `xorm:"default 0"`
+	Longitude float64 `xorm:"default 0"`
+    ProjectId string `xorm:"index"`
+    DomainId string `xorm:"index"`
+	CreatedAt time.Time `xorm:"created"`
+	UpdateAt time.Time `xorm:"updated"`
+	DeleteAt time.Time `xorm:"deleted"`
+}
+
+func (aggregationDeviceV2) TableName() string {
+    return "aggregation_device"
+}
+
+type deviceV2 struct {
+	Id int64
+	AggregationDeviceId string `xorm:"index"`
+	Description string `xorm:"varchar(255) notnull unique"`
+	Latitude float64
+	Longitude float64
+	CreateAt time.Time `xorm:"created"`
+	UpdateAt time.Time `xorm:"updated"`
+	DeleteAt time.Time `xorm:"deleted"`
+}
+
+func (deviceV2) TableName() string {
+    return "device"
+}
+
+type dataStreamAttributeV3 struct {
+	Id int64
+	Description string `xorm:"varchar(255) notnull unique"`
+	NumDataPoints int16
+	DataPointNames []string
+	DataPointTypes []string
+	DataPointUnits []int64
+	TimestampDataPoint int16
+	WriteMode string `xorm:"varchar(16)"`
+	Version int32
+	DataPointRetired []bool
+	DataPointAliases [][]string
+	DataPointPreviousTypes [][]string
+
+    ProjectId string `xorm:"index"`
+    DomainId string `xorm:"index"`
+	CreatedAt time.Time `xorm:"created"`
+	UpdateAt time.Time `xorm:"updated"`
+	DeleteAt time.Time `xorm:"deleted"`
+}
+
+func (dataStreamAttributeV3) TableName() string {
+    return "data_stream_attribute"
+}
+
+type dataStreamV3 struct {
+	Id int64
+	DeviceId int64
+	DataStreamAttributeId int64
+
+	CreatedAt time.Time `xorm:"created"`
+	UpdateAt time.Time `xorm:"updated"`
+	DeleteAt time.Time `xorm:"deleted"`
+}
+
+func (dataStreamV3) TableName() string {
+    return "data_stream"
+}
+
+type retentionPolicyV4 struct {
+	Id int64
+	DataStreamId int64 `xorm:"index"`
+	DataStreamAttributeId int64 `xorm:"index"`
+	KeepSeconds int64
+
+    ProjectId string `xorm:"index"`
+    DomainId string `xorm:"index"`
+	CreatedAt time.Time `xorm:"created"`
+	UpdateAt time.Time `xorm:"updated"`
+}
+
+func (retentionPolicyV4) TableName() string {
+    return "retention_policy"
+}
+
+type rollupV4 struct {
+	Id int64
+	DataStreamId int64 `xorm:"index"`
+	TargetDataStreamId int64 `xorm:"unique"`
+	TargetDataStreamAttributeId int64
+	IntervalSeconds int64
+	Watermark int64
+
+    ProjectId string `xorm:"index"`
+    DomainId string `xorm:"index"`
+	CreatedAt time.Time `xorm:"created"`
+	UpdateAt time.Time `xorm:"updated"`
+}
+
+func (rollupV4) TableName() string {
+    return "rollup"
+}
+
+type currencyV5 struct {
+	Id int64
+	CategoryId int64 `xorm:"index notnull"`
+	Name string `xorm:"varchar(64) notnull"`
+	ISOCode string `xorm:"varchar(8) notnull unique iso_code"`
+	NumericCode int `xorm:"notnull"`
+	Symbol string `xorm:"varchar(8) notnull"`
+	State string `xorm:"varchar(64) notnull"`
+	CreatedAt time.Time `xorm:"created"`
+	UpdatedAt time.Time `xorm:"updated"`
+	DeletedAt time.Time `xorm:"deleted"`
+}
+
+func (currencyV5) TableName() string {
+    return "currency"
+}
+func newCurrencyV5(c *Currency) *currencyV5 {
+    return &currencyV5{
+        Id: c.Id,
+        CategoryId: c.CategoryId,
+        Name: c.Name,
+        ISOCode: c.ISOCode,
+        NumericCode: c.NumericCode,
+        Symbol: c.Symbol,
+        State: c.State,
+    }
+}
+
+type exchangeRateV5 struct {
+	Id int64
+	CurrencyId int64 `xorm:"notnull unique(currency_valid_from)"`
+	Rate float64 `xorm:"notnull"`
+	ValidFrom time.Time `xorm:"notnull unique(currency_valid_from)"`
+	CreatedAt time.Time `xorm:"created"`
+}
+
+func (exchangeRateV5) TableName() string {
+    return "exchange_rate"
+}
+
+type dataStreamAttributeVersionV6 struct {
+	Id int64
+	DataStreamAttributeId int64 `xorm:"notnull unique(attribute_version)"`
+	Version int32 `xorm:"notnull unique(attribute_version)"`
+	NumDataPoints int16
+	DataPointNames []string
+	DataPointTypes []string
+	DataPointUnits []int64
+	DataPointRetired []bool
+	CreatedAt time.Time `xorm:"created"`
+}
+
+func (dataStreamAttributeVersionV6) TableName() string {
+    return "data_stream_attribute_version"
+}
+
+type deviceTokenV7 struct {
+	Id int64
+	DeviceId int64 `xorm:"index"`
+	TokenHash string `xorm:"varchar(64) notnull unique"`
+	ExpireAt time.Time
+	Revoked bool `xorm:"index"`
+	RevokedAt time.Time
+	CreatedAt time.Time `xorm:"created"`
+}
+
+func (deviceTokenV7) TableName() string {
+    return "device_token"
+}
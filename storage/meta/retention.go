@@ -0,0 +1,166 @@
+package meta
+
+// Retention meta, how long raw data points are kept.
+//
+// A RetentionPolicy is attached to either a DataStream or a DataStreamAttribute
+// (the other id is 0). The policy of a DataStream overrides the policy of its
+// DataStreamAttribute, data points of a DataStream without any policy are kept forever.
+import (
+    "time"
+)
+
+type RetentionPolicy struct {
+	Id int64
+	DataStreamId int64 `xorm:"index"`
+	DataStreamAttributeId int64 `xorm:"index"`
+	//Seconds to keep data points, 0 keeps forever
+	KeepSeconds int64
+
+    ProjectId string `xorm:"index"` //keystone project id
+    DomainId string `xorm:"index"` //keystone domain id
+	CreatedAt time.Time `xorm:"created"`
+	UpdateAt time.Time `xorm:"updated"`
+}
+
+func (p *RetentionPolicy) Keep() time.Duration {
+    return time.Duration(p.KeepSeconds) * time.Second
+}
+
+func CreateRetentionPolicyTable() error {
+    p := &RetentionPolicy{}
+	_, err := syncTable(p)
+    return err
+}
+func GetRetentionPolicy(id int64) (*RetentionPolicy, error) {
+    p := &RetentionPolicy{}
+    has, err := primary().Id(id).Get(p)
+    if err != nil {
+        return nil, err
+    }
+    if !has {
+        return nil, ErrNotFound
+    }
+    return p, nil
+}
+func InsertRetentionPolicy(p *RetentionPolicy) error {
+    _, err := primary().Insert(p)
+    return err
+}
+func DeleteRetentionPolicy(id int64) error {
+    p := &RetentionPolicy{}
+    _, err := primary().Id(id).Delete(p)
+    return err
+}
+
+// Policy attached to the DataStream itself (not inherited from its attribute)
+func GetDataStreamRetentionPolicy(dataStreamId int64) (*RetentionPolicy, error) {
+    p := &RetentionPolicy{}
+    has, err := primary().Where("data_stream_id = ?", dataStreamId).Get(p)
+    if err != nil {
+        return nil, err
+    }
+    if !has {
+        return nil, ErrNotFound
+    }
+    return p, nil
+}
+func GetDataStreamAttributeRetentionPolicy(dataStreamAttributeId int64) (*RetentionPolicy, error) {
+    p := &RetentionPolicy{}
+    has, err := primary().Where("data_stream_attribute_id = ? and data_stream_id = 0", dataStreamAttributeId).Get(p)
+    if err != nil {
+        return nil, err
+    }
+    if !has {
+        return nil, ErrNotFound
+    }
+    return p, nil
+}
+
+// Policy that applies to a DataStream, ErrNotFound if data points are kept forever
+func GetEffectiveRetentionPolicy(dataStreamId int64) (*RetentionPolicy, error) {
+    p, err := GetDataStreamRetentionPolicy(dataStreamId)
+    if err != ErrNotFound {
+        return p, err
+    }
+    s, err := GetDataStream(dataStreamId)
+    if err != nil {
+        return nil, err
+    }
+    return GetDataStreamAttributeRetentionPolicy(s.DataStreamAttributeId)
+}
+
+func GetRetentionPoliciesByProject(projectId string) ([]*RetentionPolicy, error) {
+    policies := make([]*RetentionPolicy, 0)
+    err := primary().Where("project_id = ?", projectId).Find(&policies)
+    if err != nil {
+        return nil, err
+    }
+    return policies, nil
+}
+
+func GetAllRetentionPolicies() ([]*RetentionPolicy, error) {
+    policies := make([]*RetentionPolicy, 0)
+    err := primary().Find(&policies)
+    if err != nil {
+        return nil, err
+    }
+    return policies, nil
+}
+
+// Create or change the policy of a DataStream, project and domain are
+// taken from its DataStreamAttribute
+func SetDataStreamRetentionPolicy(dataStreamId int64, keep time.Duration) (*RetentionPolicy, error) {
+    if keep < 0 {
+        return nil, ErrInvalidRetention
+    }
+    a, err := GetDataStreamAttributeByDataStreamId(dataStreamId)
+    if err != nil {
+        return nil, err
+    }
+    p, err := GetDataStreamRetentionPolicy(dataStreamId)
+    if err == ErrNotFound {
+        p = &RetentionPolicy{
+            DataStreamId: dataStreamId,
+            DataStreamAttributeId: a.Id,
+        }
+    } else if err != nil {
+        return nil, err
+    }
+    return saveRetentionPolicy(p, a, keep)
+}
+
+// Create or change the policy shared by all DataStreams of a DataStreamAttribute
+func SetDataStreamAttributeRetentionPolicy(dataStreamAttributeId int64, keep time.Duration) (*RetentionPolicy, error) {
+    if keep < 0 {
+        return nil, ErrInvalidRetention
+    }
+    a, err := GetDataStreamAttribute(dataStreamAttributeId)
+    if err != nil {
+        return nil, err
+    }
+    p, err := GetDataStreamAttributeRetentionPolicy(dataStreamAttributeId)
+    if err == ErrNotFound {
+        p = &RetentionPolicy{
+            DataStreamAttributeId: dataStreamAttributeId,
+        }
+    } else if err != nil {
+        return nil, err
+    }
+    return saveRetentionPolicy(p, a, keep)
+}
+
+func saveRetentionPolicy(p *RetentionPolicy, a *DataStreamAttribute, keep time.Duration) (*RetentionPolicy, error) {
+    p.KeepSeconds = int64(keep / time.Second)
+    p.ProjectId = a.ProjectId
+    p.DomainId = a.DomainId
+    var err error
+    if p.Id == 0 {
+        _, err = primary().Insert(p)
+    } else {
+        _, err = primary().Id(p.Id).Cols("keep_seconds", "project_id", "domain_id").Update(p)
+    }
+    if err != nil {
+        return nil, err
+    }
+    return p, nil
+}
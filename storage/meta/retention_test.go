@@ -0,0 +1,84 @@
+package meta
+
+import (
+    "testing"
+    "time"
+)
+
+// test DB
+func TestRetentionPolicy(t *testing.T) {
+    InitEngine("mysql", []string{"dasea:dasea@tcp(127.0.0.1:3306)/dasea?charset=utf8"})
+    err := CreateDataStreamAttributeTable()
+    if err != nil {
+        t.Error(err)
+    }
+    err = CreateDataStreamTable()
+    if err != nil {
+        t.Error(err)
+    }
+    err = CreateRetentionPolicyTable()
+    if err != nil {
+        t.Error(err)
+    }
+    testProjectDevice(t, "123", "test")
+
+    a, err := CreateDataStreamAttribute("test", "test", "test 1", 1, []string{"data"}, []string{"uint16"}, []int64{10001})
+    if err != nil {
+        t.Fatal(err)
+    }
+    s1, err := CreateDataStream(1, a.Id)
+    if err != nil {
+        t.Fatal(err)
+    }
+    s2, err := CreateDataStream(1, a.Id)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    _, err = GetEffectiveRetentionPolicy(s1.Id)
+    if err != ErrNotFound {
+        t.Error("Data stream without policy should be kept forever")
+    }
+
+    _, err = SetDataStreamAttributeRetentionPolicy(a.Id, 90*24*time.Hour)
+    if err != nil {
+        t.Error(err)
+    }
+    p, err := SetDataStreamRetentionPolicy(s2.Id, time.Hour)
+    if err != nil {
+        t.Error(err)
+    }
+    //change
+    p, err = SetDataStreamRetentionPolicy(s2.Id, 2*time.Hour)
+    if err != nil {
+        t.Error(err)
+    }
+    if p.ProjectId != "test" {
+        t.Error("Project should be taken from attribute")
+    }
+
+    p1, err := GetEffectiveRetentionPolicy(s1.Id)
+    if err != nil || p1.Keep() != 90*24*time.Hour {
+        t.Error("Data stream should inherit policy from attribute")
+    }
+    p2, err := GetEffectiveRetentionPolicy(s2.Id)
+    if err != nil || p2.Keep() != 2*time.Hour {
+        t.Error("Data stream policy should override attribute policy")
+    }
+
+    policies, err := GetRetentionPoliciesByProject("test")
+    if err != nil || len(policies) != 2 {
+        t.Error("Should get 2 policies of the project")
+    }
+
+    _, err = SetDataStreamRetentionPolicy(s2.Id, -time.Hour)
+    if err != ErrInvalidRetention {
+        t.Error("Negative retention should be rejected")
+    }
+
+    Engine.DropTables("retention_policy")
+    Engine.DropTables("data_stream_attribute")
+    Engine.DropTables("data_stream")
+    Engine.DropTables("device")
+    Engine.DropTables("aggregation_device")
+}
@@ -0,0 +1,81 @@
+package meta
+
+// Rollup meta, downsampled DataStreams maintained by the storage service.
+//
+// A Rollup materialises statistics of a (source) DataStream in fixed buckets
+// into a derived DataStream (with its own DataStreamAttribute), so that the
+// derived DataStream can have its own RetentionPolicy and long range
+// aggregate queries read the rollup instead of raw data points.
+import (
+    "time"
+)
+
+type Rollup struct {
+	Id int64
+	DataStreamId int64 `xorm:"index"` //source DataStream
+	TargetDataStreamId int64 `xorm:"unique"`
+	TargetDataStreamAttributeId int64
+	//Bucket size, buckets are aligned to the epoch (UTC)
+	IntervalSeconds int64
+	//Buckets before the watermark (unix nano) are materialised
+	Watermark int64
+
+    ProjectId string `xorm:"index"` //keystone project id
+    DomainId string `xorm:"index"` //keystone domain id
+	CreatedAt time.Time `xorm:"created"`
+	UpdateAt time.Time `xorm:"updated"`
+}
+
+func (r *Rollup) Interval() time.Duration {
+    return time.Duration(r.IntervalSeconds) * time.Second
+}
+
+func CreateRollupTable() error {
+    r := &Rollup{}
+	_, err := syncTable(r)
+    return err
+}
+func GetRollup(id int64) (*Rollup, error) {
+    r := &Rollup{}
+    has, err := primary().Id(id).Get(r)
+    if err != nil {
+        return nil, err
+    }
+    if !has {
+        return nil, ErrNotFound
+    }
+    return r, nil
+}
+func InsertRollup(r *Rollup) error {
+    _, err := primary().Insert(r)
+    return err
+}
+func DeleteRollup(id int64) error {
+    r := &Rollup{}
+    _, err := primary().Id(id).Delete(r)
+    return err
+}
+
+func GetRollupsByDataStreamId(dataStreamId int64) ([]*Rollup, error) {
+    rollups := make([]*Rollup, 0)
+    err := primary().Where("data_stream_id = ?", dataStreamId).Find(&rollups)
+    if err != nil {
+        return nil, err
+    }
+    return rollups, nil
+}
+
+func GetAllRollups() ([]*Rollup, error) {
+    rollups := make([]*Rollup, 0)
+    err := primary().Find(&rollups)
+    if err != nil {
+        return nil, err
+    }
+    return rollups, nil
+}
+
+func UpdateRollupWatermark(id int64, watermark int64) error {
+    r := &Rollup{Watermark: watermark}
+    _, err := primary().Id(id).Cols("watermark").Update(r)
+    return err
+}
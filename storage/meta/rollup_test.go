@@ -0,0 +1,54 @@
+package meta
+
+import (
+    "testing"
+    "time"
+)
+
+// test DB
+func TestRollup(t *testing.T) {
+    InitEngine("mysql", []string{"dasea:dasea@tcp(127.0.0.1:3306)/dasea?charset=utf8"})
+    err := CreateRollupTable()
+    if err != nil {
+        t.Error(err)
+    }
+
+    err = InsertRollup(&Rollup{
+        DataStreamId: 1,
+        TargetDataStreamId: 2,
+        TargetDataStreamAttributeId: 2,
+        IntervalSeconds: 300,
+        ProjectId: "test",
+        DomainId: "test",
+    })
+    if err != nil {
+        t.Error(err)
+    }
+    rollups, err := GetRollupsByDataStreamId(1)
+    if err != nil || len(rollups) != 1 {
+        t.Fatal("Should get 1 rollup of data stream 1")
+    }
+    r := rollups[0]
+    if r.Interval() != 5*time.Minute {
+        t.Error("Rollup interval error")
+    }
+
+    err = UpdateRollupWatermark(r.Id, 1000)
+    if err != nil {
+        t.Error(err)
+    }
+    r, err = GetRollup(r.Id)
+    if err != nil || r.Watermark != 1000 {
+        t.Error("Watermark not updated")
+    }
+
+    err = DeleteRollup(r.Id)
+    if err != nil {
+        t.Error(err)
+    }
+    _, err = GetRollup(r.Id)
+    if err != ErrNotFound {
+        t.Error("Still get something after delete")
+    }
+    Engine.DropTables("rollup")
+}
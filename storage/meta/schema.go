@@ -0,0 +1,281 @@
+package meta
+
+// Schema evolution of DataStreamAttribute
+//
+// Data points are saved by position, so a DataStreamAttribute can evolve in
+// place as long as positions never change:
+//  - add: a data point is appended, older records read it as its zero value
+//  - rename: the old name is kept as an alias (e.g. for json from devices
+//            which are not upgraded yet)
+//  - retire: the data point keeps its position and old values but is no
+//            longer written, values sent for it are dropped
+//  - widen: the type becomes a larger type of the same family (e.g. int16
+//           to int32, float32 to float64), values are saved normalised so
+//           saved records need no change
+// Every change bumps Version, the replaced version is kept in
+// DataStreamAttributeVersion.
+//
+// Example:
+//  previous, a, err := meta.EvolveDataStreamAttribute(id, []*meta.DataPointChange{
+//      {Op: meta.DataPointAdd, Name: "humidity", Type: "float32", Unit: meta.URelativeHumidity},
+//      {Op: meta.DataPointRename, Name: "temp", NewName: "temperature"},
+//  })
+import (
+    "time"
+)
+
+// Ops of DataPointChange
+const (
+    DataPointAdd = "add"
+    DataPointRename = "rename"
+    DataPointRetire = "retire"
+    DataPointWiden = "widen"
+)
+
+type DataPointChange struct {
+    Op string
+    //data point to change, or the name of the new data point for add
+    Name string
+    //new name for rename
+    NewName string
+    //type for add and widen
+    Type string
+    //unit for add
+    Unit int64
+}
+
+// A replaced version of a DataStreamAttribute
+type DataStreamAttributeVersion struct {
+	Id int64
+	DataStreamAttributeId int64 `xorm:"notnull unique(attribute_version)"`
+	Version int32 `xorm:"notnull unique(attribute_version)"`
+	NumDataPoints int16
+	DataPointNames []string
+	DataPointTypes []string
+	DataPointUnits []int64
+	DataPointRetired []bool
+	CreatedAt time.Time `xorm:"created"`
+}
+
+// Family, size and protobuf value encoding of data point types, a type can
+// only be widened to a larger type of the same family and encoding. Devices
+// not upgraded yet still send the old type, which is told from the new one
+// by its wire type only, so plain varints (int16) must not be widened to
+// zigzag varints (sint64) or the other way round.
+var dataPointTypeSizes = map[string]struct {
+    family string
+    size int
+    encoding string
+}{
+    "int8": {"int", 8, "varint"}, "sint8": {"int", 8, "zigzag"},
+    "int16": {"int", 16, "varint"}, "sint16": {"int", 16, "zigzag"},
+    "int": {"int", 32, "varint"}, "int32": {"int", 32, "varint"},
+    "sint": {"int", 32, "zigzag"}, "sint32": {"int", 32, "zigzag"}, "sfixed32": {"int", 32, "fixed"},
+    "int64": {"int", 64, "varint"}, "sint64": {"int", 64, "zigzag"}, "sfixed64": {"int", 64, "fixed"},
+    "uint8": {"uint", 8, "varint"}, "uint16": {"uint", 16, "varint"},
+    "uint": {"uint", 32, "varint"}, "uint32": {"uint", 32, "varint"}, "fixed32": {"uint", 32, "fixed"},
+    "uint64": {"uint", 64, "varint"}, "fixed64": {"uint", 64, "fixed"},
+    "float": {"float", 32, "fixed"}, "float32": {"float", 32, "fixed"},
+    "double": {"float", 64, "fixed"}, "float64": {"float", 64, "fixed"},
+    "bool": {"bool", 1, "varint"},
+    "timestamp": {"time", 64, "bytes"}, "datetime": {"time", 64, "bytes"},
+    "string": {"string", 0, "bytes"},
+}
+
+func canWiden(from string, to string) bool {
+    f, ok := dataPointTypeSizes[from]
+    if !ok {
+        return false
+    }
+    t, ok := dataPointTypeSizes[to]
+    return ok && f.family == t.family && f.encoding == t.encoding && t.size > f.size
+}
+
+// Whether values of types a and b are encoded the same way in protobuf
+// (given the same wire type), e.g. int16 and int64 but not int16 and sint64
+func SameEncoding(a string, b string) bool {
+    ta, ok := dataPointTypeSizes[a]
+    tb, okb := dataPointTypeSizes[b]
+    return ok && okb && ta.family == tb.family && ta.encoding == tb.encoding
+}
+
+// Whether data point i is retired
+func (a *DataStreamAttribute) IsRetired(i int) bool {
+    return i < len(a.DataPointRetired) && a.DataPointRetired[i]
+}
+
+// Index of the data point named name, previous names are looked up only if
+// no data point has the name now. -1 if not found.
+func (a *DataStreamAttribute) DataPointIndex(name string) int {
+    for i, n := range a.DataPointNames {
+        if n == name {
+            return i
+        }
+    }
+    for i, aliases := range a.DataPointAliases {
+        for _, alias := range aliases {
+            if alias == name {
+                return i
+            }
+        }
+    }
+    return -1
+}
+
+// Current and previous types of data point i, the current type first
+func (a *DataStreamAttribute) DataPointTypesOf(i int) []string {
+    types := []string{a.DataPointTypes[i]}
+    if i < len(a.DataPointPreviousTypes) {
+        types = append(types, a.DataPointPreviousTypes[i]...)
+    }
+    return types
+}
+
+// Apply changes in order to a copy of a, a itself is not changed
+func (a *DataStreamAttribute) Evolve(changes []*DataPointChange) (*DataStreamAttribute, error) {
+    if len(changes) == 0 {
+        return nil, ErrInvalidDataPointChange
+    }
+    next := *a
+    n := int(a.NumDataPoints)
+    next.DataPointNames = append([]string{}, a.DataPointNames...)
+    next.DataPointTypes = append([]string{}, a.DataPointTypes...)
+    next.DataPointUnits = append([]int64{}, a.DataPointUnits...)
+    next.DataPointRetired = make([]bool, n)
+    next.DataPointAliases = make([][]string, n)
+    next.DataPointPreviousTypes = make([][]string, n)
+    for i := 0; i < n; i++ {
+        next.DataPointRetired[i] = a.IsRetired(i)
+        if i < len(a.DataPointAliases) {
+            next.DataPointAliases[i] = append([]string{}, a.DataPointAliases[i]...)
+        }
+        if i < len(a.DataPointPreviousTypes) {
+            next.DataPointPreviousTypes[i] = append([]string{}, a.DataPointPreviousTypes[i]...)
+        }
+    }
+
+    for _, c := range changes {
+        index := -1
+        for i, name := range next.DataPointNames {
+            if name == c.Name {
+                index = i
+            }
+        }
+        switch c.Op {
+        case DataPointAdd:
+            if c.Name == "" || index >= 0 || next.NumDataPoints == 1<<15-1 {
+                return nil, ErrInvalidDataPointChange
+            }
+            if _, ok := dataPointTypeSizes[c.Type]; !ok {
+                return nil, ErrInvalidDataPointChange
+            }
+            next.NumDataPoints++
+            next.DataPointNames = append(next.DataPointNames, c.Name)
+            next.DataPointTypes = append(next.DataPointTypes, c.Type)
+            next.DataPointUnits = append(next.DataPointUnits, c.Unit)
+            next.DataPointRetired = append(next.DataPointRetired, false)
+            next.DataPointAliases = append(next.DataPointAliases, nil)
+            next.DataPointPreviousTypes = append(next.DataPointPreviousTypes, nil)
+        case DataPointRename:
+            if index < 0 || c.NewName == "" || c.NewName == c.Name {
+                return nil, ErrInvalidDataPointChange
+            }
+            for _, name := range next.DataPointNames {
+                if name == c.NewName {
+                    return nil, ErrInvalidDataPointChange
+                }
+            }
+            next.DataPointAliases[index] = append(next.DataPointAliases[index], c.Name)
+            next.DataPointNames[index] = c.NewName
+        case DataPointRetire:
+            if index < 0 || next.DataPointRetired[index] || int(next.TimestampDataPoint) == index+1 {
+                return nil, ErrInvalidDataPointChange
+            }
+            next.DataPointRetired[index] = true
+        case DataPointWiden:
+            if index < 0 || next.DataPointRetired[index] || !canWiden(next.DataPointTypes[index], c.Type) {
+                return nil, ErrInvalidDataPointChange
+            }
+            next.DataPointPreviousTypes[index] = append(next.DataPointPreviousTypes[index], next.DataPointTypes[index])
+            next.DataPointTypes[index] = c.Type
+        default:
+            return nil, ErrInvalidDataPointChange
+        }
+    }
+    next.Version = a.version() + 1
+    return &next, nil
+}
+
+// Attributes saved before versioning have version 0
+func (a *DataStreamAttribute) version() int32 {
+    if a.Version == 0 {
+        return 1
+    }
+    return a.Version
+}
+
+func CreateDataStreamAttributeVersionTable() error {
+    v := &DataStreamAttributeVersion{}
+	_, err := syncTable(v)
+    return err
+}
+
+// Apply changes to a saved DataStreamAttribute, returns the previous and
+// the new version. Data stores are not touched, see data.EvolveDataStreamAttribute.
+func EvolveDataStreamAttribute(id int64, changes []*DataPointChange) (*DataStreamAttribute, *DataStreamAttribute, error) {
+    a, err := getDataStreamAttribute(primary(), id)
+    if err != nil {
+        return nil, nil, err
+    }
+    next, err := a.Evolve(changes)
+    if err != nil {
+        return nil, nil, err
+    }
+    if err = checkDataPointUnits(a.ProjectId, next.DataPointUnits[a.NumDataPoints:]); err != nil {
+        return nil, nil, err
+    }
+    //the replaced version is saved in the same transaction, so that it is
+    // never missing for records written with it
+    session := primary().NewSession()
+    defer session.Close()
+    if err = session.Begin(); err != nil {
+        return nil, nil, err
+    }
+    //the version check makes concurrent changes fail instead of overwriting
+    // each other
+    n, err := session.Id(id).Where("version = ?", a.Version).
+        Cols("num_data_points", "data_point_names", "data_point_types", "data_point_units", "data_point_retired",
+            "data_point_aliases", "data_point_previous_types", "version").Update(next)
+    if err != nil {
+        session.Rollback()
+        return nil, nil, err
+    }
+    if n == 0 {
+        session.Rollback()
+        return nil, nil, ErrVersionConflict
+    }
+    _, err = session.Insert(&DataStreamAttributeVersion{
+        DataStreamAttributeId: id,
+        Version: a.version(),
+        NumDataPoints: a.NumDataPoints,
+        DataPointNames: a.DataPointNames,
+        DataPointTypes: a.DataPointTypes,
+        DataPointUnits: a.DataPointUnits,
+        DataPointRetired: a.DataPointRetired,
+    })
+    if err != nil {
+        session.Rollback()
+        return nil, nil, err
+    }
+    if err = session.Commit(); err != nil {
+        return nil, nil, err
+    }
+    return a, next, nil
+}
+
+// Versions replaced so far, oldest first
+func GetDataStreamAttributeVersions(id int64) ([]*DataStreamAttributeVersion, error) {
+    versions := make([]*DataStreamAttributeVersion, 0)
+    err := primary().Where("data_stream_attribute_id = ?", id).Asc("version").Find(&versions)
+    return versions, err
+}
@@ -0,0 +1,130 @@
+package meta
+
+import (
+    "testing"
+)
+
+func testSchemaAttribute() *DataStreamAttribute {
+    return &DataStreamAttribute{
+        Id: 1,
+        NumDataPoints: 3,
+        DataPointNames: []string{"temp", "count", "time"},
+        DataPointTypes: []string{"float32", "int16", "timestamp"},
+        DataPointUnits: []int64{UDegreeCelsius, UCount, UUnit},
+        TimestampDataPoint: 3,
+        Version: 1,
+    }
+}
+
+func TestEvolve(t *testing.T) {
+    a := testSchemaAttribute()
+    next, err := a.Evolve([]*DataPointChange{
+        {Op: DataPointAdd, Name: "humidity", Type: "float32", Unit: URelativeHumidity},
+        {Op: DataPointRename, Name: "temp", NewName: "temperature"},
+        {Op: DataPointWiden, Name: "temperature", Type: "float64"},
+        {Op: DataPointWiden, Name: "count", Type: "int32"},
+        {Op: DataPointWiden, Name: "count", Type: "int64"},
+        {Op: DataPointRetire, Name: "humidity"},
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if next.Version != 2 || next.NumDataPoints != 4 || next.DataPointNames[0] != "temperature" ||
+        next.DataPointNames[3] != "humidity" || next.DataPointUnits[3] != URelativeHumidity {
+        t.Errorf("changes are not applied, got %v", next)
+    }
+    if next.DataPointTypes[0] != "float64" || next.DataPointTypes[1] != "int64" {
+        t.Errorf("types should be widened, got %v", next.DataPointTypes)
+    }
+    if types := next.DataPointTypesOf(1); len(types) != 3 || types[1] != "int16" || types[2] != "int32" {
+        t.Errorf("previous types should be kept, got %v", types)
+    }
+    if !next.IsRetired(3) || next.IsRetired(0) {
+        t.Errorf("only humidity should be retired, got %v", next.DataPointRetired)
+    }
+    if next.DataPointIndex("temperature") != 0 || next.DataPointIndex("temp") != 0 || next.DataPointIndex("x") != -1 {
+        t.Errorf("old names should be aliases")
+    }
+    //a is not changed
+    if a.NumDataPoints != 3 || a.DataPointNames[0] != "temp" || a.DataPointTypes[0] != "float32" ||
+        len(a.DataPointRetired) != 0 || a.Version != 1 {
+        t.Errorf("original attribute should not change, got %v", a)
+    }
+
+    //the current name wins over an alias
+    again, err := next.Evolve([]*DataPointChange{{Op: DataPointAdd, Name: "temp", Type: "string"}})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if again.DataPointIndex("temp") != 4 || again.Version != 3 {
+        t.Errorf("temp should be the new data point, got %d", again.DataPointIndex("temp"))
+    }
+
+    bad := [][]*DataPointChange{
+        {},
+        {{Op: "drop", Name: "temp"}},
+        {{Op: DataPointAdd, Name: "temp", Type: "float32"}},
+        {{Op: DataPointAdd, Name: "", Type: "float32"}},
+        {{Op: DataPointAdd, Name: "x", Type: "complex64"}},
+        {{Op: DataPointRename, Name: "temp", NewName: "count"}},
+        {{Op: DataPointRename, Name: "x", NewName: "y"}},
+        {{Op: DataPointRetire, Name: "time"}},
+        {{Op: DataPointRetire, Name: "count"}, {Op: DataPointRetire, Name: "count"}},
+        {{Op: DataPointRetire, Name: "count"}, {Op: DataPointWiden, Name: "count", Type: "int64"}},
+        {{Op: DataPointWiden, Name: "temp", Type: "float32"}},
+        {{Op: DataPointWiden, Name: "count", Type: "int8"}},
+        {{Op: DataPointWiden, Name: "count", Type: "uint64"}},
+        {{Op: DataPointWiden, Name: "count", Type: "float64"}},
+        //plain and zigzag varints cannot be told apart
+        {{Op: DataPointWiden, Name: "count", Type: "sint64"}},
+        {{Op: DataPointWiden, Name: "count", Type: "sfixed64"}},
+    }
+    for i, changes := range bad {
+        if _, err = a.Evolve(changes); err != ErrInvalidDataPointChange {
+            t.Errorf("changes %d should be rejected, got %v", i, err)
+        }
+    }
+}
+
+// test DB
+func TestEvolveDataStreamAttribute(t *testing.T) {
+    InitEngine("mysql", []string{"dasea:dasea@tcp(127.0.0.1:3306)/dasea?charset=utf8"})
+    err := CreateDataStreamAttributeTable()
+    if err != nil {
+        t.Error(err)
+    }
+    err = CreateDataStreamAttributeVersionTable()
+    if err != nil {
+        t.Error(err)
+    }
+    a, err := CreateDataStreamAttribute("test", "test", "sensor", 2, []string{"temp", "count"},
+        []string{"float32", "int16"}, []int64{UDegreeCelsius, UCount})
+    if err != nil {
+        t.Fatal(err)
+    }
+    previous, next, err := EvolveDataStreamAttribute(a.Id, []*DataPointChange{
+        {Op: DataPointAdd, Name: "humidity", Type: "float32", Unit: URelativeHumidity},
+        {Op: DataPointRename, Name: "temp", NewName: "temperature"},
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if previous.Version != 1 || next.Version != 2 {
+        t.Errorf("version should go from 1 to 2, got %d %d", previous.Version, next.Version)
+    }
+    saved, err := GetDataStreamAttribute(a.Id)
+    if err != nil || saved.Version != 2 || saved.NumDataPoints != 3 || saved.DataPointIndex("temp") != 0 {
+        t.Errorf("new version should be saved, got %v %v", saved, err)
+    }
+    versions, err := GetDataStreamAttributeVersions(a.Id)
+    if err != nil || len(versions) != 1 || versions[0].Version != 1 || versions[0].DataPointNames[0] != "temp" {
+        t.Errorf("version 1 should be kept, got %v %v", versions, err)
+    }
+    _, _, err = EvolveDataStreamAttribute(a.Id, []*DataPointChange{{Op: DataPointAdd, Name: "x", Type: "int8", Unit: 12345}})
+    if err != ErrUnknownUnit {
+        t.Errorf("unknown unit should be rejected, got %v", err)
+    }
+
+    Engine.DropTables("data_stream_attribute")
+    Engine.DropTables("data_stream_attribute_version")
+}
@@ -0,0 +1,363 @@
+package meta
+
+// Project scoped access
+//
+// AggregationDevices and DataStreamAttributes belong to the keystone project
+// (and its domain) they are created in, Devices belong to the project of
+// their AggregationDevice and DataStreams to the project of their
+// DataStreamAttribute. The methods of Scope only see and change items of
+// the project of the token, items of other projects are reported as
+// ErrNotFound so that their existence is not revealed.
+//
+// The package level functions are not scoped, they are meant for the
+// storage service itself (e.g. retention and rollups).
+//
+// Example:
+//  scope, err := meta.ScopeFromToken(access.TokenInfo)
+//  devices, err := scope.ListDevices(&meta.ListOpts{Limit: 50})
+import (
+    "time"
+    "github.com/heartsg/dasea/keystone/keystoneclient/types"
+)
+
+type Scope struct {
+    ProjectId string
+    DomainId string
+}
+
+// Scope of a project scoped token
+func ScopeFromToken(token *types.Token) (*Scope, error) {
+    if token == nil || token.Project == nil || token.Project.Id == "" {
+        return nil, ErrNoScope
+    }
+    s := &Scope{ProjectId: token.Project.Id, DomainId: token.Project.DomainId}
+    if token.Project.Domain != nil && token.Project.Domain.Id != "" {
+        s.DomainId = token.Project.Domain.Id
+    }
+    return s, nil
+}
+
+// Scope of the project of a device, for requests authenticated by a device
+// token
+func ScopeFromDevice(deviceId int64) (*Scope, error) {
+    agg, err := getDeviceOwner(replica(), deviceId)
+    if err != nil {
+        return nil, err
+    }
+    return &Scope{ProjectId: agg.ProjectId, DomainId: agg.DomainId}, nil
+}
+
+// Whether an item of projectId and domainId is in the scope, the domain is
+// compared only if both are known
+func (s *Scope) Owns(projectId string, domainId string) bool {
+    if s.ProjectId == "" || projectId != s.ProjectId {
+        return false
+    }
+    return s.DomainId == "" || domainId == "" || domainId == s.DomainId
+}
+
+// Copy of opts limited to the scope
+func (s *Scope) listOpts(opts *ListOpts) *ListOpts {
+    scoped := ListOpts{}
+    if opts != nil {
+        scoped = *opts
+    }
+    scoped.ProjectId = s.ProjectId
+    scoped.DomainId = s.DomainId
+    return &scoped
+}
+
+func (s *Scope) GetAggregationDevice(id string) (*AggregationDevice, error) {
+    a, err := GetAggregationDevice(id)
+    if err != nil {
+        return nil, err
+    }
+    if !s.Owns(a.ProjectId, a.DomainId) {
+        return nil, ErrNotFound
+    }
+    return a, nil
+}
+func (s *Scope) ListAggregationDevices(opts *ListOpts) ([]*AggregationDevice, error) {
+    return ListAggregationDevices(s.listOpts(opts))
+}
+// Insert a into the project of the scope
+func (s *Scope) InsertAggregationDevice(a *AggregationDevice) error {
+    a.ProjectId = s.ProjectId
+    a.DomainId = s.DomainId
+    return InsertAggregationDevice(a)
+}
+func (s *Scope) UpdateAggregationDevice(a *AggregationDevice) error {
+    if _, err := s.ownAggregationDevice(a.Id); err != nil {
+        return err
+    }
+    return UpdateAggregationDevice(a)
+}
+func (s *Scope) DeleteAggregationDevice(id string) error {
+    if _, err := s.ownAggregationDevice(id); err != nil {
+        return err
+    }
+    return DeleteAggregationDevice(id)
+}
+// Aggregation device read from the primary before a write
+func (s *Scope) ownAggregationDevice(id string) (*AggregationDevice, error) {
+    a, err := getAggregationDevice(primary(), id)
+    if err != nil {
+        return nil, err
+    }
+    if !s.Owns(a.ProjectId, a.DomainId) {
+        return nil, ErrNotFound
+    }
+    return a, nil
+}
+
+func (s *Scope) GetDevice(id int64) (*Device, error) {
+    d, err := GetDevice(id)
+    if err != nil {
+        return nil, err
+    }
+    if _, err = s.GetAggregationDevice(d.AggregationDeviceId); err != nil {
+        return nil, err
+    }
+    return d, nil
+}
+func (s *Scope) ListDevices(opts *ListOpts) ([]*Device, error) {
+    return ListDevices(s.listOpts(opts))
+}
+// Insert d, its AggregationDevice must be in the scope
+func (s *Scope) InsertDevice(d *Device) error {
+    if _, err := s.ownAggregationDevice(d.AggregationDeviceId); err != nil {
+        return err
+    }
+    return InsertDevice(d)
+}
+// Update d, it can only be moved to an AggregationDevice in the scope
+func (s *Scope) UpdateDevice(d *Device) error {
+    if err := s.ownDevice(d.Id); err != nil {
+        return err
+    }
+    if _, err := s.ownAggregationDevice(d.AggregationDeviceId); err != nil {
+        return err
+    }
+    return UpdateDevice(d)
+}
+func (s *Scope) DeleteDevice(id int64) error {
+    if err := s.ownDevice(id); err != nil {
+        return err
+    }
+    return DeleteDevice(id)
+}
+func (s *Scope) ownDevice(id int64) error {
+    agg, err := getDeviceOwner(primary(), id)
+    if err != nil {
+        return err
+    }
+    if !s.Owns(agg.ProjectId, agg.DomainId) {
+        return ErrNotFound
+    }
+    return nil
+}
+
+// Tokens of a device in the scope, see IssueDeviceToken
+func (s *Scope) IssueDeviceToken(deviceId int64, ttl time.Duration) (string, *DeviceToken, error) {
+    if err := s.ownDevice(deviceId); err != nil {
+        return "", nil, err
+    }
+    return IssueDeviceToken(deviceId, ttl)
+}
+func (s *Scope) RotateDeviceToken(deviceId int64, ttl time.Duration) (string, *DeviceToken, error) {
+    if err := s.ownDevice(deviceId); err != nil {
+        return "", nil, err
+    }
+    return RotateDeviceToken(deviceId, ttl)
+}
+func (s *Scope) ListDeviceTokens(deviceId int64) ([]*DeviceToken, error) {
+    if _, err := s.GetDevice(deviceId); err != nil {
+        return nil, err
+    }
+    return ListDeviceTokens(deviceId)
+}
+// Revoke token id of the device
+func (s *Scope) RevokeDeviceToken(deviceId int64, id int64) error {
+    if err := s.ownDevice(deviceId); err != nil {
+        return err
+    }
+    t, err := GetDeviceToken(id)
+    if err != nil {
+        return err
+    }
+    if t.DeviceId != deviceId {
+        return ErrNotFound
+    }
+    return RevokeDeviceToken(id)
+}
+func (s *Scope) RevokeDeviceTokens(deviceId int64) error {
+    if err := s.ownDevice(deviceId); err != nil {
+        return err
+    }
+    return RevokeDeviceTokens(deviceId)
+}
+
+func (s *Scope) GetDataStreamAttribute(id int64) (*DataStreamAttribute, error) {
+    a, err := GetDataStreamAttribute(id)
+    if err != nil {
+        return nil, err
+    }
+    if !s.Owns(a.ProjectId, a.DomainId) {
+        return nil, ErrNotFound
+    }
+    return a, nil
+}
+func (s *Scope) ListDataStreamAttributes(opts *ListOpts) ([]*DataStreamAttribute, error) {
+    return ListDataStreamAttributes(s.listOpts(opts))
+}
+// Create a DataStreamAttribute in the project of the scope
+func (s *Scope) CreateDataStreamAttribute(desc string, numDataPoints int16, dataPointNames []string,
+        dataPointTypes []string, dataPointUnits []int64) (*DataStreamAttribute, error) {
+    return CreateDataStreamAttribute(s.ProjectId, s.DomainId, desc, numDataPoints, dataPointNames,
+        dataPointTypes, dataPointUnits)
+}
+func (s *Scope) CreateDataStreamAttributeWriteMode(desc string, numDataPoints int16, dataPointNames []string,
+        dataPointTypes []string, dataPointUnits []int64, timestampDataPoint int16, mode string) (*DataStreamAttribute, error) {
+    return CreateDataStreamAttributeWriteMode(s.ProjectId, s.DomainId, desc, numDataPoints, dataPointNames,
+        dataPointTypes, dataPointUnits, timestampDataPoint, mode)
+}
+func (s *Scope) UpdateDataStreamAttribute(a *DataStreamAttribute) error {
+    if _, err := s.ownDataStreamAttribute(a.Id); err != nil {
+        return err
+    }
+    return UpdateDataStreamAttribute(a)
+}
+func (s *Scope) DeleteDataStreamAttribute(id int64) error {
+    if _, err := s.ownDataStreamAttribute(id); err != nil {
+        return err
+    }
+    return DeleteDataStreamAttribute(id)
+}
+func (s *Scope) ownDataStreamAttribute(id int64) (*DataStreamAttribute, error) {
+    a, err := getDataStreamAttribute(primary(), id)
+    if err != nil {
+        return nil, err
+    }
+    if !s.Owns(a.ProjectId, a.DomainId) {
+        return nil, ErrNotFound
+    }
+    return a, nil
+}
+
+func (s *Scope) GetDataStream(id int64) (*DataStream, error) {
+    ds, err := GetDataStream(id)
+    if err != nil {
+        return nil, err
+    }
+    if _, err = s.GetDataStreamAttribute(ds.DataStreamAttributeId); err != nil {
+        return nil, err
+    }
+    return ds, nil
+}
+// DataStream of the device and the DataStreamAttribute of the descriptions,
+// see FindDataStream
+func (s *Scope) FindDataStream(deviceDesc string, attributeDesc string) (*DataStream, error) {
+    a, err := GetDataStreamAttributeByDescription(s.ProjectId, attributeDesc)
+    if err != nil {
+        return nil, err
+    }
+    if !s.Owns(a.ProjectId, a.DomainId) {
+        return nil, ErrNotFound
+    }
+    d, err := GetDeviceByDescription(s.ProjectId, deviceDesc)
+    if err != nil {
+        return nil, err
+    }
+    if _, err = s.GetAggregationDevice(d.AggregationDeviceId); err != nil {
+        return nil, err
+    }
+    return FindDataStream(d.Id, a.Id)
+}
+func (s *Scope) ListDataStreams(opts *ListOpts) ([]*DataStream, error) {
+    return ListDataStreams(s.listOpts(opts))
+}
+// Create a DataStream, the device and the DataStreamAttribute must be in the scope
+func (s *Scope) CreateDataStream(deviceId int64, dataStreamAttributeId int64) (*DataStream, error) {
+    if _, err := s.ownDataStreamAttribute(dataStreamAttributeId); err != nil {
+        return nil, err
+    }
+    if err := s.ownDevice(deviceId); err != nil {
+        return nil, err
+    }
+    return CreateDataStream(deviceId, dataStreamAttributeId)
+}
+// Move a DataStream to another device in the scope
+func (s *Scope) UpdateDataStream(ds *DataStream) error {
+    if err := s.ownDataStream(ds.Id); err != nil {
+        return err
+    }
+    if err := s.ownDevice(ds.DeviceId); err != nil {
+        return err
+    }
+    return UpdateDataStream(ds)
+}
+func (s *Scope) DeleteDataStream(id int64) error {
+    if err := s.ownDataStream(id); err != nil {
+        return err
+    }
+    return DeleteDataStream(id)
+}
+// Retention policies of the project of the scope
+func (s *Scope) ListRetentionPolicies() ([]*RetentionPolicy, error) {
+    policies, err := GetRetentionPoliciesByProject(s.ProjectId)
+    if err != nil {
+        return nil, err
+    }
+    scoped := make([]*RetentionPolicy, 0, len(policies))
+    for _, p := range policies {
+        if s.Owns(p.ProjectId, p.DomainId) {
+            scoped = append(scoped, p)
+        }
+    }
+    return scoped, nil
+}
+// Policy that applies to a DataStream in the scope (see
+// GetEffectiveRetentionPolicy), KeepSeconds is 0 if none is set
+func (s *Scope) GetDataStreamRetentionPolicy(dataStreamId int64) (*RetentionPolicy, error) {
+    if _, err := s.GetDataStream(dataStreamId); err != nil {
+        return nil, err
+    }
+    p, err := GetEffectiveRetentionPolicy(dataStreamId)
+    if err == ErrNotFound {
+        return &RetentionPolicy{DataStreamId: dataStreamId}, nil
+    }
+    return p, err
+}
+func (s *Scope) SetDataStreamRetentionPolicy(dataStreamId int64, keep time.Duration) (*RetentionPolicy, error) {
+    if err := s.ownDataStream(dataStreamId); err != nil {
+        return nil, err
+    }
+    return SetDataStreamRetentionPolicy(dataStreamId, keep)
+}
+// Policy shared by the DataStreams of a DataStreamAttribute in the scope,
+// KeepSeconds is 0 if none is set
+func (s *Scope) GetDataStreamAttributeRetentionPolicy(dataStreamAttributeId int64) (*RetentionPolicy, error) {
+    if _, err := s.GetDataStreamAttribute(dataStreamAttributeId); err != nil {
+        return nil, err
+    }
+    p, err := GetDataStreamAttributeRetentionPolicy(dataStreamAttributeId)
+    if err == ErrNotFound {
+        return &RetentionPolicy{DataStreamAttributeId: dataStreamAttributeId}, nil
+    }
+    return p, err
+}
+func (s *Scope) SetDataStreamAttributeRetentionPolicy(dataStreamAttributeId int64, keep time.Duration) (*RetentionPolicy, error) {
+    if _, err := s.ownDataStreamAttribute(dataStreamAttributeId); err != nil {
+        return nil, err
+    }
+    return SetDataStreamAttributeRetentionPolicy(dataStreamAttributeId, keep)
+}
+
+func (s *Scope) ownDataStream(id int64) error {
+    ds, err := getDataStream(primary(), id)
+    if err != nil {
+        return err
+    }
+    _, err = s.ownDataStreamAttribute(ds.DataStreamAttributeId)
+    return err
+}
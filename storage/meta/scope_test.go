@@ -0,0 +1,155 @@
+package meta
+
+import (
+    "testing"
+    "github.com/heartsg/dasea/keystone/keystoneclient/types"
+)
+
+func TestScopeFromToken(t *testing.T) {
+    s, err := ScopeFromToken(&types.Token{Project: &types.Project{Id: "p1", Domain: &types.Domain{Id: "d1"}}})
+    if err != nil || s.ProjectId != "p1" || s.DomainId != "d1" {
+        t.Errorf("scope should be p1 of d1, got %v %v", s, err)
+    }
+    for _, token := range []*types.Token{nil, {}, {Project: &types.Project{Name: "p1"}}} {
+        if _, err = ScopeFromToken(token); err != ErrNoScope {
+            t.Errorf("unscoped token should be rejected, got %v", err)
+        }
+    }
+
+    cases := []struct {
+        projectId string
+        domainId string
+        want bool
+    }{
+        {"p1", "d1", true},
+        {"p1", "", true},
+        {"p2", "d1", false},
+        {"p1", "d2", false},
+        {"", "", false},
+    }
+    for _, c := range cases {
+        if s.Owns(c.projectId, c.domainId) != c.want {
+            t.Errorf("owns %s %s should be %v", c.projectId, c.domainId, c.want)
+        }
+    }
+    if (&Scope{}).Owns("", "") {
+        t.Errorf("empty scope should own nothing")
+    }
+    opts := s.listOpts(&ListOpts{ProjectId: "p2", Limit: 5})
+    if opts.ProjectId != "p1" || opts.DomainId != "d1" || opts.Limit != 5 {
+        t.Errorf("list should be limited to the scope, got %v", opts)
+    }
+}
+
+// aggregation device and device of a project for DB tests, tables are
+// created if missing
+func testProjectDevice(t *testing.T, aggregationDeviceId string, projectId string) *Device {
+    if err := CreateAggregationDeviceTable(); err != nil {
+        t.Fatal(err)
+    }
+    if err := CreateDeviceTable(); err != nil {
+        t.Fatal(err)
+    }
+    err := InsertAggregationDevice(&AggregationDevice{
+        Id: aggregationDeviceId,
+        Description: "gateway of " + projectId,
+        ProjectId: projectId,
+        DomainId: "test",
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    d := &Device{AggregationDeviceId: aggregationDeviceId, Description: "sensor of " + aggregationDeviceId}
+    if err = InsertDevice(d); err != nil {
+        t.Fatal(err)
+    }
+    return d
+}
+
+// test DB
+func TestScope(t *testing.T) {
+    InitEngine("mysql", []string{"dasea:dasea@tcp(127.0.0.1:3306)/dasea?charset=utf8"})
+    err := CreateDataStreamAttributeTable()
+    if err != nil {
+        t.Error(err)
+    }
+    err = CreateDataStreamTable()
+    if err != nil {
+        t.Error(err)
+    }
+    d1 := testProjectDevice(t, "agg1", "p1")
+    d2 := testProjectDevice(t, "agg2", "p2")
+    s1 := &Scope{ProjectId: "p1", DomainId: "test"}
+    s2 := &Scope{ProjectId: "p2", DomainId: "test"}
+
+    a1, err := s1.CreateDataStreamAttribute("p1 sensor", 1, []string{"temp"}, []string{"float32"}, []int64{UDegreeCelsius})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if a1.ProjectId != "p1" {
+        t.Errorf("attribute should be created in p1, got %s", a1.ProjectId)
+    }
+    if _, err = s2.GetDataStreamAttribute(a1.Id); err != ErrNotFound {
+        t.Errorf("p2 should not see attributes of p1, got %v", err)
+    }
+    if _, err = s2.CreateDataStream(d2.Id, a1.Id); err != ErrNotFound {
+        t.Errorf("p2 should not use attributes of p1, got %v", err)
+    }
+    if _, err = CreateDataStream(d2.Id, a1.Id); err != ErrProjectMismatch {
+        t.Errorf("device and attribute of different projects should be rejected, got %v", err)
+    }
+    ds, err := s1.CreateDataStream(d1.Id, a1.Id)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err = s1.GetDataStream(ds.Id); err != nil {
+        t.Error(err)
+    }
+    if found, err := s1.FindDataStream(d1.Description, "p1 sensor"); err != nil || found.Id != ds.Id {
+        t.Errorf("data stream %d should be found by descriptions, got %v %v", ds.Id, found, err)
+    }
+    if _, err = s2.FindDataStream(d1.Description, "p1 sensor"); err != ErrNotFound {
+        t.Errorf("p2 should not find data streams of p1, got %v", err)
+    }
+    if _, err = s1.FindDataStream(d2.Description, "p1 sensor"); err != ErrNotFound {
+        t.Errorf("p1 should not find data streams of devices of p2, got %v", err)
+    }
+    //descriptions are unique per project only
+    if _, err = s2.CreateDataStreamAttribute("p1 sensor", 1, []string{"temp"}, []string{"float32"}, []int64{0}); err != nil {
+        t.Errorf("p2 should use the description of an attribute of p1, got %v", err)
+    }
+    if found, err := s1.FindDataStream(d1.Description, "p1 sensor"); err != nil || found.Id != ds.Id {
+        t.Errorf("attribute of p2 should not be found for p1, got %v %v", found, err)
+    }
+    if err = UpdateDevice(&Device{Id: d1.Id, AggregationDeviceId: "agg2", Description: d1.Description}); err != ErrProjectMismatch {
+        t.Errorf("device should not move to an aggregation device of p2, got %v", err)
+    }
+    if _, err = s2.GetDataStream(ds.Id); err != ErrNotFound {
+        t.Errorf("p2 should not see data streams of p1, got %v", err)
+    }
+    if err = s1.UpdateDataStream(&DataStream{Id: ds.Id, DeviceId: d2.Id}); err != ErrNotFound {
+        t.Errorf("data stream should not move to a device of p2, got %v", err)
+    }
+    if err = s2.DeleteDataStream(ds.Id); err != ErrNotFound {
+        t.Errorf("p2 should not delete data streams of p1, got %v", err)
+    }
+
+    if _, err = s2.GetDevice(d1.Id); err != ErrNotFound {
+        t.Errorf("p2 should not see devices of p1, got %v", err)
+    }
+    if err = s2.InsertDevice(&Device{AggregationDeviceId: "agg1", Description: "intruder"}); err != ErrNotFound {
+        t.Errorf("p2 should not add devices to p1, got %v", err)
+    }
+    devices, err := s1.ListDevices(&ListOpts{ProjectId: "p2"})
+    if err != nil || len(devices) != 1 || devices[0].Id != d1.Id {
+        t.Errorf("p1 should list its own device only, got %v %v", devices, err)
+    }
+    if err = s1.DeleteAggregationDevice("agg2"); err != ErrNotFound {
+        t.Errorf("p1 should not delete aggregation devices of p2, got %v", err)
+    }
+
+    Engine.DropTables("data_stream_attribute")
+    Engine.DropTables("data_stream")
+    Engine.DropTables("device")
+    Engine.DropTables("aggregation_device")
+}
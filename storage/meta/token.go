@@ -0,0 +1,194 @@
+package meta
+
+// Device tokens
+//
+// End devices have no keystone accounts, they authenticate to the storage
+// API with a token issued for the device (X-Device-Token) and may only send
+// and read data points of their own DataStreams. Only the SHA-256 hash of a
+// token is saved, the token itself is returned once when it is issued.
+//
+// A device may have several valid tokens, so that a new token can be issued
+// before the old one expires. RotateDeviceToken issues a new token and
+// revokes all others at once, e.g. when a device is lost.
+//
+// Example:
+//  token, t, err := meta.IssueDeviceToken(deviceId, 0)
+//  ...
+//  t, err = meta.AuthenticateDeviceToken(token, time.Now())
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "time"
+    "github.com/heartsg/dasea/common"
+)
+
+const (
+    // Validity of tokens issued without one, as the legacy device tokens
+    DefaultDeviceTokenTTL = 7 * 24 * time.Hour
+    // Longer validities are reduced to MaxDeviceTokenTTL
+    MaxDeviceTokenTTL = 365 * 24 * time.Hour
+    // Characters of issued tokens
+    deviceTokenSize = 32
+)
+
+type DeviceToken struct {
+	Id int64
+	DeviceId int64 `xorm:"index"`
+	//hex SHA-256 of the token
+	TokenHash string `xorm:"varchar(64) notnull unique" json:"-"`
+	ExpireAt time.Time
+	Revoked bool `xorm:"index"`
+	RevokedAt time.Time
+	CreatedAt time.Time `xorm:"created"`
+}
+
+// Whether the token can be used at now
+func (t *DeviceToken) Valid(now time.Time) bool {
+    return !t.Revoked && now.Before(t.ExpireAt)
+}
+
+func hashDeviceToken(token string) string {
+    sum := sha256.Sum256([]byte(token))
+    return hex.EncodeToString(sum[:])
+}
+
+// Validity with default and maximum applied
+func deviceTokenTTL(ttl time.Duration) time.Duration {
+    if ttl <= 0 {
+        return DefaultDeviceTokenTTL
+    }
+    if ttl > MaxDeviceTokenTTL {
+        return MaxDeviceTokenTTL
+    }
+    return ttl
+}
+
+func CreateDeviceTokenTable() error {
+    t := &DeviceToken{}
+    _, err := syncTable(t)
+    return err
+}
+
+// Issue a token of the device valid for ttl (see DefaultDeviceTokenTTL),
+// the token is only returned here
+func IssueDeviceToken(deviceId int64, ttl time.Duration) (string, *DeviceToken, error) {
+    token, t, err := newDeviceToken(deviceId, ttl)
+    if err != nil {
+        return "", nil, err
+    }
+    if _, err = primary().Insert(t); err != nil {
+        return "", nil, err
+    }
+    return token, t, nil
+}
+
+// Issue a new token and revoke all other tokens of the device, in one
+// transaction so that the device is never left without a token or with
+// the old ones still valid
+func RotateDeviceToken(deviceId int64, ttl time.Duration) (string, *DeviceToken, error) {
+    token, t, err := newDeviceToken(deviceId, ttl)
+    if err != nil {
+        return "", nil, err
+    }
+    session := primary().NewSession()
+    defer session.Close()
+    if err = session.Begin(); err != nil {
+        return "", nil, err
+    }
+    _, err = session.Where("device_id = ? and revoked = ?", deviceId, false).
+        Cols("revoked", "revoked_at").Update(revokedDeviceToken())
+    if err != nil {
+        session.Rollback()
+        return "", nil, err
+    }
+    if _, err = session.Insert(t); err != nil {
+        session.Rollback()
+        return "", nil, err
+    }
+    if err = session.Commit(); err != nil {
+        return "", nil, err
+    }
+    return token, t, nil
+}
+
+// Token of a device not saved yet, the token itself is only returned here
+func newDeviceToken(deviceId int64, ttl time.Duration) (string, *DeviceToken, error) {
+    if _, err := getDevice(primary(), deviceId); err != nil {
+        return "", nil, err
+    }
+    token, err := common.Token(deviceTokenSize)
+    if err != nil {
+        return "", nil, err
+    }
+    t := &DeviceToken{
+        DeviceId: deviceId,
+        TokenHash: hashDeviceToken(token),
+        ExpireAt: time.Now().Add(deviceTokenTTL(ttl)),
+    }
+    return token, t, nil
+}
+
+func GetDeviceToken(id int64) (*DeviceToken, error) {
+    t := &DeviceToken{}
+    has, err := primary().Id(id).Get(t)
+    if err != nil {
+        return nil, err
+    }
+    if !has {
+        return nil, ErrNotFound
+    }
+    return t, nil
+}
+
+// Tokens of a device including expired and revoked ones, oldest first
+func ListDeviceTokens(deviceId int64) ([]*DeviceToken, error) {
+    tokens := make([]*DeviceToken, 0)
+    err := replica().Where("device_id = ?", deviceId).Asc("id").Find(&tokens)
+    if err != nil {
+        return nil, err
+    }
+    return tokens, nil
+}
+
+// Columns set by revocations
+func revokedDeviceToken() *DeviceToken {
+    return &DeviceToken{Revoked: true, RevokedAt: time.Now()}
+}
+
+func RevokeDeviceToken(id int64) error {
+    n, err := primary().Id(id).Where("revoked = ?", false).Cols("revoked", "revoked_at").Update(revokedDeviceToken())
+    if err != nil {
+        return err
+    }
+    if n == 0 {
+        //already revoked or no such token
+        _, err = GetDeviceToken(id)
+        return err
+    }
+    return nil
+}
+
+// Revoke all tokens of a device
+func RevokeDeviceTokens(deviceId int64) error {
+    _, err := primary().Where("device_id = ? and revoked = ?", deviceId, false).
+        Cols("revoked", "revoked_at").Update(revokedDeviceToken())
+    return err
+}
+
+// Token of a device which is valid at now, ErrInvalidToken if the token is
+// unknown, expired or revoked
+func AuthenticateDeviceToken(token string, now time.Time) (*DeviceToken, error) {
+    if token == "" {
+        return nil, ErrInvalidToken
+    }
+    t := &DeviceToken{}
+    //revocations must be seen at once, so the primary is read
+    has, err := primary().Where("token_hash = ?", hashDeviceToken(token)).Get(t)
+    if err != nil {
+        return nil, err
+    }
+    if !has || !t.Valid(now) {
+        return nil, ErrInvalidToken
+    }
+    return t, nil
+}
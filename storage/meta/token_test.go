@@ -0,0 +1,81 @@
+package meta
+
+import (
+    "testing"
+    "time"
+)
+
+func TestDeviceTokenValid(t *testing.T) {
+    now := time.Now()
+    if hashDeviceToken("abc") == hashDeviceToken("abd") || len(hashDeviceToken("abc")) != 64 {
+        t.Error("token hashes should be distinct hex SHA-256")
+    }
+    if deviceTokenTTL(0) != DefaultDeviceTokenTTL || deviceTokenTTL(time.Hour) != time.Hour ||
+        deviceTokenTTL(10 * MaxDeviceTokenTTL) != MaxDeviceTokenTTL {
+        t.Error("token ttl default or maximum not applied")
+    }
+    token := &DeviceToken{ExpireAt: now.Add(time.Hour)}
+    if !token.Valid(now) || token.Valid(now.Add(time.Hour)) {
+        t.Error("token should be valid until it expires")
+    }
+    token.Revoked = true
+    if token.Valid(now) {
+        t.Error("revoked token should not be valid")
+    }
+}
+
+// test DB
+func TestDeviceToken(t *testing.T) {
+    InitEngine("mysql", []string{"dasea:dasea@tcp(127.0.0.1:3306)/dasea?charset=utf8"})
+    if err := CreateDeviceTokenTable(); err != nil {
+        t.Fatal(err)
+    }
+    d := testProjectDevice(t, "token-gateway", "p1")
+    defer DeleteAggregationDevice("token-gateway")
+    defer DeleteDevice(d.Id)
+
+    token, issued, err := IssueDeviceToken(d.Id, time.Hour)
+    if err != nil {
+        t.Fatal(err)
+    }
+    got, err := AuthenticateDeviceToken(token, time.Now())
+    if err != nil || got.Id != issued.Id || got.DeviceId != d.Id {
+        t.Errorf("issued token should authenticate the device, got %v %v", got, err)
+    }
+    if _, err = AuthenticateDeviceToken(token, time.Now().Add(2 * time.Hour)); err != ErrInvalidToken {
+        t.Errorf("expired token should be rejected, got %v", err)
+    }
+    if _, err = AuthenticateDeviceToken(token + "x", time.Now()); err != ErrInvalidToken {
+        t.Errorf("unknown token should be rejected, got %v", err)
+    }
+
+    rotated, _, err := RotateDeviceToken(d.Id, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err = AuthenticateDeviceToken(token, time.Now()); err != ErrInvalidToken {
+        t.Errorf("rotated token should be revoked, got %v", err)
+    }
+    if _, err = AuthenticateDeviceToken(rotated, time.Now()); err != nil {
+        t.Errorf("new token should be valid, got %v", err)
+    }
+
+    s := &Scope{ProjectId: "p2", DomainId: "test"}
+    if _, _, err = s.IssueDeviceToken(d.Id, 0); err != ErrNotFound {
+        t.Errorf("tokens of devices of other projects cannot be issued, got %v", err)
+    }
+    s = &Scope{ProjectId: "p1", DomainId: "test"}
+    if err = s.RevokeDeviceTokens(d.Id); err != nil {
+        t.Fatal(err)
+    }
+    if _, err = AuthenticateDeviceToken(rotated, time.Now()); err != ErrInvalidToken {
+        t.Errorf("revoked token should be rejected, got %v", err)
+    }
+    tokens, err := s.ListDeviceTokens(d.Id)
+    if err != nil || len(tokens) != 2 {
+        t.Errorf("both tokens should be listed, got %v %v", tokens, err)
+    }
+    if ds, err := ScopeFromDevice(d.Id); err != nil || ds.ProjectId != "p1" {
+        t.Errorf("device scope should be p1, got %v %v", ds, err)
+    }
+}
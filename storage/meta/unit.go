@@ -1,16 +1,18 @@
 package meta
 
 import (
+	"math"
 	"time"
 )
 
 // UnitCategory
 // Unit
 // Currency
-// All the above three meta data are currently loaded in memory and they cannot
-// be modified (may be modifiable in future) currently.
-// So they are not needed to be saved in database.
-// We can just use cache values (in memory) to directly use them.
+// All the above three meta data are loaded in memory and the built-in ones
+// cannot be modified, we can just use cache values (in memory) to directly use
+// them. Projects may add their own custom units and categories, which are
+// saved in database and merged into the caches (see customunit.go). Currencies
+// are in currency.go.
 //
 // Example:
 //  units := meta.GetUnitsCache()
@@ -20,6 +22,9 @@ import (
 type UnitCategory struct {
 	Id int64
 	Name string `xorm:"varchar(64) notnull"`
+
+    ProjectId string `xorm:"index"` //keystone project id, empty for built-in
+    DomainId string `xorm:"index"` //keystone domain id
 	CreatedAt time.Time `xorm:"created"`
 	UpdatedAt time.Time `xorm:"updated"`
 	DeletedAt time.Time `xorm:"deleted"`
@@ -27,21 +32,34 @@ type UnitCategory struct {
 
 func CreateUnitCategoryTable() error {
     u := &UnitCategory{}
-	_ = Engine.DropTables(u)
-	err := Engine.CreateTables(u)
-    if err != nil {
+	created, err := syncTable(u)
+    //built-in rows are inserted only into a new table
+    if err != nil || !created {
         return err
     }
 	for _, category := range unitCategories {
-		_, err = Engine.Insert(category)
+		err = seedRow(category, category.Id, &UnitCategory{})
         if err != nil {
             return err
         }
 	}
     return nil
 }
+// Built-in categories and the custom ones loaded so far (of all projects)
 func GetUnitCategoriesCache() map[int]*UnitCategory {
-    return unitCategories
+    customUnitsLock.RLock()
+    defer customUnitsLock.RUnlock()
+    if len(customUnitCategories) == 0 {
+        return unitCategories
+    }
+    categories := make(map[int]*UnitCategory, len(unitCategories)+len(customUnitCategories))
+    for id, c := range unitCategories {
+        categories[id] = c
+    }
+    for id, c := range customUnitCategories {
+        categories[id] = c
+    }
+    return categories
 }
 
 type Unit struct {
@@ -51,10 +69,19 @@ type Unit struct {
 	PluralName string `xorm:"varchar(64) default NULL"`
 	Symbol string `xorm:"varchar(32) default NULL"`
 	IsConversionBase bool `xorm:"index"`
+	//value in conversion base = value * ConversionFactor + ConversionOffset
 	ConversionFactor float64 `xorm:"default 0"`
+	ConversionOffset float64 `xorm:"default 0"`
+	//for non-linear units (e.g. logarithmic), used instead of factor and
+	// offset, see SetUnitConversionFuncs
+	ToBase func(float64) float64 `xorm:"-" json:"-"`
+	FromBase func(float64) float64 `xorm:"-" json:"-"`
 	IsMetricSystem bool `xorm:"index default false"`
 	IsUSSystem bool `xorm:"index default false is_us_system"`
 	IsUKSystem bool `xorm:"index default false is_uk_system"`
+
+    ProjectId string `xorm:"index"` //keystone project id, empty for built-in
+    DomainId string `xorm:"index"` //keystone domain id
 	CreatedAt time.Time `xorm:"created"`
 	UpdatedAt time.Time `xorm:"updated"`
 	DeletedAt time.Time `xorm:"deleted"`
@@ -62,13 +89,13 @@ type Unit struct {
 
 func CreateUnitTable() error {
     u := &Unit{}
-	_ = Engine.DropTables(u)
-	err := Engine.CreateTables(u)
-    if err != nil {
+	created, err := syncTable(u)
+    //built-in rows are inserted only into a new table
+    if err != nil || !created {
         return err
     }
 	for _, unit := range units {
-		_, err = Engine.Insert(unit)
+		err = seedRow(unit, unit.Id, &Unit{})
         if err != nil {
             return err
         }
@@ -76,36 +103,21 @@ func CreateUnitTable() error {
     return nil
 }
 
+// Built-in units and the custom ones loaded so far (of all projects)
 func GetUnitsCache() map[int]*Unit {
-    return units
-}
-
-
-type Currency struct {
-	Id int64
-	CategoryId int64 `xorm:"index notnull"`
-	Name string `xorm:"varchar(64) notnull"`
-	ISOCode string `xorm:"varchar(8) notnull iso_code"`
-	Symbol string `xorm:"varchar(8) notnull"`
-	State string `xorm:"varchar(64) notnull"`
-	ConversionFactor float64 `xom:"default 0"`
-	CreatedAt time.Time `xorm:"created"`
-	UpdatedAt time.Time `xorm:"updated"`
-	DeletedAt time.Time `xorm:"deleted"`
-}
-
-func CreateCurrency() error {
-    c := &Currency{}
-    err := Engine.DropTables(c)
-    if err != nil {
-        return err
+    customUnitsLock.RLock()
+    defer customUnitsLock.RUnlock()
+    if len(customUnits) == 0 {
+        return units
     }
-    err = Engine.CreateTables(c)
-    if err != nil {
-        return err
+    all := make(map[int]*Unit, len(units)+len(customUnits))
+    for id, u := range units {
+        all[id] = u
     }
-    return nil
-    //currently not support currencies
+    for id, u := range customUnits {
+        all[id] = u
+    }
+    return all
 }
 
 
@@ -478,6 +490,8 @@ const (
 )
 const (
     UDbm = iota + UcRssi * 10000 + 1
+    UDbw
+    URssiMilliwatt
 )
 const (
     UStrain = iota + UcStrain * 10000 + 1
@@ -545,7 +559,7 @@ var units = map[int]*Unit {
 	UPound: {Id: UPound, CategoryId: UcMass, Name: "Pound", PluralName: "Pounds", Symbol: "pounds",
 		IsConversionBase: false, ConversionFactor: 0.45359237, IsUSSystem: true, IsUKSystem: true},
 	UOunce: {Id: UOunce, CategoryId: UcMass, Name: "Ounce", PluralName: "Ounces", Symbol: "ounces",
-		IsConversionBase: false, ConversionFactor: 0.0311034768, IsUSSystem: true, IsUKSystem: true},
+		IsConversionBase: false, ConversionFactor: 0.028349523125, IsUSSystem: true, IsUKSystem: true},
 	UTonUK: {Id: UTonUK, CategoryId: UcMass, Name: "Ton", PluralName: "Tons", Symbol: "tons",
 		IsConversionBase: false, ConversionFactor: 1016.0469088, IsUKSystem: true},
 	UTonUS: {Id: UTonUS, CategoryId: UcMass, Name: "Ton", PluralName: "Tons", Symbol: "tons",
@@ -581,9 +595,9 @@ var units = map[int]*Unit {
 	UKelvin: {Id: UKelvin, CategoryId: UcThermodynamicTemperature, Name: "Kelvin", PluralName: "Kelvins", Symbol: "K",
 		IsConversionBase: true, ConversionFactor: 1.0},
 	UDegreeCelsius: {Id: UDegreeCelsius, CategoryId: UcThermodynamicTemperature, Name: "Degree Celsius", PluralName: "Degrees Celsius", Symbol: "\u2103",
-		IsConversionBase: false, ConversionFactor: 0},
+		IsConversionBase: false, ConversionFactor: 1.0, ConversionOffset: 273.15, IsMetricSystem: true},
 	UDegreeFahrenheit: {Id: UDegreeFahrenheit, CategoryId: UcThermodynamicTemperature, Name: "Degree Fahrenheit", PluralName: "Degrees Fahrenheit", Symbol: "\u2109",
-		IsConversionBase: false, ConversionFactor: 0},
+		IsConversionBase: false, ConversionFactor: 5.0/9, ConversionOffset: 459.67*5/9, IsUSSystem: true},
 	
 	//Amount of Substance
 	UMole: {Id: UMole, CategoryId: UcAmountOfSubstance, Name: "Mole", PluralName: "Moles", Symbol: "mol",
@@ -597,7 +611,7 @@ var units = map[int]*Unit {
 	URadian: {Id: URadian, CategoryId: UcPlaneAngle, Name: "Radian", PluralName: "Radians", Symbol: "rad",
 		IsConversionBase: true, ConversionFactor: 1.0},
 	UDegree: {Id: UDegree, CategoryId: UcPlaneAngle, Name: "Degree", PluralName: "Degrees", Symbol: "\u00B0",
-		IsConversionBase: false, ConversionFactor: 360/3.1415926535},
+		IsConversionBase: false, ConversionFactor: math.Pi/180},
 		
 	//Solid Angle
 	USteradian: {Id: USteradian, CategoryId: UcSolidAngle, Name: "Steradian", PluralName: "Steradian", Symbol: "sr",
@@ -605,25 +619,25 @@ var units = map[int]*Unit {
 	
 	//Pressure or Stress
 	UPascal: {Id: UPascal, CategoryId: UcPressure, Name: "Pascal", PluralName: "Pascals", Symbol: "Pa",
-		IsConversionBase: true, ConversionFactor: 1.0},
+		IsConversionBase: true, ConversionFactor: 1.0, IsMetricSystem: true},
 	UHectopascal: {Id: UHectopascal, CategoryId: UcPressure, Name: "Hectopascal", PluralName: "Hectopascals", Symbol:"hPa",
-		IsConversionBase: false, ConversionFactor: 100},
+		IsConversionBase: false, ConversionFactor: 100, IsMetricSystem: true},
 	UKilopascal: {Id: UKilopascal, CategoryId: UcPressure, Name: "Kilopascal", PluralName: "Kilopascals", Symbol:"kPa",
-		IsConversionBase: false, ConversionFactor: 1000},
+		IsConversionBase: false, ConversionFactor: 1000, IsMetricSystem: true},
 	UMegapascal: {Id: UMegapascal, CategoryId: UcPressure, Name: "Megapascal", PluralName: "Megapascals", Symbol:"MPa",
-		IsConversionBase: false, ConversionFactor: 1000000},
+		IsConversionBase: false, ConversionFactor: 1000000, IsMetricSystem: true},
 	UStandardAtmosphere: {Id: UStandardAtmosphere, CategoryId: UcPressure, Name: "Standard Atmosphere", PluralName: "Standard Atmospheres", Symbol:"standard atmospheres",
 		IsConversionBase: false, ConversionFactor: 101325},
 	UBar: {Id: UBar, CategoryId: UcPressure, Name: "Bar", PluralName: "Bars", Symbol:"bars",
-		IsConversionBase: false, ConversionFactor: 100000},
+		IsConversionBase: false, ConversionFactor: 100000, IsMetricSystem: true},
 	UMillibar: {Id: UMillibar, CategoryId: UcPressure, Name: "Millibar", PluralName: "Millibars", Symbol:"millibars",
-		IsConversionBase: false, ConversionFactor: 100},
+		IsConversionBase: false, ConversionFactor: 100, IsMetricSystem: true},
 	UCentimeterOfMercury: {Id: UCentimeterOfMercury, CategoryId: UcPressure, Name: "Centimeter of Mercury", PluralName: "Centimeters of Mercury", Symbol:"centimeters of mercury",
 		IsConversionBase: false, ConversionFactor: 1333.22},
 	UMillimeterOfMercury: {Id: UMillimeterOfMercury, CategoryId: UcPressure, Name: "Millimeter of Mercury", PluralName: "Millimeters of Mercury", Symbol:"millimeters of mercury",
 		IsConversionBase: false, ConversionFactor: 133.322},
 	UInchOfMercury: {Id: UInchOfMercury, CategoryId: UcPressure, Name: "Inch of Mercury", PluralName: "Inches of Mercury", Symbol:"inches of mercury",
-		IsConversionBase: false, ConversionFactor: 3386.388},
+		IsConversionBase: false, ConversionFactor: 3386.388, IsUSSystem: true, IsUKSystem: true},
 	UCentimeterOfWater: {Id: UCentimeterOfWater, CategoryId: UcPressure, Name: "Centimeter of Water", PluralName: "Centimeters of Water", Symbol:"centimeters of water",
 		IsConversionBase: false, ConversionFactor: 98.0665},
 	UMillimeterOfWater: {Id: UMillimeterOfWater, CategoryId: UcPressure, Name: "Millimeter of Water", PluralName: "Millimeters of Water", Symbol:"millimeters of water",
@@ -637,23 +651,23 @@ var units = map[int]*Unit {
 	UNewtonPerSquareMeter: {Id: UNewtonPerSquareMeter, CategoryId: UcPressure, Name: "Newton Per Square Meter", PluralName: "Newtons Per Square Meter", Symbol:"newtons/square meter",
 		IsConversionBase: false, ConversionFactor: 1.0},
 	UPoundPerSquareInch: {Id: UPoundPerSquareInch, CategoryId: UcPressure, Name: "Pound Per Square Inch", PluralName: "Pounds Per Square Inch", Symbol:"pounds/square inch",
-		IsConversionBase: false, ConversionFactor: 6894.757},
+		IsConversionBase: false, ConversionFactor: 6894.757, IsUSSystem: true, IsUKSystem: true},
 
 	//Energy, Work, Heat
 	UJoule: {Id: UJoule, CategoryId: UcEnergy, Name: "Joule", PluralName: "Joules", Symbol: "J",
-		IsConversionBase: true, ConversionFactor: 1.0},
+		IsConversionBase: true, ConversionFactor: 1.0, IsMetricSystem: true},
 	UKilojoule: {Id: UKilojoule, CategoryId: UcEnergy, Name: "Kilojoule", PluralName: "Kilojoules", Symbol: "kJ",
-		IsConversionBase: false, ConversionFactor: 1000},
+		IsConversionBase: false, ConversionFactor: 1000, IsMetricSystem: true},
 	UMegajoule: {Id: UMegajoule, CategoryId: UcEnergy, Name: "Megajoule", PluralName: "Megajoules", Symbol: "MJ",
-		IsConversionBase: false, ConversionFactor: 1000000},
+		IsConversionBase: false, ConversionFactor: 1000000, IsMetricSystem: true},
 	UGigajoule: {Id: UGigajoule, CategoryId: UcEnergy, Name: "Gigajoule", PluralName: "Gigajoules", Symbol: "GJ",
-		IsConversionBase: false, ConversionFactor: 1000000000},
+		IsConversionBase: false, ConversionFactor: 1000000000, IsMetricSystem: true},
 	UWattSecond: {Id: UWattSecond, CategoryId: UcEnergy, Name: "Watt Second", PluralName: "Watt Seconds", Symbol: "Ws",
 		IsConversionBase: false, ConversionFactor: 1},
 	UWattHour: {Id: UWattHour, CategoryId: UcEnergy, Name: "Watt Hour", PluralName: "Watt Hours", Symbol: "Wh",
-		IsConversionBase: false, ConversionFactor: 3600},
+		IsConversionBase: false, ConversionFactor: 3600, IsMetricSystem: true},
 	UKilowattHour: {Id: UKilowattHour, CategoryId: UcEnergy, Name: "Kilowatt Hour", PluralName: "Kilowatt Hours", Symbol: "kWh",
-		IsConversionBase: false, ConversionFactor: 3600000},
+		IsConversionBase: false, ConversionFactor: 3600000, IsMetricSystem: true},
 	UNewtonMeter: {Id: UNewtonMeter, CategoryId: UcEnergy, Name: "Newton Meter", PluralName: "Newton Meters", Symbol: "Nm",
 		IsConversionBase: false, ConversionFactor: 1},
 	UCalorieFood: {Id: UCalorieFood, CategoryId: UcEnergy, Name: "Calorie (Food)", PluralName: "Calories (Food)", Symbol: "calories",
@@ -673,29 +687,29 @@ var units = map[int]*Unit {
 
 	//Power
 	UWatt: {Id: UWatt, CategoryId: UcPower, Name: "Watt", PluralName: "Watts", Symbol: "W",
-		IsConversionBase: true, ConversionFactor: 1.0},
+		IsConversionBase: true, ConversionFactor: 1.0, IsMetricSystem: true},
 	UMilliwatt: {Id: UMilliwatt, CategoryId: UcPower, Name: "Milliwatt", PluralName: "Milliwatts", Symbol: "mW",
-		IsConversionBase: false, ConversionFactor: 0.001},
+		IsConversionBase: false, ConversionFactor: 0.001, IsMetricSystem: true},
 	UKilowatt: {Id: UKilowatt, CategoryId: UcPower, Name: "Kilowatt", PluralName: "Kilowatts", Symbol: "kW",
-		IsConversionBase: false, ConversionFactor: 1000},
+		IsConversionBase: false, ConversionFactor: 1000, IsMetricSystem: true},
 	UMegawatt: {Id: UMegawatt, CategoryId: UcPower, Name: "Megawatt", PluralName: "Megawatts", Symbol: "MW",
-		IsConversionBase: false, ConversionFactor: 1000000},
+		IsConversionBase: false, ConversionFactor: 1000000, IsMetricSystem: true},
 	UGigawatt: {Id: UGigawatt, CategoryId: UcPower, Name: "Gigawatt", PluralName: "Gigawatts", Symbol: "GW",
-		IsConversionBase: false, ConversionFactor: 100000000},
+		IsConversionBase: false, ConversionFactor: 1000000000, IsMetricSystem: true},
 	UHorsepowerElectric: {Id: UHorsepowerElectric, CategoryId: UcPower, Name: "Horsepower (Electric)", PluralName: "Horsepower (Electric)", Symbol: "horsepower",
-		IsConversionBase: false, ConversionFactor: 746},
+		IsConversionBase: false, ConversionFactor: 746, IsUSSystem: true, IsUKSystem: true},
 	UHorsepowerMetric: {Id: UHorsepowerMetric, CategoryId: UcPower, Name: "Horsepower (Metric)", PluralName: "Horsepower (Metric)", Symbol: "horsepower",
 		IsConversionBase: false, ConversionFactor: 735.499},	
 
 	//Force, Weight
 	UNewton: {Id: UNewton, CategoryId: UcForce, Name: "Newton", PluralName: "Newtons", Symbol: "N",
-		IsConversionBase: true, ConversionFactor: 1.0},
+		IsConversionBase: true, ConversionFactor: 1.0, IsMetricSystem: true},
 	UKilonewton: {Id: UKilonewton, CategoryId: UcForce, Name: "Kilonewton", PluralName: "Kilonewtons", Symbol: "kN",
-		IsConversionBase: false, ConversionFactor: 1000},
+		IsConversionBase: false, ConversionFactor: 1000, IsMetricSystem: true},
 	UMeganewton: {Id: UMeganewton, CategoryId: UcForce, Name: "Meganewton", PluralName: "Meganewtons", Symbol: "MN",
-		IsConversionBase: false, ConversionFactor: 1000000},
+		IsConversionBase: false, ConversionFactor: 1000000, IsMetricSystem: true},
 	UPoundForce: {Id: UPoundForce, CategoryId: UcForce, Name: "Pound Force", PluralName: "Pounds Force", Symbol: "pounds force",
-		IsConversionBase: false, ConversionFactor: 4.448222},
+		IsConversionBase: false, ConversionFactor: 4.448222, IsUSSystem: true, IsUKSystem: true},
 	
 	//Magnetic Field
 	UTesla: {Id: UTesla, CategoryId: UcMagneticField, Name: "Tesla", PluralName: "Teslas", Symbol: "T",
@@ -777,53 +791,53 @@ var units = map[int]*Unit {
 		
 	//Area
 	USquareMeter: {Id: USquareMeter, CategoryId: UcArea, Name: "Square Meter", PluralName: "Square Meters", Symbol: "square meters",
-		IsConversionBase: true, ConversionFactor: 1.0},
+		IsConversionBase: true, ConversionFactor: 1.0, IsMetricSystem: true},
 	USquareFoot: {Id: USquareFoot, CategoryId: UcArea, Name: "Square Foot", PluralName: "Square Feet", Symbol: "square feet",
-		IsConversionBase: false, ConversionFactor: 0.09290304},
+		IsConversionBase: false, ConversionFactor: 0.09290304, IsUSSystem: true, IsUKSystem: true},
 	USquareInch: {Id: USquareInch, CategoryId: UcArea, Name: "Square Inch", PluralName: "Square Inches", Symbol: "square inches",
-		IsConversionBase: false, ConversionFactor: 0.00064516},
+		IsConversionBase: false, ConversionFactor: 0.00064516, IsUSSystem: true, IsUKSystem: true},
 	USquareKilometer: {Id: USquareKilometer, CategoryId: UcArea, Name: "Square Kilometer", PluralName: "Square Kilometers", Symbol: "square kilometers",
-		IsConversionBase: false, ConversionFactor: 1000000},
+		IsConversionBase: false, ConversionFactor: 1000000, IsMetricSystem: true},
 	UAcre: {Id: UAcre, CategoryId: UcArea, Name: "Acre", PluralName: "Acres", Symbol: "acres",
-		IsConversionBase: false, ConversionFactor: 4046.8564224},
+		IsConversionBase: false, ConversionFactor: 4046.8564224, IsUSSystem: true, IsUKSystem: true},
 		
 	//Volume, Capacity
 	UCubicMeter: {Id: UCubicMeter, CategoryId: UcVolume, Name: "Cubic Meter", PluralName: "Cubic Meters", Symbol: "cubic meters",
-		IsConversionBase: true, ConversionFactor: 1.0},
+		IsConversionBase: true, ConversionFactor: 1.0, IsMetricSystem: true},
 	UCubicDecimeter: {Id: UCubicDecimeter, CategoryId: UcVolume, Name: "Cubic Decimeter", PluralName: "Cubic Decimeters", Symbol: "cubic decimeters",
-		IsConversionBase: false, ConversionFactor: 0.001},
+		IsConversionBase: false, ConversionFactor: 0.001, IsMetricSystem: true},
 	UCubicCentimeter: {Id: UCubicCentimeter, CategoryId: UcVolume, Name: "Cubic Centimeter", PluralName: "Cubic Centimeters", Symbol: "cubic centimeters",
-		IsConversionBase: false, ConversionFactor: 0.000001},
+		IsConversionBase: false, ConversionFactor: 0.000001, IsMetricSystem: true},
 	UCubicMillimeter: {Id: UCubicMillimeter, CategoryId: UcVolume, Name: "Cubic Millimeter", PluralName: "Cubic Millimeters", Symbol: "cubic millimeters",
-		IsConversionBase: false, ConversionFactor: 0.000000001},
+		IsConversionBase: false, ConversionFactor: 0.000000001, IsMetricSystem: true},
 	UCubicFoot: {Id: UCubicFoot, CategoryId: UcVolume, Name: "Cubic Foot", PluralName: "Cubic Feet", Symbol: "cubic feet",
-		IsConversionBase: false, ConversionFactor: 0.028316846592},
+		IsConversionBase: false, ConversionFactor: 0.028316846592, IsUSSystem: true, IsUKSystem: true},
 	UCubicInch: {Id: UCubicInch, CategoryId: UcVolume, Name: "Cubic Inch", PluralName: "Cubic Inches", Symbol: "cubic inches",
-		IsConversionBase: false, ConversionFactor: 0.000016387064},
+		IsConversionBase: false, ConversionFactor: 0.000016387064, IsUSSystem: true, IsUKSystem: true},
 	ULitre: {Id: ULitre, CategoryId: UcVolume, Name: "Litre", PluralName: "Liters", Symbol: "L",
-		IsConversionBase: false, ConversionFactor: 0.001},
+		IsConversionBase: false, ConversionFactor: 0.001, IsMetricSystem: true},
 	UGallonUK: {Id: UGallonUK, CategoryId: UcVolume, Name: "Gallon (UK)", PluralName: "Gallons (UK)", Symbol: "gallons",
-		IsConversionBase: false, ConversionFactor: 0.00454609},
+		IsConversionBase: false, ConversionFactor: 0.00454609, IsUKSystem: true},
 	UGallonUSDry: {Id: UGallonUSDry, CategoryId: UcVolume, Name: "Gallon (US, Dry)", PluralName: "Gallons (US, Dry)", Symbol: "gallons",
-		IsConversionBase: false, ConversionFactor: 0.00440488377086},
+		IsConversionBase: false, ConversionFactor: 0.00440488377086, IsUSSystem: true},
 	UGallonUSLiquid: {Id: UGallonUSLiquid, CategoryId: UcVolume, Name: "Gallon (US, Liquid)", PluralName: "Gallons (US, Liquid)", Symbol: "gallons",
-		IsConversionBase: false, ConversionFactor: 0.003785411784},
+		IsConversionBase: false, ConversionFactor: 0.003785411784, IsUSSystem: true},
 	UBarrel: {Id: UBarrel, CategoryId: UcVolume, Name: "Barrel", PluralName: "Barrels", Symbol: "barrels",
 		IsConversionBase: false, ConversionFactor: 0.158987294928},
 		
 	//Line Density
-	UKilogramPerMeter: {Id: UKilogramPerMeter, CategoryId: UcLineDensity, Name: "Kilogram Per Meter", PluralName: "Kilograms Per Meter", Symbol: "km/m",
+	UKilogramPerMeter: {Id: UKilogramPerMeter, CategoryId: UcLineDensity, Name: "Kilogram Per Meter", PluralName: "Kilograms Per Meter", Symbol: "kg/m",
 		IsConversionBase: true, ConversionFactor: 1.0},
 		
 	//Area Density
-	UKilogramPerSquareMeter: {Id: UKilogramPerSquareMeter, CategoryId: UcAreaDensity, Name: "Kilogram Per Square Meter", PluralName: "Kilograms Per Square Meter", Symbol: "km/square meter",
+	UKilogramPerSquareMeter: {Id: UKilogramPerSquareMeter, CategoryId: UcAreaDensity, Name: "Kilogram Per Square Meter", PluralName: "Kilograms Per Square Meter", Symbol: "kg/square meter",
 		IsConversionBase: true, ConversionFactor: 1.0},
 	
 	//Volume Density
-	UKilogramPerCubicMeter: {Id: UKilogramPerCubicMeter, CategoryId: UcVolumeDensity, Name: "Kilogram Per Cubic Meter", PluralName: "Kilograms Per Cubic Meter", Symbol: "km/cubic meter",
-		IsConversionBase: true, ConversionFactor: 1.0},
-	UKilogramPerLitre: {Id: UKilogramPerLitre, CategoryId: UcVolumeDensity, Name: "Kilogram Per Litre", PluralName: "Kilograms Per Litre", Symbol: "km/L",
-		IsConversionBase: true, ConversionFactor: 0.001},
+	UKilogramPerCubicMeter: {Id: UKilogramPerCubicMeter, CategoryId: UcVolumeDensity, Name: "Kilogram Per Cubic Meter", PluralName: "Kilograms Per Cubic Meter", Symbol: "kg/cubic meter",
+		IsConversionBase: true, ConversionFactor: 1.0, IsMetricSystem: true},
+	UKilogramPerLitre: {Id: UKilogramPerLitre, CategoryId: UcVolumeDensity, Name: "Kilogram Per Litre", PluralName: "Kilograms Per Litre", Symbol: "kg/L",
+		IsConversionBase: false, ConversionFactor: 1000, IsMetricSystem: true},
 	
 	//Fuel Consumption
 	UKilometerPerLitre: {Id: UKilometerPerLitre, CategoryId: UcFuelConsumption, Name: "Kilometer Per Litre", PluralName: "Kilometers Per Litre", Symbol: "km/L",
@@ -831,13 +845,13 @@ var units = map[int]*Unit {
 		
 	//Velocity
 	UMeterPerSecond: {Id: UMeterPerSecond, CategoryId: UcVelocity, Name: "Meter Per Second", PluralName: "Meters Per Second", Symbol: "m/s",
-		IsConversionBase: true, ConversionFactor: 1.0},
+		IsConversionBase: true, ConversionFactor: 1.0, IsMetricSystem: true},
 	UKilometerPerSecond: {Id: UKilometerPerSecond, CategoryId: UcVelocity, Name: "Kilometer Per Second", PluralName: "Kilometers Per Second", Symbol: "km/s",
-		IsConversionBase: false, ConversionFactor: 1000},
+		IsConversionBase: false, ConversionFactor: 1000, IsMetricSystem: true},
 	UKilometerPerHour: {Id: UKilometerPerHour, CategoryId: UcVelocity, Name: "Kilometer Per Hour", PluralName: "Kilometers Per Hour", Symbol: "km/h",
-		IsConversionBase: false, ConversionFactor: 1.0/3.6},
+		IsConversionBase: false, ConversionFactor: 1.0/3.6, IsMetricSystem: true},
 	UMilePerHour: {Id: UMilePerHour, CategoryId: UcVelocity, Name: "Mile Per Hour", PluralName: "Miles Per Hour", Symbol: "MPH",
-		IsConversionBase: false, ConversionFactor: 0.44704},
+		IsConversionBase: false, ConversionFactor: 0.44704, IsUSSystem: true, IsUKSystem: true},
 	UKnot: {Id: UKnot, CategoryId: UcVelocity, Name: "Knot", PluralName: "Knots", Symbol: "knots",
 		IsConversionBase: false, ConversionFactor: 0.514444},
 		
@@ -855,11 +869,11 @@ var units = map[int]*Unit {
 	
 	//Torque		
 	UNewtonMeterTorque: {Id: UNewtonMeterTorque, CategoryId: UcTorque, Name: "Newton Meter", PluralName: "Newton Meters", Symbol: "Nm",
-		IsConversionBase: true, ConversionFactor: 1.0},
+		IsConversionBase: true, ConversionFactor: 1.0, IsMetricSystem: true},
 	UPoundForceFoot: {Id: UPoundForceFoot, CategoryId: UcTorque, Name: "Pound-Force Foot", PluralName: "Pound-Force Feet", Symbol: "pound-force feet",
-		IsConversionBase: true, ConversionFactor: 1.355818},
+		IsConversionBase: false, ConversionFactor: 1.3558179483314004, IsUSSystem: true, IsUKSystem: true},
 	UPoundForceInch: {Id: UPoundForceInch, CategoryId: UcTorque, Name: "Pound-Force Inch", PluralName: "Pound-Force Inches", Symbol: "pound-force inches",
-		IsConversionBase: true, ConversionFactor: 0.112984},
+		IsConversionBase: false, ConversionFactor: 0.1129848290276167, IsUSSystem: true, IsUKSystem: true},
 		
 	//Irradiance
 	UWattPerSquareMeter: {Id: UWattPerSquareMeter, CategoryId: UcIrradiance, Name: "Watt Per Square Meter", PluralName: "Watts Per Square Meter", Symbol: "W/square meter",
@@ -872,6 +886,10 @@ var units = map[int]*Unit {
 	//RSSI
 	UDbm: {Id: UDbm, CategoryId: UcRssi, Name: "dBm", PluralName: "dBm", Symbol: "dBm",
 		IsConversionBase: true, ConversionFactor: 1.0},
+	UDbw: {Id: UDbw, CategoryId: UcRssi, Name: "dBW", PluralName: "dBW", Symbol: "dBW",
+		IsConversionBase: false, ConversionFactor: 1.0, ConversionOffset: 30},
+	URssiMilliwatt: {Id: URssiMilliwatt, CategoryId: UcRssi, Name: "Milliwatt", PluralName: "Milliwatts", Symbol: "mW",
+		IsConversionBase: false, ToBase: milliwattToDbm, FromBase: dbmToMilliwatt},
 	
 	//Strain
 	UStrain: {Id: UStrain, CategoryId: UcStrain, Name: "Strain", PluralName: "Strains", Symbol: "strains",
@@ -0,0 +1,191 @@
+package storage
+
+// MQTT ingestion (see storage/mqtt)
+//
+// Field gateways publish records to a data stream on the topics
+//
+//   streams/{id}/data          protobuf, as POST /v1/streams/:id/data
+//   streams/{id}/data/json     json
+//
+// and connect with user name "device" and a device token as password, or
+// user name "keystone" and a keystone token, which must pass the
+// "storage.put" rule like HTTP writes. QoS 1 and 2 messages are acknowledged
+// after their records are written. QoS 0 protobuf messages are queued in
+// the ingestion pipeline without waiting.
+import (
+    "errors"
+    "log"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+    "github.com/heartsg/dasea/router"
+    "github.com/heartsg/dasea/storage/data"
+    "github.com/heartsg/dasea/storage/meta"
+    "github.com/heartsg/dasea/storage/mqtt"
+    "golang.org/x/net/context"
+)
+
+var ErrInvalidTopic = errors.New("Invalid MQTT topic, must be streams/{id}/data or streams/{id}/data/json.")
+
+const (
+    MQTTDeviceUser = "device"
+    MQTTKeystoneUser = "keystone"
+
+    // Credentials of a connection are checked again after this time, so
+    // that revoked and expired tokens stop publishing
+    mqttRecheck = time.Minute
+)
+
+type mqttAuth struct {
+    s *Server
+}
+
+func (a *mqttAuth) Authenticate(clientId string, username string, password []byte) (mqtt.Session, error) {
+    m := &mqttSession{s: a.s, username: username, password: string(password)}
+    if err := m.authenticate(time.Now()); err != nil {
+        return nil, err
+    }
+    return m, nil
+}
+
+type mqttSession struct {
+    s *Server
+    username string
+    password string
+
+    scope *meta.Scope
+    // nil for keystone tokens
+    device *meta.DeviceToken
+    checkedAt time.Time
+}
+
+// Check the credentials, mqtt.ErrBadCredentials and mqtt.ErrNotAuthorized
+// are refusals
+func (m *mqttSession) authenticate(now time.Time) error {
+    switch m.username {
+    case MQTTDeviceUser:
+        t, err := meta.AuthenticateDeviceToken(m.password, now)
+        if err == meta.ErrInvalidToken {
+            return mqtt.ErrBadCredentials
+        }
+        if err != nil {
+            return err
+        }
+        scope, err := meta.ScopeFromDevice(t.DeviceId)
+        if err == meta.ErrNotFound {
+            return mqtt.ErrBadCredentials
+        }
+        if err != nil {
+            return err
+        }
+        m.scope, m.device = scope, t
+    case MQTTKeystoneUser:
+        //through the same middlewares as HTTP writes
+        r, err := http.NewRequest("POST", "/mqtt", nil)
+        if err != nil {
+            return err
+        }
+        r.Header.Set("X-Auth-Token", m.password)
+        w := &statusWriter{header: make(http.Header)}
+        ctx := router.MiddlewareChain(m.s.Auth, m.s.authorize(rulePut)).ServeHTTPContext(context.Background(), w, r)
+        if ctx == nil {
+            switch w.status {
+            case http.StatusUnauthorized:
+                return mqtt.ErrBadCredentials
+            case http.StatusForbidden:
+                return mqtt.ErrNotAuthorized
+            }
+            return errors.New("keystone authentication failed with status " + strconv.Itoa(w.status))
+        }
+        m.scope = scopeOf(ctx)
+    default:
+        return mqtt.ErrBadCredentials
+    }
+    m.checkedAt = now
+    return nil
+}
+
+func (m *mqttSession) Publish(topic string, payload []byte, qos byte) error {
+    now := time.Now()
+    if now.Sub(m.checkedAt) >= mqttRecheck {
+        if err := m.authenticate(now); err != nil {
+            return err
+        }
+    }
+    id, isJson, err := parseTopic(topic)
+    if err != nil {
+        return &mqtt.RejectedError{Err: err}
+    }
+    if err = checkStream(m.scope, m.device, id); err != nil {
+        return mqttError(err)
+    }
+    if isJson {
+        recordErrors, err := data.PutDataPointsFromJson(id, payload)
+        if len(recordErrors) > 0 {
+            log.Printf("MQTT: %d bad records to data stream %d, first: %v", len(recordErrors), id, recordErrors[0])
+        }
+        return mqttError(err)
+    }
+    if qos == 0 {
+        //nobody waits for an acknowledgement
+        return mqttError(data.QueueDataPointsFromProtobuf(id, payload, func(err error) {
+            if err != nil {
+                log.Printf("MQTT: records to data stream %d not saved: %v", id, err)
+            }
+        }))
+    }
+    return mqttError(data.PutDataPointsFromProtobuf(id, payload))
+}
+
+// Data stream id of a topic and whether records are json
+func parseTopic(topic string) (int64, bool, error) {
+    parts := strings.Split(topic, "/")
+    if len(parts) < 3 || len(parts) > 4 || parts[0] != "streams" || parts[2] != "data" {
+        return 0, false, ErrInvalidTopic
+    }
+    isJson := len(parts) == 4
+    if isJson && parts[3] != "json" {
+        return 0, false, ErrInvalidTopic
+    }
+    id, err := strconv.ParseInt(parts[1], 10, 64)
+    if err != nil {
+        return 0, false, ErrInvalidTopic
+    }
+    return id, isJson, nil
+}
+
+// Errors which would be client errors over HTTP cannot be fixed by sending
+// the message again, others (e.g. a full pipeline) close the connection so
+// that the message is resent
+func mqttError(err error) error {
+    if err == nil {
+        return nil
+    }
+    switch status := errorStatus(err); {
+    case status == http.StatusUnauthorized || status == http.StatusTooManyRequests:
+        return err
+    case status >= 400 && status < 500:
+        return &mqtt.RejectedError{Err: err}
+    }
+    return err
+}
+
+// Response of middlewares run outside HTTP, only the status is kept
+type statusWriter struct {
+    header http.Header
+    status int
+}
+
+func (w *statusWriter) Header() http.Header {
+    return w.header
+}
+func (w *statusWriter) Write(b []byte) (int, error) {
+    if w.status == 0 {
+        w.status = http.StatusOK
+    }
+    return len(b), nil
+}
+func (w *statusWriter) WriteHeader(status int) {
+    w.status = status
+}
@@ -0,0 +1,305 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+)
+
+var (
+	ErrMalformedPacket = errors.New("Malformed MQTT packet.")
+	ErrPacketTooLarge = errors.New("MQTT packet exceeds the maximum size.")
+	ErrProtocolViolation = errors.New("MQTT protocol violation.")
+)
+
+//Control packet types (MQTT 3.1.1 section 2.2.1)
+const (
+	CONNECT = 1
+	CONNACK = 2
+	PUBLISH = 3
+	PUBACK = 4
+	PUBREC = 5
+	PUBREL = 6
+	PUBCOMP = 7
+	SUBSCRIBE = 8
+	SUBACK = 9
+	UNSUBSCRIBE = 10
+	UNSUBACK = 11
+	PINGREQ = 12
+	PINGRESP = 13
+	DISCONNECT = 14
+)
+
+//CONNACK return codes
+const (
+	ConnectAccepted = 0
+	ConnectBadProtocol = 1
+	ConnectIdentifierRejected = 2
+	ConnectServerUnavailable = 3
+	ConnectBadCredentials = 4
+	ConnectNotAuthorized = 5
+)
+
+//SUBACK return code of refused subscriptions
+const SubscribeFailure = 0x80
+
+//A control packet, body is everything after the fixed header
+type packet struct {
+	typ byte
+	flags byte
+	body []byte
+}
+
+//Read a packet, bodies larger than max bytes are refused
+func readPacket(r *bufio.Reader, max int) (*packet, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	p := &packet{typ: b >> 4, flags: b & 0x0f}
+	length, err := readRemainingLength(r)
+	if err != nil {
+		return nil, err
+	}
+	if max > 0 && length > max {
+		return nil, ErrPacketTooLarge
+	}
+	p.body = make([]byte, length)
+	if _, err = io.ReadFull(r, p.body); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func readRemainingLength(r io.ByteReader) (int, error) {
+	length, multiplier := 0, 1
+	for i := 0; i < 4; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		length += int(b&0x7f) * multiplier
+		if b&0x80 == 0 {
+			return length, nil
+		}
+		multiplier *= 128
+	}
+	return 0, ErrMalformedPacket
+}
+
+func appendRemainingLength(buf []byte, length int) []byte {
+	for {
+		b := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			b |= 0x80
+		}
+		buf = append(buf, b)
+		if length == 0 {
+			return buf
+		}
+	}
+}
+
+//Encode a packet with its fixed header
+func encodePacket(typ byte, flags byte, body []byte) []byte {
+	buf := make([]byte, 0, len(body)+5)
+	buf = append(buf, typ<<4|flags&0x0f)
+	buf = appendRemainingLength(buf, len(body))
+	return append(buf, body...)
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = append(buf, byte(len(s)>>8), byte(len(s)))
+	return append(buf, s...)
+}
+
+//Decoder of packet bodies, the first error sticks
+type reader struct {
+	buf []byte
+	err error
+}
+
+func (r *reader) byte() byte {
+	if r.err != nil || len(r.buf) < 1 {
+		r.err = ErrMalformedPacket
+		return 0
+	}
+	b := r.buf[0]
+	r.buf = r.buf[1:]
+	return b
+}
+
+func (r *reader) uint16() uint16 {
+	if r.err != nil || len(r.buf) < 2 {
+		r.err = ErrMalformedPacket
+		return 0
+	}
+	v := binary.BigEndian.Uint16(r.buf)
+	r.buf = r.buf[2:]
+	return v
+}
+
+func (r *reader) bytes() []byte {
+	n := int(r.uint16())
+	if r.err != nil || len(r.buf) < n {
+		r.err = ErrMalformedPacket
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *reader) string() string {
+	return string(r.bytes())
+}
+
+type connectPacket struct {
+	protocol string
+	level byte
+	cleanSession bool
+	keepAlive uint16
+	clientId string
+	willTopic string
+	willMessage []byte
+	username string
+	password []byte
+	hasUsername bool
+	hasPassword bool
+}
+
+func parseConnect(body []byte) (*connectPacket, error) {
+	r := &reader{buf: body}
+	c := &connectPacket{}
+	c.protocol = r.string()
+	c.level = r.byte()
+	flags := r.byte()
+	c.keepAlive = r.uint16()
+	if r.err != nil {
+		return nil, r.err
+	}
+	//reserved flag must be 0, no password without username
+	if flags&0x01 != 0 || (flags&0x40 != 0 && flags&0x80 == 0) {
+		return nil, ErrProtocolViolation
+	}
+	c.cleanSession = flags&0x02 != 0
+	c.clientId = r.string()
+	if flags&0x04 != 0 {
+		c.willTopic = r.string()
+		c.willMessage = r.bytes()
+	}
+	if flags&0x80 != 0 {
+		c.hasUsername = true
+		c.username = r.string()
+	}
+	if flags&0x40 != 0 {
+		c.hasPassword = true
+		c.password = r.bytes()
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return c, nil
+}
+
+func encodeConnack(sessionPresent bool, code byte) []byte {
+	var flags byte
+	if sessionPresent {
+		flags = 1
+	}
+	return encodePacket(CONNACK, 0, []byte{flags, code})
+}
+
+type publishPacket struct {
+	topic string
+	qos byte
+	dup bool
+	retain bool
+	id uint16
+	payload []byte
+}
+
+func parsePublish(flags byte, body []byte) (*publishPacket, error) {
+	p := &publishPacket{
+		dup: flags&0x08 != 0,
+		qos: (flags >> 1) & 0x03,
+		retain: flags&0x01 != 0,
+	}
+	if p.qos > 2 {
+		return nil, ErrProtocolViolation
+	}
+	r := &reader{buf: body}
+	p.topic = r.string()
+	if p.qos > 0 {
+		p.id = r.uint16()
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	//topic names of PUBLISH cannot have wildcards
+	if p.topic == "" || strings.ContainsAny(p.topic, "#+") {
+		return nil, ErrProtocolViolation
+	}
+	p.payload = r.buf
+	return p, nil
+}
+
+func encodePublish(p *publishPacket) []byte {
+	flags := p.qos << 1
+	if p.dup {
+		flags |= 0x08
+	}
+	if p.retain {
+		flags |= 0x01
+	}
+	body := appendString(nil, p.topic)
+	if p.qos > 0 {
+		body = append(body, byte(p.id>>8), byte(p.id))
+	}
+	return encodePacket(PUBLISH, flags, append(body, p.payload...))
+}
+
+//PUBACK, PUBREC, PUBREL (flags 2), PUBCOMP and UNSUBACK carry only a packet id
+func encodeAck(typ byte, id uint16) []byte {
+	var flags byte
+	if typ == PUBREL {
+		flags = 0x02
+	}
+	return encodePacket(typ, flags, []byte{byte(id >> 8), byte(id)})
+}
+
+func parseAck(body []byte) (uint16, error) {
+	if len(body) != 2 {
+		return 0, ErrMalformedPacket
+	}
+	return binary.BigEndian.Uint16(body), nil
+}
+
+//Packet id and topic filters of SUBSCRIBE (with requested qos) or
+// UNSUBSCRIBE (subscribe false)
+func parseSubscribe(body []byte, subscribe bool) (uint16, []string, error) {
+	r := &reader{buf: body}
+	id := r.uint16()
+	filters := make([]string, 0)
+	for r.err == nil && len(r.buf) > 0 {
+		filters = append(filters, r.string())
+		if subscribe {
+			r.byte()
+		}
+	}
+	if r.err != nil {
+		return 0, nil, r.err
+	}
+	if len(filters) == 0 {
+		return 0, nil, ErrProtocolViolation
+	}
+	return id, filters, nil
+}
+
+func encodeSuback(id uint16, codes []byte) []byte {
+	body := append([]byte{byte(id >> 8), byte(id)}, codes...)
+	return encodePacket(SUBACK, 0, body)
+}
@@ -0,0 +1,112 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+func TestRemainingLength(t *testing.T) {
+	for _, n := range []int{0, 127, 128, 16383, 16384, 2097151, 2097152, 268435455} {
+		buf := appendRemainingLength(nil, n)
+		got, err := readRemainingLength(bytes.NewReader(buf))
+		if err != nil || got != n {
+			t.Errorf("remaining length %d encoded as %v decoded as %d %v", n, buf, got, err)
+		}
+	}
+	if _, err := readRemainingLength(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff, 0x01})); err != ErrMalformedPacket {
+		t.Errorf("remaining length of 5 bytes should be malformed, got %v", err)
+	}
+}
+
+//CONNECT as sent by clients
+func encodeConnect(clientId string, username string, password string, keepAlive uint16) []byte {
+	body := appendString(nil, "MQTT")
+	flags := byte(0x02)
+	if username != "" {
+		flags |= 0x80
+	}
+	if password != "" {
+		flags |= 0x40
+	}
+	body = append(body, 4, flags, byte(keepAlive>>8), byte(keepAlive))
+	body = appendString(body, clientId)
+	if username != "" {
+		body = appendString(body, username)
+	}
+	if password != "" {
+		body = appendString(body, password)
+	}
+	return encodePacket(CONNECT, 0, body)
+}
+
+func TestParseConnect(t *testing.T) {
+	r := bufio.NewReader(bytes.NewReader(encodeConnect("gw1", "device", "secret", 30)))
+	p, err := readPacket(r, 0)
+	if err != nil || p.typ != CONNECT {
+		t.Fatalf("CONNECT not read, got %v %v", p, err)
+	}
+	c, err := parseConnect(p.body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.protocol != "MQTT" || c.level != 4 || !c.cleanSession || c.keepAlive != 30 || c.clientId != "gw1" ||
+		c.username != "device" || string(c.password) != "secret" {
+		t.Errorf("CONNECT not match, got %+v", c)
+	}
+
+	//password flag without user name flag
+	body := appendString(nil, "MQTT")
+	body = append(body, 4, 0x42, 0, 0)
+	if _, err = parseConnect(appendString(body, "gw1")); err != ErrProtocolViolation {
+		t.Errorf("password without user name should be refused, got %v", err)
+	}
+	if _, err = parseConnect(body[:3]); err != ErrMalformedPacket {
+		t.Errorf("truncated CONNECT should be malformed, got %v", err)
+	}
+}
+
+func TestPublishPacket(t *testing.T) {
+	want := &publishPacket{topic: "streams/1/data", qos: 1, dup: true, id: 7, payload: []byte{1, 2, 3}}
+	p, err := readPacket(bufio.NewReader(bytes.NewReader(encodePublish(want))), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := parsePublish(p.flags, p.body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.topic != want.topic || got.qos != 1 || !got.dup || got.retain || got.id != 7 ||
+		!bytes.Equal(got.payload, want.payload) {
+		t.Errorf("PUBLISH not match, got %+v", got)
+	}
+
+	for _, bad := range []*publishPacket{{topic: "streams/+/data"}, {topic: "#"}, {topic: ""}} {
+		p, _ := readPacket(bufio.NewReader(bytes.NewReader(encodePublish(bad))), 0)
+		if _, err = parsePublish(p.flags, p.body); err != ErrProtocolViolation {
+			t.Errorf("topic %q should be refused, got %v", bad.topic, err)
+		}
+	}
+	if _, err = parsePublish(0x06, appendString(nil, "a")); err != ErrProtocolViolation {
+		t.Errorf("QoS 3 should be refused, got %v", err)
+	}
+
+	if _, err = readPacket(bufio.NewReader(bytes.NewReader(encodePublish(want))), 4); err != ErrPacketTooLarge {
+		t.Errorf("packet larger than max should be refused, got %v", err)
+	}
+}
+
+func TestParseSubscribe(t *testing.T) {
+	body := []byte{0, 9}
+	body = appendString(body, "a/b")
+	body = append(body, 1)
+	body = appendString(body, "c/#")
+	body = append(body, 0)
+	id, filters, err := parseSubscribe(body, true)
+	if err != nil || id != 9 || len(filters) != 2 || filters[1] != "c/#" {
+		t.Errorf("SUBSCRIBE not match, got %d %v %v", id, filters, err)
+	}
+	if _, _, err = parseSubscribe([]byte{0, 9}, true); err != ErrProtocolViolation {
+		t.Errorf("SUBSCRIBE without filters should be refused, got %v", err)
+	}
+}
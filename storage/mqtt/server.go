@@ -0,0 +1,338 @@
+package mqtt
+
+//MQTT 3.1.1 listener for devices sending data points
+//
+//Clients only publish: each PUBLISH is handed to the Session returned by
+// the Authenticator for the credentials of CONNECT, which persists it.
+// QoS 1 PUBACKs (QoS 2 PUBRECs) are sent only after Session.Publish
+// returns, so an acknowledged message is never lost. If Publish fails with
+// an error which may go away (e.g. the ingestion pipeline is full), the
+// connection is closed without acknowledging and the client sends the
+// message again after reconnecting; messages which can never be saved
+// (RejectedError) are acknowledged and dropped.
+//
+//Subscriptions are refused, retained messages and wills are ignored and
+// no session state is kept between connections.
+//
+//Example:
+//	s := mqtt.NewServer(auth)
+//	log.Fatal(s.ListenAndServe(":1883"))
+import (
+	"bufio"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	ErrServerClosed = errors.New("MQTT server is closed.")
+	ErrBadCredentials = errors.New("Bad MQTT user name or password.")
+	ErrNotAuthorized = errors.New("MQTT client is not authorized.")
+)
+
+const (
+	DefaultMaxPacketSize = 1 << 20
+	//Time a new connection has to send CONNECT
+	DefaultConnectTimeout = 10 * time.Second
+)
+
+//Checks the credentials of CONNECT. ErrBadCredentials and ErrNotAuthorized
+// are answered with the CONNACK return codes of the same name, other
+// errors as server unavailable.
+type Authenticator interface {
+	Authenticate(clientId string, username string, password []byte) (Session, error)
+}
+
+//A connected client, Publish is called for every message it sends and in
+// the order they are sent
+type Session interface {
+	Publish(topic string, payload []byte, qos byte) error
+}
+
+//A message which can never be saved (e.g. invalid data or a topic the
+// client may not publish to), redelivery would not help
+type RejectedError struct {
+	Err error
+}
+
+func (e *RejectedError) Error() string {
+	return e.Err.Error()
+}
+
+type Server struct {
+	Auth Authenticator
+	//Largest accepted packet body
+	MaxPacketSize int
+	ConnectTimeout time.Duration
+
+	mutex sync.Mutex
+	listeners map[net.Listener]bool
+	conns map[*conn]bool
+	//connection of each client id, a client connecting again replaces it
+	clients map[string]*conn
+	closed bool
+	wg sync.WaitGroup
+}
+
+func NewServer(auth Authenticator) *Server {
+	return &Server{
+		Auth: auth,
+		MaxPacketSize: DefaultMaxPacketSize,
+		ConnectTimeout: DefaultConnectTimeout,
+		listeners: make(map[net.Listener]bool),
+		conns: make(map[*conn]bool),
+		clients: make(map[string]*conn),
+	}
+}
+
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+//Accept connections on l until the server is closed
+func (s *Server) Serve(l net.Listener) error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listeners[l] = true
+	s.mutex.Unlock()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.listeners, l)
+		s.mutex.Unlock()
+	}()
+
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			s.mutex.Lock()
+			closed := s.closed
+			s.mutex.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		c := &conn{server: s, nc: nc, r: bufio.NewReader(nc)}
+		if !s.track(c) {
+			nc.Close()
+			return ErrServerClosed
+		}
+		go func() {
+			defer s.wg.Done()
+			defer s.untrack(c)
+			c.serve()
+		}()
+	}
+}
+
+func (s *Server) track(c *conn) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[c] = true
+	s.wg.Add(1)
+	return true
+}
+
+func (s *Server) untrack(c *conn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.conns, c)
+	if c.clientId != "" && s.clients[c.clientId] == c {
+		delete(s.clients, c.clientId)
+	}
+}
+
+//Register c under its client id, the connection of the same client id is
+// closed (MQTT 3.1.1 section 3.1.4)
+func (s *Server) register(c *conn) {
+	s.mutex.Lock()
+	old := s.clients[c.clientId]
+	s.clients[c.clientId] = c
+	s.mutex.Unlock()
+	if old != nil {
+		old.nc.Close()
+	}
+}
+
+//Stop listening and close all connections. Publishes in progress finish,
+// but their acknowledgements may not reach the clients.
+func (s *Server) Close() error {
+	s.mutex.Lock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for c := range s.conns {
+		c.nc.Close()
+	}
+	s.mutex.Unlock()
+	s.wg.Wait()
+	return nil
+}
+
+type conn struct {
+	server *Server
+	nc net.Conn
+	r *bufio.Reader
+	clientId string
+	session Session
+	keepAlive time.Duration
+	//QoS 2 packet ids published but not released yet
+	received map[uint16]bool
+}
+
+func (c *conn) serve() {
+	defer c.nc.Close()
+	if err := c.connect(); err != nil {
+		return
+	}
+	for {
+		if c.keepAlive > 0 {
+			//one and a half keep alive periods (section 3.1.2.10)
+			c.nc.SetReadDeadline(time.Now().Add(c.keepAlive * 3 / 2))
+		}
+		p, err := readPacket(c.r, c.server.MaxPacketSize)
+		if err != nil {
+			return
+		}
+		if p.typ == DISCONNECT {
+			return
+		}
+		if err = c.handle(p); err != nil {
+			if err != ErrProtocolViolation && err != ErrMalformedPacket {
+				log.Printf("MQTT client %s disconnected: %v", c.clientId, err)
+			}
+			return
+		}
+	}
+}
+
+//Read CONNECT and answer CONNACK
+func (c *conn) connect() error {
+	c.nc.SetReadDeadline(time.Now().Add(c.server.ConnectTimeout))
+	p, err := readPacket(c.r, c.server.MaxPacketSize)
+	if err != nil {
+		return err
+	}
+	if p.typ != CONNECT {
+		return ErrProtocolViolation
+	}
+	cp, err := parseConnect(p.body)
+	if err != nil {
+		return err
+	}
+	if cp.protocol != "MQTT" || cp.level != 4 {
+		c.write(encodeConnack(false, ConnectBadProtocol))
+		return ErrProtocolViolation
+	}
+	//without a client id nothing could be resumed
+	if cp.clientId == "" && !cp.cleanSession {
+		c.write(encodeConnack(false, ConnectIdentifierRejected))
+		return ErrProtocolViolation
+	}
+	session, err := c.server.Auth.Authenticate(cp.clientId, cp.username, cp.password)
+	if err != nil {
+		code := byte(ConnectServerUnavailable)
+		switch err {
+		case ErrBadCredentials:
+			code = ConnectBadCredentials
+		case ErrNotAuthorized:
+			code = ConnectNotAuthorized
+		}
+		c.write(encodeConnack(false, code))
+		return err
+	}
+	c.session = session
+	c.clientId = cp.clientId
+	c.keepAlive = time.Duration(cp.keepAlive) * time.Second
+	c.received = make(map[uint16]bool)
+	c.nc.SetReadDeadline(time.Time{})
+	if c.clientId != "" {
+		c.server.register(c)
+	}
+	return c.write(encodeConnack(false, ConnectAccepted))
+}
+
+func (c *conn) handle(p *packet) error {
+	switch p.typ {
+	case PUBLISH:
+		return c.publish(p)
+	case PUBREL:
+		id, err := parseAck(p.body)
+		if err != nil {
+			return err
+		}
+		delete(c.received, id)
+		return c.write(encodeAck(PUBCOMP, id))
+	case SUBSCRIBE:
+		id, filters, err := parseSubscribe(p.body, true)
+		if err != nil {
+			return err
+		}
+		codes := make([]byte, len(filters))
+		for i := range codes {
+			codes[i] = SubscribeFailure
+		}
+		return c.write(encodeSuback(id, codes))
+	case UNSUBSCRIBE:
+		id, _, err := parseSubscribe(p.body, false)
+		if err != nil {
+			return err
+		}
+		return c.write(encodeAck(UNSUBACK, id))
+	case PINGREQ:
+		return c.write(encodePacket(PINGRESP, 0, nil))
+	case PUBACK, PUBREC, PUBCOMP:
+		//nothing is published to clients
+		return nil
+	}
+	//a second CONNECT or a server packet
+	return ErrProtocolViolation
+}
+
+func (c *conn) publish(p *packet) error {
+	pp, err := parsePublish(p.flags, p.body)
+	if err != nil {
+		return err
+	}
+	//QoS 2 messages are saved once, a resent PUBLISH is only acknowledged again
+	if pp.qos == 2 && c.received[pp.id] {
+		return c.write(encodeAck(PUBREC, pp.id))
+	}
+	if err = c.session.Publish(pp.topic, pp.payload, pp.qos); err != nil {
+		if _, ok := err.(*RejectedError); !ok {
+			return err
+		}
+		log.Printf("MQTT message of client %s to %s dropped: %v", c.clientId, pp.topic, err)
+	}
+	switch pp.qos {
+	case 1:
+		return c.write(encodeAck(PUBACK, pp.id))
+	case 2:
+		c.received[pp.id] = true
+		return c.write(encodeAck(PUBREC, pp.id))
+	}
+	return nil
+}
+
+func (c *conn) write(b []byte) error {
+	_, err := c.nc.Write(b)
+	return err
+}
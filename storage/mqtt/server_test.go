@@ -0,0 +1,232 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errTestFull = errors.New("full")
+
+type testMessage struct {
+	topic string
+	payload string
+	qos byte
+}
+
+//Accepts password "secret", fails publishes to topic "full" and rejects
+// publishes to topic "bad"
+type testAuth struct {
+	mutex sync.Mutex
+	messages []testMessage
+	//closed when a publish starts, the publish waits for release
+	started chan struct{}
+	release chan struct{}
+}
+
+func (a *testAuth) Authenticate(clientId string, username string, password []byte) (Session, error) {
+	switch {
+	case username == "nobody":
+		return nil, ErrNotAuthorized
+	case string(password) != "secret":
+		return nil, ErrBadCredentials
+	}
+	return a, nil
+}
+
+func (a *testAuth) Publish(topic string, payload []byte, qos byte) error {
+	if a.started != nil {
+		close(a.started)
+		<-a.release
+	}
+	switch topic {
+	case "full":
+		return errTestFull
+	case "bad":
+		return &RejectedError{Err: errors.New("bad topic")}
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.messages = append(a.messages, testMessage{topic, string(payload), qos})
+	return nil
+}
+
+func (a *testAuth) saved() []testMessage {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return append([]testMessage{}, a.messages...)
+}
+
+func testServer(t *testing.T, auth *testAuth) (*Server, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(auth)
+	go s.Serve(l)
+	return s, l.Addr().String()
+}
+
+type testClient struct {
+	t *testing.T
+	nc net.Conn
+	r *bufio.Reader
+}
+
+func dial(t *testing.T, addr string, clientId string, username string, password string) (*testClient, byte) {
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &testClient{t: t, nc: nc, r: bufio.NewReader(nc)}
+	c.send(encodeConnect(clientId, username, password, 60))
+	p := c.expect(CONNACK)
+	return c, p.body[1]
+}
+
+func (c *testClient) send(b []byte) {
+	if _, err := c.nc.Write(b); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *testClient) expect(typ byte) *packet {
+	c.nc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	p, err := readPacket(c.r, 0)
+	if err != nil {
+		c.t.Fatalf("expect packet %d, got %v", typ, err)
+	}
+	if p.typ != typ {
+		c.t.Fatalf("expect packet %d, got %d", typ, p.typ)
+	}
+	return p
+}
+
+//Whether the server closed the connection
+func (c *testClient) closed() bool {
+	c.nc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := readPacket(c.r, 0)
+	return err != nil
+}
+
+func TestConnect(t *testing.T) {
+	s, addr := testServer(t, &testAuth{})
+	defer s.Close()
+
+	tests := []struct {
+		clientId string
+		username string
+		password string
+		code byte
+	}{
+		{"gw1", "device", "secret", ConnectAccepted},
+		{"", "device", "secret", ConnectAccepted},
+		{"gw2", "device", "wrong", ConnectBadCredentials},
+		{"gw3", "nobody", "secret", ConnectNotAuthorized},
+	}
+	for _, test := range tests {
+		c, code := dial(t, addr, test.clientId, test.username, test.password)
+		if code != test.code {
+			t.Errorf("client %q: CONNACK should be %d, got %d", test.clientId, test.code, code)
+		}
+		c.nc.Close()
+	}
+
+	//other protocol levels are refused
+	c, _ := net.Dial("tcp", addr)
+	body := appendString(nil, "MQIsdp")
+	body = appendString(append(body, 3, 0x02, 0, 60), "gw4")
+	c.Write(encodePacket(CONNECT, 0, body))
+	p, err := readPacket(bufio.NewReader(c), 0)
+	if err != nil || p.body[1] != ConnectBadProtocol {
+		t.Errorf("MQTT 3.1 should be refused, got %v %v", p, err)
+	}
+	c.Close()
+}
+
+func TestPublish(t *testing.T) {
+	auth := &testAuth{}
+	s, addr := testServer(t, auth)
+	defer s.Close()
+	c, _ := dial(t, addr, "gw1", "device", "secret")
+	defer c.nc.Close()
+
+	c.send(encodePublish(&publishPacket{topic: "a", qos: 0, payload: []byte("0")}))
+	c.send(encodePublish(&publishPacket{topic: "a", qos: 1, id: 1, payload: []byte("1")}))
+	if id, _ := parseAck(c.expect(PUBACK).body); id != 1 {
+		t.Errorf("PUBACK of packet 1 expected, got %d", id)
+	}
+
+	//QoS 2 is saved once even if resent before PUBREL
+	c.send(encodePublish(&publishPacket{topic: "a", qos: 2, id: 2, payload: []byte("2")}))
+	c.expect(PUBREC)
+	c.send(encodePublish(&publishPacket{topic: "a", qos: 2, id: 2, dup: true, payload: []byte("2")}))
+	c.expect(PUBREC)
+	c.send(encodeAck(PUBREL, 2))
+	c.expect(PUBCOMP)
+
+	//rejected messages are acknowledged and dropped
+	c.send(encodePublish(&publishPacket{topic: "bad", qos: 1, id: 3, payload: []byte("3")}))
+	c.expect(PUBACK)
+
+	c.send(encodePacket(PINGREQ, 0, nil))
+	c.expect(PINGRESP)
+
+	sub := appendString([]byte{0, 4}, "streams/#")
+	c.send(encodePacket(SUBSCRIBE, 0x02, append(sub, 1)))
+	if p := c.expect(SUBACK); !bytes.Equal(p.body, []byte{0, 4, SubscribeFailure}) {
+		t.Errorf("subscriptions should be refused, got %v", p.body)
+	}
+
+	saved := auth.saved()
+	want := []testMessage{{"a", "0", 0}, {"a", "1", 1}, {"a", "2", 2}}
+	if len(saved) != len(want) {
+		t.Fatalf("saved messages should be %v, got %v", want, saved)
+	}
+	for i := range want {
+		if saved[i] != want[i] {
+			t.Errorf("saved message %d should be %v, got %v", i, want[i], saved[i])
+		}
+	}
+
+	//a failed save closes the connection without PUBACK
+	c.send(encodePublish(&publishPacket{topic: "full", qos: 1, id: 5, payload: []byte("5")}))
+	if !c.closed() {
+		t.Error("connection should be closed when a message cannot be saved")
+	}
+}
+
+func TestPubackAfterPublish(t *testing.T) {
+	auth := &testAuth{started: make(chan struct{}), release: make(chan struct{})}
+	s, addr := testServer(t, auth)
+	defer s.Close()
+	c, _ := dial(t, addr, "gw1", "device", "secret")
+	defer c.nc.Close()
+
+	c.send(encodePublish(&publishPacket{topic: "a", qos: 1, id: 1, payload: []byte("1")}))
+	<-auth.started
+	c.nc.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := readPacket(c.r, 0); err == nil {
+		t.Error("PUBACK should not be sent before the message is saved")
+	}
+	close(auth.release)
+	c.expect(PUBACK)
+}
+
+func TestClientTakeover(t *testing.T) {
+	s, addr := testServer(t, &testAuth{})
+	defer s.Close()
+	c1, _ := dial(t, addr, "gw1", "device", "secret")
+	defer c1.nc.Close()
+	c2, _ := dial(t, addr, "gw1", "device", "secret")
+	defer c2.nc.Close()
+	if !c1.closed() {
+		t.Error("connection of the same client id should be closed")
+	}
+	c2.send(encodePacket(PINGREQ, 0, nil))
+	c2.expect(PINGRESP)
+}
@@ -0,0 +1,82 @@
+package storage
+
+import (
+    "testing"
+    "time"
+    "github.com/heartsg/dasea/storage/data"
+    "github.com/heartsg/dasea/storage/meta"
+    "github.com/heartsg/dasea/storage/mqtt"
+)
+
+func TestParseTopic(t *testing.T) {
+    tests := []struct {
+        topic string
+        id int64
+        isJson bool
+        err error
+    }{
+        {"streams/12/data", 12, false, nil},
+        {"streams/12/data/json", 12, true, nil},
+        {"streams/12/data/xml", 0, false, ErrInvalidTopic},
+        {"streams/abc/data", 0, false, ErrInvalidTopic},
+        {"streams/12", 0, false, ErrInvalidTopic},
+        {"devices/12/data", 0, false, ErrInvalidTopic},
+    }
+    for _, test := range tests {
+        id, isJson, err := parseTopic(test.topic)
+        if id != test.id || isJson != test.isJson || err != test.err {
+            t.Errorf("%s: should be %d %v %v, got %d %v %v", test.topic, test.id, test.isJson, test.err, id, isJson, err)
+        }
+    }
+}
+
+func TestMQTTError(t *testing.T) {
+    for _, err := range []error{meta.ErrNotFound, data.ErrInvalidData, ErrInvalidTopic} {
+        if _, ok := mqttError(err).(*mqtt.RejectedError); !ok {
+            t.Errorf("%v should be rejected", err)
+        }
+    }
+    for _, err := range []error{data.ErrPipelineFull, meta.ErrInvalidToken, data.ErrCorruptBlock} {
+        if mqttError(err) != err {
+            t.Errorf("%v should close the connection", err)
+        }
+    }
+    if mqttError(nil) != nil {
+        t.Error("no error should stay nil")
+    }
+}
+
+func TestMQTTAuthenticate(t *testing.T) {
+    tests := []struct {
+        username string
+        s *Server
+        err error
+    }{
+        {MQTTKeystoneUser, testServer(testToken("admin")), nil},
+        {MQTTKeystoneUser, testServer(testToken("reader")), mqtt.ErrNotAuthorized},
+        {MQTTKeystoneUser, testServer(nil), mqtt.ErrBadCredentials},
+        {"guest", testServer(testToken("admin")), mqtt.ErrBadCredentials},
+    }
+    for _, test := range tests {
+        session, err := (&mqttAuth{s: test.s}).Authenticate("gw1", test.username, []byte("token"))
+        if err != test.err {
+            t.Errorf("%s: should be %v, got %v", test.username, test.err, err)
+            continue
+        }
+        if err == nil && session.(*mqttSession).scope.ProjectId != "p1" {
+            t.Errorf("%s: scope of the token not kept", test.username)
+        }
+    }
+
+    session, _ := (&mqttAuth{s: testServer(testToken("admin"))}).Authenticate("gw1", MQTTKeystoneUser, []byte("token"))
+    if _, ok := session.Publish("streams/x/data", nil, 1).(*mqtt.RejectedError); !ok {
+        t.Error("messages to invalid topics should be rejected")
+    }
+    //credentials are checked again after a while
+    m := session.(*mqttSession)
+    m.s = testServer(testToken("reader"))
+    m.checkedAt = time.Now().Add(-mqttRecheck)
+    if err := m.Publish("streams/1/data", nil, 1); err != mqtt.ErrNotAuthorized {
+        t.Errorf("session should lose its authorization, got %v", err)
+    }
+}
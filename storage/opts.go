@@ -1,19 +1,83 @@
 package storage
 
 import (
+    "errors"
+    "fmt"
+    "net/url"
 	"github.com/heartsg/dasea/keystone/keystonemiddleware"
+	"github.com/heartsg/dasea/policy"
 )
+
+var ErrUnknownDBType = errors.New("Unknown database type.")
+
+// Database name used when DBOpts.Name is not given
+const DefaultDBName = "dasea"
+
 type DBOpts struct {
+    // Relational databases are "mysql", "postgres" and "sqlite3"
     Type string
     Hosts []string
     User string
     Password string
+    // Database of relational databases
+    Name string
+    // Meta database only. Without failover the first host is always the
+    // primary taking the writes and the others are read replicas, writes fail
+    // while the first host is down. With failover writes move to the next
+    // healthy host and back to the first host once it recovers, which needs
+    // hosts that all accept writes (e.g. Galera), not asynchronous replicas.
+    Failover bool
 }
+
+// Data source names of the hosts of relational databases, as taken by
+// meta.InitEngine. Hosts of mysql and postgres are host[:port], hosts of
+// sqlite3 are database files (User, Password and Name are not used).
+func (o *DBOpts) DataSourceNames() ([]string, error) {
+    name := o.Name
+    if name == "" {
+        name = DefaultDBName
+    }
+    names := make([]string, len(o.Hosts))
+    for i, host := range o.Hosts {
+        switch o.Type {
+        case "mysql":
+            names[i] = fmt.Sprintf("%s:%s@tcp(%s)/%s?charset=utf8", o.User, o.Password, host, name)
+        case "postgres":
+            u := &url.URL{
+                Scheme: "postgres",
+                User: url.UserPassword(o.User, o.Password),
+                Host: host,
+                Path: "/" + name,
+                RawQuery: "sslmode=disable",
+            }
+            names[i] = u.String()
+        case "sqlite3":
+            names[i] = host
+        default:
+            return nil, ErrUnknownDBType
+        }
+    }
+    return names, nil
+}
+
 type Opts struct {
+    // Address the storage API listens on
+    Listen string `default:":8080"`
+    // Address of the MQTT listener (see mqtt.go), empty disables MQTT
+    MQTTListen string
+    // UDP address of the CoAP listener (see coap.go), empty disables CoAP
+    CoAPListen string
+    // Largest request body in bytes, larger bodies are answered 413, 0 is
+    // no limit
+    MaxBodySize int64 `default:"16777216"`
     // We currently uses sql-like relational database for meta data
 	MetaDB DBOpts
-    // We currently choose to use cassandra for real-time data
+    // We currently choose to use cassandra for real-time data (Type "cassandra",
+    // Hosts are the contact points, User/Password for PasswordAuthenticator),
+    // Type "embedded" saves data in local segment files (Hosts[0] is the directory),
+    // relational databases save data in tables (Hosts[0] is the database)
     DataDB DBOpts
 	KeystoneMiddleware keystonemiddleware.Opts
+    // Rules "storage.get" (reads) and "storage.put" (writes) of the storage API
+    Policy policy.Opts
 }
-
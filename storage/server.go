@@ -0,0 +1,259 @@
+package storage
+
+// Storage API service
+//
+// All routes are under /v1 and take a project scoped keystone token in
+// X-Auth-Token (see keystonemiddleware.AuthToken). Reads are authorized by
+// the policy rule "storage.get" and writes by "storage.put", with the roles,
+// user_id, project_id and domain_id of the token as credentials and the
+// project_id and domain_id of the token as target. Items of other projects
+// are not found (see meta.Scope).
+//
+// End devices without keystone accounts may instead send a device token in
+// X-Device-Token to the data and aggregate routes (*), for the data streams
+// of their own device only (see meta.IssueDeviceToken).
+//
+//   GET, POST               /v1/aggregation-devices
+//   GET, PUT, DELETE        /v1/aggregation-devices/:id
+//   GET, POST               /v1/devices
+//   GET, PUT, DELETE        /v1/devices/:id
+//   GET, POST, PUT, DELETE  /v1/devices/:id/tokens (PUT rotates)
+//   DELETE                  /v1/devices/:id/tokens/:token_id
+//   GET, POST               /v1/attributes
+//   GET, PUT, DELETE        /v1/attributes/:id
+//   GET, POST               /v1/streams
+//   GET, PUT, DELETE        /v1/streams/:id
+//   GET*, POST*, DELETE     /v1/streams/:id/data
+//   GET*                    /v1/streams/:id/aggregate
+//   POST*                   /v1/write (line protocol, see influx.go)
+//
+// Records are also taken over MQTT (see mqtt.go) and CoAP (see coap.go).
+//
+// Example:
+//  func main() {
+//      log.Fatal(storage.Run())
+//  }
+import (
+    "log"
+    "net/http"
+    "os"
+    "time"
+    "github.com/heartsg/dasea/keystone/keystonemiddleware"
+    "github.com/heartsg/dasea/policy"
+    "github.com/heartsg/dasea/router"
+    "github.com/heartsg/dasea/storage/coap"
+    "github.com/heartsg/dasea/storage/data"
+    "github.com/heartsg/dasea/storage/meta"
+    "github.com/heartsg/dasea/storage/mqtt"
+)
+
+type Server struct {
+    Opts *Opts
+    Router *router.Router
+    Enforcer *policy.PolicyEnforcer
+    // Authenticates requests before the policy is enforced, normally
+    // keystonemiddleware.AuthToken
+    Auth router.Middleware
+    // Ingestion over MQTT (see mqtt.go), served if Opts.MQTTListen is given
+    MQTT *mqtt.Server
+    // Ingestion over CoAP (see coap.go), served if Opts.CoAPListen is given
+    CoAP *coap.Server
+
+    sweeper *data.Sweeper
+}
+
+// Open the meta database (migrated to the latest schema version) and the
+// data store, and start the ingestion pipeline, rollups and retention.
+func NewServer(o *Opts) (*Server, error) {
+    hosts, err := o.MetaDB.DataSourceNames()
+    if err != nil {
+        return nil, err
+    }
+    if err = meta.InitEngine(o.MetaDB.Type, hosts); err != nil {
+        return nil, err
+    }
+    meta.Group.SetFailover(o.MetaDB.Failover)
+    s := &Server{Opts: o}
+    if err = s.start(); err != nil {
+        s.Close()
+        return nil, err
+    }
+    s.Enforcer = policy.New(&o.Policy)
+    s.Auth = keystonemiddleware.NewAuthToken(&o.KeystoneMiddleware)
+    s.Router = router.NewRouter()
+    s.routes()
+    s.MQTT = mqtt.NewServer(&mqttAuth{s: s})
+    s.CoAP = coap.NewServer(coap.HandlerFunc(serveCoAP))
+    s.CoAP.Authorize = coap.HandlerFunc(authorizeCoAP)
+    return s, nil
+}
+
+func (s *Server) start() error {
+    if err := meta.MigrateToLatest(os.Stdout); err != nil {
+        return err
+    }
+    if err := meta.LoadCustomUnits(); err != nil {
+        return err
+    }
+    if err := meta.LoadExchangeRates(); err != nil {
+        return err
+    }
+
+    //relational data stores take data source names as hosts
+    db := s.Opts.DataDB
+    hosts := db.Hosts
+    switch db.Type {
+    case "mysql", "postgres", "sqlite3":
+        names, err := db.DataSourceNames()
+        if err != nil {
+            return err
+        }
+        hosts = names
+    }
+    if err := data.InitStore(db.Type, hosts, db.User, db.Password); err != nil {
+        return err
+    }
+
+    data.Rollups = data.NewRoller(data.Store, 0)
+    if err := data.Rollups.Load(time.Now()); err != nil {
+        return err
+    }
+    data.Rollups.Start()
+    data.Ingest = data.NewPipeline(data.Store)
+    data.Ingest.Start()
+    s.sweeper = data.NewSweeper(data.Store, 0)
+    s.sweeper.Start()
+    return nil
+}
+
+// Register a route authorized by rule
+func (s *Server) handle(method string, path string, rule string, h router.ContextHandlerFunc) {
+    s.Router.Handle(method, path, router.MiddlewareHandlerChain(h, s.Auth, s.authorize(rule)))
+}
+// Register a route also open to device tokens
+func (s *Server) handleDevice(method string, path string, rule string, h router.ContextHandlerFunc) {
+    s.Router.Handle(method, path, router.MiddlewareHandlerChain(h, router.MiddlewareFunc(s.authenticateDevice),
+        s.authorize(rule)))
+}
+
+func (s *Server) routes() {
+    s.handle("GET", "/v1/aggregation-devices", ruleGet, listAggregationDevices)
+    s.handle("POST", "/v1/aggregation-devices", rulePut, createAggregationDevice)
+    s.handle("GET", "/v1/aggregation-devices/:id", ruleGet, getAggregationDevice)
+    s.handle("PUT", "/v1/aggregation-devices/:id", rulePut, updateAggregationDevice)
+    s.handle("DELETE", "/v1/aggregation-devices/:id", rulePut, deleteAggregationDevice)
+
+    s.handle("GET", "/v1/devices", ruleGet, listDevices)
+    s.handle("POST", "/v1/devices", rulePut, createDevice)
+    s.handle("GET", "/v1/devices/:id", ruleGet, getDevice)
+    s.handle("PUT", "/v1/devices/:id", rulePut, updateDevice)
+    s.handle("DELETE", "/v1/devices/:id", rulePut, deleteDevice)
+    s.handle("GET", "/v1/devices/:id/tokens", ruleGet, listDeviceTokens)
+    s.handle("POST", "/v1/devices/:id/tokens", rulePut, issueDeviceToken)
+    s.handle("PUT", "/v1/devices/:id/tokens", rulePut, rotateDeviceToken)
+    s.handle("DELETE", "/v1/devices/:id/tokens", rulePut, revokeDeviceTokens)
+    s.handle("DELETE", "/v1/devices/:id/tokens/:token_id", rulePut, revokeDeviceToken)
+
+    s.handle("GET", "/v1/attributes", ruleGet, listDataStreamAttributes)
+    s.handle("POST", "/v1/attributes", rulePut, createDataStreamAttribute)
+    s.handle("GET", "/v1/attributes/:id", ruleGet, getDataStreamAttribute)
+    s.handle("PUT", "/v1/attributes/:id", rulePut, updateDataStreamAttribute)
+    s.handle("DELETE", "/v1/attributes/:id", rulePut, deleteDataStreamAttribute)
+    s.handle("GET", "/v1/attributes/:id/retention", ruleGet, getAttributeRetention)
+    s.handle("PUT", "/v1/attributes/:id/retention", rulePut, setAttributeRetention)
+
+    s.handle("GET", "/v1/streams", ruleGet, listDataStreams)
+    s.handle("POST", "/v1/streams", rulePut, createDataStream)
+    s.handle("GET", "/v1/streams/:id", ruleGet, getDataStream)
+    s.handle("PUT", "/v1/streams/:id", rulePut, updateDataStream)
+    s.handle("DELETE", "/v1/streams/:id", rulePut, deleteDataStream)
+    s.handle("GET", "/v1/streams/:id/retention", ruleGet, getStreamRetention)
+    s.handle("PUT", "/v1/streams/:id/retention", rulePut, setStreamRetention)
+
+    s.handle("GET", "/v1/retention-policies", ruleGet, listRetentionPolicies)
+
+    s.handleDevice("POST", "/v1/streams/:id/data", rulePut, putDataPoints)
+    s.handleDevice("GET", "/v1/streams/:id/data", ruleGet, getDataPoints)
+    s.handle("DELETE", "/v1/streams/:id/data", rulePut, deleteDataPoints)
+    s.handleDevice("GET", "/v1/streams/:id/aggregate", ruleGet, aggregateDataPoints)
+
+    s.handleDevice("POST", "/v1/write", rulePut, s.writeLines)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    if r.Body != nil && s.Opts.MaxBodySize > 0 {
+        r.Body = limitBody(w, r.Body, s.Opts.MaxBodySize)
+    }
+    s.Router.ServeHTTP(w, r)
+}
+
+func (s *Server) ListenAndServe() error {
+    log.Printf("storage: listening on %s", s.Opts.Listen)
+    return http.ListenAndServe(s.Opts.Listen, s)
+}
+
+func (s *Server) ListenAndServeMQTT() error {
+    log.Printf("storage: MQTT listening on %s", s.Opts.MQTTListen)
+    return s.MQTT.ListenAndServe(s.Opts.MQTTListen)
+}
+
+func (s *Server) ListenAndServeCoAP() error {
+    log.Printf("storage: CoAP listening on %s", s.Opts.CoAPListen)
+    return s.CoAP.ListenAndServe(s.Opts.CoAPListen)
+}
+
+// Stop background work, queued records are written before the data store
+// is closed
+func (s *Server) Close() error {
+    if s.MQTT != nil {
+        s.MQTT.Close()
+    }
+    if s.CoAP != nil {
+        s.CoAP.Close()
+    }
+    if s.sweeper != nil {
+        s.sweeper.Stop()
+    }
+    var err error
+    if data.Ingest != nil {
+        err = data.Ingest.Close()
+        data.Ingest = nil
+    }
+    if data.Rollups != nil {
+        if stopErr := data.Rollups.Stop(); stopErr != nil {
+            err = stopErr
+        }
+        data.Rollups = nil
+    }
+    if closeErr := data.CloseStore(); closeErr != nil {
+        err = closeErr
+    }
+    if closeErr := meta.CloseEngine(); closeErr != nil {
+        err = closeErr
+    }
+    return err
+}
+
+// Serve the storage API (and MQTT, CoAP) with the Opts loaded by init
+func Run() error {
+    s, err := NewServer(&opts)
+    if err != nil {
+        return err
+    }
+    defer s.Close()
+    errs := make(chan error, 3)
+    if opts.MQTTListen != "" {
+        go func() {
+            errs <- s.ListenAndServeMQTT()
+        }()
+    }
+    if opts.CoAPListen != "" {
+        go func() {
+            errs <- s.ListenAndServeCoAP()
+        }()
+    }
+    go func() {
+        errs <- s.ListenAndServe()
+    }()
+    return <-errs
+}
@@ -0,0 +1,285 @@
+package storage
+
+import (
+    "errors"
+    "io/ioutil"
+    "math"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+    "github.com/heartsg/dasea/keystone/keystoneclient/client"
+    "github.com/heartsg/dasea/keystone/keystoneclient/types"
+    "github.com/heartsg/dasea/keystone/keystonemiddleware"
+    "github.com/heartsg/dasea/policy"
+    "github.com/heartsg/dasea/router"
+    "github.com/heartsg/dasea/storage/data"
+    "github.com/heartsg/dasea/storage/meta"
+    "golang.org/x/net/context"
+)
+
+// Server without databases, Auth authenticates every request as token
+func testServer(token *types.Token) *Server {
+    s := &Server{
+        Opts: &Opts{},
+        Enforcer: policy.New(&policy.Opts{File: "testdata/policy.json"}),
+        Auth: router.MiddlewareFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) context.Context {
+            if token == nil {
+                return ctx
+            }
+            return router.SetMiddlewareParam(ctx, keystonemiddleware.UserAccessInfoKey, client.NewAccess("token", token))
+        }),
+        Router: router.NewRouter(),
+    }
+    s.routes()
+    return s
+}
+
+func testToken(roles ...string) *types.Token {
+    token := &types.Token{
+        Project: &types.Project{Id: "p1", DomainId: "d1"},
+        User: &types.User{Id: "u1"},
+    }
+    for _, role := range roles {
+        token.Roles = append(token.Roles, &types.Role{Name: role})
+    }
+    return token
+}
+
+func TestAuthorize(t *testing.T) {
+    var scope *meta.Scope
+    handler := router.ContextHandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+        scope = scopeOf(ctx)
+    })
+    tests := []struct {
+        token *types.Token
+        rule string
+        status int
+    }{
+        {nil, ruleGet, http.StatusUnauthorized},
+        {&types.Token{User: &types.User{Id: "u1"}}, ruleGet, http.StatusForbidden},
+        {testToken("reader"), rulePut, http.StatusForbidden},
+        {testToken("reader"), ruleGet, http.StatusOK},
+        {testToken("admin"), rulePut, http.StatusOK},
+    }
+    for i, test := range tests {
+        scope = nil
+        s := testServer(test.token)
+        h := router.MiddlewareHandlerChain(handler, s.Auth, s.authorize(test.rule))
+        w := httptest.NewRecorder()
+        h.ServeHTTPContext(context.Background(), w, httptest.NewRequest("GET", "/", nil))
+        if w.Code != test.status {
+            t.Errorf("test %d: status should be %d, got %d", i, test.status, w.Code)
+        }
+        if test.status == http.StatusOK && (scope == nil || scope.ProjectId != "p1" || scope.DomainId != "d1") {
+            t.Errorf("test %d: scope of the token not passed to the handler, got %v", i, scope)
+        }
+    }
+}
+
+func TestAuthenticateDevice(t *testing.T) {
+    s := testServer(testToken("admin"))
+    r := httptest.NewRequest("POST", "/v1/streams/1/data", nil)
+    r.Header.Set("X-Auth-Token", "token")
+    r.Header.Set(DeviceTokenHeader, "device")
+    ctx := s.authenticateDevice(context.Background(), httptest.NewRecorder(), r)
+    if ctx == nil || router.MiddlewareParam(ctx, keystonemiddleware.UserAccessInfoKey) == nil {
+        t.Error("keystone tokens should be preferred over device tokens")
+    }
+
+    //devices are authorized by their device token instead of the policy
+    ctx = router.SetMiddlewareParam(context.Background(), DeviceTokenKey, &meta.DeviceToken{DeviceId: 1})
+    ctx = router.SetMiddlewareParam(ctx, ScopeKey, &meta.Scope{ProjectId: "p1"})
+    s = testServer(nil)
+    if s.authorize(rulePut).ServeHTTPContext(ctx, httptest.NewRecorder(), r) == nil {
+        t.Error("device token should pass authorization")
+    }
+    if deviceTokenOf(ctx).DeviceId != 1 || deviceTokenOf(context.Background()) != nil {
+        t.Error("device token of the request not match")
+    }
+}
+
+func TestRoutes(t *testing.T) {
+    s := testServer(testToken("admin"))
+    w := httptest.NewRecorder()
+    s.ServeHTTP(w, httptest.NewRequest("GET", "/v1/streams/abc/data", nil))
+    if w.Code != http.StatusNotFound {
+        t.Errorf("stream id must be a number, got status %d", w.Code)
+    }
+
+    s = testServer(nil)
+    w = httptest.NewRecorder()
+    s.ServeHTTP(w, httptest.NewRequest("DELETE", "/v1/devices/1", nil))
+    if w.Code != http.StatusUnauthorized {
+        t.Errorf("requests without token should be unauthorized, got status %d", w.Code)
+    }
+}
+
+func TestMaxBodySize(t *testing.T) {
+    s := testServer(testToken("admin"))
+    s.Opts.MaxBodySize = 16
+    body := `{"id": "` + strings.Repeat("a", 32) + `"}`
+    w := httptest.NewRecorder()
+    s.ServeHTTP(w, httptest.NewRequest("POST", "/v1/aggregation-devices", strings.NewReader(body)))
+    if w.Code != http.StatusRequestEntityTooLarge {
+        t.Errorf("large json body should be status 413, got %d", w.Code)
+    }
+    w = httptest.NewRecorder()
+    s.ServeHTTP(w, httptest.NewRequest("POST", "/v1/aggregation-devices", strings.NewReader("{")))
+    if w.Code != http.StatusBadRequest {
+        t.Errorf("bad json body should be status 400, got %d", w.Code)
+    }
+
+    b := limitBody(httptest.NewRecorder(), ioutil.NopCloser(strings.NewReader(body)), 16)
+    if _, err := ioutil.ReadAll(b); err != ErrBodyTooLarge {
+        t.Errorf("reading past the limit should fail with ErrBodyTooLarge, got %v", err)
+    }
+    b = limitBody(httptest.NewRecorder(), ioutil.NopCloser(strings.NewReader(body)), int64(len(body)))
+    if buf, err := ioutil.ReadAll(b); err != nil || string(buf) != body {
+        t.Errorf("body within the limit should be read, got %q %v", buf, err)
+    }
+}
+
+func TestCreateDataStreamAttribute(t *testing.T) {
+    s := testServer(testToken("admin"))
+    bodies := []string{
+        `{"NumDataPoints": 1, "DataPointNames": ["level"], "DataPointTypes": ["int16"], "DataPointUnits": [0], "WriteMode": "latest"}`,
+        `{"NumDataPoints": 1, "DataPointNames": ["level"], "DataPointTypes": ["int16"], "DataPointUnits": [0], "TimestampDataPoint": 1}`,
+        `{"NumDataPoints": 2, "DataPointNames": ["level"], "DataPointTypes": ["int16"], "DataPointUnits": [0], "TimestampDataPoint": 2}`,
+    }
+    for _, body := range bodies {
+        w := httptest.NewRecorder()
+        s.ServeHTTP(w, httptest.NewRequest("POST", "/v1/attributes", strings.NewReader(body)))
+        if w.Code != http.StatusBadRequest {
+            t.Errorf("%s: bad write mode should be rejected before creating, got status %d", body, w.Code)
+        }
+    }
+}
+
+func TestRetentionPolicy(t *testing.T) {
+    tests := []struct {
+        token *types.Token
+        method, path, body string
+        status int
+    }{
+        {testToken("reader"), "PUT", "/v1/streams/1/retention", `{"KeepSeconds": 60}`, http.StatusForbidden},
+        {testToken("reader"), "PUT", "/v1/attributes/1/retention", `{"KeepSeconds": 60}`, http.StatusForbidden},
+        {testToken("admin"), "PUT", "/v1/streams/1/retention", `{"KeepSeconds": -1}`, http.StatusBadRequest},
+        {testToken("admin"), "PUT", "/v1/attributes/1/retention", `{"KeepSeconds": 9223372036854775807}`, http.StatusBadRequest},
+        {testToken("admin"), "GET", "/v1/streams/abc/retention", "", http.StatusNotFound},
+        {testToken("admin"), "PUT", "/v1/attributes/abc/retention", `{"KeepSeconds": 60}`, http.StatusNotFound},
+        {nil, "GET", "/v1/retention-policies", "", http.StatusUnauthorized},
+    }
+    for _, test := range tests {
+        w := httptest.NewRecorder()
+        testServer(test.token).ServeHTTP(w, httptest.NewRequest(test.method, test.path, strings.NewReader(test.body)))
+        if w.Code != test.status {
+            t.Errorf("%s %s %s: status should be %d, got %d", test.method, test.path, test.body, test.status, w.Code)
+        }
+    }
+}
+
+func TestErrorStatus(t *testing.T) {
+    tests := map[error]int{
+        ErrForbidden: http.StatusForbidden,
+        meta.ErrInvalidToken: http.StatusUnauthorized,
+        meta.ErrNoScope: http.StatusForbidden,
+        meta.ErrNotFound: http.StatusNotFound,
+        data.ErrStreamNotFound: http.StatusNotFound,
+        data.ErrDuplicateRecord: http.StatusConflict,
+        meta.ErrProjectMismatch: http.StatusBadRequest,
+        meta.ErrInvalidRetention: http.StatusBadRequest,
+        data.ErrInvalidInterval: http.StatusBadRequest,
+        data.ErrPipelineFull: http.StatusTooManyRequests,
+        ErrBodyTooLarge: http.StatusRequestEntityTooLarge,
+        data.ErrCorruptBlock: http.StatusInternalServerError,
+    }
+    for err, status := range tests {
+        if s := errorStatus(err); s != status {
+            t.Errorf("%v: status should be %d, got %d", err, status, s)
+        }
+    }
+
+    w := httptest.NewRecorder()
+    writeError(w, data.ErrPipelineFull)
+    if w.Header().Get("Retry-After") == "" {
+        t.Error("Retry-After should be set when the pipeline is full")
+    }
+    if !strings.Contains(w.Body.String(), data.ErrPipelineFull.Error()) {
+        t.Errorf("client errors should be told, got %s", w.Body.String())
+    }
+    w = httptest.NewRecorder()
+    writeError(w, errors.New("dial tcp 10.0.0.2:3306: connection refused"))
+    if w.Code != http.StatusInternalServerError || strings.Contains(w.Body.String(), "10.0.0.2") {
+        t.Errorf("server errors should not be told, got %d %s", w.Code, w.Body.String())
+    }
+}
+
+func TestWriteJson(t *testing.T) {
+    w := httptest.NewRecorder()
+    writeJson(w, http.StatusOK, []float64{1, math.NaN()})
+    if w.Code != http.StatusInternalServerError || strings.Contains(w.Body.String(), "[1") {
+        t.Errorf("values which cannot be marshalled should be status 500, got %d %s", w.Code, w.Body.String())
+    }
+    w = httptest.NewRecorder()
+    writeJson(w, http.StatusCreated, []float64{1, 2})
+    if w.Code != http.StatusCreated || w.Body.String() != "[1,2]\n" {
+        t.Errorf("got %d %s", w.Code, w.Body.String())
+    }
+}
+
+func TestParseTime(t *testing.T) {
+    want := time.Date(2016, 3, 1, 8, 0, 0, 0, time.UTC)
+    for _, s := range []string{"2016-03-01T08:00:00Z", "2016-03-01T16:00:00+08:00", "1456819200"} {
+        got, err := parseTime(s)
+        if err != nil || !got.Equal(want) {
+            t.Errorf("%s: should be %v, got %v %v", s, want, got, err)
+        }
+    }
+    if _, err := parseTime("yesterday"); err != ErrInvalidParameter {
+        t.Errorf("invalid time should fail, got %v", err)
+    }
+}
+
+func TestParseListOpts(t *testing.T) {
+    r := httptest.NewRequest("GET", "/v1/streams?device_id=3&created_since=1456819200&limit=20&marker=7", nil)
+    o, err := parseListOpts(r)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if o.DeviceId != 3 || o.Limit != 20 || o.Marker != "7" || o.CreatedSince.Unix() != 1456819200 {
+        t.Errorf("list opts not match, got %+v", o)
+    }
+
+    r = httptest.NewRequest("GET", "/v1/streams?limit=ten", nil)
+    if _, err = parseListOpts(r); err != ErrInvalidParameter {
+        t.Errorf("invalid limit should fail, got %v", err)
+    }
+}
+
+func TestParseQuery(t *testing.T) {
+    r := httptest.NewRequest("GET", "/v1/streams/1/data?start=1456819200&columns=a,b&units=3,0&descending=true", nil)
+    q, err := parseQuery(r)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if q.Start.Unix() != 1456819200 || q.End.IsZero() || len(q.Columns) != 2 || q.Columns[1] != "b" ||
+        len(q.Units) != 2 || q.Units[0] != 3 || !q.Descending {
+        t.Errorf("query not match, got %+v", q)
+    }
+
+    r = httptest.NewRequest("GET", "/v1/streams/1/aggregate?interval=1h&tz=Asia/Singapore&functions=mean,max", nil)
+    g, err := parseAggregate(r)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if g.Interval.Duration != time.Hour || g.Location == nil || len(g.Functions) != 2 {
+        t.Errorf("aggregate not match, got %+v", g)
+    }
+
+    r = httptest.NewRequest("GET", "/v1/streams/1/aggregate", nil)
+    if _, err = parseAggregate(r); err != data.ErrInvalidInterval {
+        t.Errorf("interval is required, got %v", err)
+    }
+}